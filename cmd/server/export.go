@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/csnight/storm-aqi-server/middleware"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd dumps history to a file without starting the http server
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export station history as csv, parquet or netcdf",
+	Long: `Export the history of a station set (--sids, --city or --bbox) between --start and --end to --out.
+The bbox is minLon,minLat,maxLon,maxLat and dates are utc days, the end day is included.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		sids, _ := flags.GetStringSlice("sids")
+		city, _ := flags.GetString("city")
+		bbox, _ := flags.GetString("bbox")
+		pols, _ := flags.GetStringSlice("pols")
+		start, _ := flags.GetString("start")
+		end, _ := flags.GetString("end")
+		format, _ := flags.GetString("format")
+		out, _ := flags.GetString("out")
+		req, err := buildExportRequest(sids, city, bbox, pols, start, end, format)
+		if err != nil {
+			return err
+		}
+		return export(cfgFile, req, out)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	flags := exportCmd.Flags()
+	flags.StringSlice("sids", nil, "station ids, comma separated")
+	flags.String("city", "", "city name of the stations")
+	flags.String("bbox", "", "bounding box of the stations as minLon,minLat,maxLon,maxLat")
+	flags.StringSlice("pols", nil, "pollutants, comma separated (default all)")
+	flags.String("start", "", "first day as 2006-01-02")
+	flags.String("end", "", "last day as 2006-01-02")
+	flags.String("format", "csv", "csv, parquet or netcdf")
+	flags.String("out", "", "output file")
+	_ = exportCmd.MarkFlagRequired("start")
+	_ = exportCmd.MarkFlagRequired("end")
+	_ = exportCmd.MarkFlagRequired("out")
+}
+
+func buildExportRequest(sids []string, city string, bbox string, pols []string, start string, end string, format string) (*db.ExportRequest, error) {
+	if _, ok := db.ExportFormats[format]; !ok {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	st, err := time.ParseInLocation("2006-01-02", start, time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("bad start time: %v", err)
+	}
+	et, err := time.ParseInLocation("2006-01-02", end, time.UTC)
+	if err != nil {
+		return nil, fmt.Errorf("bad end time: %v", err)
+	}
+	if et.Before(st) {
+		return nil, errors.New("end time can't less then start time")
+	}
+	req := &db.ExportRequest{
+		Sids:   sids,
+		City:   city,
+		Pols:   pols,
+		Start:  st,
+		End:    et.Add(24*time.Hour - time.Millisecond),
+		Format: format,
+	}
+	if bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+		}
+		var v [4]float64
+		for i, p := range parts {
+			v[i], err = strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad bbox: %v", err)
+			}
+		}
+		req.Bbox = &db.Bounds{
+			TopLeft:     db.GeoPoint{Lon: v[0], Lat: v[3]},
+			BottomRight: db.GeoPoint{Lon: v[2], Lat: v[1]},
+		}
+	}
+	if len(req.Sids) == 0 && req.City == "" && req.Bbox == nil {
+		return nil, errors.New("one of --sids, --city or --bbox is required")
+	}
+	return req, nil
+}
+
+func export(confFile string, req *db.ExportRequest, out string) error {
+	confIns, _, err := conf.InitConf(confFile, func(config interface{}) {
+	})
+	if err != nil {
+		return fmt.Errorf("init conf failed, err:%v", err)
+	}
+	logger := middleware.InitLogger(confIns.LogConf)
+	dbIns, err := db.InitReadOnly(confIns, logger)
+	if err != nil {
+		return fmt.Errorf("init db failed, err:%v", err)
+	}
+	defer dbIns.Close()
+	stations, err := dbIns.ResolveExportStations(req)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	err = dbIns.ExportHistory(f, req, stations)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("exported %d stations to %s", len(stations), out))
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -66,30 +67,34 @@ func initConfig() {
 	}
 }
 
-var app *server.AQIServer
+// running holds the *server.AQIServer once it is built, the config watcher calls back from its own goroutine
+var running atomic.Value
+var hotConf *conf.HotConfig
 
 func start(confFile string) {
-	confIns, err := conf.InitConf(confFile, func(config interface{}) {
+	confIns, hc, err := conf.InitConf(confFile, func(config interface{}) {
+		if app, ok := running.Load().(*server.AQIServer); ok {
+			app.Reload(config.(*conf.GConfig))
+		}
 	})
 	if err != nil {
 		fmt.Printf("init conf failed, err:%v\n", err)
 		return
 	}
-	app, err = server.New(confIns)
+	hotConf = hc
+	app, err := server.New(confIns)
 	if err != nil {
 		fmt.Printf("init app failed, err:%v\n", err)
 		return
 	}
+	running.Store(app)
 	go app.StartHttpServer()
-	defer func() {
-		app.Close()
-	}()
-	handleProcessSignal()
+	handleProcessSignal(app)
 }
 
-var signChan = make(chan os.Signal)
+var signChan = make(chan os.Signal, 1)
 
-func handleProcessSignal() {
+func handleProcessSignal(app *server.AQIServer) {
 	var sig os.Signal
 	signal.Notify(
 		signChan,
@@ -98,6 +103,7 @@ func handleProcessSignal() {
 		syscall.SIGKILL,
 		syscall.SIGTERM,
 		syscall.SIGABRT,
+		syscall.SIGHUP,
 	)
 	for {
 		sig = <-signChan
@@ -105,8 +111,11 @@ func handleProcessSignal() {
 		switch sig {
 		// Shutdown the servers.
 		case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGABRT, syscall.SIGTERM, syscall.SIGKILL:
-			app.Close()
+			app.Shutdown()
 			return
+		// Reload the config file even if it is unchanged.
+		case syscall.SIGHUP:
+			hotConf.Reload()
 		default:
 		}
 	}
@@ -1,7 +1,6 @@
 package conf
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
@@ -17,6 +16,11 @@ import (
 type AppConfig struct {
 	Port           int  `yaml:"port" json:"port"`
 	EnableCompress bool `yaml:"enable_compress" json:"enable_compress"`
+	// ShutdownTimeout is the number of seconds in-flight requests get to finish on shutdown
+	ShutdownTimeout int `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// CacheExpiration is the lifetime in seconds of the response cache entries, negative disables the cache
+	CacheExpiration int    `yaml:"cache_expiration" json:"cache_expiration"`
+	CorsOrigins     string `yaml:"cors_origins" json:"cors_origins"`
 }
 
 type LogConfig struct {
@@ -28,10 +32,30 @@ type LogConfig struct {
 }
 
 type AQIConfig struct {
-	ImageOss      string `yaml:"image_oss" json:"image_oss"`
-	StationIndex  string `yaml:"station_index" json:"station_index"`
-	HisIndex      string `yaml:"his_index" json:"his_index"`
-	RealtimeIndex string `yaml:"realtime_index" json:"realtime_index"`
+	ImageOss         string             `yaml:"image_oss" json:"image_oss"`
+	StationIndex     string             `yaml:"station_index" json:"station_index"`
+	HisIndex         string             `yaml:"his_index" json:"his_index"`
+	RealtimeIndex    string             `yaml:"realtime_index" json:"realtime_index"`
+	AqiStandard      string             `yaml:"aqi_standard" json:"aqi_standard"`
+	StreamInterval   int                `yaml:"stream_interval" json:"stream_interval"`
+	RankingTz        string             `yaml:"ranking_tz" json:"ranking_tz"`
+	ExceedThresholds map[string]float64 `yaml:"exceed_thresholds" json:"exceed_thresholds"`
+	Regions          *RegionConfig      `yaml:"regions" json:"regions"`
+	AlertRuleIndex   string             `yaml:"alert_rule_index" json:"alert_rule_index"`
+	AlertStateIndex  string             `yaml:"alert_state_index" json:"alert_state_index"`
+	AuditIndex       string             `yaml:"audit_index" json:"audit_index"`
+	// ImageExtent is the lon lat extent of the silam images as [west, south, east, north]
+	ImageExtent []float64 `yaml:"image_extent" json:"image_extent"`
+	// ImageScale maps the values between the min and max tags of an image to the color ramp, linear or log
+	ImageScale string `yaml:"image_scale" json:"image_scale"`
+	// TileCache is where the silam map tiles are cached, memory or object to also keep them in the bucket
+	TileCache string `yaml:"tile_cache" json:"tile_cache"`
+}
+
+type RegionConfig struct {
+	File         string `yaml:"file" json:"file"`
+	IdProperty   string `yaml:"id_property" json:"id_property"`
+	NameProperty string `yaml:"name_property" json:"name_property"`
 }
 
 type MinIOConfig struct {
@@ -40,6 +64,66 @@ type MinIOConfig struct {
 	Secret  string `yaml:"secret" json:"secret"`
 }
 
+type StoreConfig struct {
+	Backend   string `yaml:"backend" json:"backend"`
+	DataDir   string `yaml:"data_dir" json:"data_dir"`
+	ObjectDir string `yaml:"object_dir" json:"object_dir"`
+}
+
+type AlertConfig struct {
+	Enable   bool `yaml:"enable" json:"enable"`
+	Interval int  `yaml:"interval" json:"interval"`
+	Retries  int  `yaml:"retries" json:"retries"`
+	Timeout  int  `yaml:"timeout" json:"timeout"`
+}
+
+type AuthConfig struct {
+	Enable    bool           `yaml:"enable" json:"enable"`
+	KeysFile  string         `yaml:"keys_file" json:"keys_file"`
+	Keys      []ApiKeyConfig `yaml:"keys" json:"keys"`
+	Rate      float64        `yaml:"rate" json:"rate"`
+	Burst     int            `yaml:"burst" json:"burst"`
+	IpRate    float64        `yaml:"ip_rate" json:"ip_rate"`
+	IpBurst   int            `yaml:"ip_burst" json:"ip_burst"`
+	QuotaFile string         `yaml:"quota_file" json:"quota_file"`
+}
+
+type ApiKeyConfig struct {
+	Key          string   `yaml:"key" json:"key"`
+	Name         string   `yaml:"name" json:"name"`
+	Scopes       []string `yaml:"scopes" json:"scopes"`
+	Rate         float64  `yaml:"rate" json:"rate"`
+	Burst        int      `yaml:"burst" json:"burst"`
+	MonthlyQuota int64    `yaml:"monthly_quota" json:"monthly_quota"`
+}
+
+type TraceConfig struct {
+	Enable      bool    `yaml:"enable" json:"enable"`
+	ServiceName string  `yaml:"service_name" json:"service_name"`
+	Exporter    string  `yaml:"exporter" json:"exporter"`
+	Endpoint    string  `yaml:"endpoint" json:"endpoint"`
+	Insecure    bool    `yaml:"insecure" json:"insecure"`
+	File        string  `yaml:"file" json:"file"`
+	SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"`
+}
+
+type SilamConfig struct {
+	Enable bool `yaml:"enable" json:"enable"`
+	// Source is a directory or the http url of a directory listing holding the netcdf files
+	Source    string `yaml:"source" json:"source"`
+	Pattern   string `yaml:"pattern" json:"pattern"`
+	Interval  int    `yaml:"interval" json:"interval"`
+	StateFile string `yaml:"state_file" json:"state_file"`
+	// Variables maps the pollutants to their netcdf variables
+	Variables map[string]SilamVariable `yaml:"variables" json:"variables"`
+}
+
+type SilamVariable struct {
+	Name string `yaml:"name" json:"name"`
+	// Factor turns the values into the units of the pollutant, 0 keeps them
+	Factor float64 `yaml:"factor" json:"factor"`
+}
+
 type ESConfig struct {
 	Uri                          []string `yaml:"uri" json:"uri"`
 	Username                     string   `yaml:"username" json:"username"`
@@ -60,14 +144,23 @@ type ESConfig struct {
 	RemoveAbandonedOnBorrow      bool     `yaml:"remove_abandoned_on_borrow" json:"remove_abandoned_on_borrow"`
 	RemoveAbandonedOnMaintenance bool     `yaml:"remove_abandoned_on_maintenance" json:"remove_abandoned_on_maintenance"`
 	RemoveAbandonedTimeout       int      `yaml:"remove_abandoned_timeout" json:"remove_abandoned_timeout"`
+	FailQueueFile                string   `yaml:"fail_queue_file" json:"fail_queue_file"`
+	DeadLetterFile               string   `yaml:"dead_letter_file" json:"dead_letter_file"`
+	FailRetryMax                 int      `yaml:"fail_retry_max" json:"fail_retry_max"`
+	FailRetryBackoff             int      `yaml:"fail_retry_backoff" json:"fail_retry_backoff"`
 }
 
 type GConfig struct {
-	AppConf *AppConfig   `yaml:"app"`
-	AQIConf *AQIConfig   `yaml:"aqi"`
-	ESConf  *ESConfig    `yaml:"elastic"`
-	LogConf *LogConfig   `yaml:"log"`
-	OssConf *MinIOConfig `yaml:"minio"`
+	AppConf   *AppConfig   `yaml:"app" json:"app"`
+	AQIConf   *AQIConfig   `yaml:"aqi" json:"aqi"`
+	ESConf    *ESConfig    `yaml:"elastic" json:"elastic"`
+	LogConf   *LogConfig   `yaml:"log" json:"log"`
+	OssConf   *MinIOConfig `yaml:"minio" json:"minio"`
+	StoreConf *StoreConfig `yaml:"store" json:"store"`
+	AlertConf *AlertConfig `yaml:"alert" json:"alert"`
+	AuthConf  *AuthConfig  `yaml:"auth" json:"auth"`
+	TraceConf *TraceConfig `yaml:"trace" json:"trace"`
+	SilamConf *SilamConfig `yaml:"silam" json:"silam"`
 }
 
 type Config struct {
@@ -84,6 +177,7 @@ type Config struct {
 type HotConfig struct {
 	*Config
 	configModTimes map[string]time.Time
+	reload         chan bool
 }
 
 // New initialize a HotConfig
@@ -108,7 +202,16 @@ func New(config *Config) *HotConfig {
 		config.AutoReloadInterval = time.Second
 	}
 
-	return &HotConfig{Config: config}
+	return &HotConfig{Config: config, reload: make(chan bool, 1)}
+}
+
+// Reload makes the auto reload loop load the files on its next turn even if they are unchanged,
+// it does nothing when AutoReload is off
+func (hc *HotConfig) Reload() {
+	select {
+	case hc.reload <- true:
+	default:
+	}
 }
 
 var testRegexp = regexp.MustCompile("_test|(\\.test$)")
@@ -147,15 +250,24 @@ func (hc *HotConfig) Load(config interface{}, files ...string) (err error) {
 	if hc.Config.AutoReload {
 		go func() {
 			timer := time.NewTimer(hc.Config.AutoReloadInterval)
-			for range timer.C {
+			for {
+				select {
+				case <-timer.C:
+				case <-hc.reload:
+					// forget the mod times so the files count as changed
+					hc.configModTimes = nil
+					if !timer.Stop() {
+						<-timer.C
+					}
+				}
+				// load into a new value instead of over the config in use, whose nested pointers the
+				// decoder would write through while readers use them, the callback swaps it in
 				reflectPtr := reflect.New(reflect.ValueOf(config).Elem().Type())
-				reflectPtr.Elem().Set(defaultValue)
 
 				var changed bool
 				if err, changed = hc.load(reflectPtr.Interface(), true, files...); err == nil && changed {
-					reflect.ValueOf(config).Elem().Set(reflectPtr.Elem())
 					if hc.Config.AutoReloadCallback != nil {
-						hc.Config.AutoReloadCallback(config)
+						hc.Config.AutoReloadCallback(reflectPtr.Interface())
 					}
 				} else if err != nil {
 					fmt.Printf("Failed to reload configuration from %v, got error %v\n", files, err)
@@ -461,22 +573,20 @@ func (hc *HotConfig) load(config interface{}, watchMode bool, files ...string) (
 	return err, true
 }
 
-func InitConf(path string, cb func(config interface{})) (*GConfig, error) {
+// InitConf loads the config file, cb gets a new *GConfig every time the file changes and the
+// returned HotConfig forces a reload
+func InitConf(path string, cb func(config interface{})) (*GConfig, *HotConfig, error) {
 	t := GConfig{}
-	err := New(&Config{
+	hc := New(&Config{
 		AutoReload:         true,
 		AutoReloadInterval: time.Second * 5,
 		AutoReloadCallback: func(config interface{}) {
-			confStr, err := json.Marshal(config)
-			if err != nil {
-				return
-			}
-			fmt.Printf("new config %v \r\n", string(confStr))
 			cb(config)
 		},
-	}).Load(&t, path)
+	})
+	err := hc.Load(&t, path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &t, nil
+	return &t, hc, nil
 }
@@ -0,0 +1,94 @@
+package conf
+
+import (
+	"encoding/json"
+	"net/url"
+	"sort"
+)
+
+const redacted = "******"
+
+// Redact returns a copy of the config without the es password, the minio secret, the api keys and the
+// password of the silam source url
+func (c *GConfig) Redact() *GConfig {
+	r := *c
+	if c.ESConf != nil {
+		es := *c.ESConf
+		if es.Password != "" {
+			es.Password = redacted
+		}
+		r.ESConf = &es
+	}
+	if c.OssConf != nil {
+		oss := *c.OssConf
+		if oss.Secret != "" {
+			oss.Secret = redacted
+		}
+		r.OssConf = &oss
+	}
+	if c.AuthConf != nil {
+		auth := *c.AuthConf
+		auth.Keys = make([]ApiKeyConfig, len(c.AuthConf.Keys))
+		for i, key := range c.AuthConf.Keys {
+			key.Key = redacted
+			auth.Keys[i] = key
+		}
+		r.AuthConf = &auth
+	}
+	if c.SilamConf != nil {
+		silam := *c.SilamConf
+		if u, err := url.Parse(silam.Source); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				silam.Source = u.String()
+			}
+		}
+		r.SilamConf = &silam
+	}
+	return &r
+}
+
+// Diff lists the settings changed from c to other as "section.key: old -> new" sorted by key,
+// the values are shown redacted
+func (c *GConfig) Diff(other *GConfig) []string {
+	oldRaw, newRaw := flattenConfig(c), flattenConfig(other)
+	oldShow, newShow := flattenConfig(c.Redact()), flattenConfig(other.Redact())
+	var changes []string
+	for key, value := range newRaw {
+		if oldRaw[key] != value {
+			changes = append(changes, key+": "+oldShow[key]+" -> "+newShow[key])
+		}
+	}
+	for key := range oldRaw {
+		if _, ok := newRaw[key]; !ok {
+			changes = append(changes, key+": "+oldShow[key]+" -> ")
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// flattenConfig maps the dotted json path of every scalar setting to its json value,
+// lists are kept whole so a reordered list counts as changed
+func flattenConfig(c *GConfig) map[string]string {
+	data, _ := json.Marshal(c)
+	var tree map[string]interface{}
+	_ = json.Unmarshal(data, &tree)
+	values := map[string]string{}
+	var walk func(prefix string, node interface{})
+	walk = func(prefix string, node interface{}) {
+		if m, ok := node.(map[string]interface{}); ok {
+			for k, v := range m {
+				walk(prefix+"."+k, v)
+			}
+			return
+		}
+		if prefix == "" {
+			return
+		}
+		v, _ := json.Marshal(node)
+		values[prefix[1:]] = string(v)
+	}
+	walk("", tree)
+	return values
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/tools"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var ErrAlertRuleNotFound = errors.New("alert rule not found")
+
+// AlertRule fires when the metric of a pollutant matches op threshold for hours consecutive hourly
+// realtime values at one of its stations, the stations are the sids plus every station of the city
+type AlertRule struct {
+	Id        string   `json:"id"`
+	Name      string   `json:"name"`
+	Pol       string   `json:"pol"`
+	Metric    string   `json:"metric"`
+	Op        string   `json:"op"`
+	Threshold float64  `json:"threshold"`
+	Hours     int      `json:"hours"`
+	Sids      []string `json:"sids"`
+	City      string   `json:"city"`
+	Webhook   string   `json:"webhook"`
+	Secret    string   `json:"secret,omitempty"`
+	Enabled   bool     `json:"enabled"`
+	CreatedAt int64    `json:"created_at"`
+	UpdatedAt int64    `json:"updated_at"`
+}
+
+// AlertState is the evaluation state of a rule at one station, Pending holds an event not delivered
+// yet, after Attempts failed posts it is posted again in the first round from NextTry on
+type AlertState struct {
+	Id       string  `json:"id"`
+	RuleId   string  `json:"rule_id"`
+	Sid      string  `json:"sid"`
+	Streak   int     `json:"streak"`
+	LastTm   int64   `json:"last_tm"`
+	Value    float64 `json:"value"`
+	Firing   bool    `json:"firing"`
+	FiredAt  int64   `json:"fired_at"`
+	Pending  string  `json:"pending"`
+	Attempts int     `json:"attempts"`
+	NextTry  int64   `json:"next_try"`
+}
+
+func alertStateId(ruleId string, sid string) string {
+	return ruleId + "$" + sid
+}
+
+// Match tells whether a realtime value hits the rule, metric aqi compares the sub index of the value
+func (r *AlertRule) Match(std string, data float64) (float64, bool) {
+	val := data
+	if r.Metric == "aqi" {
+		val = float64(SubIndex(std, r.Pol, data))
+	}
+	switch r.Op {
+	case "gte":
+		return val, val >= r.Threshold
+	case "lt":
+		return val, val < r.Threshold
+	case "lte":
+		return val, val <= r.Threshold
+	default:
+		return val, val > r.Threshold
+	}
+}
+
+func (db *DB) GetAlertRules() ([]AlertRule, error) {
+	db, span := db.startSpan("GetAlertRules")
+	defer span.End()
+	rules, err := db.ListAlertRules()
+	if err != nil {
+		db.log.Error("GetAlertRules(). db.ListAlertRules(). err:", zap.Error(err))
+		return nil, err
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].CreatedAt < rules[j].CreatedAt
+	})
+	return rules, nil
+}
+
+func (db *DB) GetAlertRule(id string) (*AlertRule, error) {
+	db, span := db.startSpan("GetAlertRule", attribute.String("rule", id))
+	defer span.End()
+	rules, err := db.GetAlertRules()
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].Id == id {
+			return &rules[i], nil
+		}
+	}
+	return nil, ErrAlertRuleNotFound
+}
+
+func (db *DB) CreateAlertRule(rule *AlertRule) error {
+	db, span := db.startSpan("CreateAlertRule")
+	defer span.End()
+	id, err := tools.NewNanoId()
+	if err != nil {
+		return err
+	}
+	rule.Id = id
+	rule.CreatedAt = time.Now().UnixMilli()
+	rule.UpdatedAt = rule.CreatedAt
+	if err = db.SaveAlertRule(rule); err != nil {
+		db.log.Error("CreateAlertRule(). db.SaveAlertRule(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// UpdateAlertRule replaces a rule, an empty secret keeps the stored one and the states are reset
+// as the streaks were counted against the old condition. With a running AlertEngine go through
+// AlertEngine.UpdateRule, which resolves the firing stations first
+func (db *DB) UpdateAlertRule(id string, rule *AlertRule) error {
+	db, span := db.startSpan("UpdateAlertRule", attribute.String("rule", id))
+	defer span.End()
+	old, err := db.GetAlertRule(id)
+	if err != nil {
+		return err
+	}
+	rule.Id = old.Id
+	rule.CreatedAt = old.CreatedAt
+	rule.UpdatedAt = time.Now().UnixMilli()
+	if rule.Secret == "" {
+		rule.Secret = old.Secret
+	}
+	if err = db.SaveAlertRule(rule); err != nil {
+		db.log.Error("UpdateAlertRule(). db.SaveAlertRule(). err:", zap.Error(err))
+		return err
+	}
+	if err = db.RemoveAlertStates(id); err != nil {
+		db.log.Error("UpdateAlertRule(). db.RemoveAlertStates(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// DeleteAlertRule removes a rule and its states, with a running AlertEngine go through AlertEngine.DeleteRule
+func (db *DB) DeleteAlertRule(id string) error {
+	db, span := db.startSpan("DeleteAlertRule", attribute.String("rule", id))
+	defer span.End()
+	if err := db.RemoveAlertRule(id); err != nil {
+		if err != ErrAlertRuleNotFound {
+			db.log.Error("DeleteAlertRule(). db.RemoveAlertRule(). err:", zap.Error(err))
+		}
+		return err
+	}
+	if err := db.RemoveAlertStates(id); err != nil {
+		db.log.Error("DeleteAlertRule(). db.RemoveAlertStates(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetAlertStates returns the states of a rule or of all rules when ruleId is empty
+func (db *DB) GetAlertStates(ruleId string, firing bool) ([]AlertState, error) {
+	db, span := db.startSpan("GetAlertStates", attribute.String("rule", ruleId))
+	defer span.End()
+	states, err := db.ListAlertStates(ruleId)
+	if err != nil {
+		db.log.Error("GetAlertStates(). db.ListAlertStates(). err:", zap.Error(err))
+		return nil, err
+	}
+	result := []AlertState{}
+	for _, state := range states {
+		if firing && !state.Firing {
+			continue
+		}
+		result = append(result, state)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+// alertStations resolves the sids of a rule, the city matches the cached stations case insensitively
+func (db *DB) alertStations(rule *AlertRule) []string {
+	seen := map[string]bool{}
+	var sids []string
+	for _, sid := range rule.Sids {
+		if !seen[sid] {
+			seen[sid] = true
+			sids = append(sids, sid)
+		}
+	}
+	if rule.City != "" {
+		for _, st := range db.GetCachedStations() {
+			if strings.EqualFold(st.CityName, rule.City) && !seen[st.Sid] {
+				seen[st.Sid] = true
+				sids = append(sids, st.Sid)
+			}
+		}
+	}
+	return sids
+}
@@ -0,0 +1,273 @@
+package db
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"go.uber.org/zap"
+)
+
+// alertHourGap is the longest step between two realtime values still counted as consecutive hours
+const alertHourGap = int64(90 * time.Minute / time.Millisecond)
+
+// AlertEngine evaluates the enabled rules against the realtime values on its own ticker
+// and delivers firing and resolved events to the rule webhooks
+type AlertEngine struct {
+	db       *DB
+	log      *zap.Logger
+	interval time.Duration
+	retries  int
+	sender   *webhookSender
+	// lock orders the rounds and the rule writes, so a round never saves states of a replaced rule
+	lock   sync.Mutex
+	ticker *time.Ticker
+	done   chan bool
+}
+
+func (db *DB) NewAlertEngine(cfg *conf.AlertConfig) *AlertEngine {
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	retries := cfg.Retries
+	if retries <= 0 {
+		retries = 5
+	}
+	return &AlertEngine{
+		db:       db,
+		log:      db.log.Named("[alert]"),
+		interval: interval,
+		retries:  retries,
+		sender:   &webhookSender{client: &http.Client{Timeout: timeout}},
+		done:     make(chan bool),
+	}
+}
+
+func (e *AlertEngine) Start() {
+	e.ticker = time.NewTicker(e.interval)
+	go func() {
+		e.Evaluate()
+		for {
+			select {
+			case <-e.done:
+				return
+			case <-e.ticker.C:
+				e.Evaluate()
+			}
+		}
+	}()
+}
+
+func (e *AlertEngine) Close() {
+	if e.ticker != nil {
+		e.ticker.Stop()
+	}
+	close(e.done)
+}
+
+// Evaluate runs one round over all enabled rules, rounds never overlap
+func (e *AlertEngine) Evaluate() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	rules, err := e.db.GetAlertRules()
+	if err != nil {
+		e.log.Warn("load alert rules failed, skip this round", zap.Error(err))
+		return
+	}
+	now := time.Now()
+	for i := range rules {
+		if !rules[i].Enabled {
+			continue
+		}
+		if err = e.evaluateRule(&rules[i], now); err != nil {
+			e.log.Error("evaluateRule(). err:", zap.String("rule", rules[i].Id), zap.Error(err))
+		}
+	}
+}
+
+// UpdateRule replaces a rule between two rounds, the stations firing under the old rule are resolved first
+func (e *AlertEngine) UpdateRule(id string, rule *AlertRule) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.resolveRule(id); err != nil {
+		return err
+	}
+	return e.db.UpdateAlertRule(id, rule)
+}
+
+// DeleteRule removes a rule between two rounds, the stations firing under it are resolved first
+func (e *AlertEngine) DeleteRule(id string) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if err := e.resolveRule(id); err != nil {
+		return err
+	}
+	return e.db.DeleteAlertRule(id)
+}
+
+// resolveRule posts a resolve for every station of the rule announced as firing and for the resolves still
+// pending, once each as the states are reset right after
+func (e *AlertEngine) resolveRule(id string) error {
+	rule, err := e.db.GetAlertRule(id)
+	if err != nil {
+		return err
+	}
+	states, err := e.db.ListAlertStates(id)
+	if err != nil {
+		return err
+	}
+	for i := range states {
+		state := &states[i]
+		if !(state.Firing && state.Pending != "firing") && state.Pending != "resolved" {
+			continue
+		}
+		state.Firing = false
+		state.Pending = "resolved"
+		if err = e.deliver(rule, state); err != nil {
+			e.log.Warn("resolve alert of a changed rule failed", zap.String("rule", rule.Id),
+				zap.String("sid", state.Sid), zap.Error(err))
+			// the other stations share the webhook
+			return nil
+		}
+	}
+	return nil
+}
+
+func (e *AlertEngine) evaluateRule(rule *AlertRule, now time.Time) error {
+	sids := e.db.alertStations(rule)
+	if len(sids) == 0 {
+		return nil
+	}
+	rts, err := e.db.GetRealtimeByPol(rule.Pol, sids)
+	if err != nil {
+		return err
+	}
+	stored, err := e.db.ListAlertStates(rule.Id)
+	if err != nil {
+		return err
+	}
+	states := map[string]*AlertState{}
+	for i := range stored {
+		states[stored[i].Sid] = &stored[i]
+	}
+	var changed []AlertState
+	// the events of a rule share its webhook, after a failed post the others wait for the next round too
+	var deliverErr error
+	// rounds start one interval apart give or take the scheduling, half an interval of slack keeps a
+	// retry due in the round it was planned for
+	due := now.Add(e.interval / 2).UnixMilli()
+	for _, rt := range rts {
+		state, ok := states[rt.Sid]
+		if !ok {
+			state = &AlertState{Id: alertStateId(rule.Id, rt.Sid), RuleId: rule.Id, Sid: rt.Sid}
+			states[rt.Sid] = state
+		}
+		dirty := false
+		if rt.Tm > state.LastTm {
+			e.advance(rule, state, &rt)
+			dirty = true
+		}
+		// a delivered resolve may let a held back firing go out in the same round
+		for state.Pending != "" && deliverErr == nil && state.NextTry <= due {
+			dirty = true
+			if deliverErr = e.deliver(rule, state); deliverErr != nil {
+				e.retryLater(rule, state, now, deliverErr)
+				break
+			}
+			e.settle(rule, state)
+		}
+		if dirty {
+			changed = append(changed, *state)
+		}
+	}
+	return e.db.SaveAlertStates(changed)
+}
+
+// advance counts a new realtime value into the streak, firing once when the streak reaches the rule hours
+// and resolving once when a value stops matching, a gap in the hourly values restarts the streak
+func (e *AlertEngine) advance(rule *AlertRule, state *AlertState, rt *AqiRealtime) {
+	val, hit := rule.Match(e.db.Conf().AqiStandard, rt.Data)
+	if !hit {
+		state.Streak = 0
+	} else if state.Streak > 0 && rt.Tm-state.LastTm <= alertHourGap {
+		state.Streak++
+	} else {
+		state.Streak = 1
+	}
+	state.LastTm = rt.Tm
+	state.Value = val
+	e.transition(rule, state)
+}
+
+// transition fires or resolves the state by its streak. A firing waits while the resolve of the previous
+// one is pending, so receivers always see them in order
+func (e *AlertEngine) transition(rule *AlertRule, state *AlertState) {
+	if !state.Firing && state.Streak >= rule.Hours && state.Pending != "resolved" {
+		state.Firing = true
+		state.FiredAt = state.LastTm
+		e.queue(state, "firing")
+	} else if state.Firing && state.Streak == 0 {
+		state.Firing = false
+		if state.Pending == "firing" {
+			// never announced, so there is nothing to resolve
+			e.queue(state, "")
+		} else {
+			e.queue(state, "resolved")
+		}
+	}
+}
+
+func (e *AlertEngine) queue(state *AlertState, event string) {
+	state.Pending = event
+	state.Attempts = 0
+	state.NextTry = 0
+}
+
+// settle clears a delivered or dropped event and lets a held back firing go
+func (e *AlertEngine) settle(rule *AlertRule, state *AlertState) {
+	e.queue(state, "")
+	e.transition(rule, state)
+}
+
+// retryLater plans the next post of a failed event after a doubling number of rounds,
+// the event is dropped once its retries are used up
+func (e *AlertEngine) retryLater(rule *AlertRule, state *AlertState, now time.Time, err error) {
+	state.Attempts++
+	if state.Attempts > e.retries {
+		e.log.Error("deliver alert failed, drop the event", zap.String("rule", rule.Id), zap.String("sid", state.Sid),
+			zap.String("event", state.Pending), zap.Int("attempts", state.Attempts), zap.Error(err))
+		e.settle(rule, state)
+		return
+	}
+	wait := e.interval << (state.Attempts - 1)
+	if wait <= 0 || wait > 24*time.Hour {
+		wait = 24 * time.Hour
+	}
+	state.NextTry = now.Add(wait).UnixMilli()
+	e.log.Warn("deliver alert failed, retry later", zap.String("rule", rule.Id), zap.String("sid", state.Sid),
+		zap.String("event", state.Pending), zap.Int("attempts", state.Attempts), zap.Duration("wait", wait), zap.Error(err))
+}
+
+func (e *AlertEngine) deliver(rule *AlertRule, state *AlertState) error {
+	event := &AlertEvent{
+		Event:   "alert." + state.Pending,
+		Rule:    *rule,
+		Sid:     state.Sid,
+		Value:   state.Value,
+		Streak:  state.Streak,
+		Tm:      state.LastTm,
+		FiredAt: state.FiredAt,
+		Time:    time.Now().UnixMilli(),
+	}
+	event.Rule.Secret = ""
+	if st, err := e.db.getStationFromCache(state.Sid); err == nil {
+		event.Station = st
+	}
+	return e.sender.send(rule.Webhook, rule.Secret, event)
+}
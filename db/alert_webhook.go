@@ -0,0 +1,76 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AlertEvent is the json body posted to the webhook of a rule
+type AlertEvent struct {
+	Event   string          `json:"event"`
+	Rule    AlertRule       `json:"rule"`
+	Station *AqiStationResp `json:"station"`
+	Sid     string          `json:"sid"`
+	Value   float64         `json:"value"`
+	Streak  int             `json:"streak"`
+	Tm      int64           `json:"tm"`
+	FiredAt int64           `json:"fired_at"`
+	Time    int64           `json:"time"`
+}
+
+// SignAlert signs a webhook body, receivers recompute it over the X-Aqi-Timestamp header and the raw body
+func SignAlert(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookSender struct {
+	client *http.Client
+}
+
+// send posts the event once, a failed event stays pending in its state until the engine retries it
+func (w *webhookSender) send(url string, secret string, event *AlertEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return w.post(url, secret, event.Event, body)
+}
+
+func (w *webhookSender) post(url string, secret string, event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "storm-aqi-server")
+	req.Header.Set("X-Aqi-Event", event)
+	req.Header.Set("X-Aqi-Timestamp", timestamp)
+	if secret != "" {
+		req.Header.Set("X-Aqi-Signature", SignAlert(secret, timestamp, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("webhook responded " + resp.Status)
+	}
+	return nil
+}
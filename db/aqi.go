@@ -0,0 +1,227 @@
+package db
+
+import (
+	"math"
+	"sort"
+)
+
+// Pollutant concentrations are expected in µg/m³, except co which is in mg/m³.
+// Standards defined in ppb/ppm are converted at 25°C and 1 atm.
+
+const (
+	StdUsEpa   = "us_epa"
+	StdCnHj633 = "cn_hj633"
+	StdEuCaqi  = "eu_caqi"
+)
+
+const molarVolume = 24.45
+
+var molecularWeight = map[string]float64{
+	"no2": 46.01,
+	"so2": 64.07,
+	"o3":  48.00,
+	"co":  28.01,
+}
+
+type breakpoint struct {
+	CLow  float64
+	CHigh float64
+	ILow  float64
+	IHigh float64
+}
+
+type category struct {
+	Max   int
+	Name  string
+	Color string
+}
+
+type aqiStandard struct {
+	convert     func(pol string, c float64) float64
+	breakpoints map[string][]breakpoint
+	categories  []category
+	// minMain is the lowest index at which a dominant pollutant is reported
+	minMain int
+}
+
+type AqiIndex struct {
+	Standard string         `json:"standard"`
+	Aqi      int            `json:"aqi"`
+	MainPol  string         `json:"main_pol"`
+	Level    int            `json:"level"`
+	Category string         `json:"category"`
+	Color    string         `json:"color"`
+	SubIndex map[string]int `json:"sub_index"`
+}
+
+type AqiTimeIndex struct {
+	Tm  int64     `json:"tm"`
+	Tms string    `json:"tms"`
+	Aqi *AqiIndex `json:"aqi"`
+}
+
+var standards = map[string]*aqiStandard{
+	StdUsEpa: {
+		convert: func(pol string, c float64) float64 {
+			// µg/m³ to ppb, and mg/m³ to ppm for co
+			if mw, ok := molecularWeight[pol]; ok {
+				return c * molarVolume / mw
+			}
+			return c
+		},
+		// pm25 follows the 2024 revision, which merged the two hazardous rows into 225.5-325.4. The 8 hour
+		// o3 rows end at 200 ppb and the rows from 301 only exist for 1 hour values from 405 ppb, in between
+		// the o3 index holds at 300
+		breakpoints: map[string][]breakpoint{
+			"pm25": buildBreakpoints([]float64{0, 9.0, 35.4, 55.4, 125.4, 225.4, 325.4}, []float64{0, 50, 100, 150, 200, 300, 500}),
+			"pm10": buildBreakpoints([]float64{0, 54, 154, 254, 354, 424, 504, 604}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"o3":   buildBreakpoints([]float64{0, 54, 70, 85, 105, 200, 404, 504, 604}, []float64{0, 50, 100, 150, 200, 300, 300, 400, 500}),
+			"co":   buildBreakpoints([]float64{0, 4.4, 9.4, 12.4, 15.4, 30.4, 40.4, 50.4}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"so2":  buildBreakpoints([]float64{0, 35, 75, 185, 304, 604, 804, 1004}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"no2":  buildBreakpoints([]float64{0, 53, 100, 360, 649, 1249, 1649, 2049}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+		},
+		categories: []category{
+			{Max: 50, Name: "Good", Color: "#00E400"},
+			{Max: 100, Name: "Moderate", Color: "#FFFF00"},
+			{Max: 150, Name: "Unhealthy for Sensitive Groups", Color: "#FF7E00"},
+			{Max: 200, Name: "Unhealthy", Color: "#FF0000"},
+			{Max: 300, Name: "Very Unhealthy", Color: "#8F3F97"},
+			{Max: math.MaxInt32, Name: "Hazardous", Color: "#7E0023"},
+		},
+		minMain: 0,
+	},
+	StdCnHj633: {
+		convert: func(pol string, c float64) float64 {
+			return c
+		},
+		breakpoints: map[string][]breakpoint{
+			"so2":  buildBreakpoints([]float64{0, 50, 150, 475, 800, 1600, 2100, 2620}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"no2":  buildBreakpoints([]float64{0, 40, 80, 180, 280, 565, 750, 940}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"pm10": buildBreakpoints([]float64{0, 50, 150, 250, 350, 420, 500, 600}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"co":   buildBreakpoints([]float64{0, 2, 4, 14, 24, 36, 48, 60}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"o3":   buildBreakpoints([]float64{0, 160, 200, 300, 400, 800, 1000, 1200}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+			"pm25": buildBreakpoints([]float64{0, 35, 75, 115, 150, 250, 350, 500}, []float64{0, 50, 100, 150, 200, 300, 400, 500}),
+		},
+		categories: []category{
+			{Max: 50, Name: "Excellent", Color: "#00E400"},
+			{Max: 100, Name: "Good", Color: "#FFFF00"},
+			{Max: 150, Name: "Lightly Polluted", Color: "#FF7E00"},
+			{Max: 200, Name: "Moderately Polluted", Color: "#FF0000"},
+			{Max: 300, Name: "Heavily Polluted", Color: "#99004C"},
+			{Max: math.MaxInt32, Name: "Severely Polluted", Color: "#7E0023"},
+		},
+		minMain: 51,
+	},
+	StdEuCaqi: {
+		convert: func(pol string, c float64) float64 {
+			if pol == "co" {
+				return c * 1000
+			}
+			return c
+		},
+		breakpoints: map[string][]breakpoint{
+			"no2":  buildBreakpoints([]float64{0, 50, 100, 200, 400}, []float64{0, 25, 50, 75, 100}),
+			"pm10": buildBreakpoints([]float64{0, 25, 50, 90, 180}, []float64{0, 25, 50, 75, 100}),
+			"pm25": buildBreakpoints([]float64{0, 15, 30, 55, 110}, []float64{0, 25, 50, 75, 100}),
+			"o3":   buildBreakpoints([]float64{0, 60, 120, 180, 240}, []float64{0, 25, 50, 75, 100}),
+			"co":   buildBreakpoints([]float64{0, 5000, 7500, 10000, 20000}, []float64{0, 25, 50, 75, 100}),
+			"so2":  buildBreakpoints([]float64{0, 50, 100, 350, 500}, []float64{0, 25, 50, 75, 100}),
+		},
+		categories: []category{
+			{Max: 25, Name: "Very Low", Color: "#79BC6A"},
+			{Max: 50, Name: "Low", Color: "#BBCF4C"},
+			{Max: 75, Name: "Medium", Color: "#EEC20B"},
+			{Max: 100, Name: "High", Color: "#F29305"},
+			{Max: math.MaxInt32, Name: "Very High", Color: "#E8416F"},
+		},
+		minMain: 0,
+	},
+}
+
+func buildBreakpoints(conc []float64, index []float64) []breakpoint {
+	var bps []breakpoint
+	for i := 1; i < len(conc); i++ {
+		bps = append(bps, breakpoint{
+			CLow:  conc[i-1],
+			CHigh: conc[i],
+			ILow:  index[i-1],
+			IHigh: index[i],
+		})
+	}
+	return bps
+}
+
+// IsAqiStandard reports whether std names a supported breakpoint table
+func IsAqiStandard(std string) bool {
+	_, ok := standards[std]
+	return ok
+}
+
+func getStandard(std string) (string, *aqiStandard) {
+	if s, ok := standards[std]; ok {
+		return std, s
+	}
+	return StdUsEpa, standards[StdUsEpa]
+}
+
+// SubIndex returns the individual index of a pollutant concentration, or -1 if it can't be rated.
+// Concentrations above the last breakpoint are extrapolated with the slope of the last segment.
+func SubIndex(std string, pol string, c float64) int {
+	_, s := getStandard(std)
+	bps, ok := s.breakpoints[pol]
+	if !ok || c < 0 || math.IsNaN(c) {
+		return -1
+	}
+	c = s.convert(pol, c)
+	for _, bp := range bps {
+		if c <= bp.CHigh {
+			return int(math.Round((bp.IHigh-bp.ILow)/(bp.CHigh-bp.CLow)*(c-bp.CLow) + bp.ILow))
+		}
+	}
+	last := bps[len(bps)-1]
+	return int(math.Round((last.IHigh-last.ILow)/(last.CHigh-last.CLow)*(c-last.CLow) + last.ILow))
+}
+
+// CalcAqi rates a set of pollutant concentrations and picks the dominant pollutant
+func CalcAqi(std string, values map[string]float64) *AqiIndex {
+	name, s := getStandard(std)
+	index := &AqiIndex{
+		Standard: name,
+		Aqi:      -1,
+		SubIndex: map[string]int{},
+	}
+	var keys []string
+	for pol := range values {
+		keys = append(keys, pol)
+	}
+	sort.Strings(keys)
+	for _, pol := range keys {
+		sub := SubIndex(name, pol, values[pol])
+		if sub < 0 {
+			continue
+		}
+		index.SubIndex[pol] = sub
+		if sub > index.Aqi {
+			index.Aqi = sub
+			index.MainPol = pol
+		}
+	}
+	if index.Aqi < 0 {
+		return nil
+	}
+	if index.Aqi < s.minMain {
+		index.MainPol = ""
+	}
+	index.Level, index.Category, index.Color = s.categoryOf(index.Aqi)
+	return index
+}
+
+func (s *aqiStandard) categoryOf(aqi int) (int, string, string) {
+	for i, cat := range s.categories {
+		if aqi <= cat.Max {
+			return i + 1, cat.Name, cat.Color
+		}
+	}
+	last := s.categories[len(s.categories)-1]
+	return len(s.categories), last.Name, last.Color
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"math"
+	"testing"
+)
+
+// ppb converts a us epa breakpoint back to the µg/m³ the values are read in
+func ppb(pol string, v float64) float64 {
+	return v * molecularWeight[pol] / molarVolume
+}
+
+func TestSubIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		std  string
+		pol  string
+		c    float64
+		want int
+	}{
+		{name: "us pm25 zero", std: StdUsEpa, pol: "pm25", c: 0, want: 0},
+		{name: "us pm25 2024 good", std: StdUsEpa, pol: "pm25", c: 9, want: 50},
+		{name: "us pm25 2024 moderate", std: StdUsEpa, pol: "pm25", c: 12, want: 56},
+		{name: "us pm25 upper breakpoint", std: StdUsEpa, pol: "pm25", c: 35.4, want: 100},
+		{name: "us pm25 next segment", std: StdUsEpa, pol: "pm25", c: 55.5, want: 150},
+		{name: "us pm25 2024 unhealthy", std: StdUsEpa, pol: "pm25", c: 125.4, want: 200},
+		{name: "us pm25 2024 very unhealthy", std: StdUsEpa, pol: "pm25", c: 225.4, want: 300},
+		{name: "us pm25 2024 hazardous", std: StdUsEpa, pol: "pm25", c: 275.4, want: 400},
+		{name: "us pm25 2024 top", std: StdUsEpa, pol: "pm25", c: 325.4, want: 500},
+		{name: "us pm25 extrapolated", std: StdUsEpa, pol: "pm25", c: 600, want: 1049},
+		{name: "us pm10", std: StdUsEpa, pol: "pm10", c: 154, want: 100},
+		{name: "us o3 in ppb", std: StdUsEpa, pol: "o3", c: 96, want: 45},
+		{name: "us o3 8h good", std: StdUsEpa, pol: "o3", c: ppb("o3", 54), want: 50},
+		{name: "us o3 8h moderate", std: StdUsEpa, pol: "o3", c: ppb("o3", 70), want: 100},
+		{name: "us o3 8h unhealthy", std: StdUsEpa, pol: "o3", c: ppb("o3", 105), want: 200},
+		{name: "us o3 8h top", std: StdUsEpa, pol: "o3", c: ppb("o3", 200), want: 300},
+		{name: "us o3 between the 8h and 1h rows", std: StdUsEpa, pol: "o3", c: ppb("o3", 300), want: 300},
+		{name: "us o3 below the 1h rows", std: StdUsEpa, pol: "o3", c: ppb("o3", 404), want: 300},
+		{name: "us o3 1h hazardous", std: StdUsEpa, pol: "o3", c: ppb("o3", 405), want: 301},
+		{name: "us o3 1h hazardous top", std: StdUsEpa, pol: "o3", c: ppb("o3", 504), want: 400},
+		{name: "us o3 1h top", std: StdUsEpa, pol: "o3", c: ppb("o3", 604), want: 500},
+		{name: "us no2 in ppb", std: StdUsEpa, pol: "no2", c: 100, want: 50},
+		{name: "us co in ppm", std: StdUsEpa, pol: "co", c: 10, want: 93},
+		{name: "cn pm25", std: StdCnHj633, pol: "pm25", c: 75, want: 100},
+		{name: "cn o3", std: StdCnHj633, pol: "o3", c: 250, want: 125},
+		{name: "cn co", std: StdCnHj633, pol: "co", c: 3, want: 75},
+		{name: "eu pm25", std: StdEuCaqi, pol: "pm25", c: 30, want: 50},
+		{name: "eu co in µg", std: StdEuCaqi, pol: "co", c: 6, want: 35},
+		{name: "eu no2 extrapolated", std: StdEuCaqi, pol: "no2", c: 450, want: 106},
+		{name: "unknown standard is us", std: "who", pol: "pm25", c: 35.4, want: 100},
+		{name: "unknown pollutant", std: StdUsEpa, pol: "dust", c: 10, want: -1},
+		{name: "negative", std: StdUsEpa, pol: "pm25", c: -1, want: -1},
+		{name: "nan", std: StdUsEpa, pol: "pm25", c: math.NaN(), want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SubIndex(tt.std, tt.pol, tt.c); got != tt.want {
+				t.Errorf("SubIndex(%s, %s, %v) = %d, want %d", tt.std, tt.pol, tt.c, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalcAqi(t *testing.T) {
+	tests := []struct {
+		name     string
+		std      string
+		values   map[string]float64
+		want     *AqiIndex
+		wantNone bool
+	}{
+		{
+			name:   "us dominant pollutant",
+			std:    StdUsEpa,
+			values: map[string]float64{"pm25": 35.4, "pm10": 54},
+			want: &AqiIndex{Standard: StdUsEpa, Aqi: 100, MainPol: "pm25", Level: 2, Category: "Moderate", Color: "#FFFF00",
+				SubIndex: map[string]int{"pm25": 100, "pm10": 50}},
+		},
+		{
+			name:   "us hazardous",
+			std:    StdUsEpa,
+			values: map[string]float64{"pm25": 600},
+			want: &AqiIndex{Standard: StdUsEpa, Aqi: 1049, MainPol: "pm25", Level: 6, Category: "Hazardous", Color: "#7E0023",
+				SubIndex: map[string]int{"pm25": 1049}},
+		},
+		{
+			name:   "cn dominant pollutant",
+			std:    StdCnHj633,
+			values: map[string]float64{"pm25": 75, "pm10": 50},
+			want: &AqiIndex{Standard: StdCnHj633, Aqi: 100, MainPol: "pm25", Level: 2, Category: "Good", Color: "#FFFF00",
+				SubIndex: map[string]int{"pm25": 100, "pm10": 50}},
+		},
+		{
+			name:   "cn excellent has no dominant pollutant",
+			std:    StdCnHj633,
+			values: map[string]float64{"pm25": 35, "no2": 40},
+			want: &AqiIndex{Standard: StdCnHj633, Aqi: 50, MainPol: "", Level: 1, Category: "Excellent", Color: "#00E400",
+				SubIndex: map[string]int{"pm25": 50, "no2": 50}},
+		},
+		{
+			name:   "eu very high",
+			std:    StdEuCaqi,
+			values: map[string]float64{"no2": 450, "pm25": 30},
+			want: &AqiIndex{Standard: StdEuCaqi, Aqi: 106, MainPol: "no2", Level: 5, Category: "Very High", Color: "#E8416F",
+				SubIndex: map[string]int{"no2": 106, "pm25": 50}},
+		},
+		{
+			name:   "unrated values are left out",
+			std:    StdEuCaqi,
+			values: map[string]float64{"pm25": 30, "dust": 900, "o3": -1},
+			want: &AqiIndex{Standard: StdEuCaqi, Aqi: 50, MainPol: "pm25", Level: 2, Category: "Low", Color: "#BBCF4C",
+				SubIndex: map[string]int{"pm25": 50}},
+		},
+		{
+			name:     "nothing to rate",
+			std:      StdUsEpa,
+			values:   map[string]float64{"dust": 900},
+			wantNone: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CalcAqi(tt.std, tt.values)
+			if tt.wantNone {
+				if got != nil {
+					t.Fatalf("CalcAqi() = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("CalcAqi() = nil")
+			}
+			if got.Standard != tt.want.Standard || got.Aqi != tt.want.Aqi || got.MainPol != tt.want.MainPol ||
+				got.Level != tt.want.Level || got.Category != tt.want.Category || got.Color != tt.want.Color {
+				t.Errorf("CalcAqi() = %+v, want %+v", got, tt.want)
+			}
+			if len(got.SubIndex) != len(tt.want.SubIndex) {
+				t.Errorf("SubIndex = %v, want %v", got.SubIndex, tt.want.SubIndex)
+			}
+			for pol, want := range tt.want.SubIndex {
+				if got.SubIndex[pol] != want {
+					t.Errorf("SubIndex[%s] = %d, want %d", pol, got.SubIndex[pol], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/csnight/storm-aqi-server/elastic"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNoFailQueue   = errors.New("the bulk fail queue needs the elastic backend")
+	ErrNoDeadLetters = elastic.ErrNoDeadLetters
+)
+
+// BulkFailures is the state of the bulk fail queue with some of its items, the items waiting
+// for a retry come without their bodies
+type BulkFailures struct {
+	elastic.FailQueueStats
+	Items []elastic.FailedItem `json:"items"`
+}
+
+// GetBulkFailures returns the counts of the fail queue and up to size of the items waiting for a retry
+func (db *DB) GetBulkFailures(index string, size int) (*BulkFailures, error) {
+	if db.api == nil {
+		return nil, ErrNoFailQueue
+	}
+	return &BulkFailures{FailQueueStats: db.api.FailQueueStats(), Items: db.api.FailedItems(index, size)}, nil
+}
+
+// GetDeadLetters returns the counts of the fail queue and up to size dead letters, newest first
+func (db *DB) GetDeadLetters(index string, size int) (*BulkFailures, error) {
+	if db.api == nil {
+		return nil, ErrNoFailQueue
+	}
+	return &BulkFailures{FailQueueStats: db.api.FailQueueStats(), Items: db.api.DeadLetters(index, size)}, nil
+}
+
+// ReplayDeadLetters queues the dead letters with the seqs, or of the index, all of them when both are empty,
+// for a retry with their attempts reset
+func (db *DB) ReplayDeadLetters(index string, seqs []uint64) (int, error) {
+	if db.api == nil {
+		return 0, ErrNoFailQueue
+	}
+	count, err := db.api.ReplayDeadLetters(index, seqs)
+	if err != nil && err != ErrNoDeadLetters {
+		db.log.Error("ReplayDeadLetters(). api.ReplayDeadLetters(). err:", zap.Error(err))
+	}
+	return count, err
+}
+
+// PurgeDeadLetters drops the dead letters with the seqs, or of the index, all of them when both are empty
+func (db *DB) PurgeDeadLetters(index string, seqs []uint64) (int, error) {
+	if db.api == nil {
+		return 0, ErrNoFailQueue
+	}
+	count, err := db.api.PurgeDeadLetters(index, seqs)
+	if err != nil && err != ErrNoDeadLetters {
+		db.log.Error("PurgeDeadLetters(). api.PurgeDeadLetters(). err:", zap.Error(err))
+	}
+	return count, err
+}
@@ -1,6 +1,9 @@
 package db
 
-import "go.uber.org/zap"
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
 
 type GeoPoint struct {
 	Lon float64 `json:"lon" validate:"longitude"`
@@ -46,6 +49,8 @@ type EsRespTotal struct {
 }
 
 func (db *DB) getStationFromCache(sid string) (*AqiStationResp, error) {
+	db, span := db.startSpan("getStationFromCache", attribute.String("sid", sid))
+	defer span.End()
 	var st AqiStationResp
 	stb, err := db.cache.Get([]byte(sid))
 	if err != nil {
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const compareStep = int64(time.Hour / time.Millisecond)
+
+// CompareData is what a CompareStore reads for a comparison, history is keyed by sid
+type CompareData struct {
+	Stations []AqiStationResp
+	Realtime []AqiRealtime
+	History  map[string][]AqiHistory
+}
+
+type CompareSeries struct {
+	Idx      int      `json:"idx"`
+	Sid      string   `json:"sid"`
+	Name     string   `json:"name"`
+	Loc      GeoPoint `json:"loc"`
+	CityName string   `json:"city_name"`
+	// aligned with CompareResp.Times, null marks a missing point
+	Data     []*float64    `json:"data"`
+	Missing  int           `json:"missing"`
+	Realtime *RealtimeResp `json:"realtime"`
+}
+
+type CompareResp struct {
+	Pol      string          `json:"pol"`
+	Start    string          `json:"start"`
+	End      string          `json:"end"`
+	Step     int64           `json:"step"`
+	Times    []int64         `json:"times"`
+	Stations []CompareSeries `json:"stations"`
+	NotFound []string        `json:"not_found"`
+}
+
+// CompareStations aligns the history of a pollutant of several stations on a common hourly axis,
+// values are truncated to their hour and the last one in an hour wins
+func (db *DB) CompareStations(sids []string, pol string, st time.Time, et time.Time) (*CompareResp, error) {
+	db, span := db.startSpan("CompareStations", attribute.StringSlice("sids", sids), attribute.String("pol", pol))
+	defer span.End()
+	data, err := db.SearchCompare(sids, pol, st, et)
+	if err != nil {
+		db.log.Error("CompareStations(). db.SearchCompare(). err:", zap.Error(err))
+		return nil, err
+	}
+	response := &CompareResp{
+		Pol:      pol,
+		Start:    st.Format("2006-01-02"),
+		End:      et.Format("2006-01-02"),
+		Step:     compareStep,
+		Times:    []int64{},
+		Stations: []CompareSeries{},
+		NotFound: []string{},
+	}
+	first := st.UnixMilli() - st.UnixMilli()%compareStep
+	for tm := first; tm <= et.UnixMilli(); tm += compareStep {
+		response.Times = append(response.Times, tm)
+	}
+	stations := map[string]*AqiStationResp{}
+	for i := range data.Stations {
+		stations[data.Stations[i].Sid] = &data.Stations[i]
+	}
+	realtime := map[string][]AqiRealtime{}
+	for _, rt := range data.Realtime {
+		realtime[rt.Sid] = append(realtime[rt.Sid], rt)
+	}
+	for _, sid := range sids {
+		station, ok := stations[sid]
+		if !ok {
+			response.NotFound = append(response.NotFound, sid)
+			continue
+		}
+		series := CompareSeries{
+			Idx:      station.Idx,
+			Sid:      station.Sid,
+			Name:     station.Name,
+			Loc:      station.Loc,
+			CityName: station.CityName,
+			Data:     make([]*float64, len(response.Times)),
+			Realtime: db.buildRealtimeResp(station, realtime[sid]),
+		}
+		hisList := data.History[sid]
+		sort.SliceStable(hisList, func(i, j int) bool {
+			return hisList[i].Tm < hisList[j].Tm
+		})
+		for i := range hisList {
+			slot := (hisList[i].Tm - first) / compareStep
+			if hisList[i].Tm < first || slot >= int64(len(series.Data)) {
+				continue
+			}
+			series.Data[slot] = &hisList[i].Data
+		}
+		for _, v := range series.Data {
+			if v == nil {
+				series.Missing++
+			}
+		}
+		response.Stations = append(response.Stations, series)
+	}
+	return response, nil
+}
+
+// buildRealtimeResp builds the realtime snapshot of a station from its realtime documents like GetAqiRealtimeById
+func (db *DB) buildRealtimeResp(st *AqiStationResp, rtList []AqiRealtime) *RealtimeResp {
+	response := &RealtimeResp{
+		Idx:      st.Idx,
+		Sid:      st.Sid,
+		Name:     st.Name,
+		Loc:      st.Loc,
+		CityName: st.CityName,
+	}
+	if len(rtList) == 0 {
+		return response
+	}
+	values := map[string]float64{}
+	for _, item := range rtList {
+		values[item.Pol] = item.Data
+		response.Realtime = append(response.Realtime, RealtimeInfo{
+			Pol:   item.Pol,
+			Data:  item.Data,
+			Daily: item.Daily,
+		})
+	}
+	response.Tz = rtList[0].Tz
+	response.Tm = rtList[0].Tm
+	response.Tms = rtList[0].Tms
+	response.Aqi = CalcAqi(db.Conf().AqiStandard, values)
+	if response.Aqi != nil {
+		response.MainPol = response.Aqi.MainPol
+	}
+	return response
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const maxExportStations = 2000
+
+var (
+	ErrExportNoStation       = errors.New("no station matches the export station set")
+	ErrExportTooManyStations = errors.New("export station set exceeds " + strconv.Itoa(maxExportStations) + " stations")
+)
+
+// ExportFormats maps an export format to its content type and file extension
+var ExportFormats = map[string][2]string{
+	"csv":     {"text/csv; charset=utf-8", "csv"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+	"netcdf":  {"application/x-netcdf", "nc"},
+}
+
+// ExportRequest selects the stations by sids, city or bbox, the first one set wins
+type ExportRequest struct {
+	Sids   []string
+	City   string
+	Bbox   *Bounds
+	Pols   []string
+	Start  time.Time
+	End    time.Time
+	Format string
+}
+
+// ExportRow is one history value with the metadata of its station, shared by the csv and parquet writers
+type ExportRow struct {
+	Sid      string  `parquet:"name=sid, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Idx      int32   `parquet:"name=idx, type=INT32"`
+	Name     string  `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	CityName string  `parquet:"name=city_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Lon      float64 `parquet:"name=lon, type=DOUBLE"`
+	Lat      float64 `parquet:"name=lat, type=DOUBLE"`
+	Tz       string  `parquet:"name=tz, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Pol      string  `parquet:"name=pol, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Tm       int64   `parquet:"name=tm, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Data     float64 `parquet:"name=data, type=DOUBLE"`
+}
+
+// exportErrorMarker starts the line ending a failed export, it is followed by a comma and the error
+const exportErrorMarker = "#error"
+
+// historyExporter writes the scanned history, rows arrive ordered by station and time. Abort ends a failed
+// export with the error marker line instead of the footer of the format, so the file doesn't pass as complete
+type historyExporter interface {
+	Write(his *AqiHistory, station *AqiStationResp, index int) error
+	Close() error
+	Abort(err error) error
+}
+
+func writeExportError(w io.Writer, err error) error {
+	_, werr := io.WriteString(w, "\n"+exportErrorMarker+","+strings.ReplaceAll(err.Error(), "\n", " ")+"\n")
+	return werr
+}
+
+// ResolveExportStations returns the stations of the export ordered by idx
+func (db *DB) ResolveExportStations(req *ExportRequest) ([]AqiStationResp, error) {
+	db, span := db.startSpan("ResolveExportStations")
+	defer span.End()
+	var stations []AqiStationResp
+	switch {
+	case len(req.Sids) > 0:
+		if len(req.Sids) > maxExportStations {
+			return nil, ErrExportTooManyStations
+		}
+		for _, sid := range req.Sids {
+			st, err := db.getStationFromCache(sid)
+			if err != nil {
+				if strings.HasPrefix(err.Error(), "404") {
+					continue
+				}
+				return nil, err
+			}
+			if st != nil {
+				stations = append(stations, *st)
+			}
+		}
+	case req.City != "":
+		sts, err := db.SearchStationsByCityName(req.City, maxExportStations+1)
+		if err != nil {
+			db.log.Error("ResolveExportStations(). db.SearchStationsByCityName(). err:", zap.Error(err))
+			return nil, err
+		}
+		stations = sts
+	case req.Bbox != nil:
+		sts, err := db.SearchStationsByArea(*req.Bbox, maxExportStations+1)
+		if err != nil {
+			db.log.Error("ResolveExportStations(). db.SearchStationsByArea(). err:", zap.Error(err))
+			return nil, err
+		}
+		stations = sts
+	}
+	if len(stations) == 0 {
+		return nil, ErrExportNoStation
+	}
+	if len(stations) > maxExportStations {
+		return nil, ErrExportTooManyStations
+	}
+	sort.SliceStable(stations, func(i, j int) bool {
+		return stations[i].Idx < stations[j].Idx
+	})
+	return stations, nil
+}
+
+// ExportHistory streams the history of the stations to w in the requested format, only one page of the scroll is held at a time
+func (db *DB) ExportHistory(w io.Writer, req *ExportRequest, stations []AqiStationResp) error {
+	db, span := db.startSpan("ExportHistory", attribute.Int("stations", len(stations)))
+	defer span.End()
+	exportPols := req.Pols
+	if len(exportPols) == 0 {
+		exportPols = pols
+	}
+	var exporter historyExporter
+	switch req.Format {
+	case "parquet":
+		pe, err := newParquetExporter(w)
+		if err != nil {
+			db.log.Error("ExportHistory(). newParquetExporter(). err:", zap.Error(err))
+			return err
+		}
+		exporter = pe
+	case "netcdf":
+		ne, err := newNetcdfExporter(w, stations, exportPols, req.Start, req.End)
+		if err != nil {
+			db.log.Error("ExportHistory(). newNetcdfExporter(). err:", zap.Error(err))
+			return err
+		}
+		exporter = ne
+	default:
+		exporter = newCsvExporter(w)
+	}
+	index := map[string]int{}
+	sids := make([]string, len(stations))
+	for i, st := range stations {
+		index[st.Sid] = i
+		sids[i] = st.Sid
+	}
+	err := db.ScanHistory(sids, req.Pols, req.Start, req.End, func(his *AqiHistory) error {
+		i, ok := index[his.Sid]
+		if !ok {
+			return nil
+		}
+		return exporter.Write(his, &stations[i], i)
+	})
+	if err != nil {
+		db.log.Error("ExportHistory(). db.ScanHistory(). err:", zap.Error(err))
+		_ = exporter.Abort(err)
+		return err
+	}
+	return exporter.Close()
+}
+
+func newExportRow(his *AqiHistory, station *AqiStationResp) ExportRow {
+	return ExportRow{
+		Sid:      station.Sid,
+		Idx:      int32(station.Idx),
+		Name:     station.Name,
+		CityName: station.CityName,
+		Lon:      station.Loc.Lon,
+		Lat:      station.Loc.Lat,
+		Tz:       station.Tz,
+		Pol:      his.Pol,
+		Tm:       his.Tm,
+		Data:     his.Data,
+	}
+}
+
+var csvHeader = []string{"sid", "idx", "name", "city_name", "lon", "lat", "tz", "pol", "tm", "time", "data"}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func newCsvExporter(w io.Writer) *csvExporter {
+	cw := csv.NewWriter(w)
+	// the writer is buffered, a failed header shows up in Close
+	_ = cw.Write(csvHeader)
+	return &csvExporter{w: cw}
+}
+
+func (e *csvExporter) Write(his *AqiHistory, station *AqiStationResp, _ int) error {
+	row := newExportRow(his, station)
+	return e.w.Write([]string{
+		row.Sid,
+		strconv.Itoa(int(row.Idx)),
+		row.Name,
+		row.CityName,
+		strconv.FormatFloat(row.Lon, 'f', -1, 64),
+		strconv.FormatFloat(row.Lat, 'f', -1, 64),
+		row.Tz,
+		row.Pol,
+		strconv.FormatInt(row.Tm, 10),
+		time.UnixMilli(row.Tm).UTC().Format(time.RFC3339),
+		strconv.FormatFloat(row.Data, 'f', -1, 64),
+	})
+}
+
+func (e *csvExporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExporter) Abort(err error) error {
+	_ = e.w.Write([]string{exportErrorMarker, err.Error()})
+	return e.Close()
+}
@@ -0,0 +1,403 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// The netcdf export is written in the classic 64-bit offset format (CDF-2) as a CF timeSeries
+// indexed ragged array: station metadata lives on the station dimension and every record of the
+// unlimited obs dimension holds the values of all pollutants of one station at one time.
+// https://docs.unidata.ucar.edu/netcdf-c/current/file_format_specifications.html
+
+const (
+	ncChar   int32 = 2
+	ncInt    int32 = 4
+	ncDouble int32 = 6
+
+	ncDimensionTag uint32 = 0x0A
+	ncVariableTag  uint32 = 0x0B
+	ncAttributeTag uint32 = 0x0C
+
+	// numrecs of a streamed file, the record count is unknown while the header is written
+	ncStreaming uint32 = 0xFFFFFFFF
+
+	ncFillDouble = 9.9692099683868690e+36
+)
+
+var polLongNames = map[string]string{
+	"co":   "carbon monoxide",
+	"no2":  "nitrogen dioxide",
+	"pm25": "particulate matter 2.5",
+	"pm10": "particulate matter 10",
+	"o3":   "ozone",
+	"so2":  "sulfur dioxide",
+}
+
+type ncDim struct {
+	name string
+	// 0 is the unlimited record dimension
+	length int
+}
+
+type ncAttr struct {
+	name string
+	// string, int32 or float64
+	value interface{}
+}
+
+type ncVar struct {
+	name  string
+	dims  []int
+	typ   int32
+	attrs []ncAttr
+	// big endian values of a fixed size variable
+	data  []byte
+	vsize int64
+	begin int64
+}
+
+type ncHeader struct {
+	dims  []ncDim
+	attrs []ncAttr
+	vars  []*ncVar
+}
+
+func ncTypeSize(typ int32) int64 {
+	switch typ {
+	case ncChar:
+		return 1
+	case ncInt:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func ncPad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+func (h *ncHeader) isRecord(v *ncVar) bool {
+	return len(v.dims) > 0 && h.dims[v.dims[0]].length == 0
+}
+
+// layout sets the size and offset of every variable, fixed size variables follow the header and records follow them
+func (h *ncHeader) layout() {
+	for _, v := range h.vars {
+		size := ncTypeSize(v.typ)
+		for i, d := range v.dims {
+			if i == 0 && h.isRecord(v) {
+				continue
+			}
+			size *= int64(h.dims[d].length)
+		}
+		v.vsize = size + ncPad(size)
+	}
+	offset := int64(len(h.encode(0)))
+	for _, v := range h.vars {
+		if !h.isRecord(v) {
+			v.begin = offset
+			offset += v.vsize
+		}
+	}
+	for _, v := range h.vars {
+		if h.isRecord(v) {
+			v.begin = offset
+			offset += v.vsize
+		}
+	}
+}
+
+func (h *ncHeader) encode(numrecs uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("CDF\x02")
+	ncPutUint32(&buf, numrecs)
+	if len(h.dims) == 0 {
+		ncPutUint32(&buf, 0)
+		ncPutUint32(&buf, 0)
+	} else {
+		ncPutUint32(&buf, ncDimensionTag)
+		ncPutUint32(&buf, uint32(len(h.dims)))
+		for _, d := range h.dims {
+			ncPutName(&buf, d.name)
+			ncPutUint32(&buf, uint32(d.length))
+		}
+	}
+	ncPutAttrs(&buf, h.attrs)
+	if len(h.vars) == 0 {
+		ncPutUint32(&buf, 0)
+		ncPutUint32(&buf, 0)
+	} else {
+		ncPutUint32(&buf, ncVariableTag)
+		ncPutUint32(&buf, uint32(len(h.vars)))
+		for _, v := range h.vars {
+			ncPutName(&buf, v.name)
+			ncPutUint32(&buf, uint32(len(v.dims)))
+			for _, d := range v.dims {
+				ncPutUint32(&buf, uint32(d))
+			}
+			ncPutAttrs(&buf, v.attrs)
+			ncPutUint32(&buf, uint32(v.typ))
+			ncPutUint32(&buf, uint32(v.vsize))
+			_ = binary.Write(&buf, binary.BigEndian, uint64(v.begin))
+		}
+	}
+	return buf.Bytes()
+}
+
+func ncPutUint32(buf *bytes.Buffer, v uint32) {
+	_ = binary.Write(buf, binary.BigEndian, v)
+}
+
+func ncPutName(buf *bytes.Buffer, name string) {
+	ncPutUint32(buf, uint32(len(name)))
+	buf.WriteString(name)
+	buf.Write(make([]byte, ncPad(int64(len(name)))))
+}
+
+func ncPutAttrs(buf *bytes.Buffer, attrs []ncAttr) {
+	if len(attrs) == 0 {
+		ncPutUint32(buf, 0)
+		ncPutUint32(buf, 0)
+		return
+	}
+	ncPutUint32(buf, ncAttributeTag)
+	ncPutUint32(buf, uint32(len(attrs)))
+	for _, attr := range attrs {
+		ncPutName(buf, attr.name)
+		switch val := attr.value.(type) {
+		case string:
+			ncPutUint32(buf, uint32(ncChar))
+			ncPutUint32(buf, uint32(len(val)))
+			buf.WriteString(val)
+			buf.Write(make([]byte, ncPad(int64(len(val)))))
+		case int32:
+			ncPutUint32(buf, uint32(ncInt))
+			ncPutUint32(buf, 1)
+			_ = binary.Write(buf, binary.BigEndian, val)
+		case float64:
+			ncPutUint32(buf, uint32(ncDouble))
+			ncPutUint32(buf, 1)
+			_ = binary.Write(buf, binary.BigEndian, val)
+		}
+	}
+}
+
+// ncCharArray packs strings into a fixed width char array, the width is the longest string and at least 1
+func ncCharArray(values []string) (int, []byte) {
+	width := 1
+	for _, v := range values {
+		if len(v) > width {
+			width = len(v)
+		}
+	}
+	data := make([]byte, width*len(values))
+	for i, v := range values {
+		copy(data[i*width:], v)
+	}
+	return width, data
+}
+
+func ncDoubleArray(values []float64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(data[i*8:], math.Float64bits(v))
+	}
+	return data
+}
+
+type netcdfExporter struct {
+	out     io.Writer
+	w       *bufio.Writer
+	pols    map[string]int
+	numrecs int64
+	// the record being collected, rows of one station and time are merged into it
+	pending bool
+	station int
+	tm      int64
+	values  []float64
+	record  []byte
+}
+
+func newNetcdfExporter(w io.Writer, stations []AqiStationResp, exportPols []string, st time.Time, et time.Time) (*netcdfExporter, error) {
+	n := len(stations)
+	lons := make([]float64, n)
+	lats := make([]float64, n)
+	sids := make([]string, n)
+	names := make([]string, n)
+	cities := make([]string, n)
+	tzs := make([]string, n)
+	for i, s := range stations {
+		lons[i], lats[i] = s.Loc.Lon, s.Loc.Lat
+		sids[i], names[i], cities[i], tzs[i] = s.Sid, s.Name, s.CityName, s.Tz
+	}
+	sidLen, sidData := ncCharArray(sids)
+	nameLen, nameData := ncCharArray(names)
+	cityLen, cityData := ncCharArray(cities)
+	tzLen, tzData := ncCharArray(tzs)
+
+	const stationDim, obsDim, sidDim, nameDim, cityDim, tzDim = 0, 1, 2, 3, 4, 5
+	header := &ncHeader{
+		dims: []ncDim{
+			{name: "station", length: n},
+			{name: "obs", length: 0},
+			{name: "sid_strlen", length: sidLen},
+			{name: "name_strlen", length: nameLen},
+			{name: "city_strlen", length: cityLen},
+			{name: "tz_strlen", length: tzLen},
+		},
+		attrs: []ncAttr{
+			{"Conventions", "CF-1.8"},
+			{"featureType", "timeSeries"},
+			{"title", "AQI station history"},
+			{"source", "storm-aqi-server"},
+			{"time_coverage_start", st.UTC().Format(time.RFC3339)},
+			{"time_coverage_end", et.UTC().Format(time.RFC3339)},
+		},
+		vars: []*ncVar{
+			{name: "lon", dims: []int{stationDim}, typ: ncDouble, data: ncDoubleArray(lons), attrs: []ncAttr{
+				{"standard_name", "longitude"},
+				{"long_name", "station longitude"},
+				{"units", "degrees_east"},
+			}},
+			{name: "lat", dims: []int{stationDim}, typ: ncDouble, data: ncDoubleArray(lats), attrs: []ncAttr{
+				{"standard_name", "latitude"},
+				{"long_name", "station latitude"},
+				{"units", "degrees_north"},
+			}},
+			{name: "sid", dims: []int{stationDim, sidDim}, typ: ncChar, data: sidData, attrs: []ncAttr{
+				{"long_name", "station id"},
+				{"cf_role", "timeseries_id"},
+			}},
+			{name: "station_name", dims: []int{stationDim, nameDim}, typ: ncChar, data: nameData, attrs: []ncAttr{
+				{"long_name", "station name"},
+			}},
+			{name: "city_name", dims: []int{stationDim, cityDim}, typ: ncChar, data: cityData, attrs: []ncAttr{
+				{"long_name", "city name"},
+			}},
+			{name: "tz", dims: []int{stationDim, tzDim}, typ: ncChar, data: tzData, attrs: []ncAttr{
+				{"long_name", "station time zone offset"},
+			}},
+			{name: "time", dims: []int{obsDim}, typ: ncDouble, attrs: []ncAttr{
+				{"standard_name", "time"},
+				{"long_name", "time of measurement"},
+				{"units", "milliseconds since 1970-01-01 00:00:00 UTC"},
+				{"calendar", "standard"},
+			}},
+			{name: "station_index", dims: []int{obsDim}, typ: ncInt, attrs: []ncAttr{
+				{"long_name", "index of the station of this record"},
+				{"instance_dimension", "station"},
+			}},
+		},
+	}
+	e := &netcdfExporter{
+		out:    w,
+		w:      bufio.NewWriterSize(w, 64*1024),
+		pols:   map[string]int{},
+		values: make([]float64, len(exportPols)),
+	}
+	for i, pol := range exportPols {
+		units := "ug m-3"
+		if pol == "co" {
+			units = "mg m-3"
+		}
+		e.pols[pol] = i
+		header.vars = append(header.vars, &ncVar{name: pol, dims: []int{obsDim}, typ: ncDouble, attrs: []ncAttr{
+			{"long_name", polLongNames[pol]},
+			{"units", units},
+			{"coordinates", "time lat lon sid"},
+			{"_FillValue", ncFillDouble},
+		}})
+	}
+	header.layout()
+	if _, err := e.w.Write(header.encode(ncStreaming)); err != nil {
+		return nil, err
+	}
+	for _, v := range header.vars {
+		if header.isRecord(v) {
+			continue
+		}
+		if _, err := e.w.Write(v.data); err != nil {
+			return nil, err
+		}
+		if _, err := e.w.Write(make([]byte, v.vsize-int64(len(v.data)))); err != nil {
+			return nil, err
+		}
+	}
+	e.record = make([]byte, 12+8*len(exportPols))
+	return e, nil
+}
+
+func (e *netcdfExporter) Write(his *AqiHistory, _ *AqiStationResp, index int) error {
+	if e.pending && (e.station != index || e.tm != his.Tm) {
+		if err := e.flushRecord(); err != nil {
+			return err
+		}
+	}
+	if !e.pending {
+		e.pending = true
+		e.station = index
+		e.tm = his.Tm
+		for i := range e.values {
+			e.values[i] = ncFillDouble
+		}
+	}
+	if i, ok := e.pols[his.Pol]; ok {
+		e.values[i] = his.Data
+	}
+	return nil
+}
+
+func (e *netcdfExporter) flushRecord() error {
+	e.pending = false
+	binary.BigEndian.PutUint64(e.record, math.Float64bits(float64(e.tm)))
+	binary.BigEndian.PutUint32(e.record[8:], uint32(int32(e.station)))
+	for i, v := range e.values {
+		binary.BigEndian.PutUint64(e.record[12+8*i:], math.Float64bits(v))
+	}
+	e.numrecs++
+	_, err := e.w.Write(e.record)
+	return err
+}
+
+// Abort keeps the streaming marker in numrecs, even on a seekable output, and writes the error marker
+// after the records
+func (e *netcdfExporter) Abort(err error) error {
+	if werr := writeExportError(e.w, err); werr != nil {
+		return werr
+	}
+	return e.w.Flush()
+}
+
+// Close writes the last record, a seekable output gets the real record count in place of the streaming marker
+func (e *netcdfExporter) Close() error {
+	if e.pending {
+		if err := e.flushRecord(); err != nil {
+			return err
+		}
+	}
+	if err := e.w.Flush(); err != nil {
+		return err
+	}
+	ws, ok := e.out.(io.WriteSeeker)
+	if !ok || e.numrecs >= int64(ncStreaming) {
+		return nil
+	}
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	if _, err = ws.Seek(4, io.SeekStart); err != nil {
+		return err
+	}
+	if err = binary.Write(ws, binary.BigEndian, uint32(e.numrecs)); err != nil {
+		return err
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testExportStations = []AqiStationResp{
+	{Sid: "1451", Name: "Beijing Dongcheng", CityName: "Beijing", Tz: "+08:00", Loc: GeoPoint{Lon: 116.41, Lat: 39.93}},
+	{Sid: "20", Name: "Toronto", CityName: "Toronto", Tz: "-05:00", Loc: GeoPoint{Lon: -79.38, Lat: 43.65}},
+}
+
+// testExportHistory holds the rows of both stations ordered by station and time, the pm25 and co of the first
+// station at 1000 are merged into one record and the second station has no co
+var testExportHistory = []struct {
+	station int
+	his     AqiHistory
+}{
+	{0, AqiHistory{Pol: "pm25", Tm: 1000, Data: 35}},
+	{0, AqiHistory{Pol: "co", Tm: 1000, Data: 0.6}},
+	{0, AqiHistory{Pol: "co", Tm: 2000, Data: 0.8}},
+	{1, AqiHistory{Pol: "pm25", Tm: 1000, Data: 12}},
+}
+
+func writeTestNetcdf(t *testing.T, w io.Writer) *netcdfExporter {
+	t.Helper()
+	st := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	e, err := newNetcdfExporter(w, testExportStations, []string{"pm25", "co"}, st, st.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("newNetcdfExporter() err: %v", err)
+	}
+	for _, row := range testExportHistory {
+		his := row.his
+		if err = e.Write(&his, &testExportStations[row.station], row.station); err != nil {
+			t.Fatalf("Write() err: %v", err)
+		}
+	}
+	return e
+}
+
+func TestNetcdfExportRoundTrip(t *testing.T) {
+	// the cli writes to a file, the record count is patched into the header on close
+	path := filepath.Join(t.TempDir(), "export.nc")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := writeTestNetcdf(t, f)
+	if err = e.Close(); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc, err := openNetcdf(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("openNetcdf() err: %v", err)
+	}
+	if nc.version != 2 || nc.numrecs != 3 {
+		t.Fatalf("version, numrecs = %d, %d, want 2, 3", nc.version, nc.numrecs)
+	}
+	if nc.attrs["Conventions"] != "CF-1.8" || nc.attrs["featureType"] != "timeSeries" {
+		t.Errorf("attrs = %v", nc.attrs)
+	}
+	if nc.attrs["time_coverage_start"] != "2021-01-01T00:00:00Z" {
+		t.Errorf("time_coverage_start = %v", nc.attrs["time_coverage_start"])
+	}
+	if fill, ok := nc.vars["pm25"].attrFloat("_FillValue"); !ok || fill != ncFillDouble {
+		t.Errorf("pm25 _FillValue = %v, %v", fill, ok)
+	}
+	sid := nc.vars["sid"]
+	raw := make([]byte, nc.sliceSize(sid))
+	if _, err = nc.r.ReadAt(raw, sid.begin); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.ReplaceAll(string(raw), "\x00", " "); got != "145120  " {
+		t.Errorf("sid = %q, want %q", got, "145120  ")
+	}
+	tests := []struct {
+		name    string
+		varName string
+		rec     int64
+		want    []float64
+	}{
+		{name: "lon", varName: "lon", want: []float64{116.41, -79.38}},
+		{name: "lat", varName: "lat", want: []float64{39.93, 43.65}},
+		{name: "merged record time", varName: "time", rec: 0, want: []float64{1000}},
+		{name: "merged record pm25", varName: "pm25", rec: 0, want: []float64{35}},
+		{name: "merged record co", varName: "co", rec: 0, want: []float64{0.6}},
+		{name: "record without pm25", varName: "pm25", rec: 1, want: []float64{ncFillDouble}},
+		{name: "second record co", varName: "co", rec: 1, want: []float64{0.8}},
+		{name: "second station index", varName: "station_index", rec: 2, want: []float64{1}},
+		{name: "second station time", varName: "time", rec: 2, want: []float64{1000}},
+		{name: "second station without co", varName: "co", rec: 2, want: []float64{ncFillDouble}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nc.values(nc.vars[tt.varName], tt.rec)
+			if err != nil {
+				t.Fatalf("values() err: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("values = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("values = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+	if _, err = nc.values(nc.vars["time"], 3); err == nil {
+		t.Error("values() of a missing record has no error")
+	}
+}
+
+func TestNetcdfExportStreamed(t *testing.T) {
+	var streamed bytes.Buffer
+	if err := writeTestNetcdf(t, &streamed).Close(); err != nil {
+		t.Fatalf("Close() err: %v", err)
+	}
+	if numrecs := binary.BigEndian.Uint32(streamed.Bytes()[4:8]); numrecs != ncStreaming {
+		t.Errorf("streamed numrecs = %x, want the STREAMING marker", numrecs)
+	}
+	var aborted bytes.Buffer
+	if err := writeTestNetcdf(t, &aborted).Abort(errors.New("scroll expired")); err != nil {
+		t.Fatalf("Abort() err: %v", err)
+	}
+	if !bytes.HasSuffix(aborted.Bytes(), []byte("\n#error,scroll expired\n")) {
+		t.Errorf("aborted export ends with %q, want the error marker", aborted.Bytes()[aborted.Len()-24:])
+	}
+	if numrecs := binary.BigEndian.Uint32(aborted.Bytes()[4:8]); numrecs != ncStreaming {
+		t.Errorf("aborted numrecs = %x, want the STREAMING marker", numrecs)
+	}
+}
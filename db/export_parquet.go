@@ -0,0 +1,40 @@
+package db
+
+import (
+	"io"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// a row group is buffered before it is flushed, keep it small so memory stays flat while streaming
+const parquetRowGroupSize = 16 * 1024 * 1024
+
+type parquetExporter struct {
+	out io.Writer
+	pw  *writer.ParquetWriter
+}
+
+func newParquetExporter(w io.Writer) (*parquetExporter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(ExportRow), 4)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	return &parquetExporter{out: w, pw: pw}, nil
+}
+
+func (e *parquetExporter) Write(his *AqiHistory, station *AqiStationResp, _ int) error {
+	return e.pw.Write(newExportRow(his, station))
+}
+
+func (e *parquetExporter) Close() error {
+	return e.pw.WriteStop()
+}
+
+// Abort writes the buffered row group without the footer, readers need the footer to open the file
+func (e *parquetExporter) Abort(err error) error {
+	if ferr := e.pw.Flush(true); ferr != nil {
+		return ferr
+	}
+	return writeExportError(e.out, err)
+}
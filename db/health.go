@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// HealthCheck is the result of checking one dependency of the server
+type HealthCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	Took  int64  `json:"took"`
+}
+
+// Readiness is ready when every check passed
+type Readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type readyCheck struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// CheckReady checks the store backend, the silam and station logo buckets and the station cache concurrently,
+// checks still running when ctx is done fail with its error
+func (db *DB) CheckReady(ctx context.Context) *Readiness {
+	checks := []readyCheck{
+		{"objects:" + bucket, func(ctx context.Context) error {
+			return db.CheckAccess(ctx, bucket, "")
+		}},
+		{"objects:" + logoBucket + "/" + logoPrefix, func(ctx context.Context) error {
+			return db.CheckAccess(ctx, logoBucket, logoPrefix)
+		}},
+		{"station_cache", func(ctx context.Context) error {
+			if db.StationsLoaded().IsZero() {
+				return errors.New("station cache is not loaded yet")
+			}
+			return nil
+		}},
+	}
+	if checker, ok := db.StationStore.(ReadyChecker); ok {
+		checks = append(checks, readyCheck{"store", checker.CheckReady})
+	}
+	resp := &Readiness{Ready: true, Checks: make([]HealthCheck, len(checks))}
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, name string, fn func(ctx context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() {
+				done <- fn(ctx)
+			}()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			resp.Checks[i] = HealthCheck{Name: name, Ok: err == nil, Took: time.Since(start).Milliseconds()}
+			if err != nil {
+				resp.Checks[i].Error = err.Error()
+			}
+		}(i, check.name, check.fn)
+	}
+	wg.Wait()
+	for _, check := range resp.Checks {
+		resp.Ready = resp.Ready && check.Ok
+	}
+	return resp
+}
@@ -1,12 +1,11 @@
 package db
 
 import (
-	"github.com/elastic/go-elasticsearch/v8/esapi"
-	"github.com/tidwall/gjson"
+	jsoniter "github.com/json-iterator/go"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -27,6 +26,7 @@ type AqiHisItem struct {
 	Pol   string  `json:"pol"`
 	Name  string  `json:"name"`
 	Data  float64 `json:"data"`
+	Iaqi  int     `json:"iaqi"`
 	Tz    string  `json:"tz"`
 	Month int     `json:"month"`
 	Year  int     `json:"year"`
@@ -41,16 +41,19 @@ type AqiHistoryResp struct {
 	Loc      GeoPoint                `json:"loc"`
 	CityName string                  `json:"city_name"`
 	History  map[string][]AqiHisItem `json:"history"`
+	Aqi      []AqiTimeIndex          `json:"aqi"`
 }
 
 type HistoryItem struct {
 	EsSearchItem
-	Source AqiHistory `json:"_source"`
+	Source AqiHistory            `json:"_source"`
+	Sort   []jsoniter.RawMessage `json:"sort"`
 }
 
 type HistorySearchResponse struct {
 	EsSearchRespMeta
-	Hits struct {
+	PitId string `json:"pit_id"`
+	Hits  struct {
 		Total    EsRespTotal   `json:"total"`
 		MaxScore float64       `json:"max_score"`
 		Hits     []HistoryItem `json:"hits"`
@@ -60,6 +63,8 @@ type HistorySearchResponse struct {
 var pols = []string{"no2", "pm25", "pm10", "o3", "so2", "co"}
 
 func (db *DB) GetHistoryYesterday(sid string, pol string) (*AqiHistoryResp, error) {
+	db, span := db.startSpan("GetHistoryYesterday", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	station, err := db.getStationFromCache(sid)
 	if err != nil || station == nil {
 		return nil, err
@@ -67,12 +72,12 @@ func (db *DB) GetHistoryYesterday(sid string, pol string) (*AqiHistoryResp, erro
 	now := time.Now().UTC()
 	et := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	st := et.AddDate(0, 0, -1)
-	hisList, err := db.getHistoryByRange(sid, pol, st, et)
+	hisList, err := db.GetHistoryByRange(sid, pol, st, et)
 	if err != nil {
-		db.log.Error("GetHistoryYesterday(). db.getHistoryByRange(). err:", zap.Error(err))
+		db.log.Error("GetHistoryYesterday(). db.GetHistoryByRange(). err:", zap.Error(err))
 		return nil, err
 	}
-	items := BuildResp(hisList)
+	items := BuildResp(hisList, db.Conf().AqiStandard)
 	return &AqiHistoryResp{
 		Idx:      station.Idx,
 		Sid:      station.Sid,
@@ -80,10 +85,13 @@ func (db *DB) GetHistoryYesterday(sid string, pol string) (*AqiHistoryResp, erro
 		Loc:      station.Loc,
 		CityName: station.CityName,
 		History:  items,
+		Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
 	}, nil
 }
 
 func (db *DB) GetHistoryLastWeek(sid string, pol string) (*AqiHistoryResp, error) {
+	db, span := db.startSpan("GetHistoryLastWeek", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	station, err := db.getStationFromCache(sid)
 	if err != nil || station == nil {
 		return nil, err
@@ -91,12 +99,12 @@ func (db *DB) GetHistoryLastWeek(sid string, pol string) (*AqiHistoryResp, error
 	now := time.Now().UTC()
 	et := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	st := et.AddDate(0, 0, -7)
-	hisList, err := db.getHistoryByRange(sid, pol, st, et)
+	hisList, err := db.GetHistoryByRange(sid, pol, st, et)
 	if err != nil {
-		db.log.Error("GetHistoryLastWeek(). db.getHistoryByRange(). err:", zap.Error(err))
+		db.log.Error("GetHistoryLastWeek(). db.GetHistoryByRange(). err:", zap.Error(err))
 		return nil, err
 	}
-	items := BuildResp(hisList)
+	items := BuildResp(hisList, db.Conf().AqiStandard)
 	return &AqiHistoryResp{
 		Idx:      station.Idx,
 		Sid:      station.Sid,
@@ -104,10 +112,13 @@ func (db *DB) GetHistoryLastWeek(sid string, pol string) (*AqiHistoryResp, error
 		Loc:      station.Loc,
 		CityName: station.CityName,
 		History:  items,
+		Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
 	}, nil
 }
 
 func (db *DB) GetHistoryLastMonth(sid string, pol string) (*AqiHistoryResp, error) {
+	db, span := db.startSpan("GetHistoryLastMonth", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	station, err := db.getStationFromCache(sid)
 	if err != nil || station == nil {
 		return nil, err
@@ -115,12 +126,12 @@ func (db *DB) GetHistoryLastMonth(sid string, pol string) (*AqiHistoryResp, erro
 	now := time.Now().UTC()
 	et := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	st := et.AddDate(0, -1, 0)
-	hisList, err := db.getHistoryByRange(sid, pol, st, et)
+	hisList, err := db.GetHistoryByRange(sid, pol, st, et)
 	if err != nil {
-		db.log.Error("GetHistoryLastMonth(). db.getHistoryByRange(). err:", zap.Error(err))
+		db.log.Error("GetHistoryLastMonth(). db.GetHistoryByRange(). err:", zap.Error(err))
 		return nil, err
 	}
-	items := BuildResp(hisList)
+	items := BuildResp(hisList, db.Conf().AqiStandard)
 	return &AqiHistoryResp{
 		Idx:      station.Idx,
 		Sid:      station.Sid,
@@ -128,10 +139,13 @@ func (db *DB) GetHistoryLastMonth(sid string, pol string) (*AqiHistoryResp, erro
 		Loc:      station.Loc,
 		CityName: station.CityName,
 		History:  items,
+		Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
 	}, nil
 }
 
 func (db *DB) GetHistoryLastQuarter(sid string, pol string) (*AqiHistoryResp, error) {
+	db, span := db.startSpan("GetHistoryLastQuarter", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	station, err := db.getStationFromCache(sid)
 	if err != nil || station == nil {
 		return nil, err
@@ -139,12 +153,12 @@ func (db *DB) GetHistoryLastQuarter(sid string, pol string) (*AqiHistoryResp, er
 	now := time.Now().UTC()
 	et := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	st := et.AddDate(0, -3, 0)
-	hisList, err := db.getHistoryByRange(sid, pol, st, et)
+	hisList, err := db.GetHistoryByRange(sid, pol, st, et)
 	if err != nil {
-		db.log.Error("GetHistoryLastQuarter(). db.getHistoryByRange(). err:", zap.Error(err))
+		db.log.Error("GetHistoryLastQuarter(). db.GetHistoryByRange(). err:", zap.Error(err))
 		return nil, err
 	}
-	items := BuildResp(hisList)
+	items := BuildResp(hisList, db.Conf().AqiStandard)
 	return &AqiHistoryResp{
 		Idx:      station.Idx,
 		Sid:      station.Sid,
@@ -152,10 +166,13 @@ func (db *DB) GetHistoryLastQuarter(sid string, pol string) (*AqiHistoryResp, er
 		Loc:      station.Loc,
 		CityName: station.CityName,
 		History:  items,
+		Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
 	}, nil
 }
 
 func (db *DB) GetHistoryYear(sid string, pol string) (*AqiHistoryResp, error) {
+	db, span := db.startSpan("GetHistoryYear", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	station, err := db.getStationFromCache(sid)
 	if err != nil || station == nil {
 		return nil, err
@@ -163,12 +180,12 @@ func (db *DB) GetHistoryYear(sid string, pol string) (*AqiHistoryResp, error) {
 	now := time.Now().UTC()
 	et := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
 	st := et.AddDate(-1, 0, 0)
-	hisList, err := db.getHistoryByRange(sid, pol, st, et)
+	hisList, err := db.GetHistoryByRange(sid, pol, st, et)
 	if err != nil {
-		db.log.Error("GetHistoryYear(). db.getHistoryByRange(). err:", zap.Error(err))
+		db.log.Error("GetHistoryYear(). db.GetHistoryByRange(). err:", zap.Error(err))
 		return nil, err
 	}
-	items := BuildResp(hisList)
+	items := BuildResp(hisList, db.Conf().AqiStandard)
 	return &AqiHistoryResp{
 		Idx:      station.Idx,
 		Sid:      station.Sid,
@@ -176,20 +193,23 @@ func (db *DB) GetHistoryYear(sid string, pol string) (*AqiHistoryResp, error) {
 		Loc:      station.Loc,
 		CityName: station.CityName,
 		History:  items,
+		Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
 	}, nil
 }
 
 func (db *DB) GetHistoryRange(sid string, pol string, st time.Time, et time.Time) (*AqiHistoryResp, error) {
+	db, span := db.startSpan("GetHistoryRange", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	station, err := db.getStationFromCache(sid)
 	if err != nil || station == nil {
 		return nil, err
 	}
-	hisList, err := db.getHistoryByRange(sid, pol, st, et)
+	hisList, err := db.GetHistoryByRange(sid, pol, st, et)
 	if err != nil {
-		db.log.Error("GetHistoryRange(). db.getHistoryByRange(). err:", zap.Error(err))
+		db.log.Error("GetHistoryRange(). db.GetHistoryByRange(). err:", zap.Error(err))
 		return nil, err
 	}
-	items := BuildResp(hisList)
+	items := BuildResp(hisList, db.Conf().AqiStandard)
 	return &AqiHistoryResp{
 		Idx:      station.Idx,
 		Sid:      station.Sid,
@@ -197,17 +217,79 @@ func (db *DB) GetHistoryRange(sid string, pol string, st time.Time, et time.Time
 		Loc:      station.Loc,
 		CityName: station.CityName,
 		History:  items,
+		Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
 	}, nil
 }
 
+func BuildResp(list []AqiHistory, std string) map[string][]AqiHisItem {
+	items := map[string][]AqiHisItem{}
+	for _, pol := range pols {
+		items[pol] = []AqiHisItem{}
+	}
+	for _, item := range list {
+		year := time.Unix(item.Tm/1000, 0).UTC().Year()
+		items[item.Pol] = append(items[item.Pol], AqiHisItem{
+			Pol:   item.Pol,
+			Name:  item.Name,
+			Data:  item.Data,
+			Iaqi:  SubIndex(std, item.Pol, item.Data),
+			Tz:    item.Tz,
+			Month: item.Month,
+			Year:  year,
+			Tm:    item.Tm,
+			Tms:   item.Tms,
+		})
+	}
+	for _, v := range items {
+		sort.Slice(v, func(i, j int) bool {
+			return v[i].Tm > v[j].Tm
+		})
+	}
+	list = nil
+	return items
+}
+
+// BuildAqiTimeline rates every timestamp with the pollutants recorded at it, newest first
+func BuildAqiTimeline(items map[string][]AqiHisItem, std string) []AqiTimeIndex {
+	values := map[int64]map[string]float64{}
+	tms := map[int64]string{}
+	for pol, list := range items {
+		for _, item := range list {
+			if _, ok := values[item.Tm]; !ok {
+				values[item.Tm] = map[string]float64{}
+				tms[item.Tm] = item.Tms
+			}
+			values[item.Tm][pol] = item.Data
+		}
+	}
+	timeline := []AqiTimeIndex{}
+	for tm, vals := range values {
+		idx := CalcAqi(std, vals)
+		if idx == nil {
+			continue
+		}
+		timeline = append(timeline, AqiTimeIndex{
+			Tm:  tm,
+			Tms: tms[tm],
+			Aqi: idx,
+		})
+	}
+	sort.Slice(timeline, func(i, j int) bool {
+		return timeline[i].Tm > timeline[j].Tm
+	})
+	return timeline
+}
+
 func (db *DB) GetNoneStation() []string {
+	db, span := db.startSpan("GetNoneStation")
+	defer span.End()
 	stations, _ := db.GetAllStations()
 	var wg = sync.WaitGroup{}
 	ch := make(chan bool, 20)
 	defer close(ch)
-	var indexes []string
+	var years []int
 	for i := 2014; i <= 2021; i++ {
-		indexes = append(indexes, strings.Replace(db.Conf.HisIndex, "$year", strconv.Itoa(i), -1))
+		years = append(years, i)
 	}
 	empty := make(chan string, 600)
 	for _, st := range stations {
@@ -218,16 +300,11 @@ func (db *DB) GetNoneStation() []string {
 				<-ch
 				wg.Done()
 			}()
-			req := esapi.CountRequest{
-				Index: indexes,
-				Body:  strings.NewReader(`{"query":{"match":{"sid":"` + sd + `"}}}`),
-			}
-			resp, err := db.api.ProcessRespWithCli(req)
+			count, err := db.CountHistory(sd, years)
 			if err != nil {
 				return
 			}
-			result := gjson.ParseBytes(resp)
-			if result.Get("count").Int() == 0 {
+			if count == 0 {
 				empty <- sd
 			}
 		}(st.Sid)
@@ -247,79 +324,3 @@ func (db *DB) GetNoneStation() []string {
 	})
 	return sidx
 }
-
-func BuildResp(list []AqiHistory) map[string][]AqiHisItem {
-	items := map[string][]AqiHisItem{}
-	for _, pol := range pols {
-		items[pol] = []AqiHisItem{}
-	}
-	for _, item := range list {
-		year := time.Unix(item.Tm/1000, 0).UTC().Year()
-		items[item.Pol] = append(items[item.Pol], AqiHisItem{
-			Pol:   item.Pol,
-			Name:  item.Name,
-			Data:  item.Data,
-			Tz:    item.Tz,
-			Month: item.Month,
-			Year:  year,
-			Tm:    item.Tm,
-			Tms:   item.Tms,
-		})
-	}
-	for _, v := range items {
-		sort.Slice(v, func(i, j int) bool {
-			return v[i].Tm > v[j].Tm
-		})
-	}
-	list = nil
-	return items
-}
-
-func (db *DB) getHistoryByRange(sid string, pol string, st time.Time, et time.Time) ([]AqiHistory, error) {
-	stYear := st.Year()
-	etYear := et.Year()
-	var indexes []string
-	for i := stYear; i <= etYear; i++ {
-		indexes = append(indexes, strings.Replace(db.Conf.HisIndex, "$year", strconv.Itoa(i), -1))
-	}
-	query := `{
-        "query": {
-            "bool": {
-                "must": [
-                    {"match": {"sid": "` + sid + `"}},
-                    {"range": {"tm":{"gte": ` + strconv.Itoa(int(st.UnixMilli())) + `,"lte": ` + strconv.Itoa(int(et.UnixMilli())) + `}}}`
-	if pol != "all" {
-		query += `,{"match": {"pol": "` + pol + `"}}`
-	}
-	query += "]}}}"
-	size := 10000
-	request := esapi.SearchRequest{
-		Index:   indexes,
-		Body:    strings.NewReader(query),
-		Size:    &size,
-		Timeout: 20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(request)
-	var esSearchResp HistorySearchResponse
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		return nil, err
-	}
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		return nil, err
-	}
-	var hisList []AqiHistory
-	if esSearchResp.Hits.Total.Value > 0 {
-		for _, item := range esSearchResp.Hits.Hits {
-			hisList = append(hisList, item.Source)
-		}
-		return hisList, nil
-	}
-	defer func() {
-		resp = nil
-	}()
-	return nil, nil
-}
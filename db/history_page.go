@@ -0,0 +1,92 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var ErrInvalidCursor = errors.New("invalid or expired cursor")
+
+type AqiHistoryPageResp struct {
+	AqiHistoryResp
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor"`
+}
+
+// HistoryRecentRange returns the utc day aligned range of a recent shortcut
+func HistoryRecentRange(recent string) (time.Time, time.Time) {
+	now := time.Now().UTC()
+	et := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch recent {
+	case "lastWeek":
+		return et.AddDate(0, 0, -7), et
+	case "lastMonth":
+		return et.AddDate(0, -1, 0), et
+	case "lastQuarter":
+		return et.AddDate(0, -3, 0), et
+	case "lastYear":
+		return et.AddDate(-1, 0, 0), et
+	default:
+		return et.AddDate(0, 0, -1), et
+	}
+}
+
+func (db *DB) GetHistoryPage(sid string, pol string, st time.Time, et time.Time, cursor string, limit int) (*AqiHistoryPageResp, error) {
+	db, span := db.startSpan("GetHistoryPage", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
+	station, err := db.getStationFromCache(sid)
+	if err != nil || station == nil {
+		return nil, err
+	}
+	hisList, next, err := db.PageHistory(sid, pol, st, et, cursor, limit)
+	if err != nil {
+		if err != ErrInvalidCursor {
+			db.log.Error("GetHistoryPage(). db.PageHistory(). err:", zap.Error(err))
+		}
+		return nil, err
+	}
+	items := BuildResp(hisList, db.Conf().AqiStandard)
+	return &AqiHistoryPageResp{
+		AqiHistoryResp: AqiHistoryResp{
+			Idx:      station.Idx,
+			Sid:      station.Sid,
+			Name:     station.Name,
+			Loc:      station.Loc,
+			CityName: station.CityName,
+			History:  items,
+			Aqi:      BuildAqiTimeline(items, db.Conf().AqiStandard),
+		},
+		Limit:      limit,
+		NextCursor: next,
+	}, nil
+}
+
+// historyCursorKey binds a cursor to the query of its first page, a cursor passed with another
+// sid, pol or range is invalid
+func historyCursorKey(sid string, pol string, st time.Time, et time.Time) string {
+	return sid + "/" + pol + "/" + strconv.FormatInt(st.UnixMilli(), 10) + "/" + strconv.FormatInt(et.UnixMilli(), 10)
+}
+
+func encodeCursor(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
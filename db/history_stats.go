@@ -0,0 +1,195 @@
+package db
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// default daily limits of GB 3095-2012 grade II, co in mg/m3 and the others in µg/m3
+var defaultExceedThresholds = map[string]float64{
+	"pm25": 75,
+	"pm10": 150,
+	"so2":  150,
+	"no2":  80,
+	"co":   4,
+	"o3":   160,
+}
+
+type HistoryStatItem struct {
+	Key        int64   `json:"key"`
+	Date       string  `json:"date"`
+	Count      int64   `json:"count"`
+	Avg        float64 `json:"avg"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	P50        float64 `json:"p50"`
+	P90        float64 `json:"p90"`
+	P95        float64 `json:"p95"`
+	P99        float64 `json:"p99"`
+	Days       int     `json:"days"`
+	ExceedDays int     `json:"exceed_days"`
+}
+
+// HistoryStats is what a HistoryStore aggregates, DailyAvg maps the day start in millis to the daily mean
+type HistoryStats struct {
+	Buckets  []HistoryStatItem
+	Summary  HistoryStatItem
+	DailyAvg map[int64]float64
+}
+
+type HistoryStatsResp struct {
+	Idx       int               `json:"idx"`
+	Sid       string            `json:"sid"`
+	Name      string            `json:"name"`
+	Loc       GeoPoint          `json:"loc"`
+	CityName  string            `json:"city_name"`
+	Pol       string            `json:"pol"`
+	Interval  string            `json:"interval"`
+	Threshold float64           `json:"threshold"`
+	Start     string            `json:"start"`
+	End       string            `json:"end"`
+	Summary   HistoryStatItem   `json:"summary"`
+	Stats     []HistoryStatItem `json:"stats"`
+}
+
+// GetHistoryStats aggregates the history of a pollutant by interval, a day counts as exceeded when its mean is above threshold,
+// threshold 0 falls back to the configured or default daily limit of the pollutant. The days of st and et are taken in the
+// time zone of the station like the buckets, et is included whole
+func (db *DB) GetHistoryStats(sid string, pol string, st time.Time, et time.Time, interval string, threshold float64) (*HistoryStatsResp, error) {
+	db, span := db.startSpan("GetHistoryStats", attribute.String("sid", sid), attribute.String("pol", pol), attribute.String("interval", interval))
+	defer span.End()
+	station, err := db.getStationFromCache(sid)
+	if err != nil || station == nil {
+		return nil, err
+	}
+	loc := StationLocation(station.Tz)
+	st = time.Date(st.Year(), st.Month(), st.Day(), 0, 0, 0, 0, loc)
+	et = time.Date(et.Year(), et.Month(), et.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, 1).Add(-time.Millisecond)
+	if threshold <= 0 {
+		threshold = db.exceedThreshold(pol)
+	}
+	stats, err := db.AggregateHistory(sid, pol, st, et, interval)
+	if err != nil {
+		db.log.Error("GetHistoryStats(). db.AggregateHistory(). err:", zap.Error(err))
+		return nil, err
+	}
+	response := &HistoryStatsResp{
+		Idx:       station.Idx,
+		Sid:       station.Sid,
+		Name:      station.Name,
+		Loc:       station.Loc,
+		CityName:  station.CityName,
+		Pol:       pol,
+		Interval:  interval,
+		Threshold: threshold,
+		Start:     st.Format("2006-01-02"),
+		End:       et.Format("2006-01-02"),
+		Stats:     []HistoryStatItem{},
+	}
+	if stats == nil {
+		return response, nil
+	}
+	index := map[int64]int{}
+	for i := range stats.Buckets {
+		index[stats.Buckets[i].Key] = i
+	}
+	for day, avg := range stats.DailyAvg {
+		exceed := threshold > 0 && avg > threshold
+		stats.Summary.Days++
+		if exceed {
+			stats.Summary.ExceedDays++
+		}
+		i, ok := index[TruncateInterval(time.UnixMilli(day).In(loc), interval).UnixMilli()]
+		if !ok {
+			continue
+		}
+		stats.Buckets[i].Days++
+		if exceed {
+			stats.Buckets[i].ExceedDays++
+		}
+	}
+	response.Summary = stats.Summary
+	if stats.Buckets != nil {
+		response.Stats = stats.Buckets
+	}
+	return response, nil
+}
+
+func (db *DB) exceedThreshold(pol string) float64 {
+	if val, ok := db.Conf().ExceedThresholds[pol]; ok {
+		return val
+	}
+	return defaultExceedThresholds[pol]
+}
+
+// StationLocation returns the fixed zone of a station tz like -05:00, utc when it is empty or malformed
+func StationLocation(tz string) *time.Location {
+	t, err := time.Parse("-07:00", tz)
+	if err != nil {
+		return time.UTC
+	}
+	_, offset := t.Zone()
+	if offset == 0 {
+		return time.UTC
+	}
+	return time.FixedZone(tz, offset)
+}
+
+// TruncateInterval returns the start of the calendar interval containing t in the location of t, weeks start on monday like es
+func TruncateInterval(t time.Time, interval string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch interval {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return day
+	}
+}
+
+// buildStatItem computes the metrics of values in place, it sorts values
+func buildStatItem(key time.Time, values []float64) HistoryStatItem {
+	item := HistoryStatItem{
+		Key:   key.UnixMilli(),
+		Date:  key.Format("2006-01-02"),
+		Count: int64(len(values)),
+	}
+	if len(values) == 0 {
+		return item
+	}
+	sort.Float64s(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	item.Avg = roundStat(sum / float64(len(values)))
+	item.Min = values[0]
+	item.Max = values[len(values)-1]
+	item.P50 = percentile(values, 50)
+	item.P90 = percentile(values, 90)
+	item.P95 = percentile(values, 95)
+	item.P99 = percentile(values, 99)
+	return item
+}
+
+// percentile interpolates linearly between the closest ranks of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return roundStat(sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo)))
+}
+
+func roundStat(v float64) float64 {
+	return math.Round(v*100) / 100
+}
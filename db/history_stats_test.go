@@ -0,0 +1,55 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTruncateIntervalInStationZone(t *testing.T) {
+	shanghai := StationLocation("+08:00")
+	toronto := StationLocation("-05:00")
+	tests := []struct {
+		name     string
+		t        time.Time
+		interval string
+		want     time.Time
+	}{
+		{name: "utc day", t: time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC), interval: "day", want: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "east of utc the day starts the evening before", t: time.Date(2020, 12, 31, 20, 0, 0, 0, time.UTC).In(shanghai), interval: "day",
+			want: time.Date(2020, 12, 31, 16, 0, 0, 0, time.UTC)},
+		{name: "east of utc the year starts the evening before", t: time.Date(2020, 12, 31, 20, 0, 0, 0, time.UTC).In(shanghai), interval: "year",
+			want: time.Date(2020, 12, 31, 16, 0, 0, 0, time.UTC)},
+		{name: "west of utc the month is still the previous one", t: time.Date(2021, 3, 1, 2, 0, 0, 0, time.UTC).In(toronto), interval: "month",
+			want: time.Date(2021, 2, 1, 5, 0, 0, 0, time.UTC)},
+		{name: "weeks start on monday", t: time.Date(2021, 1, 3, 20, 0, 0, 0, time.UTC).In(shanghai), interval: "week",
+			want: time.Date(2021, 1, 3, 16, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TruncateInterval(tt.t, tt.interval); !got.Equal(tt.want) {
+				t.Errorf("TruncateInterval(%v, %s) = %v, want %v", tt.t, tt.interval, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStationLocation(t *testing.T) {
+	tests := []struct {
+		tz         string
+		wantOffset int
+	}{
+		{tz: "+08:00", wantOffset: 8 * 3600},
+		{tz: "-05:30", wantOffset: -(5*3600 + 30*60)},
+		{tz: "+00:00", wantOffset: 0},
+		{tz: "", wantOffset: 0},
+		{tz: "-5.00", wantOffset: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tz, func(t *testing.T) {
+			_, offset := time.Date(2021, 1, 1, 0, 0, 0, 0, StationLocation(tt.tz)).Zone()
+			if offset != tt.wantOffset {
+				t.Errorf("offset = %d, want %d", offset, tt.wantOffset)
+			}
+		})
+	}
+}
@@ -1,11 +1,22 @@
 package db
 
 import (
-	"context"
+	"bytes"
+	"errors"
 	"fmt"
-	"github.com/minio/minio-go/v7"
-	"io/ioutil"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 )
 
 type ImageResponse struct {
@@ -14,17 +25,182 @@ type ImageResponse struct {
 	Min  string `json:"min"`
 }
 
+// ImageFrame is a silam image found in the bucket, Data is the object name served by /silam/:dir/:file
+type ImageFrame struct {
+	Time string `json:"time"`
+	Data string `json:"data"`
+	Max  string `json:"max"`
+	Min  string `json:"min"`
+}
+
+// AnimationOptions of AnimateImages, Width 0 keeps the width of the images
+type AnimationOptions struct {
+	Format string
+	Delay  int
+	Width  int
+	Legend bool
+}
+
+var ErrNoImages = errors.New("no images in range")
+
 var bucket = "silam"
 
+const imageTimeLayout = "2006-01-02T15:04:05Z"
+
+// colorRamp is a list of evenly spaced colors
+type colorRamp []color.NRGBA
+
+// silamRamp is the color ramp of the silam images from the min to the max tag of an image
+var silamRamp = colorRamp{
+	{R: 0x31, G: 0x36, B: 0x95, A: 0xff},
+	{R: 0x45, G: 0x75, B: 0xb4, A: 0xff},
+	{R: 0x74, G: 0xad, B: 0xd1, A: 0xff},
+	{R: 0xab, G: 0xd9, B: 0xe9, A: 0xff},
+	{R: 0xff, G: 0xff, B: 0xbf, A: 0xff},
+	{R: 0xfe, G: 0xe0, B: 0x90, A: 0xff},
+	{R: 0xfd, G: 0xae, B: 0x61, A: 0xff},
+	{R: 0xf4, G: 0x6d, B: 0x43, A: 0xff},
+	{R: 0xd7, G: 0x30, B: 0x27, A: 0xff},
+	{R: 0xa5, G: 0x00, B: 0x26, A: 0xff},
+}
+
+// imageRamps are the ramps the tiles can be drawn with instead of the silam ramp
+var imageRamps = map[string]colorRamp{
+	"silam": silamRamp,
+	"viridis": {
+		{R: 0x44, G: 0x01, B: 0x54, A: 0xff}, {R: 0x48, G: 0x28, B: 0x78, A: 0xff}, {R: 0x3e, G: 0x49, B: 0x89, A: 0xff},
+		{R: 0x31, G: 0x68, B: 0x8e, A: 0xff}, {R: 0x26, G: 0x82, B: 0x8e, A: 0xff}, {R: 0x1f, G: 0x9e, B: 0x89, A: 0xff},
+		{R: 0x35, G: 0xb7, B: 0x79, A: 0xff}, {R: 0x6e, G: 0xce, B: 0x58, A: 0xff}, {R: 0xb5, G: 0xde, B: 0x2b, A: 0xff},
+		{R: 0xfd, G: 0xe7, B: 0x25, A: 0xff},
+	},
+	"magma": {
+		{R: 0x00, G: 0x00, B: 0x04, A: 0xff}, {R: 0x18, G: 0x0f, B: 0x3d, A: 0xff}, {R: 0x44, G: 0x0f, B: 0x76, A: 0xff},
+		{R: 0x72, G: 0x1f, B: 0x81, A: 0xff}, {R: 0x9e, G: 0x2f, B: 0x7f, A: 0xff}, {R: 0xcd, G: 0x40, B: 0x71, A: 0xff},
+		{R: 0xf1, G: 0x60, B: 0x5d, A: 0xff}, {R: 0xfd, G: 0x96, B: 0x68, A: 0xff}, {R: 0xfe, G: 0xca, B: 0x8d, A: 0xff},
+		{R: 0xfc, G: 0xfd, B: 0xbf, A: 0xff},
+	},
+	"greys": {{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, {R: 0x00, G: 0x00, B: 0x00, A: 0xff}},
+}
+
+// at interpolates the ramp at t in 0..1
+func (r colorRamp) at(t float64) color.NRGBA {
+	t = math.Max(0, math.Min(1, t)) * float64(len(r)-1)
+	i := int(t)
+	if i >= len(r)-1 {
+		return r[len(r)-1]
+	}
+	f := t - float64(i)
+	a, b := r[i], r[i+1]
+	mix := func(x uint8, y uint8) uint8 {
+		return uint8(math.Round(float64(x) + (float64(y)-float64(x))*f))
+	}
+	return color.NRGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: 0xff}
+}
+
+// rampPosition finds the position on the ramp of the color nearest to c, ok is false when c is
+// transparent or farther than maxRampDistance from the ramp, like coastlines or labels
+func rampPosition(c color.NRGBA) (float64, bool) {
+	if c.A < 0x80 {
+		return 0, false
+	}
+	best, bestDist := 0.0, math.MaxFloat64
+	for i := 0; i < len(silamRamp)-1; i++ {
+		a, b := silamRamp[i], silamRamp[i+1]
+		seg := [3]float64{float64(b.R) - float64(a.R), float64(b.G) - float64(a.G), float64(b.B) - float64(a.B)}
+		off := [3]float64{float64(c.R) - float64(a.R), float64(c.G) - float64(a.G), float64(c.B) - float64(a.B)}
+		f := (off[0]*seg[0] + off[1]*seg[1] + off[2]*seg[2]) / (seg[0]*seg[0] + seg[1]*seg[1] + seg[2]*seg[2])
+		f = math.Max(0, math.Min(1, f))
+		dist := 0.0
+		for k := range seg {
+			d := off[k] - f*seg[k]
+			dist += d * d
+		}
+		if dist < bestDist {
+			best, bestDist = (float64(i)+f)/float64(len(silamRamp)-1), dist
+		}
+	}
+	return best, bestDist <= maxRampDistance*maxRampDistance
+}
+
+// maxRampDistance is the rgb distance up to which a color is taken as a ramp color
+const maxRampDistance = 24
+
+// imageScale maps the values between the min and max tags of an image onto the ramp, the log scale
+// needs a positive min and is linear otherwise
+type imageScale struct {
+	min float64
+	max float64
+	log bool
+}
+
+func newImageScale(min float64, max float64, scale string) imageScale {
+	return imageScale{min: min, max: max, log: scale == "log" && min > 0 && max > min}
+}
+
+// position is the ramp position 0..1 of v
+func (s imageScale) position(v float64) float64 {
+	if s.max <= s.min {
+		return 0
+	}
+	if s.log {
+		return (math.Log(math.Max(v, s.min)) - math.Log(s.min)) / (math.Log(s.max) - math.Log(s.min))
+	}
+	return (v - s.min) / (s.max - s.min)
+}
+
+// value is the value at the ramp position t
+func (s imageScale) value(t float64) float64 {
+	if s.log {
+		return math.Exp(math.Log(s.min) + t*(math.Log(s.max)-math.Log(s.min)))
+	}
+	return s.min + t*(s.max-s.min)
+}
+
+// imageExtent is the configured lon lat extent of the images as west, south, east and north,
+// the whole globe by default
+func (db *DB) imageExtent() [4]float64 {
+	if e := db.Conf().ImageExtent; len(e) == 4 {
+		return [4]float64{e[0], e[1], e[2], e[3]}
+	}
+	return [4]float64{-180, -90, 180, 90}
+}
+
+// CheckImageConf validates the image_extent, image_scale and tile_cache settings, all may be empty
+func CheckImageConf(aqiConf *conf.AQIConfig) error {
+	extent := aqiConf.ImageExtent
+	if len(extent) != 0 && (len(extent) != 4 || extent[0] >= extent[2] || extent[1] >= extent[3]) {
+		return errors.New("image_extent must be [west, south, east, north]")
+	}
+	if s := aqiConf.ImageScale; s != "" && s != "linear" && s != "log" {
+		return errors.New("image_scale must be linear or log")
+	}
+	if c := aqiConf.TileCache; c != "" && c != "memory" && c != "object" {
+		return errors.New("tile_cache must be memory or object")
+	}
+	return nil
+}
+
+// imageObjectName is the object name of the image of a pollutant at tm
+func imageObjectName(tm time.Time, pol string) string {
+	tm = tm.UTC()
+	return imageObjectPrefix(tm, pol) + strings.ReplaceAll(tm.Format(imageTimeLayout), ":", "$") + ".png"
+}
+
+// imageObjectPrefix is the object name prefix of the images of a pollutant on a day
+func imageObjectPrefix(day time.Time, pol string) string {
+	return day.Format("2006-01-02") + "/silam_AQ_" + pol + "_"
+}
+
 func (db *DB) GetImage(tm string, pol string) (*ImageResponse, error) {
+	db, span := db.startSpan("GetImage", attribute.String("tm", tm), attribute.String("pol", pol))
+	defer span.End()
 	objectDir := tm[0:10]
 	tf := strings.ReplaceAll(tm, ":", "$")
 	objectName := fmt.Sprintf("silam_AQ_%s_%s.png", pol, tf)
-	tagging, err := db.oss.GetObjectTagging(context.Background(), bucket, objectDir+"/"+objectName, minio.GetObjectTaggingOptions{})
+	tags, err := db.GetObjectTags(bucket, objectDir+"/"+objectName)
 	if err != nil {
 		return nil, err
 	}
-	tags := tagging.ToMap()
 	resp := &ImageResponse{
 		Data: objectDir + "/" + objectName,
 		Max:  tags["max"],
@@ -34,14 +210,155 @@ func (db *DB) GetImage(tm string, pol string) (*ImageResponse, error) {
 }
 
 func (db *DB) DownloadImage(dir string, file string) ([]byte, error) {
-	imgObj, err := db.oss.GetObject(context.Background(), bucket, dir+"/"+file, minio.GetObjectOptions{})
-	if err != nil {
-		return nil, err
+	db, span := db.startSpan("DownloadImage", attribute.String("file", file))
+	defer span.End()
+	return db.GetObject(bucket, dir+"/"+file)
+}
+
+// ListImages lists the images of a pollutant from st to et inclusive by the date directories of the bucket,
+// ordered by time with the min and max tags of every image
+func (db *DB) ListImages(pol string, st time.Time, et time.Time) ([]ImageFrame, error) {
+	db, span := db.startSpan("ListImages", attribute.String("pol", pol))
+	defer span.End()
+	st, et = st.UTC(), et.UTC()
+	frames := []ImageFrame{}
+	for day := st.Truncate(24 * time.Hour); !day.After(et); day = day.Add(24 * time.Hour) {
+		prefix := imageObjectPrefix(day, pol)
+		names, err := db.ListObjects(db.ctx, bucket, prefix)
+		if err != nil {
+			db.log.Error("ListImages(). db.ListObjects("+prefix+"). err:", zap.Error(err))
+			return nil, err
+		}
+		for _, name := range names {
+			tf := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".png")
+			tm, err := time.Parse(imageTimeLayout, strings.ReplaceAll(tf, "$", ":"))
+			if err != nil || tm.Before(st) || tm.After(et) {
+				continue
+			}
+			frames = append(frames, ImageFrame{Time: tm.Format(imageTimeLayout), Data: name})
+		}
 	}
-	defer imgObj.Close()
-	body, err := ioutil.ReadAll(imgObj)
+	sort.SliceStable(frames, func(i, j int) bool {
+		return frames[i].Time < frames[j].Time
+	})
+	queue := make(chan bool, 8)
+	wg := sync.WaitGroup{}
+	for i := range frames {
+		wg.Add(1)
+		queue <- true
+		go func(frame *ImageFrame) {
+			defer func() {
+				<-queue
+				wg.Done()
+			}()
+			tags, err := db.GetObjectTags(bucket, frame.Data)
+			if err != nil {
+				db.log.Warn("ListImages(). db.GetObjectTags(). err:", zap.String("object", frame.Data), zap.Error(err))
+				return
+			}
+			frame.Max = tags["max"]
+			frame.Min = tags["min"]
+		}(&frames[i])
+	}
+	wg.Wait()
+	return frames, nil
+}
+
+// animationWindow is the number of images AnimateImages downloads ahead of the frame it encodes
+const animationWindow = 4
+
+type animationDownload struct {
+	data []byte
+	err  error
+}
+
+// AnimateImages encodes the images of a pollutant from st to et into one animation, the images are
+// downloaded at most animationWindow ahead of the one decoded so only those and the encoded frames are held
+func (db *DB) AnimateImages(pol string, st time.Time, et time.Time, opts AnimationOptions) ([]byte, error) {
+	db, span := db.startSpan("AnimateImages", attribute.String("pol", pol), attribute.String("format", opts.Format))
+	defer span.End()
+	frames, err := db.ListImages(pol, st, et)
 	if err != nil {
 		return nil, err
 	}
-	return body, nil
+	if len(frames) == 0 {
+		return nil, ErrNoImages
+	}
+	// a download takes a slot of the window which the decode loop frees, the buffered results let the
+	// downloads started before a failed frame end on their own
+	downloads := make([]chan animationDownload, len(frames))
+	for i := range downloads {
+		downloads[i] = make(chan animationDownload, 1)
+	}
+	window := make(chan bool, animationWindow)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for i := range frames {
+			select {
+			case window <- true:
+			case <-done:
+				return
+			}
+			go func(i int) {
+				data, err := db.GetObject(bucket, frames[i].Data)
+				downloads[i] <- animationDownload{data: data, err: err}
+			}(i)
+		}
+	}()
+	var enc frameEncoder
+	switch opts.Format {
+	case "apng":
+		enc = newApngEncoder()
+	case "webp":
+		enc = newWebpEncoder()
+	default:
+		enc = newGifEncoder()
+	}
+	var canvas image.Rectangle
+	for i, frame := range frames {
+		download := <-downloads[i]
+		<-window
+		if download.err != nil {
+			db.log.Error("AnimateImages(). db.GetObject(). err:", zap.String("object", frame.Data), zap.Error(download.err))
+			return nil, download.err
+		}
+		src, err := png.Decode(bytes.NewReader(download.data))
+		if err != nil {
+			db.log.Error("AnimateImages(). png.Decode(). err:", zap.String("object", frame.Data), zap.Error(err))
+			return nil, err
+		}
+		if i == 0 {
+			canvas = src.Bounds().Sub(src.Bounds().Min)
+			if opts.Width > 0 && opts.Width != canvas.Dx() {
+				canvas.Max.Y = int(math.Max(1, math.Round(float64(canvas.Dy())*float64(opts.Width)/float64(canvas.Dx()))))
+				canvas.Max.X = opts.Width
+			}
+		}
+		img := resizeImage(src, canvas)
+		if opts.Legend {
+			drawLegend(img, pol, frame)
+		}
+		if err = enc.AddFrame(img, opts.Delay); err != nil {
+			return nil, err
+		}
+	}
+	return enc.Bytes()
+}
+
+// resizeImage copies src into an image of the canvas size, scaling it with the nearest neighbor
+func resizeImage(src image.Image, canvas image.Rectangle) *image.NRGBA {
+	dst := image.NewNRGBA(canvas)
+	b := src.Bounds()
+	if b.Dx() == canvas.Dx() && b.Dy() == canvas.Dy() {
+		draw.Draw(dst, canvas, src, b.Min, draw.Src)
+		return dst
+	}
+	for y := 0; y < canvas.Dy(); y++ {
+		sy := b.Min.Y + y*b.Dy()/canvas.Dy()
+		for x := 0; x < canvas.Dx(); x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*b.Dx()/canvas.Dx(), sy))
+		}
+	}
+	return dst
 }
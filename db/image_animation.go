@@ -0,0 +1,183 @@
+package db
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+)
+
+// frameEncoder assembles the frames of an animation, every frame has the size of the first one
+// and is shown for delay milliseconds. The animations loop forever
+type frameEncoder interface {
+	AddFrame(img *image.NRGBA, delay int) error
+	Bytes() ([]byte, error)
+}
+
+// gifEncoder maps the frames to a fixed palette of a transparent color, the legend colors, samples of the
+// silam ramp and the web safe colors. Pixels under half opacity become transparent
+type gifEncoder struct {
+	anim    gif.GIF
+	palette color.Palette
+	index   map[uint32]uint8
+}
+
+func newGifEncoder() *gifEncoder {
+	p := color.Palette{color.NRGBA{}, legendText, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}}
+	for i := 0; i < 32; i++ {
+		p = append(p, silamRamp.at(float64(i)/31))
+	}
+	p = append(p, palette.WebSafe...)
+	return &gifEncoder{palette: p, index: map[uint32]uint8{}}
+}
+
+func (e *gifEncoder) AddFrame(img *image.NRGBA, delay int) error {
+	paletted := image.NewPaletted(img.Bounds(), e.palette)
+	for i := 0; i < len(paletted.Pix); i++ {
+		px := img.Pix[i*4 : i*4+4]
+		if px[3] < 0x80 {
+			continue
+		}
+		key := uint32(px[0])<<16 | uint32(px[1])<<8 | uint32(px[2])
+		idx, ok := e.index[key]
+		if !ok {
+			idx = uint8(e.palette[1:].Index(color.NRGBA{R: px[0], G: px[1], B: px[2], A: 0xff}) + 1)
+			e.index[key] = idx
+		}
+		paletted.Pix[i] = idx
+	}
+	e.anim.Image = append(e.anim.Image, paletted)
+	e.anim.Delay = append(e.anim.Delay, delay/10)
+	e.anim.Disposal = append(e.anim.Disposal, gif.DisposalBackground)
+	return nil
+}
+
+func (e *gifEncoder) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &e.anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// apngEncoder writes 8 bit RGBA frames, the first frame is the default image so viewers without
+// APNG support show it as a still png. https://wiki.mozilla.org/APNG_Specification
+type apngEncoder struct {
+	width  int
+	height int
+	frames uint32
+	seq    uint32
+	chunks bytes.Buffer
+}
+
+func newApngEncoder() *apngEncoder {
+	return &apngEncoder{}
+}
+
+func writePngChunk(buf *bytes.Buffer, name string, data []byte) {
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[:4], uint32(len(data)))
+	copy(head[4:], name)
+	buf.Write(head[:])
+	buf.Write(data)
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(head[4:])
+	_, _ = crc.Write(data)
+	_ = binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// pngImageData filters every row by the filter among none, sub and up with the smallest sum of
+// absolute differences and deflates the result
+func pngImageData(img *image.NRGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	w := img.Bounds().Dx() * 4
+	prev := make([]byte, w)
+	cands := [3][]byte{make([]byte, w+1), make([]byte, w+1), make([]byte, w+1)}
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+w]
+		best, bestSum := 0, -1
+		for f := range cands {
+			cand := cands[f]
+			cand[0] = byte(f)
+			sum := 0
+			for i, v := range row {
+				switch f {
+				case 1:
+					if i >= 4 {
+						v -= row[i-4]
+					}
+				case 2:
+					v -= prev[i]
+				}
+				cand[i+1] = v
+				if d := int(int8(v)); d < 0 {
+					sum -= d
+				} else {
+					sum += d
+				}
+			}
+			if bestSum < 0 || sum < bestSum {
+				best, bestSum = f, sum
+			}
+		}
+		if _, err := zw.Write(cands[best]); err != nil {
+			return nil, err
+		}
+		copy(prev, row)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (e *apngEncoder) AddFrame(img *image.NRGBA, delay int) error {
+	if e.frames == 0 {
+		e.width, e.height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+	data, err := pngImageData(img)
+	if err != nil {
+		return err
+	}
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:], e.seq)
+	binary.BigEndian.PutUint32(fctl[4:], uint32(e.width))
+	binary.BigEndian.PutUint32(fctl[8:], uint32(e.height))
+	binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+	binary.BigEndian.PutUint16(fctl[22:], 1000)
+	// dispose op none and blend op source, every frame replaces the whole canvas
+	writePngChunk(&e.chunks, "fcTL", fctl)
+	e.seq++
+	if e.frames == 0 {
+		writePngChunk(&e.chunks, "IDAT", data)
+	} else {
+		fdat := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(fdat, e.seq)
+		e.seq++
+		writePngChunk(&e.chunks, "fdAT", append(fdat, data...))
+	}
+	e.frames++
+	return nil
+}
+
+func (e *apngEncoder) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(e.width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(e.height))
+	// bit depth 8, color type 6 truecolor with alpha
+	ihdr[8], ihdr[9] = 8, 6
+	writePngChunk(&buf, "IHDR", ihdr)
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:], e.frames)
+	writePngChunk(&buf, "acTL", actl)
+	buf.Write(e.chunks.Bytes())
+	writePngChunk(&buf, "IEND", nil)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestApngEncoderChunks(t *testing.T) {
+	frames := []int{0, 40, 80}
+	enc := newApngEncoder()
+	for _, seed := range frames {
+		if err := enc.AddFrame(testAnimationFrame(70, 45, seed), 250); err != nil {
+			t.Fatalf("AddFrame() err: %v", err)
+		}
+	}
+	data, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() err: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatalf("bad png signature % x", data[:8])
+	}
+	var names []string
+	var seqs []uint32
+	rest := data[8:]
+	for len(rest) > 0 {
+		if len(rest) < 12 {
+			t.Fatalf("truncated chunk % x", rest)
+		}
+		size := int(binary.BigEndian.Uint32(rest[:4]))
+		if len(rest) < 12+size {
+			t.Fatalf("chunk %s of %d bytes overruns the file", rest[4:8], size)
+		}
+		name, body := string(rest[4:8]), rest[8:8+size]
+		if crc := binary.BigEndian.Uint32(rest[8+size:]); crc != crc32.ChecksumIEEE(rest[4:8+size]) {
+			t.Errorf("chunk %d %s crc = %08x, want %08x", len(names), name, crc, crc32.ChecksumIEEE(rest[4:8+size]))
+		}
+		switch name {
+		case "acTL":
+			if n := binary.BigEndian.Uint32(body); n != uint32(len(frames)) {
+				t.Errorf("acTL frames = %d, want %d", n, len(frames))
+			}
+			if plays := binary.BigEndian.Uint32(body[4:]); plays != 0 {
+				t.Errorf("acTL plays = %d, want 0 to loop forever", plays)
+			}
+		case "fcTL":
+			seqs = append(seqs, binary.BigEndian.Uint32(body))
+			if w, h := binary.BigEndian.Uint32(body[4:]), binary.BigEndian.Uint32(body[8:]); w != 70 || h != 45 {
+				t.Errorf("fcTL size = %dx%d, want 70x45", w, h)
+			}
+			if num, den := binary.BigEndian.Uint16(body[20:]), binary.BigEndian.Uint16(body[22:]); num != 250 || den != 1000 {
+				t.Errorf("fcTL delay = %d/%d, want 250/1000", num, den)
+			}
+		case "fdAT":
+			seqs = append(seqs, binary.BigEndian.Uint32(body))
+		}
+		names = append(names, name)
+		rest = rest[12+size:]
+	}
+	want := "IHDR acTL fcTL IDAT fcTL fdAT fcTL fdAT IEND"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("chunks = %s, want %s", got, want)
+	}
+	for i, seq := range seqs {
+		if seq != uint32(i) {
+			t.Errorf("sequence numbers = %v, want 0 to %d", seqs, len(seqs)-1)
+			break
+		}
+	}
+	// viewers without apng support show the first frame as a still png
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("png.Decode() err: %v", err)
+	}
+	first := testAnimationFrame(70, 45, frames[0])
+	for y := 0; y < 45; y++ {
+		for x := 0; x < 70; x++ {
+			if got := color.NRGBAModel.Convert(img.At(x, y)); got != first.NRGBAAt(x, y) {
+				t.Fatalf("pixel %d,%d = %v, want %v", x, y, got, first.NRGBAAt(x, y))
+			}
+		}
+	}
+}
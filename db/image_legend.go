@@ -0,0 +1,89 @@
+package db
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// glyphs is a 3x5 pixel font, every row is 3 bits with the left pixel as the high bit.
+// Lower case letters are drawn upper case and unknown runes as blanks
+var glyphs = map[rune][5]uint8{
+	'0': {7, 5, 5, 5, 7}, '1': {2, 6, 2, 2, 7}, '2': {7, 1, 7, 4, 7}, '3': {7, 1, 7, 1, 7},
+	'4': {5, 5, 7, 1, 1}, '5': {7, 4, 7, 1, 7}, '6': {7, 4, 7, 5, 7}, '7': {7, 1, 1, 1, 1},
+	'8': {7, 5, 7, 5, 7}, '9': {7, 5, 7, 1, 7}, '.': {0, 0, 0, 0, 2}, '-': {0, 0, 7, 0, 0},
+	':': {0, 2, 0, 2, 0}, '+': {0, 2, 7, 2, 0},
+	'A': {2, 5, 7, 5, 5}, 'B': {6, 5, 6, 5, 6}, 'C': {3, 4, 4, 4, 3}, 'D': {6, 5, 5, 5, 6},
+	'E': {7, 4, 6, 4, 7}, 'F': {7, 4, 6, 4, 4}, 'G': {3, 4, 5, 5, 3}, 'H': {5, 5, 7, 5, 5},
+	'I': {7, 2, 2, 2, 7}, 'J': {1, 1, 1, 5, 2}, 'K': {5, 5, 6, 5, 5}, 'L': {4, 4, 4, 4, 7},
+	'M': {5, 7, 7, 5, 5}, 'N': {6, 5, 5, 5, 5}, 'O': {2, 5, 5, 5, 2}, 'P': {6, 5, 6, 4, 4},
+	'Q': {2, 5, 5, 6, 3}, 'R': {6, 5, 6, 5, 5}, 'S': {3, 4, 2, 1, 6}, 'T': {7, 2, 2, 2, 2},
+	'U': {5, 5, 5, 5, 7}, 'V': {5, 5, 5, 5, 2}, 'W': {5, 5, 7, 7, 5}, 'X': {5, 5, 2, 5, 5},
+	'Y': {5, 5, 2, 2, 2}, 'Z': {7, 1, 2, 4, 7},
+}
+
+var (
+	legendBackground = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xc8}
+	legendText       = color.NRGBA{R: 0x22, G: 0x22, B: 0x22, A: 0xff}
+)
+
+// textWidth is the width of s drawn at scale, a glyph advances 4 pixels
+func textWidth(s string, scale int) int {
+	return (len([]rune(s))*4 - 1) * scale
+}
+
+func drawText(img *image.NRGBA, x int, y int, s string, scale int, c color.NRGBA) {
+	for _, r := range s {
+		glyph := glyphs[unicode.ToUpper(r)]
+		for row := 0; row < 5; row++ {
+			for col := 0; col < 3; col++ {
+				if glyph[row]&(4>>col) == 0 {
+					continue
+				}
+				draw.Draw(img, image.Rect(x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale),
+					image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+		x += 4 * scale
+	}
+}
+
+// drawLegend draws the pollutant, the time and the color ramp between the min and max tags of the frame
+// in the bottom left corner
+func drawLegend(img *image.NRGBA, pol string, frame ImageFrame) {
+	scale := 1
+	if img.Bounds().Dx() >= 400 {
+		scale = 2
+	}
+	pad := 4 * scale
+	title := strings.ToUpper(pol)
+	if tm, err := time.Parse(imageTimeLayout, frame.Time); err == nil {
+		title += "  " + tm.Format("2006-01-02 15:04") + " UTC"
+	}
+	barWidth := 120 * scale
+	if w := textWidth(frame.Min+"  "+frame.Max, scale); w > barWidth {
+		barWidth = w
+	}
+	width := textWidth(title, scale)
+	if barWidth > width {
+		width = barWidth
+	}
+	barHeight := 5 * scale
+	lineHeight := 7 * scale
+	height := lineHeight + barHeight + 2*scale + lineHeight
+	box := image.Rect(0, img.Bounds().Dy()-height-2*pad, width+2*pad, img.Bounds().Dy())
+	draw.Draw(img, box, image.NewUniform(legendBackground), image.Point{}, draw.Over)
+	x, y := box.Min.X+pad, box.Min.Y+pad
+	drawText(img, x, y, title, scale, legendText)
+	y += lineHeight
+	for i := 0; i < barWidth; i++ {
+		draw.Draw(img, image.Rect(x+i, y, x+i+1, y+barHeight),
+			image.NewUniform(silamRamp.at(float64(i)/float64(barWidth-1))), image.Point{}, draw.Src)
+	}
+	y += barHeight + 2*scale
+	drawText(img, x, y, frame.Min, scale, legendText)
+	drawText(img, x+barWidth-textWidth(frame.Max, scale), y, frame.Max, scale, legendText)
+}
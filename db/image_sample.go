@@ -0,0 +1,138 @@
+package db
+
+import (
+	"errors"
+	"image"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// ImageSample is the modelled value of a silam image at a point, Value is nil outside of the image
+// extent and on pixels without a ramp color
+type ImageSample struct {
+	Time  string   `json:"time"`
+	Lon   float64  `json:"lon"`
+	Lat   float64  `json:"lat"`
+	Value *float64 `json:"value"`
+	Max   string   `json:"max"`
+	Min   string   `json:"min"`
+}
+
+var ErrImageNotFound = errors.New("image not found")
+
+// imageSampler reads the values of one decoded image
+type imageSampler struct {
+	img    *image.NRGBA
+	extent [4]float64
+	scale  imageScale
+}
+
+// newImageSampler reads the image object name through the decoded images of the tile cache, so sampling
+// the image a map shows doesn't decode it again
+func (db *DB) newImageSampler(name string, min string, max string) (*imageSampler, error) {
+	img, err := db.decodedImage(name)
+	if err != nil {
+		return nil, err
+	}
+	lo, err := strconv.ParseFloat(min, 64)
+	if err != nil {
+		return nil, errors.New("invalid min tag " + min)
+	}
+	hi, err := strconv.ParseFloat(max, 64)
+	if err != nil {
+		return nil, errors.New("invalid max tag " + max)
+	}
+	return &imageSampler{img: img, extent: db.imageExtent(), scale: newImageScale(lo, hi, db.Conf().ImageScale)}, nil
+}
+
+// sample maps the point to the pixel covering it
+func (s *imageSampler) sample(p GeoPoint) *float64 {
+	b := s.img.Bounds()
+	x, y := extentColumn(s.extent, b.Dx(), p.Lon), extentRow(s.extent, b.Dy(), p.Lat)
+	if x < 0 || y < 0 {
+		return nil
+	}
+	t, ok := rampPosition(s.img.NRGBAAt(b.Min.X+x, b.Min.Y+y))
+	if !ok {
+		return nil
+	}
+	// the 8 bit colors don't carry more precision
+	v := math.Round(s.scale.value(t)*1000) / 1000
+	return &v
+}
+
+// SampleImage reads the values of the image of a pollutant at tm for the points
+func (db *DB) SampleImage(tm time.Time, pol string, points []GeoPoint) ([]ImageSample, error) {
+	db, span := db.startSpan("SampleImage", attribute.String("pol", pol), attribute.Int("points", len(points)))
+	defer span.End()
+	name := imageObjectName(tm, pol)
+	if !db.ExistObject(bucket, name) {
+		return nil, ErrImageNotFound
+	}
+	tags, err := db.GetObjectTags(bucket, name)
+	if err != nil {
+		db.log.Error("SampleImage(). db.GetObjectTags(). err:", zap.String("object", name), zap.Error(err))
+		return nil, err
+	}
+	sampler, err := db.newImageSampler(name, tags["min"], tags["max"])
+	if err != nil {
+		db.log.Error("SampleImage(). db.newImageSampler(). err:", zap.String("object", name), zap.Error(err))
+		return nil, err
+	}
+	samples := make([]ImageSample, len(points))
+	for i, p := range points {
+		samples[i] = ImageSample{
+			Time:  tm.UTC().Format(imageTimeLayout),
+			Lon:   p.Lon,
+			Lat:   p.Lat,
+			Value: sampler.sample(p),
+			Max:   tags["max"],
+			Min:   tags["min"],
+		}
+	}
+	return samples, nil
+}
+
+// SampleImageSeries reads the values at a point of the images of a pollutant from st to et, images
+// which can't be read are left out
+func (db *DB) SampleImageSeries(pol string, p GeoPoint, st time.Time, et time.Time) ([]ImageSample, error) {
+	db, span := db.startSpan("SampleImageSeries", attribute.String("pol", pol))
+	defer span.End()
+	frames, err := db.ListImages(pol, st, et)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]*ImageSample, len(frames))
+	queue := make(chan bool, 4)
+	wg := sync.WaitGroup{}
+	for i := range frames {
+		wg.Add(1)
+		queue <- true
+		go func(i int) {
+			defer func() {
+				<-queue
+				wg.Done()
+			}()
+			frame := frames[i]
+			sampler, err := db.newImageSampler(frame.Data, frame.Min, frame.Max)
+			if err != nil {
+				db.log.Warn("SampleImageSeries(). db.newImageSampler(). err:", zap.String("object", frame.Data), zap.Error(err))
+				return
+			}
+			samples[i] = &ImageSample{Time: frame.Time, Lon: p.Lon, Lat: p.Lat, Value: sampler.sample(p), Max: frame.Max, Min: frame.Min}
+		}(i)
+	}
+	wg.Wait()
+	series := make([]ImageSample, 0, len(samples))
+	for _, s := range samples {
+		if s != nil {
+			series = append(series, *s)
+		}
+	}
+	return series, nil
+}
@@ -0,0 +1,336 @@
+package db
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// TileOptions style a silam tile, Ramp redraws the silam colors with one of imageRamps and Opacity
+// scales the alpha of every pixel
+type TileOptions struct {
+	Ramp    string
+	Opacity float64
+}
+
+const (
+	tileSize = 256
+	// tileCacheExpiration is the lifetime of the tiles in memory
+	tileCacheExpiration = time.Hour
+	// tileCacheBytes bounds the size of the tiles in memory, a 256px png tile is up to about 260KB
+	tileCacheBytes = 64 * 1024 * 1024
+	// tileCacheImages is the number of decoded images kept to cut tiles from
+	tileCacheImages = 4
+)
+
+// tileCache holds the encoded tiles and the last decoded images they are cut from, an image is decoded
+// once however many of its tiles are requested at the same time
+type tileCache struct {
+	tiles  *tileLRU
+	lock   sync.Mutex
+	names  []string
+	images map[string]*tileImage
+}
+
+type tileImage struct {
+	once sync.Once
+	img  *image.NRGBA
+	err  error
+}
+
+func newTileCache() *tileCache {
+	return &tileCache{tiles: newTileLRU(tileCacheBytes, tileCacheExpiration), images: map[string]*tileImage{}}
+}
+
+var errLargeTile = errors.New("tile larger than a sixteenth of the tile cache")
+
+// tileLRU keeps the encoded tiles up to max bytes, the least recently read are dropped first. Unlike
+// freecache, which rejects entries over a thousandth of its size, it takes any tile up to max/16
+type tileLRU struct {
+	lock    sync.Mutex
+	size    int
+	max     int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type tileEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func newTileLRU(max int, ttl time.Duration) *tileLRU {
+	return &tileLRU{max: max, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *tileLRU) Get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*tileEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.data, true
+}
+
+func (c *tileLRU) Set(key string, data []byte) error {
+	if len(data) > c.max/16 {
+		return errLargeTile
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&tileEntry{key: key, data: data, expires: time.Now().Add(c.ttl)})
+	c.size += len(data)
+	for c.size > c.max {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+func (c *tileLRU) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+	c.size = 0
+}
+
+// remove drops the entry of e, the lock must be held
+func (c *tileLRU) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*tileEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.data)
+}
+
+// image returns the decoded image of name, load runs once for all callers waiting on it. A failed
+// load is forgotten so the next call tries again
+func (c *tileCache) image(name string, load func() (*image.NRGBA, error)) (*image.NRGBA, error) {
+	c.lock.Lock()
+	entry, ok := c.images[name]
+	if !ok {
+		entry = &tileImage{}
+		c.images[name] = entry
+		c.names = append(c.names, name)
+		if len(c.names) > tileCacheImages {
+			delete(c.images, c.names[0])
+			c.names = c.names[1:]
+		}
+	}
+	c.lock.Unlock()
+	entry.once.Do(func() {
+		entry.img, entry.err = load()
+	})
+	if entry.err != nil {
+		c.lock.Lock()
+		if c.images[name] == entry {
+			c.forget(name)
+		}
+		c.lock.Unlock()
+	}
+	return entry.img, entry.err
+}
+
+// forget drops the decoded image of name, the lock must be held
+func (c *tileCache) forget(name string) {
+	delete(c.images, name)
+	for i, n := range c.names {
+		if n == name {
+			c.names = append(c.names[:i], c.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// purge drops the tiles and the decoded images after images were rendered again
+func (c *tileCache) purge() {
+	c.lock.Lock()
+	c.names = nil
+	c.images = map[string]*tileImage{}
+	c.lock.Unlock()
+	c.tiles.Clear()
+}
+
+// tileFrameKey is the key prefix of the tiles cut from the image of a pollutant at tm
+func tileFrameKey(pol string, tm time.Time) string {
+	return pol + "/" + strings.ReplaceAll(tm.UTC().Format(imageTimeLayout), ":", "$") + "/"
+}
+
+// removeFrameTiles drops the tiles kept in the bucket for the images rendered again, the tiles in
+// memory are purged first so no tile of an old image is kept again
+func (db *DB) removeFrameTiles(frames []string) {
+	db.tiles.purge()
+	for _, frame := range frames {
+		if err := db.RemoveObjects(db.ctx, bucket, "tiles/"+frame); err != nil {
+			db.log.Warn("removeFrameTiles(). db.RemoveObjects(). err:", zap.String("prefix", "tiles/"+frame), zap.Error(err))
+		}
+	}
+}
+
+// SilamTile cuts the web mercator tile z/x/y out of the image of a pollutant at tm. Tiles are cached in
+// memory, with tile_cache object unstyled tiles are also kept in the bucket under tiles/
+func (db *DB) SilamTile(pol string, tm time.Time, z int, x int, y int, opts TileOptions) ([]byte, error) {
+	db, span := db.startSpan("SilamTile", attribute.String("pol", pol),
+		attribute.String("tile", fmt.Sprintf("%d/%d/%d", z, x, y)))
+	defer span.End()
+	key := fmt.Sprintf("%s%d/%d/%d", tileFrameKey(pol, tm), z, x, y)
+	cacheKey := key + "?" + opts.Ramp + "&" + strconv.FormatFloat(opts.Opacity, 'f', -1, 64)
+	if data, ok := db.tiles.tiles.Get(cacheKey); ok {
+		return data, nil
+	}
+	styled := (opts.Ramp != "" && opts.Ramp != "silam") || opts.Opacity < 1
+	persist := !styled && db.Conf().TileCache == "object"
+	objectName := "tiles/" + key + ".png"
+	if persist && db.ExistObject(bucket, objectName) {
+		data, err := db.GetObject(bucket, objectName)
+		if err == nil {
+			db.cacheTile(cacheKey, data)
+			return data, nil
+		}
+		db.log.Warn("SilamTile(). db.GetObject(). err:", zap.String("object", objectName), zap.Error(err))
+	}
+	name := imageObjectName(tm, pol)
+	src, err := db.decodedImage(name)
+	if err != nil {
+		if err != ErrImageNotFound {
+			db.log.Error("SilamTile(). db.decodedImage(). err:", zap.String("object", name), zap.Error(err))
+		}
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, renderTile(src, db.imageExtent(), z, x, y, opts)); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	db.cacheTile(cacheKey, data)
+	if persist {
+		if err = db.PutObject(bucket, objectName, data, "image/png"); err != nil {
+			db.log.Warn("SilamTile(). db.PutObject(). err:", zap.String("object", objectName), zap.Error(err))
+		}
+	}
+	return data, nil
+}
+
+// decodedImage returns the decoded image object name from the tile cache, shared by the tiles and the samples
+func (db *DB) decodedImage(name string) (*image.NRGBA, error) {
+	return db.tiles.image(name, func() (*image.NRGBA, error) {
+		if !db.ExistObject(bucket, name) {
+			return nil, ErrImageNotFound
+		}
+		data, err := db.GetObject(bucket, name)
+		if err != nil {
+			return nil, err
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		nrgba := image.NewNRGBA(img.Bounds().Sub(img.Bounds().Min))
+		draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		return nrgba, nil
+	})
+}
+
+func (db *DB) cacheTile(key string, data []byte) {
+	if err := db.tiles.tiles.Set(key, data); err != nil {
+		db.log.Warn("SilamTile(). db.tiles.tiles.Set(). err:", zap.String("tile", key), zap.Int("size", len(data)), zap.Error(err))
+	}
+}
+
+// renderTile reprojects the part of the equirectangular image within the extent onto the web mercator
+// tile, every tile pixel takes the image pixel under its center
+func renderTile(src *image.NRGBA, extent [4]float64, z int, x int, y int, opts TileOptions) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, tileSize, tileSize))
+	world := float64(tileSize) * math.Exp2(float64(z))
+	cols := make([]int, tileSize)
+	for px := range cols {
+		lon := (float64(x*tileSize+px)+0.5)/world*360 - 180
+		cols[px] = extentColumn(extent, src.Bounds().Dx(), lon)
+	}
+	ramp := imageRamps[opts.Ramp]
+	if opts.Ramp == "silam" {
+		ramp = nil
+	}
+	styles := map[color.NRGBA]color.NRGBA{}
+	for py := 0; py < tileSize; py++ {
+		lat := math.Atan(math.Sinh(math.Pi*(1-2*(float64(y*tileSize+py)+0.5)/world))) * 180 / math.Pi
+		sy := extentRow(extent, src.Bounds().Dy(), lat)
+		if sy < 0 {
+			continue
+		}
+		for px, sx := range cols {
+			if sx < 0 {
+				continue
+			}
+			i := sy*src.Stride + sx*4
+			c := color.NRGBA{R: src.Pix[i], G: src.Pix[i+1], B: src.Pix[i+2], A: src.Pix[i+3]}
+			if ramp != nil || opts.Opacity < 1 {
+				styled, ok := styles[c]
+				if !ok {
+					styled = styleColor(c, ramp, opts.Opacity)
+					styles[c] = styled
+				}
+				c = styled
+			}
+			j := py*dst.Stride + px*4
+			dst.Pix[j], dst.Pix[j+1], dst.Pix[j+2], dst.Pix[j+3] = c.R, c.G, c.B, c.A
+		}
+	}
+	return dst
+}
+
+// styleColor redraws a silam ramp color with ramp and scales its alpha, other colors keep their rgb
+func styleColor(c color.NRGBA, ramp colorRamp, opacity float64) color.NRGBA {
+	if ramp != nil {
+		if t, ok := rampPosition(c); ok {
+			a := c.A
+			c = ramp.at(t)
+			c.A = a
+		}
+	}
+	c.A = uint8(math.Round(float64(c.A) * opacity))
+	if c.A == 0 {
+		return color.NRGBA{}
+	}
+	return c
+}
+
+// extentColumn is the column of an image of width pixels spanning the extent which covers lon, -1 outside
+func extentColumn(extent [4]float64, width int, lon float64) int {
+	if lon < extent[0] || lon > extent[2] {
+		return -1
+	}
+	return int(math.Min(float64(width-1), math.Floor((lon-extent[0])/(extent[2]-extent[0])*float64(width))))
+}
+
+// extentRow is the row of an image of height pixels spanning the extent which covers lat, -1 outside.
+// The rows run from north to south
+func extentRow(extent [4]float64, height int, lat float64) int {
+	if lat < extent[1] || lat > extent[3] {
+		return -1
+	}
+	return int(math.Min(float64(height-1), math.Floor((extent[3]-lat)/(extent[3]-extent[1])*float64(height))))
+}
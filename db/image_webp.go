@@ -0,0 +1,570 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"sort"
+)
+
+// The webp animation holds one lossless VP8L bitstream per frame. The encoder applies the subtract green
+// and the predictor transforms and no color cache, runs of residuals equal to the left or the upper one
+// become backward references which keeps the smooth areas of the silam images small. https://developers.google.com/speed/webp/docs/riff_container
+
+const (
+	vp8lMaxLength = 4096
+	// the distance codes of the pixel above and the pixel to the left in the distance map of the spec
+	vp8lDistAbove = 1
+	vp8lDistLeft  = 2
+	// the transform types and the predictor block size of 32 pixels
+	vp8lPredictor     = 0
+	vp8lSubtractGreen = 2
+	vp8lPredictorBits = 5
+)
+
+// vp8lPredictorModes are the predictor modes tried on every block, left, top, the average of both and
+// the clamped gradient. None of them reads the top right pixel
+var vp8lPredictorModes = []int{1, 2, 7, 12}
+
+// vp8lCodeLengthOrder is the order the lengths of the code length code are written in
+var vp8lCodeLengthOrder = []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type webpEncoder struct {
+	width  int
+	height int
+	alpha  bool
+	frames bytes.Buffer
+}
+
+func newWebpEncoder() *webpEncoder {
+	return &webpEncoder{}
+}
+
+func (e *webpEncoder) AddFrame(img *image.NRGBA, delay int) error {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if e.frames.Len() == 0 {
+		e.width, e.height = w, h
+	}
+	data, alpha := encodeVp8l(img)
+	e.alpha = e.alpha || alpha
+	var anmf bytes.Buffer
+	// X and Y offset 0, the frame covers the canvas
+	anmf.Write([]byte{0, 0, 0, 0, 0, 0})
+	writeUint24(&anmf, w-1)
+	writeUint24(&anmf, h-1)
+	writeUint24(&anmf, delay)
+	// no blending and no disposal, every frame replaces the whole canvas
+	anmf.WriteByte(0x02)
+	writeRiffChunk(&anmf, "VP8L", data)
+	writeRiffChunk(&e.frames, "ANMF", anmf.Bytes())
+	return nil
+}
+
+func (e *webpEncoder) Bytes() ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	var vp8x bytes.Buffer
+	flags := byte(0x02)
+	if e.alpha {
+		flags |= 0x10
+	}
+	vp8x.Write([]byte{flags, 0, 0, 0})
+	writeUint24(&vp8x, e.width-1)
+	writeUint24(&vp8x, e.height-1)
+	writeRiffChunk(&body, "VP8X", vp8x.Bytes())
+	// transparent background and endless loop
+	writeRiffChunk(&body, "ANIM", []byte{0, 0, 0, 0, 0, 0})
+	body.Write(e.frames.Bytes())
+	var buf bytes.Buffer
+	writeRiffChunk(&buf, "RIFF", body.Bytes())
+	return buf.Bytes(), nil
+}
+
+func writeUint24(buf *bytes.Buffer, v int) {
+	buf.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)})
+}
+
+func writeRiffChunk(buf *bytes.Buffer, name string, data []byte) {
+	buf.WriteString(name)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)%2 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+// vp8lBitWriter packs values least significant bit first
+type vp8lBitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *vp8lBitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.buf
+}
+
+// vp8lToken is a literal argb pixel or a backward reference of length pixels at distance code dist
+type vp8lToken struct {
+	argb   uint32
+	length int
+	dist   int
+}
+
+// vp8lPrefix splits a length or distance into its prefix symbol and extra bits
+func vp8lPrefix(v int) (symbol int, extraBits uint, extra uint32) {
+	n := v - 1
+	if n < 4 {
+		return n, 0, 0
+	}
+	h := 0
+	for (n >> (h + 1)) != 0 {
+		h++
+	}
+	second := (n >> (h - 1)) & 1
+	extraBits = uint(h - 1)
+	return 2*h + second, extraBits, uint32(n & (1<<extraBits - 1))
+}
+
+// huffmanCode is a canonical prefix code, codes are stored bit reversed for the lsb first writer.
+// A code of a single used symbol has no bits
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (c *huffmanCode) write(w *vp8lBitWriter, symbol int) {
+	w.write(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// huffmanLengths returns code lengths of at most maxLen bits for the frequencies, the frequencies are
+// halved until the tree fits. It needs at least two used symbols
+func huffmanLengths(freqs []uint32, maxLen int) []uint8 {
+	type node struct {
+		freq   uint64
+		parent int
+	}
+	lengths := make([]uint8, len(freqs))
+	for shift := uint(0); ; shift++ {
+		var nodes []node
+		var leaves []int
+		for sym, f := range freqs {
+			if f > 0 {
+				nodes = append(nodes, node{freq: uint64(f>>shift) + 1, parent: -1})
+				leaves = append(leaves, sym)
+			}
+		}
+		order := make([]int, len(nodes))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return nodes[order[i]].freq < nodes[order[j]].freq
+		})
+		// two queue huffman construction, the merged nodes are created in increasing frequency
+		var merged []int
+		pop := func() int {
+			if len(merged) == 0 || (len(order) > 0 && nodes[order[0]].freq <= nodes[merged[0]].freq) {
+				n := order[0]
+				order = order[1:]
+				return n
+			}
+			n := merged[0]
+			merged = merged[1:]
+			return n
+		}
+		for len(order)+len(merged) > 1 {
+			a, b := pop(), pop()
+			nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, parent: -1})
+			nodes[a].parent = len(nodes) - 1
+			nodes[b].parent = len(nodes) - 1
+			merged = append(merged, len(nodes)-1)
+		}
+		fits := true
+		for i, sym := range leaves {
+			depth := 0
+			for n := i; nodes[n].parent >= 0; n = nodes[n].parent {
+				depth++
+			}
+			if depth > maxLen {
+				fits = false
+				break
+			}
+			lengths[sym] = uint8(depth)
+		}
+		if fits {
+			return lengths
+		}
+	}
+}
+
+// canonicalCode assigns the canonical codes of the lengths like deflate
+func canonicalCode(lengths []uint8) huffmanCode {
+	var count [16]uint32
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		rev := uint32(0)
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | (c>>i)&1
+		}
+		codes[sym] = rev
+	}
+	return huffmanCode{lengths: lengths, codes: codes}
+}
+
+// writeHuffmanCode writes the code of the frequencies and returns it. One or two used symbols below
+// 256 take the simple form, anything else the code lengths compressed by a code length code
+func writeHuffmanCode(w *vp8lBitWriter, freqs []uint32) huffmanCode {
+	var used []int
+	for sym, f := range freqs {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		w.write(1, 1)
+		lengths := make([]uint8, len(freqs))
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			lengths[used[0]], lengths[used[1]] = 1, 1
+		}
+		return canonicalCode(lengths)
+	}
+	code := canonicalCode(huffmanLengths(freqs, 15))
+	w.write(0, 1)
+	// run length tokens of the code lengths, 16 repeats the previous non zero length and 17 and 18 repeat zeros
+	type clToken struct {
+		symbol    int
+		extra     uint32
+		extraBits uint
+	}
+	var tokens []clToken
+	prev := uint8(8)
+	for i := 0; i < len(code.lengths); {
+		v := code.lengths[i]
+		run := 1
+		for i+run < len(code.lengths) && code.lengths[i+run] == v {
+			run++
+		}
+		i += run
+		if v == 0 {
+			for run >= 11 {
+				r := run
+				if r > 138 {
+					r = 138
+				}
+				tokens = append(tokens, clToken{18, uint32(r - 11), 7})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, clToken{17, uint32(run - 3), 3})
+				run = 0
+			}
+		} else {
+			if v != prev {
+				tokens = append(tokens, clToken{symbol: int(v)})
+				prev = v
+				run--
+			}
+			for run >= 3 {
+				r := run
+				if r > 6 {
+					r = 6
+				}
+				tokens = append(tokens, clToken{16, uint32(r - 3), 2})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, clToken{symbol: int(v)})
+		}
+	}
+	clFreqs := make([]uint32, 19)
+	for _, t := range tokens {
+		clFreqs[t.symbol]++
+	}
+	// a code length code needs two used symbols to be a complete tree
+	if n := countUsed(clFreqs); n < 2 {
+		for sym := range clFreqs {
+			if clFreqs[sym] == 0 {
+				clFreqs[sym] = 1
+				break
+			}
+		}
+	}
+	clCode := canonicalCode(huffmanLengths(clFreqs, 7))
+	num := 4
+	for i, sym := range vp8lCodeLengthOrder {
+		if clCode.lengths[sym] > 0 && i+1 > num {
+			num = i + 1
+		}
+	}
+	w.write(uint32(num-4), 4)
+	for _, sym := range vp8lCodeLengthOrder[:num] {
+		w.write(uint32(clCode.lengths[sym]), 3)
+	}
+	// the lengths of all symbols follow
+	w.write(0, 1)
+	for _, t := range tokens {
+		clCode.write(w, t.symbol)
+		if t.extraBits > 0 {
+			w.write(t.extra, t.extraBits)
+		}
+	}
+	return code
+}
+
+func countUsed(freqs []uint32) int {
+	n := 0
+	for _, f := range freqs {
+		if f > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// encodeVp8l encodes the image as a VP8L bitstream and tells whether it has transparent pixels
+func encodeVp8l(img *image.NRGBA) ([]byte, bool) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	pix := make([]uint32, 0, w*h)
+	alpha := false
+	for y := 0; y < h; y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+w*4]
+		for x := 0; x < w; x++ {
+			p := row[x*4 : x*4+4]
+			if p[3] != 0xff {
+				alpha = true
+			}
+			pix = append(pix, uint32(p[3])<<24|uint32(p[0])<<16|uint32(p[1])<<8|uint32(p[2]))
+		}
+	}
+	bw := &vp8lBitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	if alpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+	// the decoder undoes the transforms in reverse, so the subtract green transform is written first
+	bw.write(1, 1)
+	bw.write(vp8lSubtractGreen, 2)
+	subtractGreen(pix)
+	bw.write(1, 1)
+	bw.write(vp8lPredictor, 2)
+	bw.write(vp8lPredictorBits-2, 3)
+	modes, mw := predictPixels(pix, w, h)
+	writeVp8lImage(bw, modes, mw, false)
+	bw.write(0, 1)
+	writeVp8lImage(bw, pix, w, true)
+	return bw.bytes(), alpha
+}
+
+// subtractGreen subtracts the green channel from the red and blue channels
+func subtractGreen(pix []uint32) {
+	for i, p := range pix {
+		g := (p >> 8) & 0xff
+		r := ((p >> 16) - g) & 0xff
+		b := (p - g) & 0xff
+		pix[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// vp8lPredict predicts the pixel at i by one of the modes of vp8lPredictorModes
+func vp8lPredict(pix []uint32, i int, w int, mode int) uint32 {
+	l, t := pix[i-1], pix[i-w]
+	switch mode {
+	case 1:
+		return l
+	case 2:
+		return t
+	case 7:
+		return ((l^t)&0xfefefefe)>>1 + (l & t)
+	}
+	tl := pix[i-w-1]
+	var p uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(l>>shift&0xff) + int(t>>shift&0xff) - int(tl>>shift&0xff)
+		if v < 0 {
+			v = 0
+		} else if v > 0xff {
+			v = 0xff
+		}
+		p |= uint32(v) << shift
+	}
+	return p
+}
+
+// subPixels subtracts pred from p per channel
+func subPixels(p uint32, pred uint32) uint32 {
+	var d uint32
+	for shift := 0; shift < 32; shift += 8 {
+		d |= ((p>>shift - pred>>shift) & 0xff) << shift
+	}
+	return d
+}
+
+// predictPixels replaces the pixels by their residuals. Every block picks the mode of vp8lPredictorModes with
+// the smallest sum of absolute residuals, the modes are returned as the green channel of the mode image
+func predictPixels(pix []uint32, w int, h int) ([]uint32, int) {
+	size := 1 << vp8lPredictorBits
+	mw, mh := (w+size-1)/size, (h+size-1)/size
+	modes := make([]uint32, mw*mh)
+	for by := 0; by < mh; by++ {
+		for bx := 0; bx < mw; bx++ {
+			best, bestSum := vp8lPredictorModes[0], -1
+			for _, mode := range vp8lPredictorModes {
+				sum := 0
+				for y := by * size; y < h && y < (by+1)*size && y > 0; y++ {
+					for x := bx * size; x < w && x < (bx+1)*size; x++ {
+						if x == 0 {
+							continue
+						}
+						i := y*w + x
+						d := subPixels(pix[i], vp8lPredict(pix, i, w, mode))
+						for shift := 0; shift < 32; shift += 8 {
+							if v := int(int8(d >> shift)); v < 0 {
+								sum -= v
+							} else {
+								sum += v
+							}
+						}
+					}
+				}
+				if bestSum < 0 || sum < bestSum {
+					best, bestSum = mode, sum
+				}
+			}
+			modes[by*mw+bx] = 0xff000000 | uint32(best)<<8
+		}
+	}
+	// from the last pixel backwards so the predictions still see the original pixels
+	for i := len(pix) - 1; i >= 0; i-- {
+		x, y := i%w, i/w
+		var pred uint32
+		switch {
+		case i == 0:
+			pred = 0xff000000
+		case y == 0:
+			pred = pix[i-1]
+		case x == 0:
+			pred = pix[i-w]
+		default:
+			pred = vp8lPredict(pix, i, w, int(modes[(y>>vp8lPredictorBits)*mw+x>>vp8lPredictorBits]>>8&0xff))
+		}
+		pix[i] = subPixels(pix[i], pred)
+	}
+	return modes, mw
+}
+
+// writeVp8lImage writes the entropy coded pixels without a color cache, only the main image has the bit
+// of the meta prefix codes
+func writeVp8lImage(bw *vp8lBitWriter, pix []uint32, w int, main bool) {
+	green := make([]uint32, 256+24)
+	red := make([]uint32, 256)
+	blue := make([]uint32, 256)
+	alphas := make([]uint32, 256)
+	dists := make([]uint32, 40)
+	var tokens []vp8lToken
+	for i := 0; i < len(pix); {
+		left, above := 0, 0
+		if i > 0 {
+			for i+left < len(pix) && left < vp8lMaxLength && pix[i+left] == pix[i-1] {
+				left++
+			}
+		}
+		if i >= w {
+			for i+above < len(pix) && above < vp8lMaxLength && pix[i+above] == pix[i+above-w] {
+				above++
+			}
+		}
+		if left >= 3 || above >= 3 {
+			t := vp8lToken{length: left, dist: vp8lDistLeft}
+			if above > left {
+				t = vp8lToken{length: above, dist: vp8lDistAbove}
+			}
+			sym, _, _ := vp8lPrefix(t.length)
+			green[256+sym]++
+			sym, _, _ = vp8lPrefix(t.dist)
+			dists[sym]++
+			tokens = append(tokens, t)
+			i += t.length
+			continue
+		}
+		p := pix[i]
+		green[(p>>8)&0xff]++
+		red[(p>>16)&0xff]++
+		blue[p&0xff]++
+		alphas[p>>24]++
+		tokens = append(tokens, vp8lToken{argb: p})
+		i++
+	}
+	bw.write(0, 1)
+	if main {
+		bw.write(0, 1)
+	}
+	greenCode := writeHuffmanCode(bw, green)
+	redCode := writeHuffmanCode(bw, red)
+	blueCode := writeHuffmanCode(bw, blue)
+	alphaCode := writeHuffmanCode(bw, alphas)
+	distCode := writeHuffmanCode(bw, dists)
+	for _, t := range tokens {
+		if t.length == 0 {
+			greenCode.write(bw, int((t.argb>>8)&0xff))
+			redCode.write(bw, int((t.argb>>16)&0xff))
+			blueCode.write(bw, int(t.argb&0xff))
+			alphaCode.write(bw, int(t.argb>>24))
+			continue
+		}
+		sym, extraBits, extra := vp8lPrefix(t.length)
+		greenCode.write(bw, 256+sym)
+		bw.write(extra, extraBits)
+		sym, extraBits, extra = vp8lPrefix(t.dist)
+		distCode.write(bw, sym)
+		bw.write(extra, extraBits)
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testAnimationFrame is a w by h frame with a smooth gradient like the silam images, runs of one
+// color, a transparent band and a few noisy pixels so every predictor mode and backward reference is used
+func testAnimationFrame(w int, h int, seed int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: uint8(x * 3), G: uint8(y*5 + seed), B: uint8((x + y) / 2), A: 0xff}
+			switch {
+			case y%17 == 3:
+				c = color.NRGBA{R: 0x20, G: 0x80, B: 0xc0, A: 0xff}
+			case x > w-8:
+				c = color.NRGBA{}
+			case (x*7+y*13+seed)%29 == 0:
+				c = color.NRGBA{R: uint8(x * y), G: uint8(seed), B: 0xff, A: 0x90}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// webpChunks returns the names and the bodies of the chunks of a riff container body in order
+func webpChunks(t *testing.T, data []byte) ([]string, [][]byte) {
+	t.Helper()
+	var names []string
+	var bodies [][]byte
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated chunk header %q", data)
+		}
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if len(data) < 8+size {
+			t.Fatalf("chunk %s of %d bytes overruns the file", data[:4], size)
+		}
+		names = append(names, string(data[:4]))
+		bodies = append(bodies, data[8:8+size])
+		data = data[8+size+size%2:]
+	}
+	return names, bodies
+}
+
+func TestWebpEncoderRoundTrip(t *testing.T) {
+	frames := []*image.NRGBA{testAnimationFrame(70, 45, 0), testAnimationFrame(70, 45, 40), testAnimationFrame(70, 45, 80)}
+	enc := newWebpEncoder()
+	for _, frame := range frames {
+		if err := enc.AddFrame(frame, 500); err != nil {
+			t.Fatalf("AddFrame() err: %v", err)
+		}
+	}
+	data, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() err: %v", err)
+	}
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(data[4:8])) != len(data)-8 {
+		t.Fatalf("bad riff header % x", data[:12])
+	}
+	names, bodies := webpChunks(t, data[12:])
+	if len(names) != 5 || names[0] != "VP8X" || names[1] != "ANIM" {
+		t.Fatalf("chunks = %v, want VP8X ANIM and 3 ANMF", names)
+	}
+	vp8x := bodies[0]
+	if vp8x[0] != 0x12 || int(vp8x[4])|int(vp8x[5])<<8 != 69 || int(vp8x[7])|int(vp8x[8])<<8 != 44 {
+		t.Errorf("VP8X = % x, want the animation and alpha flags on a 70x45 canvas", vp8x)
+	}
+	for i, frame := range frames {
+		if names[i+2] != "ANMF" {
+			t.Fatalf("chunk %d = %s, want ANMF", i+2, names[i+2])
+		}
+		anmf := bodies[i+2]
+		if delay := int(anmf[12]) | int(anmf[13])<<8 | int(anmf[14])<<16; delay != 500 {
+			t.Errorf("frame %d delay = %d, want 500", i, delay)
+		}
+		// a frame holds a still VP8L bitstream, wrapped in a riff container of its own to decode it
+		frameNames, frameBodies := webpChunks(t, anmf[16:])
+		if len(frameNames) != 1 || frameNames[0] != "VP8L" {
+			t.Fatalf("frame %d chunks = %v, want VP8L", i, frameNames)
+		}
+		var body, still bytes.Buffer
+		body.WriteString("WEBP")
+		writeRiffChunk(&body, "VP8L", frameBodies[0])
+		writeRiffChunk(&still, "RIFF", body.Bytes())
+		img, err := webp.Decode(&still)
+		if err != nil {
+			t.Fatalf("frame %d webp.Decode() err: %v", i, err)
+		}
+		if img.Bounds() != frame.Bounds() {
+			t.Fatalf("frame %d bounds = %v, want %v", i, img.Bounds(), frame.Bounds())
+		}
+		for y := 0; y < frame.Bounds().Dy(); y++ {
+			for x := 0; x < frame.Bounds().Dx(); x++ {
+				if got := color.NRGBAModel.Convert(img.At(x, y)); got != frame.NRGBAAt(x, y) {
+					t.Fatalf("frame %d pixel %d,%d = %v, want %v", i, x, y, got, frame.NRGBAAt(x, y))
+				}
+			}
+		}
+	}
+}
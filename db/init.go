@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"errors"
 	"github.com/coocood/freecache"
 	"github.com/csnight/storm-aqi-server/conf"
 	"github.com/csnight/storm-aqi-server/elastic"
@@ -10,18 +11,42 @@ import (
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"go.uber.org/zap"
+	"path/filepath"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type DB struct {
-	Conf  *conf.AQIConfig
-	api   *elastic.EsAPI
-	pool  *pool.ObjectPool
-	log   *zap.Logger
-	cache *freecache.Cache
-	ctx   context.Context
-	oss   *minio.Client
+	StationStore
+	StationWriter
+	AuditStore
+	RealtimeStore
+	HistoryStore
+	CompareStore
+	AlertStore
+	ObjectStore
+	aqiConf  *atomic.Value
+	api      *elastic.EsAPI
+	pool     *pool.ObjectPool
+	log      *zap.Logger
+	cache    *freecache.Cache
+	tiles    *tileCache
+	ctx      context.Context
+	stations *stationList
+	regions  []*Region
+	tick     *time.Ticker
+	done     chan bool
+}
+
+// stationList is shared by the copies of a DB made for tracing, writes serializes the station
+// writes so the check of a write and its save don't interleave with another one
+type stationList struct {
+	writes sync.Mutex
+	lock   sync.RWMutex
+	list   []AqiStationResp
+	loaded time.Time
 }
 
 var json = jsoniter.Config{
@@ -30,47 +55,129 @@ var json = jsoniter.Config{
 	ValidateJsonRawMessage: true,
 }.Froze()
 
-var tick = time.NewTicker(time.Minute * 9)
-
 func Init(conf *conf.GConfig, logger *zap.Logger) (*DB, error) {
-	var ctx = context.Background()
-	poolEs := elastic.InitEsPool(ctx, conf.ESConf)
+	return initDB(conf, logger, false)
+}
 
-	elasticApi := &elastic.EsAPI{
-		Log:       logger.Sugar().Named("\u001B[33m[ES]\u001B[0m"),
-		EsPool:    poolEs,
-		FailQueue: []elastic.BulkIndexerItem{},
-	}
-	elasticApi.Init()
+// InitReadOnly opens the stores for commands which only read, like the export, without the es fail
+// queue, the bulk indexer or the index creation so it can run next to a server on the same config
+func InitReadOnly(conf *conf.GConfig, logger *zap.Logger) (*DB, error) {
+	return initDB(conf, logger, true)
+}
 
-	ossCli, err := minio.New(conf.OssConf.Server, &minio.Options{
-		Creds:  credentials.NewStaticV4(conf.OssConf.Account, conf.OssConf.Secret, ""),
-		Secure: false,
-	})
+func initDB(conf *conf.GConfig, logger *zap.Logger, readOnly bool) (*DB, error) {
+	var ctx = context.Background()
+	db := &DB{
+		aqiConf:  &atomic.Value{},
+		cache:    freecache.NewCache(20 * 1024 * 1024),
+		log:      logger.Named("\u001B[33m[db]\u001B[0m"),
+		ctx:      ctx,
+		stations: &stationList{},
+		tiles:    newTileCache(),
+		tick:     time.NewTicker(time.Minute * 9),
+		done:     make(chan bool),
+	}
+	db.aqiConf.Store(conf.AQIConf)
+	if _, err := RankingLocation(conf.AQIConf.RankingTz); err != nil {
+		return nil, errors.New("unknown ranking_tz " + conf.AQIConf.RankingTz)
+	}
+	regions, err := LoadRegions(conf.AQIConf.Regions)
 	if err != nil {
 		return nil, err
 	}
+	db.regions = regions
+	if len(regions) > 0 {
+		db.log.Info("load regions success", zap.Int("count", len(regions)))
+	}
+	backend := "elastic"
+	if conf.StoreConf != nil && conf.StoreConf.Backend != "" {
+		backend = conf.StoreConf.Backend
+	}
+	switch backend {
+	case "elastic":
+		poolEs, factory := elastic.InitEsPool(ctx, conf.ESConf)
+		elasticApi := &elastic.EsAPI{
+			Log:            logger.Sugar().Named("\u001B[33m[ES]\u001B[0m"),
+			EsPool:         poolEs,
+			Factory:        factory,
+			FailQueueFile:  conf.ESConf.FailQueueFile,
+			DeadLetterFile: conf.ESConf.DeadLetterFile,
+			RetryMax:       conf.ESConf.FailRetryMax,
+			RetryBackoff:   time.Duration(conf.ESConf.FailRetryBackoff) * time.Second,
+			ReadOnly:       readOnly,
+		}
+		elasticApi.Init()
 
-	cache := freecache.NewCache(20 * 1024 * 1024)
-
-	return &DB{
-		Conf:  conf.AQIConf,
-		api:   elasticApi,
-		pool:  poolEs,
-		cache: cache,
-		log:   logger.Named("\u001B[33m[db]\u001B[0m"),
-		ctx:   ctx,
-		oss:   ossCli,
-	}, nil
+		transport, err := minio.DefaultTransport(false)
+		if err != nil {
+			return nil, err
+		}
+		ossCli, err := minio.New(conf.OssConf.Server, &minio.Options{
+			Creds:     credentials.NewStaticV4(conf.OssConf.Account, conf.OssConf.Secret, ""),
+			Secure:    false,
+			Transport: transport,
+		})
+		if err != nil {
+			return nil, err
+		}
+		esStore := NewEsStore(db.Conf, elasticApi, db.log)
+		db.StationStore = esStore
+		db.StationWriter = esStore
+		db.AuditStore = esStore
+		db.RealtimeStore = esStore
+		db.HistoryStore = esStore
+		db.CompareStore = esStore
+		db.AlertStore = esStore
+		db.ObjectStore = NewMinioStore(ossCli, transport)
+		if !readOnly {
+			esStore.CreateAlertIndices()
+			esStore.CreateAuditIndex()
+		}
+		db.api = elasticApi
+		db.pool = poolEs
+	case "memory":
+		dataDir := conf.StoreConf.DataDir
+		if dataDir == "" {
+			dataDir = "data"
+		}
+		objectDir := conf.StoreConf.ObjectDir
+		if objectDir == "" {
+			objectDir = filepath.Join(dataDir, "objects")
+		}
+		memStore, err := NewMemoryStore(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		db.StationStore = memStore
+		db.StationWriter = memStore
+		db.AuditStore = NewFileAuditStore(dataDir)
+		db.RealtimeStore = memStore
+		db.HistoryStore = memStore
+		db.CompareStore = memStore
+		db.AlertStore = NewFileAlertStore(dataDir)
+		db.ObjectStore = NewFileObjectStore(objectDir)
+	default:
+		return nil, errors.New("unknown store backend " + backend)
+	}
+	return db, nil
 }
 
 func (db *DB) RefreshCache() {
 	db.loadStations()
 	go func() {
+		retry := time.NewTicker(time.Second * 10)
+		defer retry.Stop()
 		for {
 			select {
-			case <-tick.C:
+			case <-db.done:
+				return
+			case <-db.tick.C:
 				db.loadStations()
+			case <-retry.C:
+				// a server started before its store is up stays unready until the first load
+				if db.StationsLoaded().IsZero() {
+					db.loadStations()
+				}
 			}
 		}
 	}()
@@ -90,6 +197,10 @@ func (db *DB) loadStations() {
 		}
 		_ = db.cache.Set([]byte(st.Sid), stb, 600)
 	}
+	db.stations.lock.Lock()
+	db.stations.list = stations
+	db.stations.loaded = time.Now()
+	db.stations.lock.Unlock()
 	defer func() {
 		stations = nil
 		runtime.GC()
@@ -97,8 +208,61 @@ func (db *DB) loadStations() {
 	db.log.Info("refresh stations cache success")
 }
 
+// GetCachedStations returns the station list of the last cache refresh without decoding the cache entries
+func (db *DB) GetCachedStations() []AqiStationResp {
+	db.stations.lock.RLock()
+	defer db.stations.lock.RUnlock()
+	return db.stations.list
+}
+
+// Conf returns the aqi config in effect, callers must not keep it across requests as a reload replaces it
+func (db *DB) Conf() *conf.AQIConfig {
+	return db.aqiConf.Load().(*conf.AQIConfig)
+}
+
+// StationsLoaded returns the time of the last successful station cache refresh, zero before the first
+func (db *DB) StationsLoaded() time.Time {
+	db.stations.lock.RLock()
+	defer db.stations.lock.RUnlock()
+	return db.stations.loaded
+}
+
+// Stats is a snapshot of the station cache and, on the elastic backend, of the es api
+type Stats struct {
+	CacheEntries   int64
+	CacheHits      int64
+	CacheMisses    int64
+	CacheEvictions int64
+	CacheExpired   int64
+	Es             *elastic.ApiStats
+}
+
+func (db *DB) Stats() Stats {
+	stats := Stats{
+		CacheEntries:   db.cache.EntryCount(),
+		CacheHits:      db.cache.HitCount(),
+		CacheMisses:    db.cache.MissCount(),
+		CacheEvictions: db.cache.EvacuateCount(),
+		CacheExpired:   db.cache.ExpiredCount(),
+	}
+	if db.api != nil {
+		esStats := db.api.Stats()
+		stats.Es = &esStats
+	}
+	return stats
+}
+
+// Close stops the station cache refresh, flushes the es bulk indexer and closes the es pool and the minio connections
 func (db *DB) Close() {
-	tick.Stop()
-	db.api.Close()
-	db.pool.Close(db.ctx)
+	db.tick.Stop()
+	close(db.done)
+	if db.api != nil {
+		db.api.Close()
+	}
+	if db.pool != nil {
+		db.pool.Close(db.ctx)
+	}
+	if store, ok := db.ObjectStore.(*MinioStore); ok {
+		store.Close()
+	}
 }
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const earthRadiusKm = 6371.0088
+
+type PointStation struct {
+	Sid      string   `json:"sid"`
+	Name     string   `json:"name"`
+	Loc      GeoPoint `json:"loc"`
+	Distance float64  `json:"distance"`
+	Weight   float64  `json:"weight"`
+}
+
+type PointValue struct {
+	Pol        string  `json:"pol"`
+	Data       float64 `json:"data"`
+	Stations   int     `json:"stations"`
+	Confidence float64 `json:"confidence"`
+}
+
+type PointRealtimeResp struct {
+	Loc        GeoPoint       `json:"loc"`
+	Method     string         `json:"method"`
+	Power      float64        `json:"power"`
+	Realtime   []PointValue   `json:"realtime"`
+	Aqi        *AqiIndex      `json:"aqi"`
+	Confidence float64        `json:"confidence"`
+	Stations   []PointStation `json:"stations"`
+}
+
+// InterpolateRealtime estimates pollutant values at a location by inverse distance weighting
+// the realtime values of the k nearest stations within radius kilometers.
+func (db *DB) InterpolateRealtime(lon float64, lat float64, k int, radius float64, power float64) (*PointRealtimeResp, error) {
+	db, span := db.startSpan("InterpolateRealtime", attribute.Int("k", k))
+	defer span.End()
+	x := strconv.FormatFloat(lon, 'f', 8, 64)
+	y := strconv.FormatFloat(lat, 'f', 8, 64)
+	sts, err := db.SearchStationByRadius(x, y, radius, "km", k)
+	if err != nil {
+		db.log.Error("InterpolateRealtime(). db.SearchStationByRadius(). err:", zap.Error(err))
+		return nil, err
+	}
+	if len(sts) == 0 {
+		return nil, nil
+	}
+	rts := make([]*RealtimeResp, len(sts))
+	var wg sync.WaitGroup
+	for i, st := range sts {
+		wg.Add(1)
+		go func(i int, sid string) {
+			defer wg.Done()
+			rt, err := db.GetAqiRealtimeById(sid)
+			if err != nil {
+				db.log.Warn("InterpolateRealtime(). db.GetAqiRealtimeById(). err:", zap.String("sid", sid), zap.Error(err))
+				return
+			}
+			rts[i] = rt
+		}(i, st.Sid)
+	}
+	wg.Wait()
+
+	response := &PointRealtimeResp{
+		Loc:      GeoPoint{Lon: lon, Lat: lat},
+		Method:   "idw",
+		Power:    power,
+		Realtime: []PointValue{},
+		Stations: []PointStation{},
+	}
+	weights := make([]float64, len(sts))
+	sumWeight := 0.0
+	for i, st := range sts {
+		dis := Haversine(lon, lat, st.Loc.Lon, st.Loc.Lat)
+		// clamp to 1m so a station at the location dominates instead of dividing by zero
+		weights[i] = 1 / math.Pow(math.Max(dis, 0.001), power)
+		if rts[i] != nil && len(rts[i].Realtime) > 0 {
+			sumWeight += weights[i]
+		}
+		response.Stations = append(response.Stations, PointStation{
+			Sid:      st.Sid,
+			Name:     st.Name,
+			Loc:      st.Loc,
+			Distance: math.Round(dis*1000) / 1000,
+		})
+	}
+	type acc struct {
+		sumW   float64
+		sumV   float64
+		sumD   float64
+		counts int
+	}
+	polAcc := map[string]*acc{}
+	for i := range sts {
+		if rts[i] == nil || len(rts[i].Realtime) == 0 {
+			continue
+		}
+		response.Stations[i].Weight = math.Round(weights[i]/sumWeight*10000) / 10000
+		for _, info := range rts[i].Realtime {
+			a, ok := polAcc[info.Pol]
+			if !ok {
+				a = &acc{}
+				polAcc[info.Pol] = a
+			}
+			a.sumW += weights[i]
+			a.sumV += weights[i] * info.Data
+			a.sumD += weights[i] * response.Stations[i].Distance
+			a.counts++
+		}
+	}
+	values := map[string]float64{}
+	confSum := 0.0
+	for pol, a := range polAcc {
+		val := math.Round(a.sumV/a.sumW*10) / 10
+		conf := confidence(a.sumD/a.sumW, radius, a.counts)
+		values[pol] = val
+		confSum += conf
+		response.Realtime = append(response.Realtime, PointValue{
+			Pol:        pol,
+			Data:       val,
+			Stations:   a.counts,
+			Confidence: conf,
+		})
+	}
+	sort.Slice(response.Realtime, func(i, j int) bool {
+		return response.Realtime[i].Pol < response.Realtime[j].Pol
+	})
+	if len(polAcc) > 0 {
+		response.Confidence = math.Round(confSum/float64(len(polAcc))*100) / 100
+		response.Aqi = CalcAqi(db.Conf().AqiStandard, values)
+	}
+	return response, nil
+}
+
+// confidence scores an estimate between 0 and 1, dropping with the weighted distance
+// to the contributing stations and rising with their number up to three
+func confidence(weightedDis float64, radius float64, count int) float64 {
+	near := math.Max(0, 1-weightedDis/radius)
+	support := math.Min(1, float64(count)/3)
+	return math.Round(near*support*100) / 100
+}
+
+// Haversine returns the great circle distance between two lon/lat points in kilometers
+func Haversine(lon1 float64, lat1 float64, lon2 float64, lat2 float64) float64 {
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
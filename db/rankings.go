@@ -0,0 +1,138 @@
+package db
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+type RankingItem struct {
+	Rank     int      `json:"rank"`
+	Name     string   `json:"name"`
+	Value    float64  `json:"value"`
+	Iaqi     int      `json:"iaqi"`
+	Stations int      `json:"stations"`
+	Centroid GeoPoint `json:"centroid"`
+}
+
+type RankingsResp struct {
+	Level    string        `json:"level"`
+	Pol      string        `json:"pol"`
+	Agg      string        `json:"agg"`
+	Period   string        `json:"period"`
+	Start    int64         `json:"start,omitempty"`
+	End      int64         `json:"end,omitempty"`
+	Order    string        `json:"order"`
+	Total    int           `json:"total"`
+	Rankings []RankingItem `json:"rankings"`
+}
+
+// RankingLocation returns the zone of the day and month rankings for the ranking_tz setting,
+// an iana name or an offset like +08:00, empty is utc
+func RankingLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.UTC, nil
+	}
+	if t, err := time.Parse("-07:00", tz); err == nil {
+		_, offset := t.Zone()
+		return time.FixedZone(tz, offset), nil
+	}
+	return time.LoadLocation(tz)
+}
+
+// GetRankings ranks cities by the avg or max of their station values, the station values are aggregated by the store
+// from realtime when period is realtime or from history between st and et, and grouped by city here
+func (db *DB) GetRankings(level string, pol string, agg string, period string, st time.Time, et time.Time, order string, limit int) (*RankingsResp, error) {
+	db, span := db.startSpan("GetRankings", attribute.String("level", level), attribute.String("pol", pol), attribute.String("period", period))
+	defer span.End()
+	var values map[string]float64
+	var err error
+	if period == "realtime" {
+		values, err = db.AggregateRealtime(pol, agg)
+	} else {
+		values, err = db.AggregateStations(pol, st, et, agg)
+	}
+	if err != nil {
+		db.log.Error("GetRankings(). aggregate station values err:", zap.String("period", period), zap.Error(err))
+		return nil, err
+	}
+	stations := db.GetCachedStations()
+	if len(stations) == 0 {
+		stations, err = db.GetAllStations()
+		if err != nil {
+			db.log.Error("GetRankings(). db.GetAllStations(). err:", zap.Error(err))
+			return nil, err
+		}
+	}
+	type group struct {
+		item   RankingItem
+		sumVal float64
+		sumLon float64
+		sumLat float64
+	}
+	groups := map[string]*group{}
+	for _, st := range stations {
+		val, ok := values[st.Sid]
+		if !ok || st.CityName == "" {
+			continue
+		}
+		g, ok := groups[st.CityName]
+		if !ok {
+			g = &group{item: RankingItem{Name: st.CityName, Value: math.Inf(-1)}}
+			groups[st.CityName] = g
+		}
+		g.item.Stations++
+		g.sumVal += val
+		g.sumLon += st.Loc.Lon
+		g.sumLat += st.Loc.Lat
+		if val > g.item.Value {
+			g.item.Value = val
+		}
+	}
+	response := &RankingsResp{
+		Level:    level,
+		Pol:      pol,
+		Agg:      agg,
+		Period:   period,
+		Order:    order,
+		Total:    len(groups),
+		Rankings: []RankingItem{},
+	}
+	if period != "realtime" {
+		response.Start = st.UnixMilli()
+		response.End = et.UnixMilli()
+	}
+	for _, g := range groups {
+		n := float64(g.item.Stations)
+		if agg != "max" {
+			g.item.Value = g.sumVal / n
+		}
+		g.item.Value = math.Round(g.item.Value*10) / 10
+		g.item.Iaqi = SubIndex(db.Conf().AqiStandard, pol, g.item.Value)
+		g.item.Centroid = GeoPoint{
+			Lon: math.Round(g.sumLon/n*1e6) / 1e6,
+			Lat: math.Round(g.sumLat/n*1e6) / 1e6,
+		}
+		response.Rankings = append(response.Rankings, g.item)
+	}
+	sort.Slice(response.Rankings, func(i, j int) bool {
+		a, b := response.Rankings[i], response.Rankings[j]
+		if a.Value != b.Value {
+			if order == "best" {
+				return a.Value < b.Value
+			}
+			return a.Value > b.Value
+		}
+		return a.Name < b.Name
+	})
+	if len(response.Rankings) > limit {
+		response.Rankings = response.Rankings[:limit]
+	}
+	for i := range response.Rankings {
+		response.Rankings[i].Rank = i + 1
+	}
+	return response, nil
+}
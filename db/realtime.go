@@ -1,12 +1,7 @@
 package db
 
 import (
-	"strconv"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 )
 
@@ -51,6 +46,7 @@ type ForecastResp struct {
 	Loc      GeoPoint                  `json:"loc"`
 	CityName string                    `json:"city_name"`
 	Forecast map[string][]ForecastItem `json:"forecast"`
+	Aqi      map[string]*AqiIndex      `json:"aqi"`
 	Tz       string                    `json:"tz"`
 	Tm       int64                     `json:"tm"`
 	Tms      string                    `json:"tms"`
@@ -64,11 +60,18 @@ type RealtimeResp struct {
 	CityName string         `json:"city_name"`
 	Realtime []RealtimeInfo `json:"realtime"`
 	MainPol  string         `json:"main_pol"`
+	Aqi      *AqiIndex      `json:"aqi"`
 	Tz       string         `json:"tz"`
 	Tm       int64          `json:"tm"`
 	Tms      string         `json:"tms"`
 }
 
+// StationAqi is the realtime index of a station with the latest value of each pollutant it is rated from
+type StationAqi struct {
+	Aqi    int
+	Values map[string]float64
+}
+
 type RealtimeStMap struct {
 	RealTimeMap map[string]float64
 }
@@ -109,32 +112,70 @@ type RealtimeSearchResponse struct {
 	} `json:"hits"`
 }
 
+func buildForecastAqi(std string, forecast map[string][]ForecastItem) map[string]*AqiIndex {
+	days := map[string]map[string]float64{}
+	for pol, items := range forecast {
+		for _, item := range items {
+			if _, ok := days[item.Day]; !ok {
+				days[item.Day] = map[string]float64{}
+			}
+			days[item.Day][pol] = item.Avg
+		}
+	}
+	aqi := map[string]*AqiIndex{}
+	for day, values := range days {
+		if idx := CalcAqi(std, values); idx != nil {
+			aqi[day] = idx
+		}
+	}
+	return aqi
+}
+
 func (db *DB) GetAllAqiRealtime() (*RealtimeStMap, error) {
-	response := &RealtimeStMap{
-		RealTimeMap: map[string]float64{},
+	db, span := db.startSpan("GetAllAqiRealtime")
+	defer span.End()
+	values, err := db.GetRealtimeMax()
+	if err != nil {
+		db.log.Error("GetAllAqiRealtime(). db.GetRealtimeMax(). err:", zap.Error(err))
+		return nil, err
 	}
-	var wg sync.WaitGroup
-	mu := sync.Mutex{}
-	for _, s := range []int{0, 8000} {
-		wg.Add(1)
-		go func(st int) {
-			defer wg.Done()
-			realResp, err := db.getHalfRealtimeStation(st, st+8000)
-			if err != nil {
-				return
-			}
-			mu.Lock()
-			for _, item := range realResp.Aggregations.Buckets.Buckets {
-				response.RealTimeMap[item.Key] = item.Data.Value
+	return &RealtimeStMap{
+		RealTimeMap: values,
+	}, nil
+}
+
+// RealtimeAqi rates the latest values of every station with the configured standard, the values come
+// from a max aggregation per pollutant
+func (db *DB) RealtimeAqi() (map[string]StationAqi, error) {
+	db, span := db.startSpan("RealtimeAqi")
+	defer span.End()
+	values := map[string]map[string]float64{}
+	for _, pol := range pols {
+		polValues, err := db.AggregateRealtime(pol, "max")
+		if err != nil {
+			db.log.Error("RealtimeAqi(). db.AggregateRealtime(). err:", zap.Error(err))
+			return nil, err
+		}
+		for sid, val := range polValues {
+			if values[sid] == nil {
+				values[sid] = map[string]float64{}
 			}
-			mu.Unlock()
-		}(s)
+			values[sid][pol] = val
+		}
 	}
-	wg.Wait()
-	return response, nil
+	std := db.Conf().AqiStandard
+	aqi := make(map[string]StationAqi, len(values))
+	for sid, stValues := range values {
+		if idx := CalcAqi(std, stValues); idx != nil {
+			aqi[sid] = StationAqi{Aqi: idx.Aqi, Values: stValues}
+		}
+	}
+	return aqi, nil
 }
 
 func (db *DB) GetAqiRealtimeById(sid string) (*RealtimeResp, error) {
+	db, span := db.startSpan("GetAqiRealtimeById", attribute.String("sid", sid))
+	defer span.End()
 	st, err := db.getStationFromCache(sid)
 	if err != nil || st == nil {
 		return nil, err
@@ -146,66 +187,39 @@ func (db *DB) GetAqiRealtimeById(sid string) (*RealtimeResp, error) {
 		Loc:      st.Loc,
 		CityName: st.CityName,
 	}
-
-	size := 10
-	query := `{
-        "query": {
-            "match": {
-                "sid": ` + sid + `
-            }
-       }
-    }`
-	search := &esapi.SearchRequest{
-		Index:          []string{db.Conf.RealtimeIndex},
-		Body:           strings.NewReader(query),
-		Size:           &size,
-		SourceExcludes: []string{"forecast"},
-		Timeout:        20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	var esSearchResp RealtimeSearchResponse
+	rtList, err := db.GetRealtimeBySid(sid, "forecast")
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return response, nil
-		}
-		db.log.Error("GetAqiRealtimeById(). es.ProcessRespWithCli(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
-		return nil, err
-	}
-	defer func() {
-		resp = nil
-	}()
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		db.log.Error("GetAqiRealtimeById(). json.Unmarshal(). err:", zap.Error(err))
+		db.log.Error("GetAqiRealtimeById(). db.GetRealtimeBySid(). err:", zap.Error(err))
 		return nil, err
 	}
 	var rts []RealtimeInfo
-	maxVal := -1.0
-	mainPol := ""
-	if esSearchResp.Hits.Total.Value > 0 {
-		for _, item := range esSearchResp.Hits.Hits {
+	values := map[string]float64{}
+	if len(rtList) > 0 {
+		for _, item := range rtList {
 			info := RealtimeInfo{
-				Pol:   item.Source.Pol,
-				Data:  item.Source.Data,
-				Daily: item.Source.Daily,
-			}
-			if item.Source.Data > maxVal {
-				maxVal = item.Source.Data
-				mainPol = item.Source.Pol
+				Pol:   item.Pol,
+				Data:  item.Data,
+				Daily: item.Daily,
 			}
+			values[item.Pol] = item.Data
 			rts = append(rts, info)
 		}
 		response.Realtime = rts
-		response.Tz = esSearchResp.Hits.Hits[0].Source.Tz
-		response.Tm = esSearchResp.Hits.Hits[0].Source.Tm
-		response.Tms = esSearchResp.Hits.Hits[0].Source.Tms
-		response.MainPol = mainPol
+		response.Tz = rtList[0].Tz
+		response.Tm = rtList[0].Tm
+		response.Tms = rtList[0].Tms
+		response.Aqi = CalcAqi(db.Conf().AqiStandard, values)
+		if response.Aqi != nil {
+			response.MainPol = response.Aqi.MainPol
+		}
 		return response, nil
 	}
 	return response, nil
 }
 
 func (db *DB) GetAqiRealtimeByIdAndPol(sid string, pol string) (*RealtimeResp, error) {
+	db, span := db.startSpan("GetAqiRealtimeByIdAndPol", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	st, err := db.getStationFromCache(sid)
 	if err != nil || st == nil {
 		return nil, err
@@ -218,43 +232,29 @@ func (db *DB) GetAqiRealtimeByIdAndPol(sid string, pol string) (*RealtimeResp, e
 		CityName: st.CityName,
 		Realtime: []RealtimeInfo{},
 	}
-	search := &esapi.GetRequest{
-		Index:          db.Conf.RealtimeIndex,
-		DocumentID:     "rt_" + sid + "$" + pol,
-		SourceExcludes: []string{"forecast"},
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	defer func() {
-		resp = nil
-	}()
+	rt, err := db.GetRealtimeBySidAndPol(sid, pol)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return infoResp, nil
-		}
-		db.log.Error("GetAqiRealtimeByIdAndPol(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		db.log.Error("GetAqiRealtimeByIdAndPol(). db.GetRealtimeBySidAndPol(). err:", zap.Error(err))
 		return nil, err
 	}
-	var response RealtimeGetResponse
-	err = json.Unmarshal(resp, &response)
-	if err != nil {
-		db.log.Error("GetAqiRealtimeByIdAndPol(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-	if response.Found {
+	if rt != nil {
 		info := RealtimeInfo{
-			Pol:   response.Source.Pol,
-			Data:  response.Source.Data,
-			Daily: response.Source.Daily,
+			Pol:   rt.Pol,
+			Data:  rt.Data,
+			Daily: rt.Daily,
 		}
 		infoResp.Realtime = []RealtimeInfo{info}
-		infoResp.Tz = response.Source.Tz
-		infoResp.Tm = response.Source.Tm
-		infoResp.Tms = response.Source.Tms
+		infoResp.Aqi = CalcAqi(db.Conf().AqiStandard, map[string]float64{info.Pol: info.Data})
+		infoResp.Tz = rt.Tz
+		infoResp.Tm = rt.Tm
+		infoResp.Tms = rt.Tms
 	}
 	return infoResp, nil
 }
 
 func (db *DB) GetForecast(sid string, pol string) (*ForecastResp, error) {
+	db, span := db.startSpan("GetForecast", attribute.String("sid", sid), attribute.String("pol", pol))
+	defer span.End()
 	st, err := db.getStationFromCache(sid)
 	if err != nil || st == nil {
 		return nil, err
@@ -266,42 +266,13 @@ func (db *DB) GetForecast(sid string, pol string) (*ForecastResp, error) {
 		Loc:      st.Loc,
 		CityName: st.CityName,
 	}
-
-	size := 10
-	query := `{
-        "query": {
-            "match": {
-                "sid": ` + sid + `
-            }
-       }
-    }`
-	search := &esapi.SearchRequest{
-		Index:          []string{db.Conf.RealtimeIndex},
-		Body:           strings.NewReader(query),
-		Size:           &size,
-		SourceExcludes: []string{"data", "pol", "daily"},
-		Timeout:        20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	var esSearchResp RealtimeSearchResponse
+	rtList, err := db.GetRealtimeBySid(sid, "data", "pol", "daily")
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return response, nil
-		}
-		db.log.Error("GetForecast(). es.ProcessRespWithCli(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
+		db.log.Error("GetForecast(). db.GetRealtimeBySid(). err:", zap.Error(err))
 		return nil, err
 	}
-	defer func() {
-		resp = nil
-	}()
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		db.log.Error("GetForecast(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-
-	if esSearchResp.Hits.Total.Value > 0 {
-		forecastStr := esSearchResp.Hits.Hits[0].Source.Forecast
+	if len(rtList) > 0 {
+		forecastStr := rtList[0].Forecast
 		var forecastSource ForecastInfo
 		err = json.Unmarshal([]byte(forecastStr), &forecastSource)
 		if err != nil {
@@ -313,63 +284,11 @@ func (db *DB) GetForecast(sid string, pol string) (*ForecastResp, error) {
 		} else {
 			response.Forecast = map[string][]ForecastItem{pol: forecastSource.Daily[pol]}
 		}
-		response.Tz = esSearchResp.Hits.Hits[0].Source.Tz
-		response.Tm = esSearchResp.Hits.Hits[0].Source.Tm
-		response.Tms = esSearchResp.Hits.Hits[0].Source.Tms
+		response.Aqi = buildForecastAqi(db.Conf().AqiStandard, response.Forecast)
+		response.Tz = rtList[0].Tz
+		response.Tm = rtList[0].Tm
+		response.Tms = rtList[0].Tms
 		return response, nil
 	}
 	return response, nil
 }
-
-func (db *DB) getHalfRealtimeStation(from int, to int) (*RealtimeAggResponse, error) {
-	query := `{
-        "query": {
-            "bool": {
-                "must": {
-                    "range": {
-                        "idx": {
-                            "lt": ` + strconv.Itoa(to) + `,
-                            "gte": ` + strconv.Itoa(from) + `
-                        }
-                    }
-                }
-            }
-        },
-        "aggs": {
-            "buckets": {
-                "terms": {
-                    "field": "sid",
-                    "order": {
-                        "data": "desc"
-                    },
-                    "size": 20000
-                },
-                "aggs": {
-                    "data": {
-                        "max": {
-                            "field": "data"
-                        }
-                    }
-                }
-            }
-        }
-    }`
-	size := 0
-	search := &esapi.SearchRequest{
-		Index:          []string{db.Conf.RealtimeIndex},
-		Body:           strings.NewReader(query),
-		Size:           &size,
-		SourceExcludes: []string{"forecast", "daily"},
-		Timeout:        20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	if err != nil {
-		return nil, err
-	}
-	var respEs RealtimeAggResponse
-	err = json.Unmarshal(resp, &respEs)
-	if err != nil {
-		return nil, err
-	}
-	return &respEs, nil
-}
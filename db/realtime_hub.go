@@ -0,0 +1,259 @@
+package db
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type RealtimeDiff struct {
+	Event   string             `json:"event"`
+	Tm      int64              `json:"tm"`
+	Changed map[string]float64 `json:"changed"`
+	Removed []string           `json:"removed"`
+}
+
+type RealtimeSub struct {
+	sids map[string]bool
+	C    chan *RealtimeDiff
+}
+
+// RealtimeHub polls the realtime index once for all subscribers and fans out the changes. It also keeps
+// the aqi of every station for the map layers, refreshed by its ticker while they are read
+type RealtimeHub struct {
+	db       *DB
+	log      *zap.Logger
+	interval time.Duration
+	lock     sync.RWMutex
+	subs     map[*RealtimeSub]bool
+	last     map[string]float64
+	lastTm   int64
+	// pollLock lets one realtime poll run at a time, polled is when the last one ended
+	pollLock sync.Mutex
+	polled   time.Time
+	aqi      map[string]StationAqi
+	// aqiRead is set by AqiSnapshot and aqiPolling while the aqi is polled, both used atomically
+	aqiRead    int32
+	aqiPolling int32
+	ticker     *time.Ticker
+	done       chan bool
+	closed     bool
+}
+
+func (db *DB) NewRealtimeHub() *RealtimeHub {
+	interval := time.Duration(db.Conf().StreamInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &RealtimeHub{
+		db:       db,
+		log:      db.log.Named("[hub]"),
+		interval: interval,
+		subs:     map[*RealtimeSub]bool{},
+		done:     make(chan bool),
+	}
+}
+
+func (h *RealtimeHub) Start() {
+	h.ticker = time.NewTicker(h.interval)
+	go func() {
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-h.ticker.C:
+				h.lock.RLock()
+				count := len(h.subs)
+				h.lock.RUnlock()
+				if count > 0 {
+					h.refresh(true)
+				}
+				if atomic.SwapInt32(&h.aqiRead, 0) == 1 {
+					h.pollAqi()
+				}
+			}
+		}
+	}()
+}
+
+// Close ends the subscriptions, it can be called more than once
+func (h *RealtimeHub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	if h.ticker != nil {
+		h.ticker.Stop()
+	}
+	close(h.done)
+	for sub := range h.subs {
+		close(sub.C)
+		delete(h.subs, sub)
+	}
+}
+
+// Subscribe registers a subscriber for the given stations, nil sids means all stations.
+// The first message on the channel is a snapshot of the current values.
+func (h *RealtimeHub) Subscribe(sids []string) *RealtimeSub {
+	sub := &RealtimeSub{
+		C: make(chan *RealtimeDiff, 16),
+	}
+	if sids != nil {
+		sub.sids = map[string]bool{}
+		for _, sid := range sids {
+			sub.sids[sid] = true
+		}
+	}
+	h.refresh(false)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	sub.C <- sub.filter(&RealtimeDiff{
+		Event:   "snapshot",
+		Tm:      h.lastTm,
+		Changed: h.last,
+		Removed: []string{},
+	})
+	if h.closed {
+		// the server is shutting down, the stream ends after the snapshot
+		close(sub.C)
+		return sub
+	}
+	h.subs[sub] = true
+	return sub
+}
+
+func (h *RealtimeHub) Unsubscribe(sub *RealtimeSub) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.C)
+	}
+}
+
+// refresh polls when the snapshot is missing or older than the interval, as it is after the subscribers
+// have been gone for a while. Callers arriving while a poll runs wait for it and share its result instead
+// of polling again, force polls whatever the age for the ticker
+func (h *RealtimeHub) refresh(force bool) {
+	called := time.Now()
+	h.pollLock.Lock()
+	defer h.pollLock.Unlock()
+	if h.polled.After(called) {
+		return
+	}
+	if !force {
+		h.lock.RLock()
+		fresh := h.last != nil && time.Since(time.UnixMilli(h.lastTm)) < h.interval
+		h.lock.RUnlock()
+		if fresh {
+			return
+		}
+	}
+	h.poll()
+	h.polled = time.Now()
+}
+
+func (h *RealtimeHub) poll() {
+	rt, err := h.db.GetAllAqiRealtime()
+	if err != nil || len(rt.RealTimeMap) == 0 {
+		h.log.Warn("poll realtime failed or empty, skip this round")
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	diff := &RealtimeDiff{
+		Event:   "diff",
+		Tm:      time.Now().UnixMilli(),
+		Changed: map[string]float64{},
+		Removed: []string{},
+	}
+	for sid, val := range rt.RealTimeMap {
+		if pre, ok := h.last[sid]; !ok || pre != val {
+			diff.Changed[sid] = val
+		}
+	}
+	for sid := range h.last {
+		if _, ok := rt.RealTimeMap[sid]; !ok {
+			diff.Removed = append(diff.Removed, sid)
+		}
+	}
+	h.last = rt.RealTimeMap
+	h.lastTm = diff.Tm
+	if len(diff.Changed) == 0 && len(diff.Removed) == 0 {
+		return
+	}
+	for sub := range h.subs {
+		msg := sub.filter(diff)
+		if len(msg.Changed) == 0 && len(msg.Removed) == 0 {
+			continue
+		}
+		select {
+		case sub.C <- msg:
+		default:
+			// a dropped diff leaves the client inconsistent, close it so it resubscribes for a snapshot
+			h.log.Warn("realtime subscriber too slow, close it")
+			delete(h.subs, sub)
+			close(sub.C)
+		}
+	}
+}
+
+func (s *RealtimeSub) filter(diff *RealtimeDiff) *RealtimeDiff {
+	if s.sids == nil {
+		return diff
+	}
+	msg := &RealtimeDiff{
+		Event:   diff.Event,
+		Tm:      diff.Tm,
+		Changed: map[string]float64{},
+		Removed: []string{},
+	}
+	for sid, val := range diff.Changed {
+		if s.sids[sid] {
+			msg.Changed[sid] = val
+		}
+	}
+	for _, sid := range diff.Removed {
+		if s.sids[sid] {
+			msg.Removed = append(msg.Removed, sid)
+		}
+	}
+	return msg
+}
+
+// AqiSnapshot returns the aqi of the last poll without waiting for elasticsearch. Before the first
+// poll it is nil and one poll starts in the background, the ticker refreshes it later on
+func (h *RealtimeHub) AqiSnapshot() map[string]StationAqi {
+	atomic.StoreInt32(&h.aqiRead, 1)
+	h.lock.RLock()
+	aqi := h.aqi
+	h.lock.RUnlock()
+	if aqi == nil {
+		go h.pollAqi()
+	}
+	return aqi
+}
+
+// pollAqi refreshes the aqi of every station, a poll already running makes it return at once
+func (h *RealtimeHub) pollAqi() {
+	if !atomic.CompareAndSwapInt32(&h.aqiPolling, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&h.aqiPolling, 0)
+	aqi, err := h.db.RealtimeAqi()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err != nil || len(aqi) == 0 {
+		h.log.Warn("poll realtime aqi failed or empty, skip this round")
+		// a failed first poll leaves the retry to the ticker instead of the next request
+		if h.aqi == nil {
+			h.aqi = map[string]StationAqi{}
+		}
+		return
+	}
+	h.aqi = aqi
+}
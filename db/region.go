@@ -0,0 +1,146 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrRegionNotFound = errors.New("region not found")
+	ErrBadPolygon     = errors.New("geometry must be a valid GeoJSON Polygon or MultiPolygon")
+)
+
+// Region is a named boundary like a province or district, matched by id or name case insensitively
+type Region struct {
+	Id      string     `json:"id"`
+	Name    string     `json:"name"`
+	Bbox    [4]float64 `json:"bbox"`
+	polygon orb.MultiPolygon
+}
+
+// LoadRegions reads the features of a GeoJSON FeatureCollection as regions, features which are not
+// polygons are skipped and the id falls back to the feature id when the id property is missing
+func LoadRegions(cfg *conf.RegionConfig) ([]*Region, error) {
+	if cfg == nil || cfg.File == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		return nil, err
+	}
+	idKey := cfg.IdProperty
+	if idKey == "" {
+		idKey = "id"
+	}
+	nameKey := cfg.NameProperty
+	if nameKey == "" {
+		nameKey = "name"
+	}
+	var regions []*Region
+	for i, f := range fc.Features {
+		polygon, err := toMultiPolygon(f.Geometry)
+		if err != nil {
+			continue
+		}
+		id := f.Properties.MustString(idKey, "")
+		if id == "" && f.ID != nil {
+			id = fmt.Sprint(f.ID)
+		}
+		if id == "" {
+			return nil, fmt.Errorf("region feature %d has no %s property or id", i, idKey)
+		}
+		bound := polygon.Bound()
+		regions = append(regions, &Region{
+			Id:      id,
+			Name:    f.Properties.MustString(nameKey, id),
+			Bbox:    [4]float64{bound.Left(), bound.Bottom(), bound.Right(), bound.Top()},
+			polygon: polygon,
+		})
+	}
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].Id < regions[j].Id
+	})
+	return regions, nil
+}
+
+// ParsePolygon parses a GeoJSON Polygon or MultiPolygon geometry with lon/lat coordinates
+func ParsePolygon(data []byte) (orb.MultiPolygon, error) {
+	g, err := geojson.UnmarshalGeometry(data)
+	if err != nil {
+		return nil, ErrBadPolygon
+	}
+	return toMultiPolygon(g.Geometry())
+}
+
+func toMultiPolygon(g orb.Geometry) (orb.MultiPolygon, error) {
+	var mp orb.MultiPolygon
+	switch geo := g.(type) {
+	case orb.Polygon:
+		mp = orb.MultiPolygon{geo}
+	case orb.MultiPolygon:
+		mp = geo
+	default:
+		return nil, ErrBadPolygon
+	}
+	if len(mp) == 0 {
+		return nil, ErrBadPolygon
+	}
+	for _, polygon := range mp {
+		if len(polygon) == 0 {
+			return nil, ErrBadPolygon
+		}
+		for _, ring := range polygon {
+			if len(ring) < 4 || !ring.Closed() {
+				return nil, ErrBadPolygon
+			}
+			for _, p := range ring {
+				if p.Lon() < -180 || p.Lon() > 180 || p.Lat() < -90 || p.Lat() > 90 {
+					return nil, ErrBadPolygon
+				}
+			}
+		}
+	}
+	return mp, nil
+}
+
+func (db *DB) GetRegion(name string) *Region {
+	name = strings.ToLower(name)
+	for _, region := range db.regions {
+		if strings.ToLower(region.Id) == name || strings.ToLower(region.Name) == name {
+			return region
+		}
+	}
+	return nil
+}
+
+func (db *DB) GetRegions() []*Region {
+	return db.regions
+}
+
+func (db *DB) SearchStationsByRegion(name string, size int) ([]AqiStationResp, error) {
+	db, span := db.startSpan("SearchStationsByRegion", attribute.String("region", name))
+	defer span.End()
+	region := db.GetRegion(name)
+	if region == nil {
+		return nil, ErrRegionNotFound
+	}
+	sts, err := db.SearchStationsByPolygon(region.polygon, size)
+	if err != nil {
+		db.log.Error("SearchStationsByRegion(). db.SearchStationsByPolygon(). err:", zap.String("region", region.Id), zap.Error(err))
+		return nil, err
+	}
+	return sts, nil
+}
@@ -0,0 +1,23 @@
+package db
+
+import (
+	"github.com/csnight/storm-aqi-server/conf"
+)
+
+// Reload puts a reloaded aqi config in effect and moves the es pool to the new address list,
+// the regions are loaded at startup only
+func (db *DB) Reload(aqi *conf.AQIConfig, es *conf.ESConfig) {
+	old := db.Conf()
+	db.aqiConf.Store(aqi)
+	if store, ok := db.StationStore.(*EsStore); ok {
+		if old.AlertRuleIndex != aqi.AlertRuleIndex || old.AlertStateIndex != aqi.AlertStateIndex {
+			store.CreateAlertIndices()
+		}
+		if old.AuditIndex != aqi.AuditIndex {
+			store.CreateAuditIndex()
+		}
+	}
+	if db.api != nil && es != nil {
+		db.api.SetAddresses(es.Uri)
+	}
+}
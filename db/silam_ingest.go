@@ -0,0 +1,553 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"go.uber.org/zap"
+)
+
+// SilamIngestStatus is the progress of the running or the last ingestion run
+type SilamIngestStatus struct {
+	Running    bool   `json:"running"`
+	File       string `json:"file,omitempty"`
+	Files      int    `json:"files"`
+	FilesDone  int    `json:"files_done"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	Frames     int    `json:"frames"`
+	FramesDone int    `json:"frames_done"`
+	LastStart  int64  `json:"last_start"`
+	LastEnd    int64  `json:"last_end"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// SilamIngester renders the silam netcdf forecasts of a directory or an http mirror into the images of
+// the silam bucket on its own ticker. Every image gets the min and max tags of its values and the colors
+// of silamRamp, so rendering a file twice gives the same objects. Files are ingested again when they change
+type SilamIngester struct {
+	db       *DB
+	log      *zap.Logger
+	cfg      *conf.SilamConfig
+	interval time.Duration
+	client   *http.Client
+	// lock keeps runs from overlapping and guards state
+	lock       sync.Mutex
+	state      map[string]string
+	statusLock sync.RWMutex
+	status     SilamIngestStatus
+	trigger    chan bool
+	ticker     *time.Ticker
+	done       chan bool
+}
+
+var ErrIngestRunning = errors.New("silam ingestion is running")
+
+// ncHref finds the links of a directory listing
+var ncHref = regexp.MustCompile(`href="([^"?#]+)"`)
+
+func (db *DB) NewSilamIngester(cfg *conf.SilamConfig) *SilamIngester {
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	return &SilamIngester{
+		db:       db,
+		log:      db.log.Named("[silam]"),
+		cfg:      cfg,
+		interval: interval,
+		client:   &http.Client{Timeout: 30 * time.Minute},
+		state:    map[string]string{},
+		trigger:  make(chan bool, 1),
+		done:     make(chan bool),
+	}
+}
+
+func (e *SilamIngester) Start() {
+	if e.cfg.StateFile != "" {
+		if err := loadJsonFile(e.cfg.StateFile, &e.state); err != nil {
+			e.log.Warn("load silam ingest state failed, every file is ingested again", zap.Error(err))
+		}
+	}
+	e.ticker = time.NewTicker(e.interval)
+	go func() {
+		e.Run()
+		for {
+			select {
+			case <-e.done:
+				return
+			case <-e.ticker.C:
+				e.Run()
+			case <-e.trigger:
+				e.Run()
+			}
+		}
+	}()
+}
+
+func (e *SilamIngester) Close() {
+	if e.ticker != nil {
+		e.ticker.Stop()
+	}
+	close(e.done)
+}
+
+// Trigger starts a run now, ErrIngestRunning when one is running or queued already
+func (e *SilamIngester) Trigger() error {
+	if e.Status().Running {
+		return ErrIngestRunning
+	}
+	select {
+	case e.trigger <- true:
+		return nil
+	default:
+		return ErrIngestRunning
+	}
+}
+
+func (e *SilamIngester) Status() SilamIngestStatus {
+	e.statusLock.RLock()
+	defer e.statusLock.RUnlock()
+	return e.status
+}
+
+func (e *SilamIngester) update(fn func(s *SilamIngestStatus)) {
+	e.statusLock.Lock()
+	fn(&e.status)
+	e.statusLock.Unlock()
+}
+
+func (e *SilamIngester) closed() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run ingests the new and changed files of the source, runs never overlap
+func (e *SilamIngester) Run() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.update(func(s *SilamIngestStatus) {
+		*s = SilamIngestStatus{Running: true, LastStart: time.Now().UnixMilli(), LastEnd: s.LastEnd}
+	})
+	defer e.update(func(s *SilamIngestStatus) {
+		s.Running = false
+		s.File = ""
+		s.LastEnd = time.Now().UnixMilli()
+	})
+	files, err := e.listFiles()
+	if err != nil {
+		e.log.Error("list silam files failed", zap.String("source", e.cfg.Source), zap.Error(err))
+		e.update(func(s *SilamIngestStatus) {
+			s.LastError = err.Error()
+		})
+		return
+	}
+	e.update(func(s *SilamIngestStatus) {
+		s.Files = len(files)
+	})
+	for _, file := range files {
+		if e.closed() {
+			return
+		}
+		e.update(func(s *SilamIngestStatus) {
+			s.File = file
+		})
+		sig, err := e.signature(file)
+		if err == nil && sig == e.state[file] {
+			e.update(func(s *SilamIngestStatus) {
+				s.FilesDone++
+				s.Skipped++
+			})
+			continue
+		}
+		if err == nil {
+			err = e.ingestFile(file)
+		}
+		if err != nil {
+			e.log.Error("ingest silam file failed", zap.String("file", file), zap.Error(err))
+			e.update(func(s *SilamIngestStatus) {
+				s.FilesDone++
+				s.Failed++
+				s.LastError = file + ": " + err.Error()
+			})
+			continue
+		}
+		e.state[file] = sig
+		if e.cfg.StateFile != "" {
+			if err = writeJsonFile(filepath.Dir(e.cfg.StateFile), filepath.Base(e.cfg.StateFile), e.state); err != nil {
+				e.log.Warn("save silam ingest state failed", zap.Error(err))
+			}
+		}
+		e.update(func(s *SilamIngestStatus) {
+			s.FilesDone++
+		})
+		e.log.Info("silam file ingested", zap.String("file", file))
+	}
+}
+
+func (e *SilamIngester) remote() bool {
+	return strings.HasPrefix(e.cfg.Source, "http://") || strings.HasPrefix(e.cfg.Source, "https://")
+}
+
+func (e *SilamIngester) matches(name string) bool {
+	pattern := e.cfg.Pattern
+	if pattern == "" {
+		pattern = "*.nc"
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// listFiles returns the sorted paths or urls of the files of the source matching the pattern
+func (e *SilamIngester) listFiles() ([]string, error) {
+	var files []string
+	if !e.remote() {
+		entries, err := ioutil.ReadDir(e.cfg.Source)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && e.matches(entry.Name()) {
+				files = append(files, filepath.Join(e.cfg.Source, entry.Name()))
+			}
+		}
+		return files, nil
+	}
+	base, err := url.Parse(strings.TrimSuffix(e.cfg.Source, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.client.Get(base.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("list " + base.String() + ": " + resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, m := range ncHref.FindAllSubmatch(body, -1) {
+		ref, err := url.Parse(string(m[1]))
+		if err != nil {
+			continue
+		}
+		u := base.ResolveReference(ref)
+		name, _ := url.PathUnescape(path.Base(u.Path))
+		if !e.matches(name) || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		files = append(files, u.String())
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// signature changes when a file changes, the size and modification time or the http etag
+func (e *SilamIngester) signature(file string) (string, error) {
+	if !e.remote() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano()), nil
+	}
+	resp, err := e.client.Head(file)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	return resp.Header.Get("Last-Modified") + "-" + strconv.FormatInt(resp.ContentLength, 10), nil
+}
+
+// open opens a local file or downloads a remote one into a temporary file removed on close
+func (e *SilamIngester) open(file string) (*os.File, func(), error) {
+	if !e.remote() {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, func() { _ = f.Close() }, nil
+	}
+	resp, err := e.client.Get(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New(resp.Status)
+	}
+	f, err := ioutil.TempFile("", "silam-*.nc")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return f, cleanup, nil
+}
+
+// silamGrid is the regular lon lat grid of a forecast file
+type silamGrid struct {
+	lons   []float64
+	lats   []float64
+	lonDim int
+	latDim int
+}
+
+func ncCoordinate(nc *ncFile, names ...string) (*ncReadVar, error) {
+	for _, name := range names {
+		if v, ok := nc.vars[name]; ok && len(v.dims) == 1 {
+			return v, nil
+		}
+	}
+	return nil, errors.New("netcdf has no coordinate " + names[0])
+}
+
+func (e *SilamIngester) ingestFile(file string) error {
+	f, cleanup, err := e.open(file)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	nc, err := openNetcdf(f)
+	if err != nil {
+		return err
+	}
+	var grid silamGrid
+	lonVar, err := ncCoordinate(nc, "lon", "longitude")
+	if err != nil {
+		return err
+	}
+	latVar, err := ncCoordinate(nc, "lat", "latitude")
+	if err != nil {
+		return err
+	}
+	if grid.lons, err = nc.values(lonVar, 0); err != nil {
+		return err
+	}
+	if grid.lats, err = nc.values(latVar, 0); err != nil {
+		return err
+	}
+	if len(grid.lons) < 2 || len(grid.lats) < 2 {
+		return errors.New("netcdf grid needs 2 lons and lats at least")
+	}
+	grid.lonDim, grid.latDim = lonVar.dims[0], latVar.dims[0]
+	times, err := e.readTimes(nc)
+	if err != nil {
+		return err
+	}
+	pols := make([]string, 0, len(e.cfg.Variables))
+	for pol, variable := range e.cfg.Variables {
+		if _, ok := nc.vars[variable.Name]; ok {
+			pols = append(pols, pol)
+		}
+	}
+	if len(pols) == 0 {
+		return errors.New("netcdf has none of the configured variables")
+	}
+	sort.Strings(pols)
+	// the tiles of the frames rendered so far are dropped even when a later frame fails
+	var frames []string
+	defer func() {
+		if len(frames) > 0 {
+			e.db.removeFrameTiles(frames)
+		}
+	}()
+	e.update(func(s *SilamIngestStatus) {
+		s.Frames += len(pols) * len(times)
+	})
+	for _, pol := range pols {
+		variable := e.cfg.Variables[pol]
+		v := nc.vars[variable.Name]
+		n := len(v.dims)
+		if n < 3 || v.dims[n-2] != grid.latDim || v.dims[n-1] != grid.lonDim || nc.dims[v.dims[0]].length != 0 && nc.dims[v.dims[0]].length != len(times) {
+			return errors.New("netcdf variable " + v.name + " is not on (time, ..., lat, lon)")
+		}
+		for rec, tm := range times {
+			if e.closed() {
+				return errors.New("ingestion stopped")
+			}
+			values, err := nc.frame(v, int64(rec), len(grid.lons)*len(grid.lats))
+			if err != nil {
+				return err
+			}
+			if err = e.renderFrame(pol, tm, grid, v, variable.Factor, values); err != nil {
+				return err
+			}
+			frames = append(frames, tileFrameKey(pol, tm))
+			e.update(func(s *SilamIngestStatus) {
+				s.FramesDone++
+			})
+		}
+	}
+	return nil
+}
+
+func (e *SilamIngester) readTimes(nc *ncFile) ([]time.Time, error) {
+	v, err := ncCoordinate(nc, "time")
+	if err != nil {
+		return nil, err
+	}
+	step, ref, err := ncTimeUnits(v.attrString("units"))
+	if err != nil {
+		return nil, err
+	}
+	var raw []float64
+	if nc.isRecord(v) {
+		for rec := int64(0); rec < nc.numrecs; rec++ {
+			values, err := nc.values(v, rec)
+			if err != nil {
+				return nil, err
+			}
+			raw = append(raw, values...)
+		}
+	} else if raw, err = nc.values(v, 0); err != nil {
+		return nil, err
+	}
+	times := make([]time.Time, len(raw))
+	for i, t := range raw {
+		times[i] = ref.Add(time.Duration(math.Round(t * float64(step)))).Truncate(time.Second)
+	}
+	return times, nil
+}
+
+// frame reads the first n values of index rec of the first dimension of v, for variables with levels
+// between time and lat these are the values of the first level
+func (f *ncFile) frame(v *ncReadVar, rec int64, n int) ([]float64, error) {
+	size := ncReadTypeSize(v.typ)
+	stride := f.recsize
+	if !f.isRecord(v) {
+		stride = f.sliceSize(v) / int64(f.dims[v.dims[0]].length)
+	}
+	data := make([]byte, int64(n)*size)
+	if _, err := f.r.ReadAt(data, v.begin+rec*stride); err != nil {
+		return nil, err
+	}
+	return ncDecode(data, v.typ), nil
+}
+
+// formatImageTag rounds to about 4 significant digits keeping one decimal at least
+func formatImageTag(v float64) string {
+	prec := 1
+	if v != 0 {
+		prec = 3 - int(math.Floor(math.Log10(math.Abs(v))))
+	}
+	if prec < 1 {
+		prec = 1
+	} else if prec > 8 {
+		prec = 8
+	}
+	pow := math.Pow(10, float64(prec))
+	return strconv.FormatFloat(math.Round(v*pow)/pow, 'f', -1, 64)
+}
+
+// renderFrame resamples the grid values onto the image extent with the nearest grid cell and uploads the image
+// with its min and max tags. Fill values and cells outside of the grid stay transparent
+func (e *SilamIngester) renderFrame(pol string, tm time.Time, grid silamGrid, v *ncReadVar, factor float64, values []float64) error {
+	scaleFactor, ok := v.attrFloat("scale_factor")
+	if !ok {
+		scaleFactor = 1
+	}
+	addOffset, _ := v.attrFloat("add_offset")
+	fill, hasFill := v.attrFloat("_FillValue")
+	missing, hasMissing := v.attrFloat("missing_value")
+	if factor == 0 {
+		factor = 1
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i, raw := range values {
+		if math.IsNaN(raw) || (hasFill && raw == fill) || (hasMissing && raw == missing) || math.Abs(raw) > 1e30 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = (raw*scaleFactor + addOffset) * factor
+		lo, hi = math.Min(lo, values[i]), math.Max(hi, values[i])
+	}
+	if math.IsInf(lo, 1) {
+		e.log.Warn("silam frame has no values, skipped", zap.String("pol", pol), zap.Time("time", tm))
+		return nil
+	}
+	// the colors follow the tags as written so sampling the image inverts them exactly
+	minTag, maxTag := formatImageTag(lo), formatImageTag(hi)
+	lo, _ = strconv.ParseFloat(minTag, 64)
+	hi, _ = strconv.ParseFloat(maxTag, 64)
+	scale := newImageScale(lo, hi, e.db.Conf().ImageScale)
+	extent := e.db.imageExtent()
+	dlon, dlat := grid.lons[1]-grid.lons[0], grid.lats[1]-grid.lats[0]
+	width := int(math.Max(1, math.Round((extent[2]-extent[0])/math.Abs(dlon))))
+	height := int(math.Max(1, math.Round((extent[3]-extent[1])/math.Abs(dlat))))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	cols := make([]int, width)
+	for x := range cols {
+		lon := extent[0] + (float64(x)+0.5)*(extent[2]-extent[0])/float64(width)
+		cols[x] = -1
+		for _, shift := range []float64{0, 360, -360} {
+			if i := int(math.Round((lon + shift - grid.lons[0]) / dlon)); i >= 0 && i < len(grid.lons) {
+				cols[x] = i
+				break
+			}
+		}
+	}
+	for y := 0; y < height; y++ {
+		lat := extent[3] - (float64(y)+0.5)*(extent[3]-extent[1])/float64(height)
+		j := int(math.Round((lat - grid.lats[0]) / dlat))
+		if j < 0 || j >= len(grid.lats) {
+			continue
+		}
+		for x, i := range cols {
+			if i < 0 {
+				continue
+			}
+			val := values[j*len(grid.lons)+i]
+			if math.IsNaN(val) {
+				continue
+			}
+			c := silamRamp.at(scale.position(val))
+			p := img.Pix[y*img.Stride+x*4:]
+			p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return e.db.PutTaggedObject(bucket, imageObjectName(tm, pol), buf.Bytes(), "image/png", map[string]string{"min": minTag, "max": maxTag})
+}
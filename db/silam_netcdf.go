@@ -0,0 +1,309 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// The silam forecasts are read from netcdf classic files, CDF-1, the 64-bit offset CDF-2 and the
+// 64-bit data CDF-5. Netcdf-4 files need a conversion first like nccopy -k nc7 in.nc out.nc
+
+const (
+	ncByte   int32 = 1
+	ncShort  int32 = 3
+	ncFloat  int32 = 5
+	ncUbyte  int32 = 7
+	ncUshort int32 = 8
+	ncUint   int32 = 9
+	ncInt64  int32 = 10
+	ncUint64 int32 = 11
+)
+
+// ncFile is the header of a netcdf classic file, the values are read on demand
+type ncFile struct {
+	r       io.ReaderAt
+	version byte
+	numrecs int64
+	recsize int64
+	dims    []ncDim
+	attrs   map[string]interface{}
+	vars    map[string]*ncReadVar
+}
+
+// ncReadVar is a variable of a read file, attribute values are strings or []float64
+type ncReadVar struct {
+	name  string
+	dims  []int
+	attrs map[string]interface{}
+	typ   int32
+	vsize int64
+	begin int64
+}
+
+// ncHeaderReader reads the big endian header fields, the first error sticks
+type ncHeaderReader struct {
+	r       *bufio.Reader
+	version byte
+	err     error
+}
+
+func (h *ncHeaderReader) read(n int) []byte {
+	buf := make([]byte, n)
+	if h.err == nil {
+		_, h.err = io.ReadFull(h.r, buf)
+	}
+	return buf
+}
+
+func (h *ncHeaderReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(h.read(4))
+}
+
+// size reads a count or length, 8 bytes in CDF-5
+func (h *ncHeaderReader) size() int64 {
+	if h.version == 5 {
+		return int64(binary.BigEndian.Uint64(h.read(8)))
+	}
+	return int64(h.uint32())
+}
+
+func (h *ncHeaderReader) name() string {
+	n := h.size()
+	if n > 1<<16 {
+		h.err = errors.New("netcdf name too long")
+		return ""
+	}
+	name := h.read(int(n))
+	h.read(int(ncPad(n)))
+	return string(name)
+}
+
+// list reads the tag and the number of items of a dimension, attribute or variable list
+func (h *ncHeaderReader) list(tag uint32) int64 {
+	t := h.uint32()
+	n := h.size()
+	if t == 0 && n == 0 {
+		return 0
+	}
+	if t != tag {
+		h.err = fmt.Errorf("netcdf header expects tag %d got %d", tag, t)
+		return 0
+	}
+	return n
+}
+
+func (h *ncHeaderReader) attrs() map[string]interface{} {
+	attrs := map[string]interface{}{}
+	n := h.list(ncAttributeTag)
+	for i := int64(0); i < n && h.err == nil; i++ {
+		name := h.name()
+		typ := int32(h.uint32())
+		count := h.size()
+		size := ncReadTypeSize(typ)
+		if size == 0 {
+			h.err = fmt.Errorf("netcdf attribute %s has unknown type %d", name, typ)
+			return attrs
+		}
+		if count > 1<<20 {
+			h.err = fmt.Errorf("netcdf attribute %s too long", name)
+			return attrs
+		}
+		data := h.read(int(count * size))
+		h.read(int(ncPad(count * size)))
+		if typ == ncChar {
+			attrs[name] = strings.TrimRight(string(data), "\x00")
+		} else {
+			attrs[name] = ncDecode(data, typ)
+		}
+	}
+	return attrs
+}
+
+func ncReadTypeSize(typ int32) int64 {
+	switch typ {
+	case ncByte, ncChar, ncUbyte:
+		return 1
+	case ncShort, ncUshort:
+		return 2
+	case ncInt, ncFloat, ncUint:
+		return 4
+	case ncDouble, ncInt64, ncUint64:
+		return 8
+	}
+	return 0
+}
+
+// ncDecode converts big endian values of a numeric type to float64
+func ncDecode(data []byte, typ int32) []float64 {
+	size := ncReadTypeSize(typ)
+	values := make([]float64, int64(len(data))/size)
+	for i := range values {
+		b := data[int64(i)*size:]
+		switch typ {
+		case ncByte:
+			values[i] = float64(int8(b[0]))
+		case ncUbyte:
+			values[i] = float64(b[0])
+		case ncShort:
+			values[i] = float64(int16(binary.BigEndian.Uint16(b)))
+		case ncUshort:
+			values[i] = float64(binary.BigEndian.Uint16(b))
+		case ncInt:
+			values[i] = float64(int32(binary.BigEndian.Uint32(b)))
+		case ncUint:
+			values[i] = float64(binary.BigEndian.Uint32(b))
+		case ncFloat:
+			values[i] = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		case ncDouble:
+			values[i] = math.Float64frombits(binary.BigEndian.Uint64(b))
+		case ncInt64:
+			values[i] = float64(int64(binary.BigEndian.Uint64(b)))
+		case ncUint64:
+			values[i] = float64(binary.BigEndian.Uint64(b))
+		}
+	}
+	return values
+}
+
+func openNetcdf(r io.ReaderAt) (*ncFile, error) {
+	h := &ncHeaderReader{r: bufio.NewReader(io.NewSectionReader(r, 0, math.MaxInt64))}
+	magic := h.read(4)
+	if h.err != nil {
+		return nil, h.err
+	}
+	if string(magic[:3]) != "CDF" || (magic[3] != 1 && magic[3] != 2 && magic[3] != 5) {
+		if string(magic[1:4]) == "HDF" {
+			return nil, errors.New("netcdf-4 files are not supported, convert them to the classic format")
+		}
+		return nil, errors.New("not a netcdf classic file")
+	}
+	h.version = magic[3]
+	f := &ncFile{r: r, version: h.version, vars: map[string]*ncReadVar{}}
+	f.numrecs = h.size()
+	n := h.list(ncDimensionTag)
+	for i := int64(0); i < n && h.err == nil; i++ {
+		f.dims = append(f.dims, ncDim{name: h.name(), length: int(h.size())})
+	}
+	f.attrs = h.attrs()
+	n = h.list(ncVariableTag)
+	var records []*ncReadVar
+	for i := int64(0); i < n && h.err == nil; i++ {
+		v := &ncReadVar{name: h.name()}
+		rank := h.size()
+		for j := int64(0); j < rank && h.err == nil; j++ {
+			d := int(h.size())
+			if d >= len(f.dims) {
+				return nil, fmt.Errorf("netcdf variable %s has unknown dimension %d", v.name, d)
+			}
+			v.dims = append(v.dims, d)
+		}
+		v.attrs = h.attrs()
+		v.typ = int32(h.uint32())
+		v.vsize = h.size()
+		if f.version == 1 {
+			v.begin = int64(h.uint32())
+		} else {
+			v.begin = int64(binary.BigEndian.Uint64(h.read(8)))
+		}
+		if ncReadTypeSize(v.typ) == 0 {
+			return nil, fmt.Errorf("netcdf variable %s has unknown type %d", v.name, v.typ)
+		}
+		f.vars[v.name] = v
+		if f.isRecord(v) {
+			records = append(records, v)
+		}
+	}
+	if h.err != nil {
+		return nil, h.err
+	}
+	// a single record variable is not padded within the record
+	for _, v := range records {
+		if len(records) == 1 {
+			f.recsize = f.sliceSize(v)
+		} else {
+			f.recsize += v.vsize
+		}
+	}
+	return f, nil
+}
+
+func (f *ncFile) isRecord(v *ncReadVar) bool {
+	return len(v.dims) > 0 && f.dims[v.dims[0]].length == 0
+}
+
+// sliceSize is the byte size of one record of a record variable or of a whole fixed size variable
+func (f *ncFile) sliceSize(v *ncReadVar) int64 {
+	size := ncReadTypeSize(v.typ)
+	for i, d := range v.dims {
+		if i == 0 && f.isRecord(v) {
+			continue
+		}
+		size *= int64(f.dims[d].length)
+	}
+	return size
+}
+
+// values reads the values of a fixed size variable or of record rec of a record variable
+func (f *ncFile) values(v *ncReadVar, rec int64) ([]float64, error) {
+	offset := v.begin
+	if f.isRecord(v) {
+		if rec >= f.numrecs {
+			return nil, fmt.Errorf("netcdf variable %s has no record %d", v.name, rec)
+		}
+		offset += rec * f.recsize
+	}
+	data := make([]byte, f.sliceSize(v))
+	if _, err := f.r.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return ncDecode(data, v.typ), nil
+}
+
+// attrFloat is the first value of a numeric attribute
+func (v *ncReadVar) attrFloat(name string) (float64, bool) {
+	values, ok := v.attrs[name].([]float64)
+	if !ok || len(values) == 0 {
+		return 0, false
+	}
+	return values[0], true
+}
+
+func (v *ncReadVar) attrString(name string) string {
+	s, _ := v.attrs[name].(string)
+	return s
+}
+
+// ncTimeUnits parses cf time units like "hours since 2022-08-01 00:00:00 UTC"
+func ncTimeUnits(units string) (time.Duration, time.Time, error) {
+	parts := strings.SplitN(strings.TrimSpace(units), " since ", 2)
+	if len(parts) != 2 {
+		return 0, time.Time{}, errors.New("bad time units " + units)
+	}
+	var step time.Duration
+	switch strings.ToLower(parts[0]) {
+	case "seconds", "second", "s":
+		step = time.Second
+	case "minutes", "minute", "min":
+		step = time.Minute
+	case "hours", "hour", "h":
+		step = time.Hour
+	case "days", "day", "d":
+		step = 24 * time.Hour
+	default:
+		return 0, time.Time{}, errors.New("bad time units " + units)
+	}
+	ref := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(parts[1]), "UTC"), "Z")
+	ref = strings.TrimSpace(ref)
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, ref); err == nil {
+			return step, t, nil
+		}
+	}
+	return 0, time.Time{}, errors.New("bad time units " + units)
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testdata/silam.nc is a CDF-1 file of 2 records on a 3 lat by 4 lon grid, a cell of record t at
+// lat j and lon i holds t*100+j*10+i in kg/m3 scaled by 1e-9 for cnc_PM2_5 and 1e-6 for cnc_CO_gas,
+// which has a height level too. The first cell of cnc_PM2_5 is its _FillValue -1
+func openTestNetcdf(t *testing.T) *ncFile {
+	t.Helper()
+	data, err := os.ReadFile("testdata/silam.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc, err := openNetcdf(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("openNetcdf() err: %v", err)
+	}
+	return nc
+}
+
+func equalValues(got []float64, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		// the fixture holds float32 values
+		if float32(got[i]) != float32(want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func testFrame(rec int, scale float64) []float64 {
+	var values []float64
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 4; i++ {
+			values = append(values, float64(rec*100+j*10+i)*scale)
+		}
+	}
+	return values
+}
+
+func TestOpenNetcdfHeader(t *testing.T) {
+	nc := openTestNetcdf(t)
+	if nc.version != 1 || nc.numrecs != 2 {
+		t.Errorf("version, numrecs = %d, %d, want 1, 2", nc.version, nc.numrecs)
+	}
+	var dims []string
+	for _, d := range nc.dims {
+		dims = append(dims, d.name)
+	}
+	if strings.Join(dims, ",") != "time,lat,lon,height" {
+		t.Errorf("dims = %v", dims)
+	}
+	if nc.attrs["title"] != "silam test" {
+		t.Errorf("title = %v", nc.attrs["title"])
+	}
+	pm25 := nc.vars["cnc_PM2_5"]
+	if pm25 == nil || !nc.isRecord(pm25) || pm25.attrString("units") != "kg/m3" {
+		t.Fatalf("cnc_PM2_5 = %+v", pm25)
+	}
+	if fill, ok := pm25.attrFloat("_FillValue"); !ok || fill != -1 {
+		t.Errorf("_FillValue = %v, %v", fill, ok)
+	}
+	if nc.recsize != 8+2*3*4*4 {
+		t.Errorf("recsize = %d", nc.recsize)
+	}
+}
+
+func TestNetcdfValues(t *testing.T) {
+	nc := openTestNetcdf(t)
+	tests := []struct {
+		name    string
+		varName string
+		rec     int64
+		frame   bool
+		want    []float64
+	}{
+		{name: "lat", varName: "lat", want: []float64{-1, 0, 1}},
+		{name: "lon", varName: "lon", want: []float64{10, 11, 12, 13}},
+		{name: "time of the first record", varName: "time", rec: 0, want: []float64{0}},
+		{name: "time of the second record", varName: "time", rec: 1, want: []float64{3}},
+		{name: "first pm25 frame", varName: "cnc_PM2_5", rec: 0, frame: true, want: append([]float64{-1}, testFrame(0, 1e-9)[1:]...)},
+		{name: "second pm25 frame", varName: "cnc_PM2_5", rec: 1, frame: true, want: testFrame(1, 1e-9)},
+		{name: "co frame of the first level", varName: "cnc_CO_gas", rec: 1, frame: true, want: testFrame(1, 1e-6)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := nc.vars[tt.varName]
+			if v == nil {
+				t.Fatalf("no variable %s", tt.varName)
+			}
+			var got []float64
+			var err error
+			if tt.frame {
+				got, err = nc.frame(v, tt.rec, len(tt.want))
+			} else {
+				got, err = nc.values(v, tt.rec)
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !equalValues(got, tt.want) {
+				t.Errorf("values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := nc.values(nc.vars["time"], 2); err == nil {
+		t.Error("values() of a missing record has no error")
+	}
+}
+
+func TestOpenNetcdfErrors(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/silam.nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{name: "netcdf-4", data: []byte("\x89HDF\r\n\x1a\n"), wantErr: "netcdf-4 files are not supported"},
+		{name: "not netcdf", data: []byte("PNG image"), wantErr: "not a netcdf classic file"},
+		{name: "unknown version", data: []byte("CDF\x03\x00\x00\x00\x00"), wantErr: "not a netcdf classic file"},
+		{name: "truncated header", data: fixture[:100], wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := openNetcdf(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("openNetcdf() err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNcTimeUnits(t *testing.T) {
+	tests := []struct {
+		units    string
+		wantStep time.Duration
+		wantRef  time.Time
+		wantErr  bool
+	}{
+		{units: "hours since 2022-08-03 00:00:00 UTC", wantStep: time.Hour, wantRef: time.Date(2022, 8, 3, 0, 0, 0, 0, time.UTC)},
+		{units: "seconds since 2022-08-03T06:30:00Z", wantStep: time.Second, wantRef: time.Date(2022, 8, 3, 6, 30, 0, 0, time.UTC)},
+		{units: "minutes since 2022-08-03 06:30", wantStep: time.Minute, wantRef: time.Date(2022, 8, 3, 6, 30, 0, 0, time.UTC)},
+		{units: "days since 2022-08-03", wantStep: 24 * time.Hour, wantRef: time.Date(2022, 8, 3, 0, 0, 0, 0, time.UTC)},
+		{units: "weeks since 2022-08-03", wantErr: true},
+		{units: "hours", wantErr: true},
+		{units: "hours since yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.units, func(t *testing.T) {
+			step, ref, err := ncTimeUnits(tt.units)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (step != tt.wantStep || !ref.Equal(tt.wantRef)) {
+				t.Errorf("step, ref = %v, %v, want %v, %v", step, ref, tt.wantStep, tt.wantRef)
+			}
+		})
+	}
+}
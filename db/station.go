@@ -2,12 +2,14 @@ package db
 
 import (
 	"github.com/csnight/storm-aqi-server/tools"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
-	"strconv"
-	"strings"
 	"sync"
-	"time"
+)
+
+const (
+	logoBucket = "sys-image"
+	logoPrefix = "aqi/"
 )
 
 type AqiStation struct {
@@ -21,6 +23,11 @@ type AqiStation struct {
 	CityName string   `json:"city_name,omitempty"`
 	HisRange string   `json:"his_range,omitempty"`
 	Sources  string   `json:"sources,omitempty"`
+	// Retired stations are kept for their history but left out of searches and the station list
+	Retired   bool  `json:"retired,omitempty"`
+	RetiredAt int64 `json:"retired_at,omitempty"`
+	// UpdatedAt is the millis of the last write through the api, its external version in es
+	UpdatedAt int64 `json:"updated_at,omitempty"`
 }
 
 type Source struct {
@@ -31,16 +38,19 @@ type Source struct {
 }
 
 type AqiStationResp struct {
-	Sid      string   `json:"sid"`
-	Idx      int      `json:"idx"`
-	Name     string   `json:"name"`
-	Loc      GeoPoint `json:"loc"`
-	UpTime   int64    `json:"up_time"`
-	Tms      string   `json:"tms"`
-	Tz       string   `json:"tz"`
-	CityName string   `json:"city_name,omitempty"`
-	HisRange string   `json:"his_range,omitempty"`
-	Sources  []Source `json:"sources,omitempty"`
+	Sid       string   `json:"sid"`
+	Idx       int      `json:"idx"`
+	Name      string   `json:"name"`
+	Loc       GeoPoint `json:"loc"`
+	UpTime    int64    `json:"up_time"`
+	Tms       string   `json:"tms"`
+	Tz        string   `json:"tz"`
+	CityName  string   `json:"city_name,omitempty"`
+	HisRange  string   `json:"his_range,omitempty"`
+	Sources   []Source `json:"sources,omitempty"`
+	Retired   bool     `json:"retired,omitempty"`
+	RetiredAt int64    `json:"retired_at,omitempty"`
+	UpdatedAt int64    `json:"updated_at,omitempty"`
 }
 
 type StationGetResponse struct {
@@ -62,35 +72,9 @@ type StationSearchResponse struct {
 	} `json:"hits"`
 }
 
-func (db *DB) GetStationById(idx string) (*AqiStationResp, error) {
-	search := &esapi.GetRequest{
-		Index:      db.Conf.StationIndex,
-		DocumentID: idx,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	defer func() {
-		resp = nil
-	}()
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		db.log.Error("GetStationById(). es.ProcessRespWithCli(). err:", zap.Error(err))
-		return nil, err
-	}
-	var response StationGetResponse
-	err = json.Unmarshal(resp, &response)
-	if err != nil {
-		db.log.Error("GetStationById(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-	if response.Found {
-		return buildResponse(&response.Source)
-	}
-	return nil, nil
-}
-
 func (db *DB) GetStationByName(name string) (*AqiStationResp, error) {
+	db, span := db.startSpan("GetStationByName", attribute.String("name", name))
+	defer span.End()
 	sts, err := db.SearchStationsByName(name, 1)
 	if err != nil {
 		db.log.Error("GetStationByName(). SearchStationsByName("+name+"). err:", zap.Error(err))
@@ -103,6 +87,8 @@ func (db *DB) GetStationByName(name string) (*AqiStationResp, error) {
 }
 
 func (db *DB) GetStationByCityName(name string) (*AqiStationResp, error) {
+	db, span := db.startSpan("GetStationByCityName", attribute.String("name", name))
+	defer span.End()
 	sts, err := db.SearchStationsByCityName(name, 1)
 	if err != nil {
 		db.log.Error("GetStationByCityName(). SearchStationsByCityName("+name+"). err:", zap.Error(err))
@@ -114,216 +100,11 @@ func (db *DB) GetStationByCityName(name string) (*AqiStationResp, error) {
 	return nil, nil
 }
 
-func (db *DB) SearchStationsByName(name string, size int) ([]AqiStationResp, error) {
-	query := `{
-        "query": {
-            "wildcard": {
-                "name": {
-                    "case_insensitive": true,
-                    "value": "*` + name + `*"
-                }
-            }
-       }
-    }`
-	search := &esapi.SearchRequest{
-		Index:   []string{db.Conf.StationIndex},
-		Body:    strings.NewReader(query),
-		Size:    &size,
-		Sort:    nil,
-		Timeout: 20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	defer func() {
-		resp = nil
-	}()
-	var esSearchResp StationSearchResponse
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		db.log.Error("SearchStationsByName(). es.ProcessRespWithCli(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
-		return nil, err
-	}
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		db.log.Error("SearchStationsByName(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-	var sts []AqiStation
-	if esSearchResp.Hits.Total.Value > 0 {
-		for _, item := range esSearchResp.Hits.Hits {
-			sts = append(sts, item.Source)
-		}
-		return buildResponses(sts), nil
-	}
-	return []AqiStationResp{}, nil
-}
-
-func (db *DB) SearchStationsByCityName(name string, size int) ([]AqiStationResp, error) {
-	query := `{
-        "query": {
-            "wildcard": {
-                "city_name": {
-                    "case_insensitive": true,
-                    "value": "*` + name + `*"
-                }
-            }
-       }
-    }`
-	search := &esapi.SearchRequest{
-		Index:   []string{db.Conf.StationIndex},
-		Body:    strings.NewReader(query),
-		Size:    &size,
-		Sort:    nil,
-		Timeout: 20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	defer func() {
-		resp = nil
-	}()
-	var esSearchResp StationSearchResponse
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		db.log.Error("SearchStationsByCityName(). es.ProcessRespWithCli(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
-		return nil, err
-	}
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		db.log.Error("SearchStationsByCityName(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-	var sts []AqiStation
-	if esSearchResp.Hits.Total.Value > 0 {
-		for _, item := range esSearchResp.Hits.Hits {
-			sts = append(sts, item.Source)
-		}
-		return buildResponses(sts), nil
-	}
-	return []AqiStationResp{}, nil
-}
-
-func (db *DB) SearchStationByRadius(x string, y string, dis float64, unit string, size int) ([]AqiStationResp, error) {
-	disStr := strconv.FormatFloat(dis, 'f', 8, 64) + unit
-	query := `{
-      "query": {
-        "bool": {
-          "must": {
-            "match_all": {}
-          },
-          "filter": {
-            "geo_distance": {
-              "distance": "` + disStr + `",
-              "loc": {
-                "lat": ` + y + `,
-                "lon": ` + x + `
-              }
-            }
-          }
-        }
-      }
-    }`
-	search := &esapi.SearchRequest{
-		Index: []string{db.Conf.StationIndex},
-		Body:  strings.NewReader(query),
-		Size:  &size,
-		Sort: []string{`{"_geo_distance": {
-        "loc": {
-          "lat": ` + y + `,
-          "lon": ` + x + `
-        }, 
-        "order": "asc",
-        "unit": ` + unit + `
-      }}`},
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	defer func() {
-		resp = nil
-	}()
-	var esSearchResp StationSearchResponse
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		db.log.Error("SearchStationByRadius(). es.ProcessRespWithCli(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
-		return nil, err
-	}
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		db.log.Error("SearchStationByRadius(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-	var sts []AqiStation
-	if esSearchResp.Hits.Total.Value > 0 {
-		for _, item := range esSearchResp.Hits.Hits {
-			sts = append(sts, item.Source)
-		}
-		return buildResponses(sts), nil
-	}
-	return []AqiStationResp{}, nil
-
-}
-
-func (db *DB) SearchStationsByArea(bounds Bounds, size int) ([]AqiStationResp, error) {
-	boundsBytes, err := json.Marshal(bounds)
-	if err != nil {
-		return nil, err
-	}
-	query := `{
-      "query": {
-        "bool": {
-          "must": {
-            "match_all": {}
-          },
-          "filter": {
-            "geo_bounding_box": {
-              "loc": ` + string(boundsBytes) + `
-            }
-          }
-        }
-      }
-    }`
-	search := &esapi.SearchRequest{
-		Index:   []string{db.Conf.StationIndex},
-		Body:    strings.NewReader(query),
-		Size:    &size,
-		Sort:    nil,
-		Timeout: 20 * time.Second,
-	}
-	resp, err := db.api.ProcessRespWithCli(search)
-	defer func() {
-		resp = nil
-	}()
-	var esSearchResp StationSearchResponse
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		db.log.Error("SearchStationsByArea(). es.ProcessRespWithCli(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
-		return nil, err
-	}
-	err = json.Unmarshal(resp, &esSearchResp)
-	if err != nil {
-		db.log.Error("SearchStationsByArea(). json.Unmarshal(). err:", zap.Error(err))
-		return nil, err
-	}
-	var sts []AqiStation
-	if esSearchResp.Hits.Total.Value > 0 {
-		for _, item := range esSearchResp.Hits.Hits {
-			sts = append(sts, item.Source)
-		}
-		return buildResponses(sts), nil
-	}
-	return []AqiStationResp{}, nil
-}
-
 func (db *DB) GetAllStations() ([]AqiStationResp, error) {
+	db, span := db.startSpan("GetAllStations")
+	defer span.End()
 	if db.cache.EntryCount() == 0 {
-		query := `{
-           "query":{"match_all":{}}
-        }`
-		return db.ScrollSearchStation(query)
+		return db.ScanStations()
 	}
 	si := db.cache.NewIterator()
 	var sts []AqiStationResp
@@ -340,57 +121,15 @@ func (db *DB) GetAllStations() ([]AqiStationResp, error) {
 	return sts, nil
 }
 
-func (db *DB) GetStationsByRange(st int, et int) ([]AqiStationResp, error) {
-	query := `{
-       "query": {
-           "range" : {
-               "idx" : {
-                   "gte" : ` + strconv.Itoa(st) + `,
-                   "lte" : ` + strconv.Itoa(et) + `
-               }
-           }
-       }
-    }`
-	return db.ScrollSearchStation(query)
-}
-
-func (db *DB) ScrollSearchStation(query string) ([]AqiStationResp, error) {
-	size := 10000
-	search := &esapi.SearchRequest{
-		Index:  []string{db.Conf.StationIndex},
-		Body:   strings.NewReader(query),
-		Scroll: time.Second * 20,
-		Size:   &size,
-		Sort:   []string{"idx"},
-	}
-	results, err := db.api.ScrollSearch(search)
-	if err != nil {
-		if strings.HasPrefix(err.Error(), "404") {
-			return nil, nil
-		}
-		db.log.Error("ScrollSearchStation(). es.ScrollSearch(). err:", zap.String("query", strings.ReplaceAll(query, " ", "")), zap.Error(err))
-		return nil, err
-	}
-	var sts []AqiStation
-	for _, hit := range results {
-		var station AqiStation
-		err = json.UnmarshalFromString(hit.Raw, &station)
-		if err != nil {
-			continue
-		}
-		sts = append(sts, station)
-	}
-	defer func() {
-		results = nil
-	}()
-	return buildResponses(sts), nil
-}
-
 func (db *DB) GetStationLogo(logo string) ([]byte, error) {
-	return tools.GetObject(db.oss, logo)
+	db, span := db.startSpan("GetStationLogo", attribute.String("logo", logo))
+	defer span.End()
+	return db.GetObject(logoBucket, logoPrefix+logo)
 }
 
 func (db *DB) SyncStationLogos() error {
+	db, span := db.startSpan("SyncStationLogos")
+	defer span.End()
 	stations, err := db.GetAllStations()
 	if err != nil {
 		return err
@@ -410,7 +149,7 @@ func (db *DB) SyncStationLogos() error {
 		}
 	}
 	for _, logo := range logos {
-		if !tools.ExistObject(db.oss, "aqi/"+logo) {
+		if !db.ExistObject(logoBucket, logoPrefix+logo) {
 			wg.Add(1)
 			queue <- true
 			go func(logoImg string) {
@@ -418,16 +157,16 @@ func (db *DB) SyncStationLogos() error {
 					<-queue
 					wg.Done()
 				}()
-				image, err := tools.DownloadImage(db.Conf.ImageOss + logoImg)
+				image, err := tools.DownloadImage(db.Conf().ImageOss + logoImg)
 				if err != nil {
 					db.log.Error("download station logo failed, err:", zap.Error(err))
 					return
 				}
-				status := tools.PutObject(db.oss, image, "aqi/"+logoImg)
-				if status {
+				err = db.PutObject(logoBucket, logoPrefix+logoImg, image, "image/png")
+				if err == nil {
 					db.log.Info("save to oss success", zap.String("object", logoImg))
 				} else {
-					db.log.Error("save to oss failed", zap.String("object", logoImg))
+					db.log.Error("save to oss failed", zap.String("object", logoImg), zap.Error(err))
 				}
 			}(logo)
 		}
@@ -442,16 +181,19 @@ func buildResponse(st *AqiStation) (*AqiStationResp, error) {
 		return nil, err
 	}
 	return &AqiStationResp{
-		Sid:      st.Sid,
-		Idx:      st.Idx,
-		Name:     st.Name,
-		Loc:      st.Loc,
-		UpTime:   st.UpTime,
-		Tms:      st.Tms,
-		Tz:       st.Tz,
-		CityName: st.CityName,
-		HisRange: st.HisRange,
-		Sources:  sources,
+		Sid:       st.Sid,
+		Idx:       st.Idx,
+		Name:      st.Name,
+		Loc:       st.Loc,
+		UpTime:    st.UpTime,
+		Tms:       st.Tms,
+		Tz:        st.Tz,
+		CityName:  st.CityName,
+		HisRange:  st.HisRange,
+		Sources:   sources,
+		Retired:   st.Retired,
+		RetiredAt: st.RetiredAt,
+		UpdatedAt: st.UpdatedAt,
 	}, nil
 }
 func buildResponses(sts []AqiStation) []AqiStationResp {
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/tools"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrStationNotFound = errors.New("station not found")
+	ErrStationExists   = errors.New("station already exists")
+	ErrStationRetired  = errors.New("station already retired")
+)
+
+// StationAudit records a station write, Before is nil for a create
+type StationAudit struct {
+	Id     string      `json:"id"`
+	Time   int64       `json:"time"`
+	Actor  string      `json:"actor"`
+	Ip     string      `json:"ip"`
+	Action string      `json:"action"`
+	Sid    string      `json:"sid"`
+	Before *AqiStation `json:"before,omitempty"`
+	After  *AqiStation `json:"after,omitempty"`
+}
+
+// AuditActor is who made a station write, the api key name is empty when auth is disabled
+type AuditActor struct {
+	Name string
+	Ip   string
+}
+
+// buildStation turns a station response back into the stored document
+func buildStation(st *AqiStationResp) (*AqiStation, error) {
+	sources := st.Sources
+	if sources == nil {
+		sources = []Source{}
+	}
+	raw, err := json.MarshalToString(sources)
+	if err != nil {
+		return nil, err
+	}
+	return &AqiStation{
+		Sid:       st.Sid,
+		Idx:       st.Idx,
+		Name:      st.Name,
+		Loc:       st.Loc,
+		UpTime:    st.UpTime,
+		Tms:       st.Tms,
+		Tz:        st.Tz,
+		CityName:  st.CityName,
+		HisRange:  st.HisRange,
+		Sources:   raw,
+		Retired:   st.Retired,
+		RetiredAt: st.RetiredAt,
+		UpdatedAt: st.UpdatedAt,
+	}, nil
+}
+
+// storedStation returns the station document of sid, retired or not, nil when it does not exist.
+// The station cache goes first as it holds the writes still queued in the bulk indexer, retires included
+func (db *DB) storedStation(sid string) (*AqiStation, error) {
+	resp, err := db.getStationFromCache(sid)
+	if err != nil || resp == nil {
+		return nil, err
+	}
+	return buildStation(resp)
+}
+
+// writeStation saves the station, updates the station cache then records the audit entry. An audit
+// entry that can't be stored is logged in full as the write is already done
+func (db *DB) writeStation(action string, actor AuditActor, before *AqiStation, after *AqiStation) (*AqiStationResp, error) {
+	resp, err := buildResponse(after)
+	if err != nil {
+		return nil, err
+	}
+	id, err := tools.NewNanoId()
+	if err != nil {
+		return nil, err
+	}
+	// the version only grows even when the clock steps back
+	after.UpdatedAt = time.Now().UnixMilli()
+	if before != nil && after.UpdatedAt <= before.UpdatedAt {
+		after.UpdatedAt = before.UpdatedAt + 1
+	}
+	resp.UpdatedAt = after.UpdatedAt
+	entry := &StationAudit{
+		Id:     id,
+		Time:   after.UpdatedAt,
+		Actor:  actor.Name,
+		Ip:     actor.Ip,
+		Action: action,
+		Sid:    after.Sid,
+		Before: before,
+		After:  after,
+	}
+	if err = db.SaveStation(after, before == nil); err != nil {
+		db.log.Error("writeStation(). db.SaveStation(). err:", zap.Error(err))
+		return nil, err
+	}
+	db.cacheStation(resp)
+	if err = db.AppendStationAudit(entry); err != nil {
+		db.log.Error("writeStation(). db.AppendStationAudit(). err:", zap.Any("audit", entry), zap.Error(err))
+	}
+	return resp, nil
+}
+
+// cacheStation puts a written station in the station cache right away instead of waiting for the next refresh.
+// A retired station stays cached flagged as retired, so the writes after it don't read the document it
+// replaces while that is still queued, and it leaves the station list
+func (db *DB) cacheStation(st *AqiStationResp) {
+	if stb, err := json.Marshal(st); err == nil {
+		_ = db.cache.Set([]byte(st.Sid), stb, 600)
+	}
+	db.stations.lock.Lock()
+	defer db.stations.lock.Unlock()
+	list := make([]AqiStationResp, 0, len(db.stations.list)+1)
+	replaced := false
+	for _, cached := range db.stations.list {
+		if cached.Sid == st.Sid {
+			replaced = true
+			if st.Retired {
+				continue
+			}
+			cached = *st
+		}
+		list = append(list, cached)
+	}
+	if !replaced && !st.Retired {
+		list = append(list, *st)
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Idx < list[j].Idx
+		})
+	}
+	db.stations.list = list
+}
+
+// CreateStation adds a station, the sid of a retired station can't be reused
+func (db *DB) CreateStation(st *AqiStation, actor AuditActor) (*AqiStationResp, error) {
+	db, span := db.startSpan("CreateStation", attribute.String("sid", st.Sid))
+	defer span.End()
+	db.stations.writes.Lock()
+	defer db.stations.writes.Unlock()
+	old, err := db.storedStation(st.Sid)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		return nil, ErrStationExists
+	}
+	st.Retired = false
+	st.RetiredAt = 0
+	return db.writeStation("create", actor, nil, st)
+}
+
+// UpdateStation replaces the metadata of a station, the fields maintained by the syncer are kept
+// and restore brings a retired station back
+func (db *DB) UpdateStation(sid string, st *AqiStation, restore bool, actor AuditActor) (*AqiStationResp, error) {
+	db, span := db.startSpan("UpdateStation", attribute.String("sid", sid))
+	defer span.End()
+	db.stations.writes.Lock()
+	defer db.stations.writes.Unlock()
+	old, err := db.storedStation(sid)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, ErrStationNotFound
+	}
+	st.Sid = old.Sid
+	st.UpTime = old.UpTime
+	st.Tms = old.Tms
+	st.HisRange = old.HisRange
+	st.Retired = old.Retired && !restore
+	if st.Retired {
+		st.RetiredAt = old.RetiredAt
+	}
+	return db.writeStation("update", actor, old, st)
+}
+
+// RetireStation soft deletes a station, its documents are kept and it is left out of searches
+func (db *DB) RetireStation(sid string, actor AuditActor) (*AqiStationResp, error) {
+	db, span := db.startSpan("RetireStation", attribute.String("sid", sid))
+	defer span.End()
+	db.stations.writes.Lock()
+	defer db.stations.writes.Unlock()
+	old, err := db.storedStation(sid)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, ErrStationNotFound
+	}
+	if old.Retired {
+		return nil, ErrStationRetired
+	}
+	st := *old
+	st.Retired = true
+	st.RetiredAt = time.Now().UnixMilli()
+	return db.writeStation("retire", actor, old, &st)
+}
+
+func (db *DB) GetStationAudits(sid string, size int) ([]StationAudit, error) {
+	db, span := db.startSpan("GetStationAudits", attribute.String("sid", sid))
+	defer span.End()
+	entries, err := db.ListStationAudits(sid, size)
+	if err != nil {
+		db.log.Error("GetStationAudits(). db.ListStationAudits(). err:", zap.Error(err))
+		return nil, err
+	}
+	if entries == nil {
+		entries = []StationAudit{}
+	}
+	return entries, nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+// StationStore reads station documents
+type StationStore interface {
+	GetStationById(sid string) (*AqiStationResp, error)
+	SearchStationsByName(name string, size int) ([]AqiStationResp, error)
+	SearchStationsByCityName(name string, size int) ([]AqiStationResp, error)
+	SearchStationByRadius(x string, y string, dis float64, unit string, size int) ([]AqiStationResp, error)
+	SearchStationsByArea(bounds Bounds, size int) ([]AqiStationResp, error)
+	SearchStationsByPolygon(polygon orb.MultiPolygon, size int) ([]AqiStationResp, error)
+	GetStationsByRange(st int, et int) ([]AqiStationResp, error)
+	ScanStations() ([]AqiStationResp, error)
+}
+
+// StationWriter writes station documents, a write may reach the store after SaveStation returns.
+// A create never replaces a stored station and an update older than the stored UpdatedAt is dropped
+type StationWriter interface {
+	SaveStation(st *AqiStation, create bool) error
+}
+
+// AuditStore keeps the audit trail of the station writes, ListStationAudits returns the newest
+// entries first and empty sid lists the entries of all stations
+type AuditStore interface {
+	AppendStationAudit(entry *StationAudit) error
+	ListStationAudits(sid string, size int) ([]StationAudit, error)
+}
+
+// RealtimeStore reads realtime documents, one per station and pollutant
+type RealtimeStore interface {
+	GetRealtimeBySid(sid string, sourceExcludes ...string) ([]AqiRealtime, error)
+	GetRealtimeBySidAndPol(sid string, pol string) (*AqiRealtime, error)
+	GetRealtimeMax() (map[string]float64, error)
+	// AggregateRealtime returns the avg or max realtime value of a pollutant keyed by sid
+	AggregateRealtime(pol string, agg string) (map[string]float64, error)
+	GetRealtimeByPol(pol string, sids []string) ([]AqiRealtime, error)
+}
+
+// HistoryStore reads history documents from the yearly indices
+type HistoryStore interface {
+	GetHistoryByRange(sid string, pol string, st time.Time, et time.Time) ([]AqiHistory, error)
+	// PageHistory returns up to limit items newest first and the cursor of the next page,
+	// the cursor format belongs to the store and an empty next cursor means the last page
+	PageHistory(sid string, pol string, st time.Time, et time.Time, cursor string, limit int) ([]AqiHistory, string, error)
+	CountHistory(sid string, years []int) (int64, error)
+	// AggregateHistory buckets the range by calendar intervals in the location of st, DailyAvg included
+	AggregateHistory(sid string, pol string, st time.Time, et time.Time, interval string) (*HistoryStats, error)
+	// AggregateStations returns the avg or max history value of a pollutant in the range keyed by sid
+	AggregateStations(pol string, st time.Time, et time.Time, agg string) (map[string]float64, error)
+	// ScanHistory streams the history of the stations ordered by idx and tm into fn without holding the whole range,
+	// empty pols means all pollutants and an error of fn stops the scan
+	ScanHistory(sids []string, pols []string, st time.Time, et time.Time, fn func(his *AqiHistory) error) error
+}
+
+// CompareStore reads the stations, realtime and history of several stations in one round trip
+type CompareStore interface {
+	SearchCompare(sids []string, pol string, st time.Time, et time.Time) (*CompareData, error)
+}
+
+// AlertStore persists alert rules and their per station evaluation states,
+// empty ruleId lists the states of all rules
+type AlertStore interface {
+	ListAlertRules() ([]AlertRule, error)
+	SaveAlertRule(rule *AlertRule) error
+	RemoveAlertRule(id string) error
+	ListAlertStates(ruleId string) ([]AlertState, error)
+	SaveAlertStates(states []AlertState) error
+	RemoveAlertStates(ruleId string) error
+}
+
+// ObjectStore reads and writes images in buckets
+type ObjectStore interface {
+	GetObject(bucket string, name string) ([]byte, error)
+	GetObjectTags(bucket string, name string) (map[string]string, error)
+	PutObject(bucket string, name string, data []byte, contentType string) error
+	// PutTaggedObject writes an object with its tags in one upload, so no reader sees it untagged
+	PutTaggedObject(bucket string, name string, data []byte, contentType string, tags map[string]string) error
+	ExistObject(bucket string, name string) bool
+	// ListObjects returns the sorted names of the objects of the bucket starting with prefix
+	ListObjects(ctx context.Context, bucket string, prefix string) ([]string, error)
+	// RemoveObjects deletes the objects of the bucket starting with prefix
+	RemoveObjects(ctx context.Context, bucket string, prefix string) error
+	// CheckAccess returns an error when the objects under prefix of the bucket can't be listed
+	CheckAccess(ctx context.Context, bucket string, prefix string) error
+}
+
+// ReadyChecker is implemented by stores backed by a remote service,
+// CheckReady returns why the store can't serve requests yet
+type ReadyChecker interface {
+	CheckReady(ctx context.Context) error
+}
@@ -0,0 +1,1116 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"github.com/csnight/storm-aqi-server/elastic"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// EsStore implements the station, realtime and history stores on elasticsearch
+type EsStore struct {
+	conf func() *conf.AQIConfig
+	api  *elastic.EsAPI
+	log  *zap.Logger
+	ctx  context.Context
+}
+
+// NewEsStore reads the index names through conf on every request, so a reload renames them at once
+func NewEsStore(conf func() *conf.AQIConfig, api *elastic.EsAPI, logger *zap.Logger) *EsStore {
+	return &EsStore{
+		conf: conf,
+		api:  api,
+		log:  logger,
+		ctx:  context.Background(),
+	}
+}
+
+// decode unmarshals a response body in a span, so slow decoding shows apart from the es request
+func (s *EsStore) decode(data []byte, v interface{}) error {
+	_, span := tracer.Start(s.ctx, "json.Unmarshal", trace.WithAttributes(attribute.Int("bytes", len(data))))
+	defer span.End()
+	return json.Unmarshal(data, v)
+}
+
+// CheckReady needs a reachable cluster in yellow or green health with the station,
+// realtime and current year history indices
+func (s *EsStore) CheckReady(ctx context.Context) error {
+	if !s.api.Reachable() {
+		return errors.New("elasticsearch is unreachable")
+	}
+	status, err := s.api.ClusterHealth(ctx)
+	if err != nil {
+		return err
+	}
+	if status != "green" && status != "yellow" {
+		return errors.New("elasticsearch cluster health is " + status)
+	}
+	year := strconv.Itoa(time.Now().Year())
+	for _, index := range []string{s.conf().StationIndex, s.conf().RealtimeIndex, strings.Replace(s.conf().HisIndex, "$year", year, -1)} {
+		exists, err := s.api.IndexExists(ctx, index)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New("index " + index + " does not exist")
+		}
+	}
+	return nil
+}
+
+// WithContext returns a copy of the store sending its requests as children of the span in ctx
+func (s *EsStore) WithContext(ctx context.Context) *EsStore {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+func (s *EsStore) GetStationById(idx string) (*AqiStationResp, error) {
+	search := &esapi.GetRequest{
+		Index:      s.conf().StationIndex,
+		DocumentID: idx,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	defer func() {
+		resp = nil
+	}()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("GetStationById(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return nil, err
+	}
+	var response StationGetResponse
+	err = s.decode(resp, &response)
+	if err != nil {
+		s.log.Error("GetStationById(). json.Unmarshal(). err:", zap.Error(err))
+		return nil, err
+	}
+	if response.Found {
+		return buildResponse(&response.Source)
+	}
+	return nil, nil
+}
+
+func (s *EsStore) SearchStationsByName(name string, size int) ([]AqiStationResp, error) {
+	query := elastic.NewWildcardQuery("name", "*"+elastic.EscapeWildcard(name)+"*").CaseInsensitive(true)
+	return s.searchStations("SearchStationsByName", elastic.NewSearchBody().Query(activeStations(query)), size)
+}
+
+func (s *EsStore) SearchStationsByCityName(name string, size int) ([]AqiStationResp, error) {
+	query := elastic.NewWildcardQuery("city_name", "*"+elastic.EscapeWildcard(name)+"*").CaseInsensitive(true)
+	return s.searchStations("SearchStationsByCityName", elastic.NewSearchBody().Query(activeStations(query)), size)
+}
+
+func (s *EsStore) SearchStationByRadius(x string, y string, dis float64, unit string, size int) ([]AqiStationResp, error) {
+	lon, err := strconv.ParseFloat(x, 64)
+	if err != nil {
+		return nil, err
+	}
+	lat, err := strconv.ParseFloat(y, 64)
+	if err != nil {
+		return nil, err
+	}
+	body := elastic.NewSearchBody().
+		Query(activeStations(elastic.NewGeoDistanceQuery("loc", lon, lat).Distance(dis, unit))).
+		Sort(elastic.NewGeoDistanceSort("loc", lon, lat).Unit(unit))
+	return s.searchStations("SearchStationByRadius", body, size)
+}
+
+func (s *EsStore) SearchStationsByArea(bounds Bounds, size int) ([]AqiStationResp, error) {
+	body := elastic.NewSearchBody().
+		Query(activeStations(elastic.NewGeoBoundingBoxQuery("loc",
+			[2]float64{bounds.TopLeft.Lon, bounds.TopLeft.Lat},
+			[2]float64{bounds.BottomRight.Lon, bounds.BottomRight.Lat})))
+	return s.searchStations("SearchStationsByArea", body, size)
+}
+
+func (s *EsStore) SearchStationsByPolygon(polygon orb.MultiPolygon, size int) ([]AqiStationResp, error) {
+	body := elastic.NewSearchBody().
+		Query(activeStations(elastic.NewGeoShapeQuery("loc", geojson.NewGeometry(polygon))))
+	return s.searchStations("SearchStationsByPolygon", body, size)
+}
+
+// activeStations filters the stations matching q down to those not retired
+func activeStations(q elastic.Query) elastic.Query {
+	return elastic.NewBoolQuery().
+		Filter(q).
+		MustNot(elastic.NewTermQuery("retired", true))
+}
+
+func (s *EsStore) searchStations(caller string, body *elastic.SearchBody, size int) ([]AqiStationResp, error) {
+	query, err := body.Build()
+	if err != nil {
+		return nil, err
+	}
+	search := &esapi.SearchRequest{
+		Index:   []string{s.conf().StationIndex},
+		Body:    strings.NewReader(query),
+		Size:    &size,
+		Timeout: 20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	defer func() {
+		resp = nil
+	}()
+	var esSearchResp StationSearchResponse
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error(caller+"(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	err = s.decode(resp, &esSearchResp)
+	if err != nil {
+		s.log.Error(caller+"(). json.Unmarshal(). err:", zap.Error(err))
+		return nil, err
+	}
+	var sts []AqiStation
+	if esSearchResp.Hits.Total.Value > 0 {
+		for _, item := range esSearchResp.Hits.Hits {
+			sts = append(sts, item.Source)
+		}
+		return buildResponses(sts), nil
+	}
+	return []AqiStationResp{}, nil
+}
+
+func (s *EsStore) GetStationsByRange(st int, et int) ([]AqiStationResp, error) {
+	return s.ScrollSearchStation(elastic.NewRangeQuery("idx").Gte(st).Lte(et))
+}
+
+func (s *EsStore) ScrollSearchStation(q elastic.Query) ([]AqiStationResp, error) {
+	query, err := elastic.NewSearchBody().Query(activeStations(q)).Sort(elastic.NewFieldSort("idx")).Build()
+	if err != nil {
+		return nil, err
+	}
+	size := 10000
+	search := &esapi.SearchRequest{
+		Index:  []string{s.conf().StationIndex},
+		Body:   strings.NewReader(query),
+		Scroll: time.Second * 20,
+		Size:   &size,
+	}
+	results, err := s.api.ScrollSearch(s.ctx, search)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("ScrollSearchStation(). es.ScrollSearch(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	var sts []AqiStation
+	for _, hit := range results {
+		var station AqiStation
+		err = json.UnmarshalFromString(hit.Raw, &station)
+		if err != nil {
+			continue
+		}
+		sts = append(sts, station)
+	}
+	defer func() {
+		results = nil
+	}()
+	return buildResponses(sts), nil
+}
+
+func (s *EsStore) ScanStations() ([]AqiStationResp, error) {
+	return s.ScrollSearchStation(elastic.NewMatchAllQuery())
+}
+
+// SaveStation hands the station to the bulk indexer, it is searchable after the next flush
+// while a get by sid sees it as soon as it is indexed. A create fails on an existing document and
+// an update carries UpdatedAt as external version, so a retry older than the stored write is rejected
+func (s *EsStore) SaveStation(st *AqiStation, create bool) error {
+	body, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	item := elastic.BulkIndexerItem{
+		Index:      s.conf().StationIndex,
+		Action:     "create",
+		DocumentID: st.Sid,
+		Body:       bytes.NewReader(body),
+	}
+	if !create {
+		version := st.UpdatedAt
+		item.Action = "index"
+		item.Version = &version
+		item.VersionType = "external"
+	}
+	return s.api.AddToBulk(s.ctx, item)
+}
+
+func (s *EsStore) GetRealtimeBySid(sid string, sourceExcludes ...string) ([]AqiRealtime, error) {
+	size := 10
+	query, err := elastic.NewSearchBody().Query(elastic.NewMatchQuery("sid", sid)).Build()
+	if err != nil {
+		return nil, err
+	}
+	search := &esapi.SearchRequest{
+		Index:          []string{s.conf().RealtimeIndex},
+		Body:           strings.NewReader(query),
+		Size:           &size,
+		SourceExcludes: sourceExcludes,
+		Timeout:        20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	var esSearchResp RealtimeSearchResponse
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("GetRealtimeBySid(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	defer func() {
+		resp = nil
+	}()
+	err = s.decode(resp, &esSearchResp)
+	if err != nil {
+		s.log.Error("GetRealtimeBySid(). json.Unmarshal(). err:", zap.Error(err))
+		return nil, err
+	}
+	var rts []AqiRealtime
+	for _, item := range esSearchResp.Hits.Hits {
+		rts = append(rts, item.Source)
+	}
+	return rts, nil
+}
+
+func (s *EsStore) GetRealtimeBySidAndPol(sid string, pol string) (*AqiRealtime, error) {
+	search := &esapi.GetRequest{
+		Index:          s.conf().RealtimeIndex,
+		DocumentID:     "rt_" + sid + "$" + pol,
+		SourceExcludes: []string{"forecast"},
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	defer func() {
+		resp = nil
+	}()
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("GetRealtimeBySidAndPol(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return nil, err
+	}
+	var response RealtimeGetResponse
+	err = s.decode(resp, &response)
+	if err != nil {
+		s.log.Error("GetRealtimeBySidAndPol(). json.Unmarshal(). err:", zap.Error(err))
+		return nil, err
+	}
+	if response.Found {
+		return &response.Source, nil
+	}
+	return nil, nil
+}
+
+// GetRealtimeMax returns the max pollutant value of every station, the idx range is split in two
+// halves so the terms aggregation stays below the bucket limit
+func (s *EsStore) GetRealtimeMax() (map[string]float64, error) {
+	values := map[string]float64{}
+	var wg sync.WaitGroup
+	mu := sync.Mutex{}
+	for _, from := range []int{0, 8000} {
+		wg.Add(1)
+		go func(st int) {
+			defer wg.Done()
+			realResp, err := s.getHalfRealtimeStation(st, st+8000)
+			if err != nil {
+				s.log.Error("GetRealtimeMax(). getHalfRealtimeStation(). err:", zap.Error(err))
+				return
+			}
+			mu.Lock()
+			for _, item := range realResp.Aggregations.Buckets.Buckets {
+				values[item.Key] = item.Data.Value
+			}
+			mu.Unlock()
+		}(from)
+	}
+	wg.Wait()
+	return values, nil
+}
+
+func (s *EsStore) AggregateRealtime(pol string, agg string) (map[string]float64, error) {
+	return s.aggregateBySid("AggregateRealtime", []string{s.conf().RealtimeIndex}, elastic.NewTermQuery("pol", pol), agg)
+}
+
+func (s *EsStore) AggregateStations(pol string, st time.Time, et time.Time, agg string) (map[string]float64, error) {
+	filter := elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery("pol", pol),
+		elastic.NewRangeQuery("tm").Gte(st.UnixMilli()).Lte(et.UnixMilli()),
+	)
+	return s.aggregateBySid("AggregateStations", s.hisIndexes(st, et), filter, agg)
+}
+
+// aggregateBySid runs an avg or max of data per sid, split in idx halves like GetRealtimeMax
+func (s *EsStore) aggregateBySid(caller string, indexes []string, filter elastic.Query, agg string) (map[string]float64, error) {
+	values := map[string]float64{}
+	var wg sync.WaitGroup
+	mu := sync.Mutex{}
+	var aggErr error
+	for _, from := range []int{0, 8000} {
+		wg.Add(1)
+		go func(st int) {
+			defer wg.Done()
+			halfValues, err := s.aggregateHalfBySid(indexes, filter, agg, st, st+8000)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				s.log.Error(caller+"(). aggregateHalfBySid(). err:", zap.Error(err))
+				aggErr = err
+				return
+			}
+			for sid, val := range halfValues {
+				values[sid] = val
+			}
+		}(from)
+	}
+	wg.Wait()
+	if aggErr != nil {
+		return nil, aggErr
+	}
+	return values, nil
+}
+
+func (s *EsStore) aggregateHalfBySid(indexes []string, filter elastic.Query, agg string, from int, to int) (map[string]float64, error) {
+	var metric elastic.Aggregation = elastic.NewAvgAggregation("data")
+	if agg == "max" {
+		metric = elastic.NewMaxAggregation("data")
+	}
+	query, err := elastic.NewSearchBody().
+		Query(elastic.NewBoolQuery().Filter(filter, elastic.NewRangeQuery("idx").Gte(from).Lt(to))).
+		Aggregation("buckets", elastic.NewTermsAggregation("sid").
+			Size(20000).
+			SubAggregation("data", metric)).
+		Size(0).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	search := &esapi.SearchRequest{
+		Index:             indexes,
+		Body:              strings.NewReader(query),
+		IgnoreUnavailable: esapi.BoolPtr(true),
+		Timeout:           20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for _, bucket := range gjson.GetBytes(resp, "aggregations.buckets.buckets").Array() {
+		// avg is null for a bucket without values
+		if val := bucket.Get("data.value"); val.Type == gjson.Number {
+			values[bucket.Get("key").String()] = val.Float()
+		}
+	}
+	return values, nil
+}
+
+func (s *EsStore) getHalfRealtimeStation(from int, to int) (*RealtimeAggResponse, error) {
+	query, err := elastic.NewSearchBody().
+		Query(elastic.NewBoolQuery().Must(elastic.NewRangeQuery("idx").Gte(from).Lt(to))).
+		Aggregation("buckets", elastic.NewTermsAggregation("sid").
+			Size(20000).
+			Order("data", false).
+			SubAggregation("data", elastic.NewMaxAggregation("data"))).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	search := &esapi.SearchRequest{
+		Index:          []string{s.conf().RealtimeIndex},
+		Body:           strings.NewReader(query),
+		Size:           &size,
+		SourceExcludes: []string{"forecast", "daily"},
+		Timeout:        20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	if err != nil {
+		return nil, err
+	}
+	var respEs RealtimeAggResponse
+	err = s.decode(resp, &respEs)
+	if err != nil {
+		return nil, err
+	}
+	return &respEs, nil
+}
+
+func (s *EsStore) hisIndexes(st time.Time, et time.Time) []string {
+	var indexes []string
+	// the indices are split by utc year
+	for i := st.UTC().Year(); i <= et.UTC().Year(); i++ {
+		indexes = append(indexes, strings.Replace(s.conf().HisIndex, "$year", strconv.Itoa(i), -1))
+	}
+	return indexes
+}
+
+func historyQuery(sid string, pol string, st time.Time, et time.Time) elastic.Query {
+	boolQuery := elastic.NewBoolQuery().Must(
+		elastic.NewMatchQuery("sid", sid),
+		elastic.NewRangeQuery("tm").Gte(st.UnixMilli()).Lte(et.UnixMilli()),
+	)
+	if pol != "all" {
+		boolQuery.Must(elastic.NewMatchQuery("pol", pol))
+	}
+	return boolQuery
+}
+
+// GetHistoryByRange scrolls through the whole range, use PageHistory to bound the response size
+func (s *EsStore) GetHistoryByRange(sid string, pol string, st time.Time, et time.Time) ([]AqiHistory, error) {
+	query, err := elastic.NewSearchBody().Query(historyQuery(sid, pol, st, et)).Build()
+	if err != nil {
+		return nil, err
+	}
+	size := 10000
+	request := &esapi.SearchRequest{
+		Index:             s.hisIndexes(st, et),
+		Body:              strings.NewReader(query),
+		Size:              &size,
+		Scroll:            time.Second * 20,
+		IgnoreUnavailable: esapi.BoolPtr(true),
+		Timeout:           20 * time.Second,
+	}
+	results, err := s.api.ScrollSearch(s.ctx, request)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hisList []AqiHistory
+	for _, hit := range results {
+		var his AqiHistory
+		err = json.UnmarshalFromString(hit.Raw, &his)
+		if err != nil {
+			continue
+		}
+		hisList = append(hisList, his)
+	}
+	defer func() {
+		results = nil
+	}()
+	return hisList, nil
+}
+
+func (s *EsStore) ScanHistory(sids []string, pols []string, st time.Time, et time.Time, fn func(his *AqiHistory) error) error {
+	boolQuery := elastic.NewBoolQuery().Filter(
+		elastic.NewTermsQueryFromStrings("sid", sids),
+		elastic.NewRangeQuery("tm").Gte(st.UnixMilli()).Lte(et.UnixMilli()),
+	)
+	if len(pols) > 0 {
+		boolQuery.Filter(elastic.NewTermsQueryFromStrings("pol", pols))
+	}
+	query, err := elastic.NewSearchBody().
+		Query(boolQuery).
+		Sort(elastic.NewFieldSort("idx"), elastic.NewFieldSort("tm")).
+		Build()
+	if err != nil {
+		return err
+	}
+	size := 10000
+	request := &esapi.SearchRequest{
+		Index:             s.hisIndexes(st, et),
+		Body:              strings.NewReader(query),
+		Size:              &size,
+		Scroll:            time.Minute,
+		IgnoreUnavailable: esapi.BoolPtr(true),
+		Timeout:           20 * time.Second,
+	}
+	err = s.api.ScrollEach(s.ctx, request, func(hits []gjson.Result) error {
+		for _, hit := range hits {
+			var his AqiHistory
+			if err := json.UnmarshalFromString(hit.Raw, &his); err != nil {
+				continue
+			}
+			if err := fn(&his); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && strings.HasPrefix(err.Error(), "404") {
+		return nil
+	}
+	return err
+}
+
+// SearchCompare sends the station, realtime and per station history searches as one _msearch,
+// history is capped at 10000 points per station
+func (s *EsStore) SearchCompare(sids []string, pol string, st time.Time, et time.Time) (*CompareData, error) {
+	msearch := elastic.NewMultiSearchBody().
+		Add([]string{s.conf().StationIndex}, elastic.NewSearchBody().
+			Query(elastic.NewTermsQueryFromStrings("sid", sids)).
+			Size(len(sids))).
+		Add([]string{s.conf().RealtimeIndex}, elastic.NewSearchBody().
+			Query(elastic.NewTermsQueryFromStrings("sid", sids)).
+			SourceExcludes("forecast").
+			Size(len(sids)*10))
+	indexes := s.hisIndexes(st, et)
+	for _, sid := range sids {
+		msearch.Add(indexes, elastic.NewSearchBody().
+			Query(historyQuery(sid, pol, st, et)).
+			Sort(elastic.NewFieldSort("tm")).
+			Size(10000))
+	}
+	body, err := msearch.Build()
+	if err != nil {
+		return nil, err
+	}
+	responses, err := s.api.MultiSearch(s.ctx, body)
+	if err != nil {
+		s.log.Error("SearchCompare(). es.MultiSearch(). err:", zap.Error(err))
+		return nil, err
+	}
+	if len(responses) != len(sids)+2 {
+		return nil, errors.New("SearchCompare(). unexpected msearch response count " + strconv.Itoa(len(responses)))
+	}
+	for i, resp := range responses {
+		// a missing index only empties its own search
+		if resp.Get("error").Exists() && resp.Get("status").Int() != 404 {
+			return nil, errors.New(resp.Get("status").String() + "," + resp.Get("error").Raw)
+		}
+		if resp.Get("_shards.failed").Int() > 0 {
+			s.log.Warn("SearchCompare(). shard failure:", zap.Int("search", i), zap.String("failures", resp.Get("_shards.failures").Raw))
+		}
+	}
+	data := &CompareData{History: map[string][]AqiHistory{}}
+	var stations []AqiStation
+	for _, hit := range responses[0].Get("hits.hits.#._source").Array() {
+		var station AqiStation
+		if err = json.UnmarshalFromString(hit.Raw, &station); err != nil {
+			continue
+		}
+		stations = append(stations, station)
+	}
+	data.Stations = buildResponses(stations)
+	for _, hit := range responses[1].Get("hits.hits.#._source").Array() {
+		var rt AqiRealtime
+		if err = json.UnmarshalFromString(hit.Raw, &rt); err != nil {
+			continue
+		}
+		data.Realtime = append(data.Realtime, rt)
+	}
+	for i, sid := range sids {
+		for _, hit := range responses[i+2].Get("hits.hits.#._source").Array() {
+			var his AqiHistory
+			if err = json.UnmarshalFromString(hit.Raw, &his); err != nil {
+				continue
+			}
+			data.History[sid] = append(data.History[sid], his)
+		}
+	}
+	return data, nil
+}
+
+const pitKeepAlive = "5m"
+
+type esHistoryCursor struct {
+	Key   string                `json:"key"`
+	Pit   string                `json:"pit"`
+	After []jsoniter.RawMessage `json:"after"`
+}
+
+// PageHistory pages through a point in time with search_after, the cursor carries the pit id and
+// the sort values of the last hit so every page sees the same snapshot. A first page is searched
+// without a pit and only a full one is searched again on a new pit. A pit handed out in a cursor is
+// closed on the last page only, a failed page keeps it so the client can retry the same cursor
+// until it expires
+func (s *EsStore) PageHistory(sid string, pol string, st time.Time, et time.Time, cursor string, limit int) ([]AqiHistory, string, error) {
+	cur := esHistoryCursor{Key: historyCursorKey(sid, pol, st, et)}
+	if cursor != "" {
+		var prev esHistoryCursor
+		if err := decodeCursor(cursor, &prev); err != nil || prev.Pit == "" || prev.Key != cur.Key {
+			return nil, "", ErrInvalidCursor
+		}
+		cur = prev
+	} else {
+		resp, err := s.searchHistoryPage(sid, pol, st, et, &cur, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(resp.Hits.Hits) < limit {
+			return historyHits(resp), "", nil
+		}
+		// the pit sorts on its shard doc tiebreaker too, the sort values of a search without it can't go on it
+		pit, err := s.api.OpenPointInTime(s.ctx, s.hisIndexes(st, et), pitKeepAlive)
+		if err != nil {
+			s.log.Error("PageHistory(). es.OpenPointInTime(). err:", zap.Error(err))
+			return nil, "", err
+		}
+		cur.Pit = pit
+	}
+	resp, err := s.searchHistoryPage(sid, pol, st, et, &cur, limit)
+	if err != nil {
+		// the pit of a first page never reached the client
+		if cursor == "" {
+			s.closePit(cur.Pit)
+		}
+		return nil, "", err
+	}
+	if resp.PitId != "" {
+		cur.Pit = resp.PitId
+	}
+	hits := resp.Hits.Hits
+	if len(hits) < limit {
+		s.closePit(cur.Pit)
+		return historyHits(resp), "", nil
+	}
+	cur.After = hits[len(hits)-1].Sort
+	next, err := encodeCursor(cur)
+	if err != nil {
+		s.closePit(cur.Pit)
+		return nil, "", err
+	}
+	return historyHits(resp), next, nil
+}
+
+// searchHistoryPage searches a page of history newest first, on the pit of the cursor after its sort
+// values or on the indices of the range without a pit
+func (s *EsStore) searchHistoryPage(sid string, pol string, st time.Time, et time.Time, cur *esHistoryCursor, limit int) (*HistorySearchResponse, error) {
+	body := elastic.NewSearchBody().
+		Query(historyQuery(sid, pol, st, et)).
+		Sort(elastic.NewFieldSort("tm").Desc()).
+		TrackTotalHits(false).
+		Size(limit)
+	request := esapi.SearchRequest{Timeout: 20 * time.Second}
+	if cur.Pit != "" {
+		body.PointInTime(cur.Pit, pitKeepAlive)
+	} else {
+		request.Index = s.hisIndexes(st, et)
+		request.IgnoreUnavailable = esapi.BoolPtr(true)
+	}
+	if len(cur.After) > 0 {
+		after := make([]interface{}, len(cur.After))
+		for i := range cur.After {
+			after[i] = cur.After[i]
+		}
+		body.SearchAfter(after...)
+	}
+	query, err := body.Build()
+	if err != nil {
+		return nil, err
+	}
+	request.Body = strings.NewReader(query)
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, request)
+	if err != nil {
+		// an expired or unknown pit id answers 404
+		if cur.Pit != "" && strings.HasPrefix(err.Error(), "404") {
+			return nil, ErrInvalidCursor
+		}
+		s.log.Error("PageHistory(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	var esSearchResp HistorySearchResponse
+	if err = s.decode(resp, &esSearchResp); err != nil {
+		return nil, err
+	}
+	return &esSearchResp, nil
+}
+
+func historyHits(resp *HistorySearchResponse) []AqiHistory {
+	var hisList []AqiHistory
+	for _, item := range resp.Hits.Hits {
+		hisList = append(hisList, item.Source)
+	}
+	return hisList
+}
+
+func (s *EsStore) closePit(pit string) {
+	if err := s.api.ClosePointInTime(s.ctx, pit); err != nil {
+		s.log.Warn("PageHistory(). es.ClosePointInTime(). err:", zap.Error(err))
+	}
+}
+
+func (s *EsStore) CountHistory(sid string, years []int) (int64, error) {
+	var indexes []string
+	for _, year := range years {
+		indexes = append(indexes, strings.Replace(s.conf().HisIndex, "$year", strconv.Itoa(year), -1))
+	}
+	query, err := elastic.NewSearchBody().Query(elastic.NewMatchQuery("sid", sid)).Build()
+	if err != nil {
+		return 0, err
+	}
+	req := esapi.CountRequest{
+		Index: indexes,
+		Body:  strings.NewReader(query),
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	return gjson.ParseBytes(resp).Get("count").Int(), nil
+}
+
+func (s *EsStore) AggregateHistory(sid string, pol string, st time.Time, et time.Time, interval string) (*HistoryStats, error) {
+	indexes := s.hisIndexes(st, et)
+	metrics := map[string]elastic.Aggregation{
+		"avg": elastic.NewAvgAggregation("data"),
+		"min": elastic.NewMinAggregation("data"),
+		"max": elastic.NewMaxAggregation("data"),
+		"pct": elastic.NewPercentilesAggregation("data", 50, 90, 95, 99),
+	}
+	tz := st.Format("-07:00")
+	buckets := elastic.NewDateHistogramAggregation("tm", interval).TimeZone(tz).MinDocCount(1)
+	body := elastic.NewSearchBody().
+		Query(historyQuery(sid, pol, st, et)).
+		TrackTotalHits(true).
+		Aggregation("buckets", buckets).
+		Aggregation("daily", elastic.NewDateHistogramAggregation("tm", "day").
+			TimeZone(tz).
+			MinDocCount(1).
+			SubAggregation("avg", elastic.NewAvgAggregation("data")))
+	for name, agg := range metrics {
+		buckets.SubAggregation(name, agg)
+		body.Aggregation(name, agg)
+	}
+	query, err := body.Build()
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	request := esapi.SearchRequest{
+		Index:             indexes,
+		Body:              strings.NewReader(query),
+		Size:              &size,
+		IgnoreUnavailable: esapi.BoolPtr(true),
+		Timeout:           20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, request)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("AggregateHistory(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	root := gjson.ParseBytes(resp)
+	total := root.Get("hits.total.value").Int()
+	if total == 0 {
+		return nil, nil
+	}
+	aggs := root.Get("aggregations")
+	summary := parseStatItem(aggs, st.Location())
+	summary.Key = TruncateInterval(st, "day").UnixMilli()
+	summary.Date = st.Format("2006-01-02")
+	summary.Count = total
+	stats := &HistoryStats{
+		Summary:  summary,
+		DailyAvg: map[int64]float64{},
+	}
+	for _, bucket := range aggs.Get("buckets.buckets").Array() {
+		stats.Buckets = append(stats.Buckets, parseStatItem(bucket, st.Location()))
+	}
+	for _, day := range aggs.Get("daily.buckets").Array() {
+		stats.DailyAvg[day.Get("key").Int()] = roundStat(day.Get("avg.value").Float())
+	}
+	return stats, nil
+}
+
+func parseStatItem(r gjson.Result, loc *time.Location) HistoryStatItem {
+	key := r.Get("key").Int()
+	return HistoryStatItem{
+		Key:   key,
+		Date:  time.UnixMilli(key).In(loc).Format("2006-01-02"),
+		Count: r.Get("doc_count").Int(),
+		Avg:   roundStat(r.Get("avg.value").Float()),
+		Min:   r.Get("min.value").Float(),
+		Max:   r.Get("max.value").Float(),
+		P50:   roundStat(r.Get(`pct.values.50\.0`).Float()),
+		P90:   roundStat(r.Get(`pct.values.90\.0`).Float()),
+		P95:   roundStat(r.Get(`pct.values.95\.0`).Float()),
+		P99:   roundStat(r.Get(`pct.values.99\.0`).Float()),
+	}
+}
+
+func (s *EsStore) GetRealtimeByPol(pol string, sids []string) ([]AqiRealtime, error) {
+	if len(sids) == 0 {
+		return nil, nil
+	}
+	query, err := elastic.NewSearchBody().
+		Query(elastic.NewBoolQuery().Filter(
+			elastic.NewTermQuery("pol", pol),
+			elastic.NewTermsQueryFromStrings("sid", sids),
+		)).
+		SourceExcludes("forecast").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	size := len(sids)
+	search := &esapi.SearchRequest{
+		Index:   []string{s.conf().RealtimeIndex},
+		Body:    strings.NewReader(query),
+		Size:    &size,
+		Timeout: 20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("GetRealtimeByPol(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	var esSearchResp RealtimeSearchResponse
+	if err = s.decode(resp, &esSearchResp); err != nil {
+		s.log.Error("GetRealtimeByPol(). json.Unmarshal(). err:", zap.Error(err))
+		return nil, err
+	}
+	var rts []AqiRealtime
+	for _, item := range esSearchResp.Hits.Hits {
+		rts = append(rts, item.Source)
+	}
+	return rts, nil
+}
+
+// alertIndexMappings keeps the string fields of rules and states as keywords
+const alertIndexMappings = `{"mappings":{"dynamic_templates":[{"strings":{"match_mapping_type":"string","mapping":{"type":"keyword"}}}]}}`
+
+// CreateAlertIndices creates the alert rule and state indices when they do not exist
+func (s *EsStore) CreateAlertIndices() {
+	s.api.CreateIndex(s.conf().AlertRuleIndex, alertIndexMappings, "")
+	s.api.CreateIndex(s.conf().AlertStateIndex, alertIndexMappings, "")
+}
+
+// searchAlertDocs returns the sources of up to 10000 documents of an alert index
+func (s *EsStore) searchAlertDocs(caller string, index string, q elastic.Query) ([]gjson.Result, error) {
+	query, err := elastic.NewSearchBody().Query(q).Build()
+	if err != nil {
+		return nil, err
+	}
+	size := 10000
+	search := &esapi.SearchRequest{
+		Index:   []string{index},
+		Body:    strings.NewReader(query),
+		Size:    &size,
+		Timeout: 20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error(caller+"(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	return gjson.GetBytes(resp, "hits.hits.#._source").Array(), nil
+}
+
+func (s *EsStore) ListAlertRules() ([]AlertRule, error) {
+	hits, err := s.searchAlertDocs("ListAlertRules", s.conf().AlertRuleIndex, elastic.NewMatchAllQuery())
+	if err != nil {
+		return nil, err
+	}
+	rules := []AlertRule{}
+	for _, hit := range hits {
+		var rule AlertRule
+		if err = json.UnmarshalFromString(hit.Raw, &rule); err != nil {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (s *EsStore) SaveAlertRule(rule *AlertRule) error {
+	body, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	req := &esapi.IndexRequest{
+		Index:      s.conf().AlertRuleIndex,
+		DocumentID: rule.Id,
+		Body:       bytes.NewReader(body),
+		Refresh:    "true",
+	}
+	if _, err = s.api.ProcessRespWithCtx(s.ctx, req); err != nil {
+		s.log.Error("SaveAlertRule(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s *EsStore) RemoveAlertRule(id string) error {
+	req := &esapi.DeleteRequest{
+		Index:      s.conf().AlertRuleIndex,
+		DocumentID: id,
+		Refresh:    "true",
+	}
+	if _, err := s.api.ProcessRespWithCtx(s.ctx, req); err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return ErrAlertRuleNotFound
+		}
+		s.log.Error("RemoveAlertRule(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func alertStateQuery(ruleId string) elastic.Query {
+	if ruleId == "" {
+		return elastic.NewMatchAllQuery()
+	}
+	return elastic.NewTermQuery("rule_id", ruleId)
+}
+
+func (s *EsStore) ListAlertStates(ruleId string) ([]AlertState, error) {
+	hits, err := s.searchAlertDocs("ListAlertStates", s.conf().AlertStateIndex, alertStateQuery(ruleId))
+	if err != nil {
+		return nil, err
+	}
+	states := []AlertState{}
+	for _, hit := range hits {
+		var state AlertState
+		if err = json.UnmarshalFromString(hit.Raw, &state); err != nil {
+			continue
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// SaveAlertStates indexes the states in one bulk request, the state id is the document id
+func (s *EsStore) SaveAlertStates(states []AlertState) error {
+	if len(states) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	for i := range states {
+		meta, err := json.Marshal(map[string]interface{}{
+			"index": map[string]string{"_index": s.conf().AlertStateIndex, "_id": states[i].Id},
+		})
+		if err != nil {
+			return err
+		}
+		doc, err := json.Marshal(&states[i])
+		if err != nil {
+			return err
+		}
+		buf.Write(meta)
+		buf.WriteByte('\n')
+		buf.Write(doc)
+		buf.WriteByte('\n')
+	}
+	req := &esapi.BulkRequest{
+		Body:    &buf,
+		Refresh: "true",
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, req)
+	if err != nil {
+		s.log.Error("SaveAlertStates(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return err
+	}
+	if gjson.GetBytes(resp, "errors").Bool() {
+		reason := gjson.GetBytes(resp, "items.#.index.error.reason").Raw
+		s.log.Error("SaveAlertStates(). bulk item err:", zap.String("reason", reason))
+		return errors.New("SaveAlertStates(). bulk item err: " + reason)
+	}
+	return nil
+}
+
+func (s *EsStore) RemoveAlertStates(ruleId string) error {
+	query, err := elastic.NewSearchBody().Query(alertStateQuery(ruleId)).Build()
+	if err != nil {
+		return err
+	}
+	refresh := true
+	req := &esapi.DeleteByQueryRequest{
+		Index:     []string{s.conf().AlertStateIndex},
+		Body:      strings.NewReader(query),
+		Conflicts: "proceed",
+		Refresh:   &refresh,
+	}
+	if _, err = s.api.ProcessRespWithCtx(s.ctx, req); err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil
+		}
+		s.log.Error("RemoveAlertStates(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// auditIndexMappings keeps the string fields as keywords and stores the station snapshots without indexing them
+const auditIndexMappings = `{"mappings":{"dynamic_templates":[{"strings":{"match_mapping_type":"string","mapping":{"type":"keyword"}}}],` +
+	`"properties":{"before":{"type":"object","enabled":false},"after":{"type":"object","enabled":false}}}}`
+
+// CreateAuditIndex creates the station audit index when it does not exist
+func (s *EsStore) CreateAuditIndex() {
+	s.api.CreateIndex(s.conf().AuditIndex, auditIndexMappings, "")
+}
+
+// AppendStationAudit indexes the entry right away, unlike the station it is not queued in the bulk indexer
+// so a write is refused when its entry can't be stored
+func (s *EsStore) AppendStationAudit(entry *StationAudit) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	req := &esapi.IndexRequest{
+		Index:      s.conf().AuditIndex,
+		DocumentID: entry.Id,
+		Body:       bytes.NewReader(body),
+		Refresh:    "true",
+	}
+	if _, err = s.api.ProcessRespWithCtx(s.ctx, req); err != nil {
+		s.log.Error("AppendStationAudit(). es.ProcessRespWithCli(). err:", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s *EsStore) ListStationAudits(sid string, size int) ([]StationAudit, error) {
+	var q elastic.Query = elastic.NewMatchAllQuery()
+	if sid != "" {
+		q = elastic.NewTermQuery("sid", sid)
+	}
+	query, err := elastic.NewSearchBody().Query(q).Sort(elastic.NewFieldSort("time").Desc()).Build()
+	if err != nil {
+		return nil, err
+	}
+	search := &esapi.SearchRequest{
+		Index:   []string{s.conf().AuditIndex},
+		Body:    strings.NewReader(query),
+		Size:    &size,
+		Timeout: 20 * time.Second,
+	}
+	resp, err := s.api.ProcessRespWithCtx(s.ctx, search)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return nil, nil
+		}
+		s.log.Error("ListStationAudits(). es.ProcessRespWithCli(). err:", zap.String("query", query), zap.Error(err))
+		return nil, err
+	}
+	entries := []StationAudit{}
+	for _, hit := range gjson.GetBytes(resp, "hits.hits.#._source").Array() {
+		var entry StationAudit
+		if err = json.UnmarshalFromString(hit.Raw, &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
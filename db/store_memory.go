@@ -0,0 +1,830 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+)
+
+// MemoryStore implements the station, realtime and history stores on in-memory slices seeded
+// from json files, so the server can run without an elasticsearch cluster. Station writes are saved back to stations.json
+type MemoryStore struct {
+	lock     sync.RWMutex
+	dir      string
+	stations []AqiStation
+	realtime []AqiRealtime
+	history  []AqiHistory
+}
+
+// NewMemoryStore loads stations.json, realtime.json and history.json from dir, missing files leave the store empty
+func NewMemoryStore(dir string) (*MemoryStore, error) {
+	s := &MemoryStore{dir: dir}
+	if err := loadJsonFile(filepath.Join(dir, "stations.json"), &s.stations); err != nil {
+		return nil, err
+	}
+	if err := loadJsonFile(filepath.Join(dir, "realtime.json"), &s.realtime); err != nil {
+		return nil, err
+	}
+	if err := loadJsonFile(filepath.Join(dir, "history.json"), &s.history); err != nil {
+		return nil, err
+	}
+	sort.Slice(s.stations, func(i, j int) bool {
+		return s.stations[i].Idx < s.stations[j].Idx
+	})
+	return s, nil
+}
+
+func loadJsonFile(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *MemoryStore) filterStations(match func(st *AqiStation) bool, size int) []AqiStationResp {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var sts []AqiStation
+	for i := range s.stations {
+		if size > 0 && len(sts) >= size {
+			break
+		}
+		if !s.stations[i].Retired && match(&s.stations[i]) {
+			sts = append(sts, s.stations[i])
+		}
+	}
+	if len(sts) == 0 {
+		return []AqiStationResp{}
+	}
+	return buildResponses(sts)
+}
+
+// GetStationById returns retired stations too, like the get by id of elasticsearch
+func (s *MemoryStore) GetStationById(sid string) (*AqiStationResp, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for i := range s.stations {
+		if s.stations[i].Sid == sid {
+			return buildResponse(&s.stations[i])
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) SaveStation(st *AqiStation, create bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stations := make([]AqiStation, 0, len(s.stations)+1)
+	replaced := false
+	for _, stored := range s.stations {
+		if stored.Sid == st.Sid {
+			if create {
+				return ErrStationExists
+			}
+			if stored.UpdatedAt > st.UpdatedAt {
+				return nil
+			}
+			stored = *st
+			replaced = true
+		}
+		stations = append(stations, stored)
+	}
+	if !replaced {
+		stations = append(stations, *st)
+	}
+	sort.SliceStable(stations, func(i, j int) bool {
+		return stations[i].Idx < stations[j].Idx
+	})
+	if err := writeJsonFile(s.dir, "stations.json", stations); err != nil {
+		return err
+	}
+	s.stations = stations
+	return nil
+}
+
+func (s *MemoryStore) SearchStationsByName(name string, size int) ([]AqiStationResp, error) {
+	name = strings.ToLower(name)
+	return s.filterStations(func(st *AqiStation) bool {
+		return strings.Contains(strings.ToLower(st.Name), name)
+	}, size), nil
+}
+
+func (s *MemoryStore) SearchStationsByCityName(name string, size int) ([]AqiStationResp, error) {
+	name = strings.ToLower(name)
+	return s.filterStations(func(st *AqiStation) bool {
+		return strings.Contains(strings.ToLower(st.CityName), name)
+	}, size), nil
+}
+
+func (s *MemoryStore) SearchStationByRadius(x string, y string, dis float64, unit string, size int) ([]AqiStationResp, error) {
+	lon, err := strconv.ParseFloat(x, 64)
+	if err != nil {
+		return nil, err
+	}
+	lat, err := strconv.ParseFloat(y, 64)
+	if err != nil {
+		return nil, err
+	}
+	switch unit {
+	case "m":
+		dis = dis / 1000
+	case "mi":
+		dis = dis * 1.609344
+	}
+	sts := s.filterStations(func(st *AqiStation) bool {
+		return Haversine(lon, lat, st.Loc.Lon, st.Loc.Lat) <= dis
+	}, 0)
+	sort.SliceStable(sts, func(i, j int) bool {
+		return Haversine(lon, lat, sts[i].Loc.Lon, sts[i].Loc.Lat) < Haversine(lon, lat, sts[j].Loc.Lon, sts[j].Loc.Lat)
+	})
+	if size > 0 && len(sts) > size {
+		sts = sts[:size]
+	}
+	return sts, nil
+}
+
+// SearchStationsByArea matches like the geo_bounding_box of es, a left edge east of the right one
+// makes the box cross the antimeridian
+func (s *MemoryStore) SearchStationsByArea(bounds Bounds, size int) ([]AqiStationResp, error) {
+	left, right := bounds.TopLeft.Lon, bounds.BottomRight.Lon
+	return s.filterStations(func(st *AqiStation) bool {
+		if st.Loc.Lat > bounds.TopLeft.Lat || st.Loc.Lat < bounds.BottomRight.Lat {
+			return false
+		}
+		if left > right {
+			return st.Loc.Lon >= left || st.Loc.Lon <= right
+		}
+		return st.Loc.Lon >= left && st.Loc.Lon <= right
+	}, size), nil
+}
+
+func (s *MemoryStore) SearchStationsByPolygon(polygon orb.MultiPolygon, size int) ([]AqiStationResp, error) {
+	bound := polygon.Bound()
+	return s.filterStations(func(st *AqiStation) bool {
+		point := orb.Point{st.Loc.Lon, st.Loc.Lat}
+		return bound.Contains(point) && planar.MultiPolygonContains(polygon, point)
+	}, size), nil
+}
+
+func (s *MemoryStore) GetStationsByRange(st int, et int) ([]AqiStationResp, error) {
+	return s.filterStations(func(station *AqiStation) bool {
+		return station.Idx >= st && station.Idx <= et
+	}, 0), nil
+}
+
+func (s *MemoryStore) ScanStations() ([]AqiStationResp, error) {
+	return s.filterStations(func(st *AqiStation) bool {
+		return true
+	}, 0), nil
+}
+
+func (s *MemoryStore) GetRealtimeBySid(sid string, sourceExcludes ...string) ([]AqiRealtime, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var rts []AqiRealtime
+	for _, rt := range s.realtime {
+		if rt.Sid == sid {
+			rts = append(rts, rt)
+		}
+	}
+	return rts, nil
+}
+
+func (s *MemoryStore) GetRealtimeBySidAndPol(sid string, pol string) (*AqiRealtime, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for i := range s.realtime {
+		if s.realtime[i].Sid == sid && s.realtime[i].Pol == pol {
+			rt := s.realtime[i]
+			return &rt, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) GetRealtimeMax() (map[string]float64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	values := map[string]float64{}
+	for _, rt := range s.realtime {
+		if pre, ok := values[rt.Sid]; !ok || rt.Data > pre {
+			values[rt.Sid] = rt.Data
+		}
+	}
+	return values, nil
+}
+
+func (s *MemoryStore) AggregateRealtime(pol string, agg string) (map[string]float64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	acc := newSidAccumulator(agg)
+	for _, rt := range s.realtime {
+		if rt.Pol == pol {
+			acc.add(rt.Sid, rt.Data)
+		}
+	}
+	return acc.values(), nil
+}
+
+func (s *MemoryStore) GetRealtimeByPol(pol string, sids []string) ([]AqiRealtime, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	match := map[string]bool{}
+	for _, sid := range sids {
+		match[sid] = true
+	}
+	var rts []AqiRealtime
+	for _, rt := range s.realtime {
+		if rt.Pol == pol && match[rt.Sid] {
+			rts = append(rts, rt)
+		}
+	}
+	return rts, nil
+}
+
+func (s *MemoryStore) AggregateStations(pol string, st time.Time, et time.Time, agg string) (map[string]float64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	acc := newSidAccumulator(agg)
+	for _, his := range s.history {
+		if his.Pol == pol && his.Tm >= st.UnixMilli() && his.Tm <= et.UnixMilli() {
+			acc.add(his.Sid, his.Data)
+		}
+	}
+	return acc.values(), nil
+}
+
+// sidAccumulator keeps the running avg or max of values per sid
+type sidAccumulator struct {
+	max    bool
+	sums   map[string]float64
+	counts map[string]int
+}
+
+func newSidAccumulator(agg string) *sidAccumulator {
+	return &sidAccumulator{max: agg == "max", sums: map[string]float64{}, counts: map[string]int{}}
+}
+
+func (a *sidAccumulator) add(sid string, val float64) {
+	if a.max {
+		if pre, ok := a.sums[sid]; ok && pre >= val {
+			return
+		}
+		a.sums[sid] = val
+		a.counts[sid] = 1
+		return
+	}
+	a.sums[sid] += val
+	a.counts[sid]++
+}
+
+func (a *sidAccumulator) values() map[string]float64 {
+	values := map[string]float64{}
+	for sid, sum := range a.sums {
+		values[sid] = sum / float64(a.counts[sid])
+	}
+	return values
+}
+
+func (s *MemoryStore) GetHistoryByRange(sid string, pol string, st time.Time, et time.Time) ([]AqiHistory, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var hisList []AqiHistory
+	for _, his := range s.history {
+		if his.Sid != sid || his.Tm < st.UnixMilli() || his.Tm > et.UnixMilli() {
+			continue
+		}
+		if pol != "all" && his.Pol != pol {
+			continue
+		}
+		hisList = append(hisList, his)
+	}
+	return hisList, nil
+}
+
+func (s *MemoryStore) ScanHistory(sids []string, pols []string, st time.Time, et time.Time, fn func(his *AqiHistory) error) error {
+	inSids := map[string]bool{}
+	for _, sid := range sids {
+		inSids[sid] = true
+	}
+	inPols := map[string]bool{}
+	for _, pol := range pols {
+		inPols[pol] = true
+	}
+	s.lock.RLock()
+	var hisList []AqiHistory
+	for _, his := range s.history {
+		if !inSids[his.Sid] || his.Tm < st.UnixMilli() || his.Tm > et.UnixMilli() {
+			continue
+		}
+		if len(inPols) > 0 && !inPols[his.Pol] {
+			continue
+		}
+		hisList = append(hisList, his)
+	}
+	s.lock.RUnlock()
+	sort.SliceStable(hisList, func(i, j int) bool {
+		if hisList[i].Idx != hisList[j].Idx {
+			return hisList[i].Idx < hisList[j].Idx
+		}
+		return hisList[i].Tm < hisList[j].Tm
+	})
+	for i := range hisList {
+		if err := fn(&hisList[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) SearchCompare(sids []string, pol string, st time.Time, et time.Time) (*CompareData, error) {
+	data := &CompareData{History: map[string][]AqiHistory{}}
+	for _, sid := range sids {
+		station, err := s.GetStationById(sid)
+		if err != nil {
+			return nil, err
+		}
+		if station == nil {
+			continue
+		}
+		data.Stations = append(data.Stations, *station)
+		rts, err := s.GetRealtimeBySid(sid)
+		if err != nil {
+			return nil, err
+		}
+		data.Realtime = append(data.Realtime, rts...)
+		hisList, err := s.GetHistoryByRange(sid, pol, st, et)
+		if err != nil {
+			return nil, err
+		}
+		data.History[sid] = hisList
+	}
+	return data, nil
+}
+
+func (s *MemoryStore) CountHistory(sid string, years []int) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	inYears := map[int]bool{}
+	for _, year := range years {
+		inYears[year] = true
+	}
+	var count int64
+	for _, his := range s.history {
+		if his.Sid == sid && inYears[time.UnixMilli(his.Tm).UTC().Year()] {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// FileObjectStore implements ObjectStore on a local directory laid out as dir/bucket/name,
+// the tags of an object are kept in a json file next to it
+type FileObjectStore struct {
+	dir string
+}
+
+func NewFileObjectStore(dir string) *FileObjectStore {
+	return &FileObjectStore{dir: dir}
+}
+
+func (s *FileObjectStore) objectPath(bucket string, name string) (string, error) {
+	p := filepath.Join(s.dir, bucket, filepath.FromSlash(name))
+	if !strings.HasPrefix(p, filepath.Join(s.dir, bucket)+string(filepath.Separator)) {
+		return "", errors.New("invalid object name " + name)
+	}
+	return p, nil
+}
+
+func (s *FileObjectStore) GetObject(bucket string, name string) ([]byte, error) {
+	p, err := s.objectPath(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+func (s *FileObjectStore) GetObjectTags(bucket string, name string) (map[string]string, error) {
+	p, err := s.objectPath(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(p); err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	if err = loadJsonFile(p+".tags.json", &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (s *FileObjectStore) PutObject(bucket string, name string, data []byte, contentType string) error {
+	p, err := s.objectPath(bucket, name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+// PutTaggedObject keeps the tags next to the object as name.tags.json, they are written first
+// as the tags of an object are only read once the object exists
+func (s *FileObjectStore) PutTaggedObject(bucket string, name string, data []byte, contentType string, tags map[string]string) error {
+	p, err := s.objectPath(bucket, name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err = writeJsonFile(filepath.Dir(p), filepath.Base(p)+".tags.json", tags); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+func (s *FileObjectStore) ExistObject(bucket string, name string) bool {
+	p, err := s.objectPath(bucket, name)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	return info.Size() > 0
+}
+
+// ListObjects walks the directory of the prefix, the tag files are not objects
+func (s *FileObjectStore) ListObjects(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	root := filepath.Join(s.dir, bucket)
+	base := root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		base = filepath.Join(root, filepath.FromSlash(prefix[:i]))
+	}
+	var names []string
+	err := filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(p, ".tags.json") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RemoveObjects deletes the listed objects with their tag files, the emptied directories are left
+func (s *FileObjectStore) RemoveObjects(ctx context.Context, bucket string, prefix string) error {
+	names, err := s.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		p, err := s.objectPath(bucket, name)
+		if err != nil {
+			return err
+		}
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = os.Remove(p + ".tags.json"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckAccess needs the bucket directory like minio needs the bucket, a missing prefix is only empty
+func (s *FileObjectStore) CheckAccess(ctx context.Context, bucket string, prefix string) error {
+	if err := readDirHead(filepath.Join(s.dir, bucket)); err != nil {
+		return err
+	}
+	if err := readDirHead(filepath.Join(s.dir, bucket, filepath.FromSlash(prefix))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readDirHead reads one entry of a directory, which proves access without listing a large bucket
+func readDirHead(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func (s *MemoryStore) AggregateHistory(sid string, pol string, st time.Time, et time.Time, interval string) (*HistoryStats, error) {
+	hisList, err := s.GetHistoryByRange(sid, pol, st, et)
+	if err != nil || len(hisList) == 0 {
+		return nil, err
+	}
+	var all []float64
+	buckets := map[int64][]float64{}
+	days := map[int64][]float64{}
+	loc := st.Location()
+	for _, his := range hisList {
+		tm := time.UnixMilli(his.Tm).In(loc)
+		key := TruncateInterval(tm, interval).UnixMilli()
+		day := TruncateInterval(tm, "day").UnixMilli()
+		buckets[key] = append(buckets[key], his.Data)
+		days[day] = append(days[day], his.Data)
+		all = append(all, his.Data)
+	}
+	stats := &HistoryStats{
+		Summary:  buildStatItem(TruncateInterval(st, "day"), all),
+		DailyAvg: map[int64]float64{},
+	}
+	for key, values := range buckets {
+		stats.Buckets = append(stats.Buckets, buildStatItem(time.UnixMilli(key).In(loc), values))
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool {
+		return stats.Buckets[i].Key < stats.Buckets[j].Key
+	})
+	for day, values := range days {
+		stats.DailyAvg[day] = buildStatItem(time.UnixMilli(day).In(loc), values).Avg
+	}
+	return stats, nil
+}
+
+type memHistoryCursor struct {
+	Key    string `json:"key"`
+	Offset int    `json:"offset"`
+}
+
+func (s *MemoryStore) PageHistory(sid string, pol string, st time.Time, et time.Time, cursor string, limit int) ([]AqiHistory, string, error) {
+	key := historyCursorKey(sid, pol, st, et)
+	var cur memHistoryCursor
+	if cursor != "" {
+		if err := decodeCursor(cursor, &cur); err != nil || cur.Offset < 0 || cur.Key != key {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	hisList, err := s.GetHistoryByRange(sid, pol, st, et)
+	if err != nil {
+		return nil, "", err
+	}
+	sort.SliceStable(hisList, func(i, j int) bool {
+		if hisList[i].Tm != hisList[j].Tm {
+			return hisList[i].Tm > hisList[j].Tm
+		}
+		return hisList[i].Pol < hisList[j].Pol
+	})
+	if cur.Offset >= len(hisList) {
+		return nil, "", nil
+	}
+	end := cur.Offset + limit
+	if end >= len(hisList) {
+		return hisList[cur.Offset:], "", nil
+	}
+	next, err := encodeCursor(memHistoryCursor{Key: key, Offset: end})
+	if err != nil {
+		return nil, "", err
+	}
+	return hisList[cur.Offset:end], next, nil
+}
+
+// FileAlertStore implements AlertStore on alert_rules.json and alert_states.json in a local directory,
+// every write rewrites the file through a temporary file so a crash never leaves it half written
+type FileAlertStore struct {
+	lock sync.Mutex
+	dir  string
+}
+
+func NewFileAlertStore(dir string) *FileAlertStore {
+	return &FileAlertStore{dir: dir}
+}
+
+// writeJsonFile rewrites a json file of dir through a temporary file so a crash never leaves it half written
+func writeJsonFile(dir string, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	p := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(p+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (s *FileAlertStore) loadRules() ([]AlertRule, error) {
+	rules := []AlertRule{}
+	if err := loadJsonFile(filepath.Join(s.dir, "alert_rules.json"), &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (s *FileAlertStore) loadStates() ([]AlertState, error) {
+	states := []AlertState{}
+	if err := loadJsonFile(filepath.Join(s.dir, "alert_states.json"), &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (s *FileAlertStore) ListAlertRules() ([]AlertRule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.loadRules()
+}
+
+func (s *FileAlertStore) SaveAlertRule(rule *AlertRule) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rules, err := s.loadRules()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range rules {
+		if rules[i].Id == rule.Id {
+			rules[i] = *rule
+			replaced = true
+		}
+	}
+	if !replaced {
+		rules = append(rules, *rule)
+	}
+	return writeJsonFile(s.dir, "alert_rules.json", rules)
+}
+
+func (s *FileAlertStore) RemoveAlertRule(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rules, err := s.loadRules()
+	if err != nil {
+		return err
+	}
+	kept := []AlertRule{}
+	for _, rule := range rules {
+		if rule.Id != id {
+			kept = append(kept, rule)
+		}
+	}
+	if len(kept) == len(rules) {
+		return ErrAlertRuleNotFound
+	}
+	return writeJsonFile(s.dir, "alert_rules.json", kept)
+}
+
+func (s *FileAlertStore) ListAlertStates(ruleId string) ([]AlertState, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states, err := s.loadStates()
+	if err != nil {
+		return nil, err
+	}
+	if ruleId == "" {
+		return states, nil
+	}
+	result := []AlertState{}
+	for _, state := range states {
+		if state.RuleId == ruleId {
+			result = append(result, state)
+		}
+	}
+	return result, nil
+}
+
+func (s *FileAlertStore) SaveAlertStates(states []AlertState) error {
+	if len(states) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, err := s.loadStates()
+	if err != nil {
+		return err
+	}
+	index := map[string]int{}
+	for i := range stored {
+		index[stored[i].Id] = i
+	}
+	for _, state := range states {
+		if i, ok := index[state.Id]; ok {
+			stored[i] = state
+			continue
+		}
+		index[state.Id] = len(stored)
+		stored = append(stored, state)
+	}
+	return writeJsonFile(s.dir, "alert_states.json", stored)
+}
+
+func (s *FileAlertStore) RemoveAlertStates(ruleId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	states, err := s.loadStates()
+	if err != nil {
+		return err
+	}
+	kept := []AlertState{}
+	for _, state := range states {
+		if state.RuleId != ruleId {
+			kept = append(kept, state)
+		}
+	}
+	if len(kept) == len(states) {
+		return nil
+	}
+	return writeJsonFile(s.dir, "alert_states.json", kept)
+}
+
+// FileAuditStore implements AuditStore on station_audit.jsonl in a local directory, one entry per line
+type FileAuditStore struct {
+	lock sync.Mutex
+	path string
+}
+
+func NewFileAuditStore(dir string) *FileAuditStore {
+	return &FileAuditStore{path: filepath.Join(dir, "station_audit.jsonl")}
+}
+
+func (s *FileAuditStore) AppendStationAudit(entry *StationAudit) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err = os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *FileAuditStore) ListStationAudits(sid string, size int) ([]StationAudit, error) {
+	s.lock.Lock()
+	data, err := ioutil.ReadFile(s.path)
+	s.lock.Unlock()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []StationAudit{}, nil
+		}
+		return nil, err
+	}
+	entries := []StationAudit{}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i := len(lines) - 1; i >= 0 && (size <= 0 || len(entries) < size); i-- {
+		var entry StationAudit
+		if err = json.UnmarshalFromString(lines[i], &entry); err != nil {
+			continue
+		}
+		if sid == "" || entry.Sid == sid {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+// testdata/stations.json holds Beijing and stations on both sides of the antimeridian around Fiji,
+// Lautoka is retired
+func TestMemorySearchStationsByArea(t *testing.T) {
+	s, err := NewMemoryStore("testdata")
+	if err != nil {
+		t.Fatalf("NewMemoryStore() err: %v", err)
+	}
+	tests := []struct {
+		name        string
+		topLeft     GeoPoint
+		bottomRight GeoPoint
+		size        int
+		want        string
+	}{
+		{name: "box around beijing", topLeft: GeoPoint{Lon: 115, Lat: 41}, bottomRight: GeoPoint{Lon: 118, Lat: 39}, want: "1451"},
+		{name: "box crossing the antimeridian", topLeft: GeoPoint{Lon: 170, Lat: -10}, bottomRight: GeoPoint{Lon: -170, Lat: -25},
+			want: "9001,9002,9003"},
+		{name: "narrow box crossing the antimeridian", topLeft: GeoPoint{Lon: 178, Lat: -10}, bottomRight: GeoPoint{Lon: -173, Lat: -25},
+			want: "9001,9002"},
+		{name: "crossing box limited to its latitudes", topLeft: GeoPoint{Lon: 170, Lat: 70}, bottomRight: GeoPoint{Lon: -140, Lat: 50},
+			want: "9004"},
+		{name: "crossing box with size", topLeft: GeoPoint{Lon: 170, Lat: -10}, bottomRight: GeoPoint{Lon: -170, Lat: -25}, size: 2,
+			want: "9001,9002"},
+		{name: "box west of the antimeridian only", topLeft: GeoPoint{Lon: 170, Lat: -10}, bottomRight: GeoPoint{Lon: 180, Lat: -25},
+			want: "9001"},
+		{name: "whole world", topLeft: GeoPoint{Lon: -180, Lat: 90}, bottomRight: GeoPoint{Lon: 180, Lat: -90},
+			want: "1451,9001,9002,9003,9004"},
+		{name: "empty box", topLeft: GeoPoint{Lon: 0, Lat: 10}, bottomRight: GeoPoint{Lon: 10, Lat: 0}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts, err := s.SearchStationsByArea(Bounds{TopLeft: tt.topLeft, BottomRight: tt.bottomRight}, tt.size)
+			if err != nil {
+				t.Fatalf("SearchStationsByArea() err: %v", err)
+			}
+			var sids []string
+			for _, st := range sts {
+				sids = append(sids, st.Sid)
+			}
+			if got := strings.Join(sids, ","); got != tt.want {
+				t.Errorf("sids = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MinioStore implements ObjectStore on a minio client
+type MinioStore struct {
+	cli       *minio.Client
+	transport *http.Transport
+}
+
+func NewMinioStore(cli *minio.Client, transport *http.Transport) *MinioStore {
+	return &MinioStore{cli: cli, transport: transport}
+}
+
+// Close drops the idle connections of the client, the client can't be closed itself
+func (s *MinioStore) Close() {
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+}
+
+func (s *MinioStore) GetObject(bucket string, name string) ([]byte, error) {
+	object, err := s.cli.GetObject(context.Background(), bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return io.ReadAll(object)
+}
+
+func (s *MinioStore) GetObjectTags(bucket string, name string) (map[string]string, error) {
+	tagging, err := s.cli.GetObjectTagging(context.Background(), bucket, name, minio.GetObjectTaggingOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return tagging.ToMap(), nil
+}
+
+func (s *MinioStore) PutObject(bucket string, name string, data []byte, contentType string) error {
+	_, err := s.cli.PutObject(context.Background(), bucket, name, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{
+			ContentEncoding: "utf-8",
+			ContentType:     contentType,
+		})
+	return err
+}
+
+func (s *MinioStore) PutTaggedObject(bucket string, name string, data []byte, contentType string, objectTags map[string]string) error {
+	_, err := s.cli.PutObject(context.Background(), bucket, name, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{
+			ContentEncoding: "utf-8",
+			ContentType:     contentType,
+			UserTags:        objectTags,
+		})
+	return err
+}
+
+func (s *MinioStore) ExistObject(bucket string, name string) bool {
+	info, err := s.cli.StatObject(context.Background(), bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return false
+	}
+	return info.Size > 0
+}
+
+func (s *MinioStore) ListObjects(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	var names []string
+	for object := range s.cli.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		names = append(names, object.Key)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MinioStore) RemoveObjects(ctx context.Context, bucket string, prefix string) error {
+	names, err := s.ListObjects(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	objects := make(chan minio.ObjectInfo, len(names))
+	for _, name := range names {
+		objects <- minio.ObjectInfo{Key: name}
+	}
+	close(objects)
+	// the errors are drained to the end so the remove goroutine of the client can finish
+	for removeErr := range s.cli.RemoveObjects(ctx, bucket, objects, minio.RemoveObjectsOptions{}) {
+		if err == nil {
+			err = removeErr.Err
+		}
+	}
+	return err
+}
+
+func (s *MinioStore) CheckAccess(ctx context.Context, bucket string, prefix string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range s.cli.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1}) {
+		return object.Err
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/csnight/storm-aqi-server/db")
+
+// WithContext returns a DB whose spans and store requests are children of the span in ctx,
+// the DB itself is returned when ctx carries no recording span so untraced requests copy nothing
+func (db *DB) WithContext(ctx context.Context) *DB {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return db
+	}
+	c := *db
+	c.ctx = ctx
+	if es, ok := db.StationStore.(*EsStore); ok {
+		es = es.WithContext(ctx)
+		c.StationStore = es
+		c.StationWriter = es
+		c.AuditStore = es
+		c.RealtimeStore = es
+		c.HistoryStore = es
+		c.CompareStore = es
+		c.AlertStore = es
+	}
+	return &c
+}
+
+// startSpan starts a span named after a db method, the returned DB runs the nested calls in it.
+// Without a recording parent span nothing is started and the span is a no-op
+func (db *DB) startSpan(name string, attrs ...attribute.KeyValue) (*DB, trace.Span) {
+	if !trace.SpanFromContext(db.ctx).IsRecording() {
+		return db, trace.SpanFromContext(context.Background())
+	}
+	ctx, span := tracer.Start(db.ctx, "db."+name, trace.WithAttributes(attrs...))
+	return db.WithContext(ctx), span
+}
@@ -1,11 +1,14 @@
 package elastic
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/attribute"
 	"io"
 	"strconv"
 	"strings"
@@ -19,27 +22,31 @@ func (t *EsAPI) NewBulkProcessor() (BulkIndexer, error) {
 		NumWorkers:    8,               // The number of worker goroutines
 		FlushInterval: 5 * time.Second, // The periodic flush interval
 		Timeout:       time.Second * 60,
+		// the callbacks run while closeBulk holds bulkLock, so they number the flushes themselves
+		// instead of reading the stats of the indexer
 		OnFlushStart: func(ctx context.Context, count int) context.Context {
-			stats := t.Bulk.Stats()
-			t.Log.Debugf("Executing bulk \u001B[36m[%d]\u001B[0m requests \u001B[36m%d\u001B[0m", stats.NumRequests+1, count)
+			seq := atomic.AddUint64(&t.bulkSeq, 1)
+			t.Log.Debugf("Executing bulk \u001B[36m[%d]\u001B[0m requests \u001B[36m%d\u001B[0m", seq, count)
 			ctx = context.WithValue(ctx, "startTm", time.Now())
-			ctx = context.WithValue(ctx, "seq", stats.NumRequests+1)
+			ctx = context.WithValue(ctx, "seq", seq)
 			return ctx
 		},
 		OnError: func(ctx context.Context, items []BulkIndexerItem, err error) {
-			if items != nil && len(items) > 0 {
-				t.AddToFailure(items...)
-				atomic.AddInt64(&t.errTotal, int64(len(items)))
+			// the items of a failed flush go to the fail queue through their own OnFailure
+			for _, item := range items {
+				if item.OnFailure != nil {
+					item.OnFailure(ctx, item, BulkIndexerResponseItem{}, err)
+				}
 			}
-			stats := t.Bulk.Stats()
-			t.Log.Errorf("\u001B[31mExecuting bulk %d \u001B[31merr: %v\u001B[0m failed count: %d\u001B[0m", stats.NumRequests, err, t.errTotal)
+			errTotal := atomic.AddInt64(&t.errTotal, int64(len(items)))
+			t.Log.Errorf("\u001B[31mExecuting bulk %d \u001B[31merr: %v\u001B[0m failed count: %d\u001B[0m", atomic.LoadUint64(&t.bulkSeq), err, errTotal)
 		},
 		OnFlushEnd: func(ctx context.Context) {
 			cost := time.Since(ctx.Value("startTm").(time.Time)).Milliseconds()
 			seq := ctx.Value("seq").(uint64)
-			success := t.sucTotal - t.sucPre
+			sucTotal := atomic.LoadUint64(&t.sucTotal)
+			success := sucTotal - atomic.SwapUint64(&t.sucPre, sucTotal)
 			t.Log.Debugf("Bulk \u001B[36m[%d]\u001B[0m \u001B[32mcompleted\u001B[0m in \u001B[36m%dms\u001B[0m requests %d", seq, cost, success)
-			t.sucPre = t.sucTotal
 		},
 	})
 	if err != nil {
@@ -48,71 +55,157 @@ func (t *EsAPI) NewBulkProcessor() (BulkIndexer, error) {
 	return bulkProcessor, err
 }
 
+// AddToFailure queues items for a retry as if they failed once
 func (t *EsAPI) AddToFailure(item ...BulkIndexerItem) {
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	t.FailQueue = append(t.FailQueue, item...)
+	for _, it := range item {
+		t.fail(nil, it, BulkIndexerResponseItem{}, errors.New("added to the fail queue"))
+	}
 }
 
 func (t *EsAPI) AddToBulk(ctx context.Context, req BulkIndexerItem) error {
-	if !t.isReachable {
+	return t.addToBulk(ctx, req, nil)
+}
+
+// addToBulk adds an item to the bulk indexer, failed is its fail queue entry when it is a retry
+func (t *EsAPI) addToBulk(ctx context.Context, req BulkIndexerItem, failed *FailedItem) error {
+	if t.ReadOnly {
+		return errors.New("es api is read only")
+	}
+	t.bulkLock.RLock()
+	defer t.bulkLock.RUnlock()
+	if !t.isReachable || t.bulk == nil {
+		if failed != nil {
+			t.fail(failed, req, BulkIndexerResponseItem{}, errors.New("elasticsearch is not reachable"))
+		}
 		return errors.New("elasticsearch is not reachable")
 	}
 	req.OnFailure = func(ctx context.Context, item BulkIndexerItem, res BulkIndexerResponseItem, err error) {
-		t.AddToFailure(item)
+		t.fail(failed, item, res, err)
 	}
 	req.OnSuccess = func(ctx context.Context, item BulkIndexerItem, resp BulkIndexerResponseItem) {
 		atomic.AddUint64(&t.sucTotal, 1)
+		if failed != nil {
+			t.ack(failed)
+		}
 	}
-	err := t.Bulk.Add(ctx, req)
+	err := t.bulk.Add(ctx, req)
 	if err != nil {
-		t.AddToFailure(req)
+		t.fail(failed, req, BulkIndexerResponseItem{}, err)
 		t.Log.Errorf("Add to bulker failure \u001B[31merr: %v\u001B[0m", err)
 		return err
 	}
 	return nil
 }
 
-func (t *EsAPI) ScrollSearch(req *esapi.SearchRequest) ([]gjson.Result, error) {
-	ctx := context.Background()
-	cli, err := t.GetClient(ctx)
+func (t *EsAPI) ScrollSearch(ctx context.Context, req *esapi.SearchRequest) ([]gjson.Result, error) {
+	var results []gjson.Result
+	err := t.ScrollEach(ctx, req, func(hits []gjson.Result) error {
+		results = append(results, hits...)
+		return nil
+	})
 	if err != nil {
-		t.Log.Errorf("ScrollSearch(). GetClient(). \u001B[31merr: %v\u001B[0m", err)
 		return nil, err
 	}
+	return results, nil
+}
+
+// ScrollEach hands the hit sources of every scroll page to fn, so callers streaming large results
+// only hold one page at a time. It stops at the first error returned by fn.
+func (t *EsAPI) ScrollEach(ctx context.Context, req *esapi.SearchRequest, fn func(hits []gjson.Result) error) (err error) {
+	ctx, span := startRequestSpan(ctx, req)
+	pages, total := 0, 0
 	defer func() {
-		err = t.CloseClient(ctx, cli)
-		if err != nil {
-			t.Log.Errorf("ScrollSearch(). CloseClient(). \u001B[31merr: %v\u001B[0m", err)
-			return
+		span.SetAttributes(attribute.Int("es.pages", pages), attribute.Int("es.hits", total))
+		endRequestSpan(span, nil, err)
+	}()
+	cli, err := t.GetClient(ctx)
+	if err != nil {
+		t.Log.Errorf("ScrollEach(). GetClient(). \u001B[31merr: %v\u001B[0m", err)
+		return err
+	}
+	defer func() {
+		if err := t.CloseClient(ctx, cli); err != nil {
+			t.Log.Errorf("ScrollEach(). CloseClient(). \u001B[31merr: %v\u001B[0m", err)
 		}
 	}()
-	respBytes, err := ProcessResp(req, cli)
+	respBytes, err := ProcessResp(ctx, req, cli)
 	if err != nil {
-		t.Log.Errorf("ScrollSearch(). ProcessResp(). \u001B[31merr: %v\u001B[0m", err)
-		return nil, err
+		t.Log.Errorf("ScrollEach(). ProcessResp(). \u001B[31merr: %v\u001B[0m", err)
+		return err
 	}
 	root := gjson.ParseBytes(respBytes)
-	rootHits := root.Get("hits")
-	var results []gjson.Result
+	scrollId := root.Get("_scroll_id").String()
+	defer func() {
+		if scrollId != "" {
+			_, _ = ProcessResp(ctx, esapi.ClearScrollRequest{ScrollID: []string{scrollId}}, cli)
+		}
+	}()
 	for {
-		getSources(rootHits, &results)
-		if root.Get("_scroll_id").Exists() {
-			scroll := esapi.ScrollRequest{
-				ScrollID: root.Get("_scroll_id").String(),
-			}
-			respBytes, err = ProcessResp(scroll, cli)
-			if err != nil {
-				t.Log.Errorf("ScrollSearch(). ProcessResp(). \u001B[31merr: %v\u001B[0m", err)
-				return nil, err
-			}
-			root = gjson.ParseBytes(respBytes)
-			rootHits = root.Get("hits")
-		} else {
-			break
+		var page []gjson.Result
+		getSources(root.Get("hits"), &page)
+		if len(page) == 0 {
+			return nil
+		}
+		pages++
+		total += len(page)
+		if err = fn(page); err != nil {
+			return err
+		}
+		if !root.Get("_scroll_id").Exists() {
+			return nil
+		}
+		scroll := esapi.ScrollRequest{
+			ScrollID: root.Get("_scroll_id").String(),
+			Scroll:   req.Scroll,
 		}
+		respBytes, err = ProcessResp(ctx, scroll, cli)
+		if err != nil {
+			t.Log.Errorf("ScrollEach(). ProcessResp(). \u001B[31merr: %v\u001B[0m", err)
+			return err
+		}
+		root = gjson.ParseBytes(respBytes)
+		scrollId = root.Get("_scroll_id").String()
 	}
-	return results, nil
+}
+
+// MultiSearch runs a _msearch and returns the responses in request order, a failed search
+// carries its own error object and status instead of failing the whole request
+func (t *EsAPI) MultiSearch(ctx context.Context, body string) ([]gjson.Result, error) {
+	request := esapi.MsearchRequest{
+		Body: strings.NewReader(body),
+	}
+	resp, err := t.ProcessRespWithCtx(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return gjson.GetBytes(resp, "responses").Array(), nil
+}
+
+// OpenPointInTime opens a point in time over indexes, missing indexes are skipped
+func (t *EsAPI) OpenPointInTime(ctx context.Context, indexes []string, keepAlive string) (string, error) {
+	ignore := true
+	request := esapi.OpenPointInTimeRequest{
+		Index:             indexes,
+		KeepAlive:         keepAlive,
+		IgnoreUnavailable: &ignore,
+	}
+	resp, err := t.ProcessRespWithCtx(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	return gjson.GetBytes(resp, "id").String(), nil
+}
+
+func (t *EsAPI) ClosePointInTime(ctx context.Context, id string) error {
+	body, err := json.Marshal(map[string]string{"id": id})
+	if err != nil {
+		return err
+	}
+	request := esapi.ClosePointInTimeRequest{
+		Body: bytes.NewReader(body),
+	}
+	_, err = t.ProcessRespWithCtx(ctx, request)
+	return err
 }
 
 func (t *EsAPI) CreateIndex(index string, mappings string, args string) bool {
@@ -159,21 +252,56 @@ func (t *EsAPI) ExistIndex(index string) bool {
 	return true
 }
 
+// Reachable reports whether the connection check found the cluster reachable
+func (t *EsAPI) Reachable() bool {
+	t.bulkLock.RLock()
+	defer t.bulkLock.RUnlock()
+	return t.isReachable
+}
+
+// ClusterHealth returns the status of the cluster, green, yellow or red
+func (t *EsAPI) ClusterHealth(ctx context.Context) (string, error) {
+	resp, err := t.ProcessRespWithCtx(ctx, esapi.ClusterHealthRequest{})
+	if err != nil {
+		return "", err
+	}
+	return gjson.GetBytes(resp, "status").String(), nil
+}
+
+// IndexExists is ExistIndex for callers which need to tell a missing index from a failed request
+func (t *EsAPI) IndexExists(ctx context.Context, index string) (bool, error) {
+	_, err := t.ProcessRespWithCtx(ctx, esapi.IndicesExistsRequest{Index: []string{index}})
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "404") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func (t *EsAPI) ProcessRespWithCli(req esapi.Request) ([]byte, error) {
-	ctx := context.Background()
+	return t.ProcessRespWithCtx(context.Background(), req)
+}
+
+// ProcessRespWithCtx runs the request with a pooled client in a span child of ctx,
+// errors carry the status and body of the response as "status,body"
+func (t *EsAPI) ProcessRespWithCtx(ctx context.Context, req esapi.Request) (respBytes []byte, err error) {
+	ctx, span := startRequestSpan(ctx, req)
+	defer func() {
+		endRequestSpan(span, respBytes, err)
+	}()
 	cli, err := t.GetClient(ctx)
 	if err != nil {
 		t.Log.Errorf("ProcessRespWithCli(). GetClient(). \u001B[31merr: %v\u001B[0m", err)
 		return nil, err
 	}
 	defer func() {
-		err = t.CloseClient(ctx, cli)
-		if err != nil {
+		if err := t.CloseClient(ctx, cli); err != nil {
 			t.Log.Errorf("ProcessRespWithCli(). CloseClient(). \u001B[31merr: %v\u001B[0m", err)
-			return
 		}
 	}()
-	resp, err := req.Do(context.Background(), cli)
+	resp, err := req.Do(ctx, cli)
 	if err != nil {
 		return nil, err
 	}
@@ -182,7 +310,7 @@ func (t *EsAPI) ProcessRespWithCli(req esapi.Request) ([]byte, error) {
 			_ = resp.Body.Close()
 		}()
 	}
-	respBytes, err := io.ReadAll(resp.Body)
+	respBytes, err = io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
@@ -192,8 +320,8 @@ func (t *EsAPI) ProcessRespWithCli(req esapi.Request) ([]byte, error) {
 	return respBytes, nil
 }
 
-func ProcessResp(req esapi.Request, cli *elasticsearch.Client) ([]byte, error) {
-	resp, err := req.Do(context.Background(), cli)
+func ProcessResp(ctx context.Context, req esapi.Request, cli *elasticsearch.Client) ([]byte, error) {
+	resp, err := req.Do(ctx, cli)
 	if err != nil {
 		return nil, err
 	}
@@ -5,25 +5,64 @@ import (
 	"github.com/elastic/go-elasticsearch/v8"
 	pool "github.com/jolestar/go-commons-pool/v2"
 	"go.uber.org/zap"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type EsAPI struct {
-	Log         *zap.SugaredLogger
-	EsPool      *pool.ObjectPool
-	Bulk        BulkIndexer
-	sucTotal    uint64
-	sucPre      uint64
-	errTotal    int64
-	globalCli   *elasticsearch.Client
-	ctxCli      context.Context
-	ctxBulk     context.Context
-	FailQueue   []BulkIndexerItem
-	lock        sync.RWMutex
-	checkTicker *time.Ticker
-	isReachable bool
+	Log     *zap.SugaredLogger
+	EsPool  *pool.ObjectPool
+	Factory *PoolFactory
+	// bulk and isReachable are guarded by bulkLock, adds hold it for reading so a reconnect can't
+	// close the indexer under them
+	bulk      BulkIndexer
+	bulkLock  sync.RWMutex
+	bulkSeq   uint64
+	sucTotal  uint64
+	sucPre    uint64
+	errTotal  int64
+	globalCli *elasticsearch.Client
+	ctxCli    context.Context
+	ctxBulk   context.Context
+	FailQueue []*FailedItem
+	// FailQueueFile is the journal keeping the fail queue across restarts, empty keeps it in memory
+	FailQueueFile string
+	// DeadLetterFile keeps the items out of attempts, empty keeps them in memory
+	DeadLetterFile string
+	// ReadOnly skips the fail queue files and the bulk indexer, for commands like the export which
+	// only read and may run next to a server sharing the files
+	ReadOnly bool
+	// RetryMax is the number of attempts before an item is a dead letter, RetryBackoff the delay
+	// before the first retry, doubled for each next one
+	RetryMax     int
+	RetryBackoff time.Duration
+	inflight     map[uint64]*FailedItem
+	deadLetters  []*FailedItem
+	failSeq      uint64
+	failLog      *os.File
+	failLock     *os.File
+	failRecords  int
+	lock         sync.RWMutex
+	checkTicker  *time.Ticker
+	checkDone    chan bool
+	connLock     sync.Mutex
+	isReachable  bool
+	borrows      uint64
+	borrowWait   int64
+}
+
+// ApiStats is a snapshot of the client pool, the bulk indexer and the fail queue
+type ApiStats struct {
+	PoolActive    int
+	PoolIdle      int
+	PoolDestroyed int
+	Borrows       uint64
+	BorrowWait    time.Duration
+	Bulk          *BulkIndexerStats
+	FailQueue     int
+	DeadLetters   int
 }
 
 type BulkItem struct {
@@ -36,29 +75,82 @@ type BulkItem struct {
 func (t *EsAPI) Init() {
 	t.ctxCli = context.Background()
 	t.ctxBulk = context.Background()
+	if t.ReadOnly {
+		t.FailQueueFile = ""
+		t.DeadLetterFile = ""
+	}
+	if err := t.openFailQueue(); err != nil {
+		// the files are left as they are for a look, the fail queue lives in memory until the restart
+		t.Log.Errorf("EsAPI open fail queue, kept in memory \u001B[31merr: %v\u001B[0m", err)
+		t.FailQueueFile = ""
+		t.DeadLetterFile = ""
+	}
 	_ = t.initClient()
+	t.checkTicker = time.NewTicker(time.Second * 3)
+	t.checkDone = make(chan bool)
 	go t.checkConn()
 }
 
+// Close flushes the bulk indexer, whose failed items join the fail queue, and compacts the fail queue journal
 func (t *EsAPI) Close() {
 	t.checkTicker.Stop()
-	err := t.Bulk.Close(t.ctxBulk)
-	if err != nil {
-		t.Log.Errorf("EsAPI bulker close \u001B[31merr: %v\u001B[0m", err)
+	close(t.checkDone)
+	t.closeBulk()
+	if err := t.closeFailQueue(); err != nil {
+		t.Log.Errorf("EsAPI close fail queue \u001B[31merr: %v\u001B[0m", err)
+	}
+}
+
+// SetAddresses moves the pool to other addresses and does nothing for the current ones, idle clients are dropped at once and borrowed ones on return.
+// The bulk indexer is flushed and rebuilt with the global client on the new addresses
+func (t *EsAPI) SetAddresses(uris []string) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if !t.Factory.SetUris(uris) {
+		return
+	}
+	t.EsPool.Clear(t.ctxCli)
+	t.closeBulk()
+	if t.globalCli != nil {
+		_ = t.EsPool.ReturnObject(t.ctxCli, t.globalCli)
+	}
+	if err := t.initClient(); err != nil {
+		t.Log.Errorf("EsAPI connect %v \u001B[31merr: %v\u001B[0m", uris, err)
 	}
-	t.lock.Lock()
-	defer t.lock.Unlock()
-	t.FailQueue = []BulkIndexerItem{}
 }
 
 func (t *EsAPI) GetClient(ctx context.Context) (*elasticsearch.Client, error) {
+	start := time.Now()
 	cli, err := t.EsPool.BorrowObject(ctx)
+	atomic.AddUint64(&t.borrows, 1)
+	atomic.AddInt64(&t.borrowWait, int64(time.Since(start)))
 	if err != nil {
 		return nil, err
 	}
 	return cli.(*elasticsearch.Client), nil
 }
 
+func (t *EsAPI) Stats() ApiStats {
+	stats := ApiStats{
+		PoolActive:    t.EsPool.GetNumActive(),
+		PoolIdle:      t.EsPool.GetNumIdle(),
+		PoolDestroyed: t.EsPool.GetDestroyedCount(),
+		Borrows:       atomic.LoadUint64(&t.borrows),
+		BorrowWait:    time.Duration(atomic.LoadInt64(&t.borrowWait)),
+	}
+	t.bulkLock.RLock()
+	if t.bulk != nil {
+		bulkStats := t.bulk.Stats()
+		stats.Bulk = &bulkStats
+	}
+	t.bulkLock.RUnlock()
+	t.lock.RLock()
+	stats.FailQueue = len(t.FailQueue) + len(t.inflight)
+	stats.DeadLetters = len(t.deadLetters)
+	t.lock.RUnlock()
+	return stats
+}
+
 func (t *EsAPI) CloseClient(ctx context.Context, cli *elasticsearch.Client) error {
 	err := t.EsPool.ReturnObject(ctx, cli)
 	if err != nil {
@@ -67,22 +159,42 @@ func (t *EsAPI) CloseClient(ctx context.Context, cli *elasticsearch.Client) erro
 	return nil
 }
 
-func (t *EsAPI) initClient() error {
+// closeBulk marks the cluster unreachable before it flushes and drops the bulk indexer, it waits
+// for the adds going on and the later ones fail until initClient builds a new indexer
+func (t *EsAPI) closeBulk() {
+	t.bulkLock.Lock()
+	defer t.bulkLock.Unlock()
 	t.isReachable = false
+	if t.bulk == nil {
+		return
+	}
+	if err := t.bulk.Close(t.ctxBulk); err != nil {
+		t.Log.Errorf("EsAPI bulker close \u001B[31merr: %v\u001B[0m", err)
+	}
+	t.bulk = nil
+}
+
+// initClient borrows the global client and builds the bulk indexer on it, the caller closed the last indexer
+func (t *EsAPI) initClient() error {
 	cli, err := t.EsPool.BorrowObject(t.ctxCli)
 	if err != nil {
 		t.globalCli = nil
 		return err
 	}
 	t.globalCli = cli.(*elasticsearch.Client)
-	t.errTotal = 0
-	t.sucTotal = 0
-	t.sucPre = 0
-	t.Bulk, err = t.NewBulkProcessor()
-	if err != nil {
-		return err
+	atomic.StoreInt64(&t.errTotal, 0)
+	atomic.StoreUint64(&t.sucTotal, 0)
+	atomic.StoreUint64(&t.sucPre, 0)
+	var bulk BulkIndexer
+	if !t.ReadOnly {
+		if bulk, err = t.NewBulkProcessor(); err != nil {
+			return err
+		}
 	}
+	t.bulkLock.Lock()
+	t.bulk = bulk
 	t.isReachable = true
+	t.bulkLock.Unlock()
 	t.Log.Infof("Elasticsearch client connect successfully!")
 	return nil
 }
@@ -100,38 +212,22 @@ func (t *EsAPI) isConnected() bool {
 }
 
 func (t *EsAPI) checkConn() {
-	t.checkTicker = time.NewTicker(time.Second * 3)
 	for {
 		select {
+		case <-t.checkDone:
+			return
 		case <-t.checkTicker.C:
+			t.connLock.Lock()
 			isCon := t.isConnected()
 			if !isCon {
-				if t.Bulk != nil {
-					err := t.Bulk.Close(t.ctxBulk)
-					if err != nil {
-						t.Log.Errorf("EsAPI bulker close \u001B[31merr: %v\u001B[0m", err)
-					}
-					t.Bulk = nil
-				}
+				t.closeBulk()
 				_ = t.initClient()
-			} else if isCon && t.isReachable {
-				t.lock.Lock()
-				count := 0
-				cF := make([]BulkIndexerItem, len(t.FailQueue))
-				copy(cF, t.FailQueue)
-				t.FailQueue = t.FailQueue[:0]
-				t.lock.Unlock()
-				for _, item := range cF {
-					_ = t.AddToBulk(context.Background(), item)
-					count++
-				}
-				atomic.AddInt64(&t.errTotal, -int64(len(cF)))
-				cF = cF[:0]
-				cF = nil
-				if count > 0 {
-					t.Log.Infof("retry failure bulk request count: %d", count)
-				}
 			}
+			t.connLock.Unlock()
+			if isCon && t.Reachable() {
+				t.retryFailures()
+			}
+
 		}
 	}
 }
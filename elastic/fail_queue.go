@@ -0,0 +1,595 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The fail queue keeps the bulk items which failed to index. Every change is appended to the
+// journal FailQueueFile before it takes effect, so the queue survives a crash and is compacted
+// on start, on close and whenever the journal outgrows the queue. Items are retried with an
+// exponential backoff, the ones out of attempts or rejected by elasticsearch move to the dead
+// letters kept in DeadLetterFile until they are replayed or purged.
+
+const (
+	failOpAdd  = "add"
+	failOpAck  = "ack"
+	failOpDead = "dead"
+	// maxFailBackoff caps the delay between two retries of an item
+	maxFailBackoff = time.Hour
+	// minFailCompact is the journal size below which it is never compacted
+	minFailCompact = 1000
+)
+
+var (
+	ErrNoDeadLetters = errors.New("no dead letters match")
+	// ErrFailQueueLocked is returned when another process, like a running server, holds the journal
+	ErrFailQueueLocked = errors.New("fail queue journal is locked by another process")
+)
+
+// FailedItem is a bulk item in the fail queue or in the dead letters
+type FailedItem struct {
+	Seq        uint64 `json:"seq"`
+	Index      string `json:"index"`
+	Action     string `json:"action"`
+	DocumentID string `json:"document_id,omitempty"`
+	Routing    string `json:"routing,omitempty"`
+	// Version and VersionType keep an external version so a retry never replaces a newer write
+	Version     *int64          `json:"version,omitempty"`
+	VersionType string          `json:"version_type,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+	Attempts    int             `json:"attempts"`
+	Error       string          `json:"error,omitempty"`
+	// FailedAt and NextRetry are unix milliseconds, no NextRetry is a retry at the next check
+	FailedAt  int64 `json:"failed_at"`
+	NextRetry int64 `json:"next_retry,omitempty"`
+}
+
+// failRecord is a json line of the journal, add queues or updates the item with its seq,
+// ack drops it after a successful retry and dead moves it to the dead letters
+type failRecord struct {
+	Op   string      `json:"op"`
+	Seq  uint64      `json:"seq,omitempty"`
+	Item *FailedItem `json:"item,omitempty"`
+}
+
+// FailQueueStats counts the items of the fail queue, Inflight are retried items the bulk indexer
+// has not acknowledged yet
+type FailQueueStats struct {
+	Waiting     int `json:"waiting"`
+	Inflight    int `json:"inflight"`
+	DeadLetters int `json:"dead_letters"`
+	MaxAttempts int `json:"max_attempts"`
+}
+
+func (f *FailedItem) bulkItem() BulkIndexerItem {
+	item := BulkIndexerItem{Index: f.Index, Action: f.Action, DocumentID: f.DocumentID, Routing: f.Routing,
+		Version: f.Version, VersionType: f.VersionType}
+	if len(f.Body) > 0 {
+		item.Body = bytes.NewReader(f.Body)
+	}
+	return item
+}
+
+// backoff is the delay before the next retry of an item failed attempts times
+func (t *EsAPI) backoff(attempts int) time.Duration {
+	delay := t.RetryBackoff
+	if delay <= 0 {
+		delay = 5 * time.Second
+	}
+	for i := 1; i < attempts && delay < maxFailBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxFailBackoff {
+		delay = maxFailBackoff
+	}
+	return delay
+}
+
+func (t *EsAPI) maxAttempts() int {
+	if t.RetryMax <= 0 {
+		return 8
+	}
+	return t.RetryMax
+}
+
+// permanentFailure tells a document elasticsearch rejects, like a mapping error, from a failure
+// worth a retry, the rejected ones go to the dead letters at once
+func permanentFailure(res BulkIndexerResponseItem) bool {
+	return res.Status >= 400 && res.Status < 500 && res.Status != 408 && res.Status != 429
+}
+
+// staleVersion tells an item with an external version rejected because a newer one is stored
+func staleVersion(f *FailedItem, res BulkIndexerResponseItem) bool {
+	return f.VersionType == "external" && res.Status == http.StatusConflict
+}
+
+func failReason(res BulkIndexerResponseItem, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if res.Error.Type != "" {
+		return res.Error.Type + ": " + res.Error.Reason
+	}
+	if res.Status > 0 {
+		return "status " + http.StatusText(res.Status)
+	}
+	return "unknown"
+}
+
+// fail queues a bulk item which failed to index, prev is its fail queue entry when it was a retry
+func (t *EsAPI) fail(prev *FailedItem, item BulkIndexerItem, res BulkIndexerResponseItem, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	f := prev
+	if f == nil {
+		t.failSeq++
+		f = &FailedItem{Seq: t.failSeq, Index: item.Index, Action: item.Action, DocumentID: item.DocumentID, Routing: item.Routing,
+			Version: item.Version, VersionType: item.VersionType}
+		if item.Body != nil {
+			var body []byte
+			_, readErr := item.Body.Seek(0, io.SeekStart)
+			if readErr == nil {
+				body, readErr = io.ReadAll(item.Body)
+			}
+			if readErr != nil {
+				t.Log.Errorf("EsAPI read failed item body \u001B[31merr: %v\u001B[0m", readErr)
+			}
+			f.Body = body
+		}
+	}
+	delete(t.inflight, f.Seq)
+	if staleVersion(f, res) {
+		// a newer write of the document is stored, the item has nothing left to do
+		if prev != nil {
+			t.appendFailLog(failRecord{Op: failOpAck, Seq: f.Seq})
+		}
+		t.Log.Infof("bulk item %s/%s dropped, a newer version is stored", f.Index, f.DocumentID)
+		return
+	}
+	f.Attempts++
+	f.Error = failReason(res, err)
+	now := time.Now()
+	f.FailedAt = now.UnixMilli()
+	if f.Attempts >= t.maxAttempts() || permanentFailure(res) {
+		f.NextRetry = 0
+		// the dead letter is written first, a crash in between leaves the item in both files
+		t.appendDeadLetter(f)
+		t.appendFailLog(failRecord{Op: failOpDead, Seq: f.Seq})
+		t.deadLetters = append(t.deadLetters, f)
+		t.Log.Errorf("bulk item %s/%s moved to the dead letters after %d attempts \u001B[31merr: %s\u001B[0m", f.Index, f.DocumentID, f.Attempts, f.Error)
+		return
+	}
+	f.NextRetry = now.Add(t.backoff(f.Attempts)).UnixMilli()
+	t.appendFailLog(failRecord{Op: failOpAdd, Item: f})
+	t.FailQueue = append(t.FailQueue, f)
+}
+
+// ack drops a retried item indexed successfully
+func (t *EsAPI) ack(f *FailedItem) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.inflight, f.Seq)
+	t.appendFailLog(failRecord{Op: failOpAck, Seq: f.Seq})
+}
+
+// dueFailures takes the items whose backoff has passed out of the queue, they stay inflight until
+// the bulk indexer acknowledges them
+func (t *EsAPI) dueFailures(now time.Time) []*FailedItem {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var due []*FailedItem
+	waiting := t.FailQueue[:0]
+	for _, f := range t.FailQueue {
+		if f.NextRetry > now.UnixMilli() {
+			waiting = append(waiting, f)
+			continue
+		}
+		due = append(due, f)
+		t.inflight[f.Seq] = f
+	}
+	for i := len(waiting); i < len(t.FailQueue); i++ {
+		t.FailQueue[i] = nil
+	}
+	t.FailQueue = waiting
+	return due
+}
+
+// retryFailures hands the due items of the fail queue back to the bulk indexer
+func (t *EsAPI) retryFailures() {
+	due := t.dueFailures(time.Now())
+	for _, f := range due {
+		_ = t.addToBulk(t.ctxBulk, f.bulkItem(), f)
+	}
+	if len(due) > 0 {
+		t.Log.Infof("retry failure bulk request count: %d", len(due))
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.failRecords > minFailCompact && t.failRecords > 2*(len(t.FailQueue)+len(t.inflight)) {
+		if err := t.compactFailLog(); err != nil {
+			t.Log.Errorf("EsAPI compact fail queue \u001B[31merr: %v\u001B[0m", err)
+		}
+	}
+}
+
+// appendFailLog writes a record to the journal, the caller holds the lock. A record is written
+// at once so the queue survives a crash of the process
+func (t *EsAPI) appendFailLog(rec failRecord) {
+	if t.failLog == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = t.failLog.Write(append(line, '\n'))
+	}
+	if err != nil {
+		t.Log.Errorf("EsAPI append fail queue \u001B[31merr: %v\u001B[0m", err)
+		return
+	}
+	t.failRecords++
+}
+
+func (t *EsAPI) appendDeadLetter(f *FailedItem) {
+	if t.DeadLetterFile == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(t.DeadLetterFile), 0755)
+	if err != nil {
+		t.Log.Errorf("EsAPI append dead letter \u001B[31merr: %v\u001B[0m", err)
+		return
+	}
+	file, err := os.OpenFile(t.DeadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Log.Errorf("EsAPI append dead letter \u001B[31merr: %v\u001B[0m", err)
+		return
+	}
+	line, err := json.Marshal(f)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Log.Errorf("EsAPI append dead letter \u001B[31merr: %v\u001B[0m", err)
+	}
+}
+
+// writeJsonLines replaces the file with a json line per value, no values removes it
+func writeJsonLines(name string, n int, value func(i int) interface{}) error {
+	if n == 0 {
+		err := os.Remove(name)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := 0; i < n; i++ {
+		if err = enc.Encode(value(i)); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// compactFailLog rewrites the journal with an add record per queued or inflight item and reopens
+// it for appending, the caller holds the lock
+func (t *EsAPI) compactFailLog() error {
+	if t.FailQueueFile == "" {
+		return nil
+	}
+	if t.failLog != nil {
+		_ = t.failLog.Close()
+		t.failLog = nil
+	}
+	items := make([]*FailedItem, 0, len(t.FailQueue)+len(t.inflight))
+	items = append(items, t.FailQueue...)
+	for _, f := range t.inflight {
+		items = append(items, f)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Seq < items[j].Seq
+	})
+	err := writeJsonLines(t.FailQueueFile, len(items), func(i int) interface{} {
+		return failRecord{Op: failOpAdd, Item: items[i]}
+	})
+	if err != nil {
+		return err
+	}
+	t.failRecords = len(items)
+	if err = os.MkdirAll(filepath.Dir(t.FailQueueFile), 0755); err != nil {
+		return err
+	}
+	t.failLog, err = os.OpenFile(t.FailQueueFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+// openFailQueue locks the journal, replays it and loads the dead letters left by the last run, the
+// items which were inflight are retried at once. The lock is released when the opening fails
+func (t *EsAPI) openFailQueue() (err error) {
+	t.inflight = map[uint64]*FailedItem{}
+	if name := t.failLockName(); name != "" {
+		if t.failLock, err = lockFailQueue(name); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				t.unlockFailQueue()
+			}
+		}()
+	}
+	dead, err := readDeadLetters(t.DeadLetterFile)
+	if err != nil {
+		return err
+	}
+	queued := map[uint64]*FailedItem{}
+	var legacy []*FailedItem
+	if t.FailQueueFile != "" {
+		if err = readFailLog(t.FailQueueFile, func(rec failRecord) {
+			switch rec.Op {
+			case "":
+				legacy = append(legacy, rec.Item)
+			case failOpAdd:
+				if rec.Item != nil {
+					queued[rec.Item.Seq] = rec.Item
+				}
+			case failOpAck, failOpDead:
+				delete(queued, rec.Seq)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// an item replayed just before a crash is in both, the queue wins
+	for _, f := range dead {
+		if _, ok := queued[f.Seq]; !ok {
+			t.deadLetters = append(t.deadLetters, f)
+		}
+		if f.Seq > t.failSeq {
+			t.failSeq = f.Seq
+		}
+	}
+	for _, f := range queued {
+		t.FailQueue = append(t.FailQueue, f)
+		if f.Seq > t.failSeq {
+			t.failSeq = f.Seq
+		}
+	}
+	sort.Slice(t.FailQueue, func(i, j int) bool {
+		return t.FailQueue[i].Seq < t.FailQueue[j].Seq
+	})
+	for _, f := range legacy {
+		t.failSeq++
+		f.Seq = t.failSeq
+		t.FailQueue = append(t.FailQueue, f)
+	}
+	if len(t.FailQueue) > 0 || len(t.deadLetters) > 0 {
+		t.Log.Infof("loaded %d failed bulk items and %d dead letters", len(t.FailQueue), len(t.deadLetters))
+	}
+	return t.compactFailLog()
+}
+
+// closeFailQueue compacts and closes the journal then unlocks it, the items left inflight by the
+// bulk indexer stay queued
+func (t *EsAPI) closeFailQueue() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := t.compactFailLog()
+	if t.failLog != nil {
+		if closeErr := t.failLog.Close(); err == nil {
+			err = closeErr
+		}
+		t.failLog = nil
+	}
+	t.unlockFailQueue()
+	return err
+}
+
+// failLockName is the file the lock is taken next to, the journal or else the dead letters
+func (t *EsAPI) failLockName() string {
+	if t.FailQueueFile != "" {
+		return t.FailQueueFile
+	}
+	return t.DeadLetterFile
+}
+
+func (t *EsAPI) unlockFailQueue() {
+	if t.failLock != nil {
+		_ = t.failLock.Close()
+		t.failLock = nil
+	}
+}
+
+// readFailLog hands the records of the journal to fn, the lines of a fail queue saved by an older
+// version are plain items and come as records without op
+func readFailLog(name string, fn func(rec failRecord)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	for {
+		var line json.RawMessage
+		if err = dec.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			// a record cut short by a crash ends the journal
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		var rec failRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		if rec.Op == "" {
+			rec.Item = &FailedItem{}
+			if err = json.Unmarshal(line, rec.Item); err != nil {
+				return err
+			}
+		}
+		fn(rec)
+	}
+}
+
+func readDeadLetters(name string) ([]*FailedItem, error) {
+	if name == "" {
+		return nil, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var items []*FailedItem
+	dec := json.NewDecoder(f)
+	for {
+		var item FailedItem
+		if err = dec.Decode(&item); err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return items, nil
+		} else if err != nil {
+			return nil, err
+		}
+		items = append(items, &item)
+	}
+}
+
+// saveDeadLetters rewrites the dead letter file after a replay or a purge, the caller holds the lock
+func (t *EsAPI) saveDeadLetters() error {
+	if t.DeadLetterFile == "" {
+		return nil
+	}
+	return writeJsonLines(t.DeadLetterFile, len(t.deadLetters), func(i int) interface{} {
+		return t.deadLetters[i]
+	})
+}
+
+// FailQueueStats counts the queued, inflight and dead items
+func (t *EsAPI) FailQueueStats() FailQueueStats {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return FailQueueStats{
+		Waiting:     len(t.FailQueue),
+		Inflight:    len(t.inflight),
+		DeadLetters: len(t.deadLetters),
+		MaxAttempts: t.maxAttempts(),
+	}
+}
+
+// FailedItems returns up to size items waiting for a retry, oldest first, without their bodies
+func (t *EsAPI) FailedItems(index string, size int) []FailedItem {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	items := make([]FailedItem, 0)
+	for _, f := range t.FailQueue {
+		if len(items) >= size {
+			break
+		}
+		if index == "" || f.Index == index {
+			item := *f
+			item.Body = nil
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DeadLetters returns up to size dead letters, newest first
+func (t *EsAPI) DeadLetters(index string, size int) []FailedItem {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	items := make([]FailedItem, 0)
+	for i := len(t.deadLetters) - 1; i >= 0 && len(items) < size; i-- {
+		if index == "" || t.deadLetters[i].Index == index {
+			items = append(items, *t.deadLetters[i])
+		}
+	}
+	return items
+}
+
+// takeDeadLetters removes the dead letters with the seqs, or of the index, all of them when both
+// are empty, the caller holds the lock
+func (t *EsAPI) takeDeadLetters(index string, seqs []uint64) []*FailedItem {
+	match := map[uint64]bool{}
+	for _, seq := range seqs {
+		match[seq] = true
+	}
+	var taken []*FailedItem
+	kept := make([]*FailedItem, 0, len(t.deadLetters))
+	for _, f := range t.deadLetters {
+		if (len(seqs) == 0 || match[f.Seq]) && (index == "" || f.Index == index) {
+			taken = append(taken, f)
+		} else {
+			kept = append(kept, f)
+		}
+	}
+	t.deadLetters = kept
+	return taken
+}
+
+// ReplayDeadLetters moves dead letters back to the fail queue with their attempts reset,
+// they are retried on the next check of the connection
+func (t *EsAPI) ReplayDeadLetters(index string, seqs []uint64) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	taken := t.takeDeadLetters(index, seqs)
+	if len(taken) == 0 {
+		return 0, ErrNoDeadLetters
+	}
+	for _, f := range taken {
+		f.Attempts = 0
+		f.NextRetry = 0
+		t.appendFailLog(failRecord{Op: failOpAdd, Item: f})
+		t.FailQueue = append(t.FailQueue, f)
+	}
+	t.Log.Infof("replay %d dead letters", len(taken))
+	return len(taken), t.saveDeadLetters()
+}
+
+// PurgeDeadLetters drops dead letters for good
+func (t *EsAPI) PurgeDeadLetters(index string, seqs []uint64) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	taken := t.takeDeadLetters(index, seqs)
+	if len(taken) == 0 {
+		return 0, ErrNoDeadLetters
+	}
+	t.Log.Infof("purge %d dead letters", len(taken))
+	return len(taken), t.saveDeadLetters()
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package elastic
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockFailQueue takes an exclusive lock on name.lock, held until the returned file is closed. The
+// journal can't carry the lock itself as a compaction renames a new file over it
+func lockFailQueue(name string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrFailQueueLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
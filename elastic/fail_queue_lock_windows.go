@@ -0,0 +1,15 @@
+package elastic
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFailQueue opens name.lock without locking it, two processes sharing a journal on windows
+// are not detected
+func lockFailQueue(name string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name+".lock", os.O_CREATE|os.O_RDWR, 0644)
+}
@@ -0,0 +1,394 @@
+package elastic
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestApi(t *testing.T, dir string) *EsAPI {
+	t.Helper()
+	return &EsAPI{
+		Log:            zap.NewNop().Sugar(),
+		FailQueueFile:  filepath.Join(dir, "fail_queue.json"),
+		DeadLetterFile: filepath.Join(dir, "dead_letters.json"),
+		RetryMax:       1000,
+	}
+}
+
+func writeTestFile(t *testing.T, name string, lines ...string) {
+	t.Helper()
+	if len(lines) == 0 {
+		return
+	}
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func seqs(items []*FailedItem) []uint64 {
+	list := make([]uint64, 0, len(items))
+	for _, f := range items {
+		list = append(list, f.Seq)
+	}
+	return list
+}
+
+func equalSeqs(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOpenFailQueue(t *testing.T) {
+	tests := []struct {
+		name         string
+		journal      []string
+		dead         []string
+		wantQueue    []uint64
+		wantDead     []uint64
+		wantAttempts map[uint64]int
+		wantSeq      uint64
+	}{
+		{
+			name:    "empty",
+			wantSeq: 0,
+		},
+		{
+			name: "acked records are dropped",
+			journal: []string{
+				`{"op":"add","item":{"seq":1,"index":"a","action":"index","attempts":1}}`,
+				`{"op":"add","item":{"seq":2,"index":"a","action":"index","attempts":1}}`,
+				`{"op":"ack","seq":1}`,
+			},
+			wantQueue: []uint64{2},
+			wantSeq:   2,
+		},
+		{
+			name: "a later add updates the item",
+			journal: []string{
+				`{"op":"add","item":{"seq":1,"index":"a","action":"index","attempts":1}}`,
+				`{"op":"add","item":{"seq":1,"index":"a","action":"index","attempts":3}}`,
+			},
+			wantQueue:    []uint64{1},
+			wantAttempts: map[uint64]int{1: 3},
+			wantSeq:      1,
+		},
+		{
+			name: "dead records move to the dead letters",
+			journal: []string{
+				`{"op":"add","item":{"seq":1,"index":"a","action":"index","attempts":1}}`,
+				`{"op":"add","item":{"seq":2,"index":"a","action":"index","attempts":1}}`,
+				`{"op":"dead","seq":1}`,
+			},
+			dead:      []string{`{"seq":1,"index":"a","action":"index","attempts":8}`},
+			wantQueue: []uint64{2},
+			wantDead:  []uint64{1},
+			wantSeq:   2,
+		},
+		{
+			name: "a truncated record ends the journal",
+			journal: []string{
+				`{"op":"add","item":{"seq":1,"index":"a","action":"index","attempts":1}}`,
+				`{"op":"add","item":{"seq":2,"ind`,
+			},
+			wantQueue: []uint64{1},
+			wantSeq:   1,
+		},
+		{
+			name: "legacy lines get new seqs",
+			journal: []string{
+				`{"op":"add","item":{"seq":5,"index":"a","action":"index","attempts":1}}`,
+				`{"index":"b","action":"index","document_id":"x","body":{"v":1}}`,
+				`{"index":"b","action":"delete","document_id":"y"}`,
+			},
+			wantQueue: []uint64{5, 6, 7},
+			wantSeq:   7,
+		},
+		{
+			name: "a dead letter replayed before a crash stays queued",
+			journal: []string{
+				`{"op":"add","item":{"seq":3,"index":"a","action":"index","attempts":0}}`,
+			},
+			dead: []string{
+				`{"seq":3,"index":"a","action":"index","attempts":8}`,
+				`{"seq":4,"index":"a","action":"index","attempts":8}`,
+			},
+			wantQueue: []uint64{3},
+			wantDead:  []uint64{4},
+			wantSeq:   4,
+		},
+		{
+			name: "a truncated dead letter is dropped",
+			dead: []string{
+				`{"seq":1,"index":"a","action":"index","attempts":8}`,
+				`{"seq":2,"index":"a"`,
+			},
+			wantDead: []uint64{1},
+			wantSeq:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestApi(t, t.TempDir())
+			writeTestFile(t, api.FailQueueFile, tt.journal...)
+			writeTestFile(t, api.DeadLetterFile, tt.dead...)
+			if err := api.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			defer api.closeFailQueue()
+			if got := seqs(api.FailQueue); !equalSeqs(got, tt.wantQueue) {
+				t.Errorf("queue = %v, want %v", got, tt.wantQueue)
+			}
+			if got := seqs(api.deadLetters); !equalSeqs(got, tt.wantDead) {
+				t.Errorf("dead letters = %v, want %v", got, tt.wantDead)
+			}
+			if api.failSeq != tt.wantSeq {
+				t.Errorf("failSeq = %d, want %d", api.failSeq, tt.wantSeq)
+			}
+			for _, f := range api.FailQueue {
+				if want, ok := tt.wantAttempts[f.Seq]; ok && f.Attempts != want {
+					t.Errorf("attempts of %d = %d, want %d", f.Seq, f.Attempts, want)
+				}
+			}
+			// opening compacts the journal to an add record per queued item
+			var records []failRecord
+			if err := readFailLog(api.FailQueueFile, func(rec failRecord) {
+				records = append(records, rec)
+			}); err != nil {
+				t.Fatalf("readFailLog() err: %v", err)
+			}
+			if len(records) != len(tt.wantQueue) {
+				t.Fatalf("journal has %d records, want %d", len(records), len(tt.wantQueue))
+			}
+			for i, rec := range records {
+				if rec.Op != failOpAdd || rec.Item == nil || rec.Item.Seq != tt.wantQueue[i] {
+					t.Errorf("journal record %d = %+v, want add of %d", i, rec, tt.wantQueue[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFailQueueSurvivesRestart(t *testing.T) {
+	tests := []struct {
+		name      string
+		retryMax  int
+		items     int
+		rounds    int
+		wantQueue int
+		wantDead  int
+	}{
+		{name: "queued items", retryMax: 1000, items: 3, rounds: 2, wantQueue: 3},
+		{name: "items out of attempts", retryMax: 2, items: 3, rounds: 2, wantDead: 3},
+		{name: "compacted journal", retryMax: 1000, items: 10, rounds: 150, wantQueue: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			api := newTestApi(t, dir)
+			api.RetryMax = tt.retryMax
+			if err := api.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			for i := 0; i < tt.items; i++ {
+				item := BulkIndexerItem{Index: "a", Action: "index", DocumentID: string(rune('a' + i)), Body: strings.NewReader(`{"v":1}`)}
+				api.fail(nil, item, BulkIndexerResponseItem{Status: 503}, nil)
+			}
+			// the cluster is unreachable so every retry fails again, the backoff is skipped
+			for i := 0; i < tt.rounds; i++ {
+				api.lock.Lock()
+				for _, f := range api.FailQueue {
+					f.NextRetry = 0
+				}
+				api.lock.Unlock()
+				api.retryFailures()
+			}
+			if tt.rounds*tt.items > minFailCompact && api.failRecords > minFailCompact {
+				t.Errorf("journal holds %d records, it was never compacted", api.failRecords)
+			}
+			if err := api.closeFailQueue(); err != nil {
+				t.Fatalf("closeFailQueue() err: %v", err)
+			}
+
+			reopened := newTestApi(t, dir)
+			if err := reopened.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			defer reopened.closeFailQueue()
+			stats := reopened.FailQueueStats()
+			if stats.Waiting != tt.wantQueue || stats.DeadLetters != tt.wantDead {
+				t.Errorf("stats = %+v, want %d waiting and %d dead letters", stats, tt.wantQueue, tt.wantDead)
+			}
+			for _, f := range reopened.FailQueue {
+				if string(f.Body) != `{"v":1}` {
+					t.Errorf("body of %d = %s", f.Seq, f.Body)
+				}
+				if f.Attempts != tt.rounds+1 {
+					t.Errorf("attempts of %d = %d, want %d", f.Seq, f.Attempts, tt.rounds+1)
+				}
+			}
+		})
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	tests := []struct {
+		name      string
+		index     string
+		seqs      []uint64
+		replay    bool
+		wantCount int
+		wantErr   error
+		wantQueue []uint64
+		wantDead  []uint64
+	}{
+		{name: "replay all", replay: true, wantCount: 3, wantQueue: []uint64{1, 2, 3}},
+		{name: "replay by seq", replay: true, seqs: []uint64{2}, wantCount: 1, wantQueue: []uint64{2}, wantDead: []uint64{1, 3}},
+		{name: "purge by index", index: "b", wantCount: 1, wantDead: []uint64{1, 2}},
+		{name: "purge no match", seqs: []uint64{9}, wantErr: ErrNoDeadLetters, wantDead: []uint64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			api := newTestApi(t, dir)
+			writeTestFile(t, api.DeadLetterFile,
+				`{"seq":1,"index":"a","action":"index","attempts":8}`,
+				`{"seq":2,"index":"a","action":"index","attempts":8}`,
+				`{"seq":3,"index":"b","action":"index","attempts":8}`)
+			if err := api.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			var count int
+			var err error
+			if tt.replay {
+				count, err = api.ReplayDeadLetters(tt.index, tt.seqs)
+			} else {
+				count, err = api.PurgeDeadLetters(tt.index, tt.seqs)
+			}
+			if count != tt.wantCount || err != tt.wantErr {
+				t.Fatalf("count, err = %d, %v, want %d, %v", count, err, tt.wantCount, tt.wantErr)
+			}
+			if err = api.closeFailQueue(); err != nil {
+				t.Fatalf("closeFailQueue() err: %v", err)
+			}
+			// the files hold the change, a replayed item is never loaded twice
+			reopened := newTestApi(t, dir)
+			if err = reopened.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			defer reopened.closeFailQueue()
+			if got := seqs(reopened.FailQueue); !equalSeqs(got, tt.wantQueue) {
+				t.Errorf("queue = %v, want %v", got, tt.wantQueue)
+			}
+			if got := seqs(reopened.deadLetters); !equalSeqs(got, tt.wantDead) {
+				t.Errorf("dead letters = %v, want %v", got, tt.wantDead)
+			}
+			for _, f := range reopened.FailQueue {
+				if f.Attempts != 0 {
+					t.Errorf("attempts of replayed %d = %d, want 0", f.Seq, f.Attempts)
+				}
+			}
+		})
+	}
+}
+
+func TestFailQueueLock(t *testing.T) {
+	dir := t.TempDir()
+	api := newTestApi(t, dir)
+	if err := api.openFailQueue(); err != nil {
+		t.Fatalf("openFailQueue() err: %v", err)
+	}
+	tests := []struct {
+		name    string
+		api     *EsAPI
+		wantErr error
+	}{
+		{name: "same journal", api: newTestApi(t, dir), wantErr: ErrFailQueueLocked},
+		{name: "other journal", api: newTestApi(t, t.TempDir()), wantErr: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.api.openFailQueue()
+			if err != tt.wantErr {
+				t.Fatalf("openFailQueue() err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil {
+				_ = tt.api.closeFailQueue()
+			}
+		})
+	}
+	if err := api.closeFailQueue(); err != nil {
+		t.Fatalf("closeFailQueue() err: %v", err)
+	}
+	// the lock goes with the close
+	again := newTestApi(t, dir)
+	if err := again.openFailQueue(); err != nil {
+		t.Fatalf("openFailQueue() after close err: %v", err)
+	}
+	_ = again.closeFailQueue()
+}
+
+func TestFailVersionedItem(t *testing.T) {
+	version := int64(1660000000000)
+	tests := []struct {
+		name        string
+		versionType string
+		status      int
+		wantQueue   int
+		wantDead    int
+	}{
+		{name: "stale external version is dropped", versionType: "external", status: 409},
+		{name: "conflict of a create is a dead letter", status: 409, wantDead: 1},
+		{name: "external version is kept for the retry", versionType: "external", status: 503, wantQueue: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			api := newTestApi(t, dir)
+			if err := api.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			item := BulkIndexerItem{Index: "station", Action: "index", DocumentID: "1", Body: strings.NewReader(`{"sid":"1"}`)}
+			if tt.versionType != "" {
+				item.Version = &version
+				item.VersionType = tt.versionType
+			}
+			// the first attempt fails on the network, the retry gets the status
+			api.fail(nil, item, BulkIndexerResponseItem{}, os.ErrDeadlineExceeded)
+			due := api.dueFailures(time.Now().Add(time.Hour))
+			if len(due) != 1 {
+				t.Fatalf("due = %d, want 1", len(due))
+			}
+			api.fail(due[0], due[0].bulkItem(), BulkIndexerResponseItem{Status: tt.status}, nil)
+			if err := api.closeFailQueue(); err != nil {
+				t.Fatalf("closeFailQueue() err: %v", err)
+			}
+			reopened := newTestApi(t, dir)
+			if err := reopened.openFailQueue(); err != nil {
+				t.Fatalf("openFailQueue() err: %v", err)
+			}
+			defer reopened.closeFailQueue()
+			stats := reopened.FailQueueStats()
+			if stats.Waiting != tt.wantQueue || stats.DeadLetters != tt.wantDead {
+				t.Errorf("stats = %+v, want %d waiting and %d dead letters", stats, tt.wantQueue, tt.wantDead)
+			}
+			for _, f := range reopened.FailQueue {
+				retry := f.bulkItem()
+				if retry.Version == nil || *retry.Version != version || retry.VersionType != tt.versionType {
+					t.Errorf("retry version = %v %q, want %d %q", retry.Version, retry.VersionType, version, tt.versionType)
+				}
+			}
+		})
+	}
+}
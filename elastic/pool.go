@@ -7,20 +7,53 @@ import (
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/jolestar/go-commons-pool/v2"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
+// PoolFactory makes clients of the current address list, clients made before SetUris are
+// dropped by the pool on their next borrow or return
 type PoolFactory struct {
 	Uris              []string
 	Username          string
 	Password          string
 	EnableDebugLogger bool
 	MaxRetries        int
+	lock              sync.RWMutex
+	gen               uint64
+	gens              map[*elasticsearch.Client]uint64
+}
+
+// SetUris changes the addresses of the clients made from now on, it returns false for the current addresses
+func (f *PoolFactory) SetUris(uris []string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if strings.Join(uris, ",") == strings.Join(f.Uris, ",") {
+		return false
+	}
+	f.Uris = uris
+	f.gen++
+	return true
+}
+
+// stale reports whether the client was made for an old address list
+func (f *PoolFactory) stale(object *pool.PooledObject) bool {
+	cli, ok := object.Object.(*elasticsearch.Client)
+	if !ok {
+		return false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.gens[cli] != f.gen
 }
 
 func (f *PoolFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
+	f.lock.RLock()
+	uris, gen := f.Uris, f.gen
+	f.lock.RUnlock()
 	cfg := elasticsearch.Config{
-		Addresses:         f.Uris,
+		Addresses:         uris,
 		Username:          f.Username,
 		Password:          f.Password,
 		EnableDebugLogger: f.EnableDebugLogger,
@@ -41,10 +74,21 @@ func (f *PoolFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error
 	if err != nil {
 		return nil, err
 	}
+	f.lock.Lock()
+	if f.gens == nil {
+		f.gens = map[*elasticsearch.Client]uint64{}
+	}
+	f.gens[es] = gen
+	f.lock.Unlock()
 	return pool.NewPooledObject(es), nil
 }
 
 func (f *PoolFactory) DestroyObject(ctx context.Context, object *pool.PooledObject) error {
+	if cli, ok := object.Object.(*elasticsearch.Client); ok {
+		f.lock.Lock()
+		delete(f.gens, cli)
+		f.lock.Unlock()
+	}
 	object.Object = nil
 	return nil
 }
@@ -67,14 +111,21 @@ func (f *PoolFactory) ActivateObject(ctx context.Context, object *pool.PooledObj
 	if object.Object == nil {
 		return errors.New("empty pool object")
 	}
+	if f.stale(object) {
+		return errors.New("pool object of old addresses")
+	}
 	return nil
 }
 
 func (f *PoolFactory) PassivateObject(ctx context.Context, object *pool.PooledObject) error {
+	if f.stale(object) {
+		return errors.New("pool object of old addresses")
+	}
 	return nil
 }
 
-func InitEsPool(ctx context.Context, conf *conf.ESConfig) *pool.ObjectPool {
+// InitEsPool returns the pool and its factory, whose SetUris moves the pool to other addresses
+func InitEsPool(ctx context.Context, conf *conf.ESConfig) (*pool.ObjectPool, *PoolFactory) {
 	factory := &PoolFactory{
 		Uris:              conf.Uri,
 		Username:          conf.Username,
@@ -103,5 +154,5 @@ func InitEsPool(ctx context.Context, conf *conf.ESConfig) *pool.ObjectPool {
 	}
 
 	objectPool := pool.NewObjectPoolWithAbandonedConfig(ctx, factory, config, abConfig)
-	return objectPool
+	return objectPool, factory
 }
@@ -0,0 +1,634 @@
+package elastic
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Query is a node of the query DSL, values are kept typed and only rendered by json.Marshal
+// so user input never reaches the request body unescaped
+type Query interface {
+	Source() map[string]interface{}
+}
+
+// Aggregation is a node of the aggregations DSL
+type Aggregation interface {
+	Source() map[string]interface{}
+}
+
+// Sort is an entry of the sort clause
+type Sort interface {
+	Source() interface{}
+}
+
+// SearchBody is the root of a search or count request body
+type SearchBody struct {
+	query       Query
+	aggs        map[string]Aggregation
+	sorts       []Sort
+	size        *int
+	from        *int
+	searchAfter []interface{}
+	pit         map[string]interface{}
+	trackTotal  *bool
+	excludes    []string
+}
+
+func NewSearchBody() *SearchBody {
+	return &SearchBody{}
+}
+
+func (b *SearchBody) Query(query Query) *SearchBody {
+	b.query = query
+	return b
+}
+
+func (b *SearchBody) Aggregation(name string, agg Aggregation) *SearchBody {
+	if b.aggs == nil {
+		b.aggs = map[string]Aggregation{}
+	}
+	b.aggs[name] = agg
+	return b
+}
+
+func (b *SearchBody) Sort(sorts ...Sort) *SearchBody {
+	b.sorts = append(b.sorts, sorts...)
+	return b
+}
+
+func (b *SearchBody) Size(size int) *SearchBody {
+	b.size = &size
+	return b
+}
+
+func (b *SearchBody) From(from int) *SearchBody {
+	b.from = &from
+	return b
+}
+
+func (b *SearchBody) SearchAfter(values ...interface{}) *SearchBody {
+	b.searchAfter = values
+	return b
+}
+
+// PointInTime searches a point in time instead of an index, keepAlive uses the es time unit format like 1m
+func (b *SearchBody) PointInTime(id string, keepAlive string) *SearchBody {
+	b.pit = map[string]interface{}{"id": id, "keep_alive": keepAlive}
+	return b
+}
+
+func (b *SearchBody) TrackTotalHits(track bool) *SearchBody {
+	b.trackTotal = &track
+	return b
+}
+
+// SourceExcludes drops fields from the returned _source
+func (b *SearchBody) SourceExcludes(fields ...string) *SearchBody {
+	b.excludes = append(b.excludes, fields...)
+	return b
+}
+
+func (b *SearchBody) Source() map[string]interface{} {
+	source := map[string]interface{}{}
+	if b.query != nil {
+		source["query"] = b.query.Source()
+	}
+	if len(b.aggs) > 0 {
+		source["aggs"] = aggsSource(b.aggs)
+	}
+	if len(b.sorts) > 0 {
+		var sorts []interface{}
+		for _, s := range b.sorts {
+			sorts = append(sorts, s.Source())
+		}
+		source["sort"] = sorts
+	}
+	if b.size != nil {
+		source["size"] = *b.size
+	}
+	if b.from != nil {
+		source["from"] = *b.from
+	}
+	if len(b.searchAfter) > 0 {
+		source["search_after"] = b.searchAfter
+	}
+	if b.pit != nil {
+		source["pit"] = b.pit
+	}
+	if b.trackTotal != nil {
+		source["track_total_hits"] = *b.trackTotal
+	}
+	if len(b.excludes) > 0 {
+		source["_source"] = map[string]interface{}{"excludes": b.excludes}
+	}
+	return source
+}
+
+// Build renders the body to json
+func (b *SearchBody) Build() (string, error) {
+	data, err := json.Marshal(b.Source())
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// MultiSearchBody is the ndjson body of a _msearch request, responses come back in the order searches are added
+type MultiSearchBody struct {
+	lines []interface{}
+}
+
+func NewMultiSearchBody() *MultiSearchBody {
+	return &MultiSearchBody{}
+}
+
+// Add appends a search over indexes, missing indexes are skipped
+func (m *MultiSearchBody) Add(indexes []string, body *SearchBody) *MultiSearchBody {
+	m.lines = append(m.lines, map[string]interface{}{"index": indexes, "ignore_unavailable": true}, body.Source())
+	return m
+}
+
+func (m *MultiSearchBody) Build() (string, error) {
+	var sb strings.Builder
+	for _, line := range m.lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return "", err
+		}
+		sb.Write(data)
+		sb.WriteByte('\n')
+	}
+	return sb.String(), nil
+}
+
+func aggsSource(aggs map[string]Aggregation) map[string]interface{} {
+	source := map[string]interface{}{}
+	for name, agg := range aggs {
+		source[name] = agg.Source()
+	}
+	return source
+}
+
+type MatchAllQuery struct{}
+
+func NewMatchAllQuery() *MatchAllQuery {
+	return &MatchAllQuery{}
+}
+
+func (q *MatchAllQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"match_all": map[string]interface{}{}}
+}
+
+type MatchQuery struct {
+	field string
+	value interface{}
+}
+
+func NewMatchQuery(field string, value interface{}) *MatchQuery {
+	return &MatchQuery{field: field, value: value}
+}
+
+func (q *MatchQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"match": map[string]interface{}{q.field: q.value}}
+}
+
+type TermQuery struct {
+	field string
+	value interface{}
+}
+
+func NewTermQuery(field string, value interface{}) *TermQuery {
+	return &TermQuery{field: field, value: value}
+}
+
+func (q *TermQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{q.field: q.value}}
+}
+
+type TermsQuery struct {
+	field  string
+	values []interface{}
+}
+
+func NewTermsQuery(field string, values ...interface{}) *TermsQuery {
+	return &TermsQuery{field: field, values: values}
+}
+
+// NewTermsQueryFromStrings saves the conversion of a string slice at the call site
+func NewTermsQueryFromStrings(field string, values []string) *TermsQuery {
+	q := &TermsQuery{field: field}
+	for _, v := range values {
+		q.values = append(q.values, v)
+	}
+	return q
+}
+
+func (q *TermsQuery) Source() map[string]interface{} {
+	values := q.values
+	if values == nil {
+		values = []interface{}{}
+	}
+	return map[string]interface{}{"terms": map[string]interface{}{q.field: values}}
+}
+
+type WildcardQuery struct {
+	field           string
+	value           string
+	caseInsensitive bool
+}
+
+// NewWildcardQuery takes a pattern as is, escape user input with EscapeWildcard first
+func NewWildcardQuery(field string, pattern string) *WildcardQuery {
+	return &WildcardQuery{field: field, value: pattern}
+}
+
+func (q *WildcardQuery) CaseInsensitive(caseInsensitive bool) *WildcardQuery {
+	q.caseInsensitive = caseInsensitive
+	return q
+}
+
+func (q *WildcardQuery) Source() map[string]interface{} {
+	params := map[string]interface{}{"value": q.value}
+	if q.caseInsensitive {
+		params["case_insensitive"] = true
+	}
+	return map[string]interface{}{"wildcard": map[string]interface{}{q.field: params}}
+}
+
+var wildcardEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+
+// EscapeWildcard escapes the wildcard operators so the input matches literally
+func EscapeWildcard(s string) string {
+	return wildcardEscaper.Replace(s)
+}
+
+type RangeQuery struct {
+	field  string
+	params map[string]interface{}
+}
+
+func NewRangeQuery(field string) *RangeQuery {
+	return &RangeQuery{field: field, params: map[string]interface{}{}}
+}
+
+func (q *RangeQuery) Gt(v interface{}) *RangeQuery {
+	q.params["gt"] = v
+	return q
+}
+
+func (q *RangeQuery) Gte(v interface{}) *RangeQuery {
+	q.params["gte"] = v
+	return q
+}
+
+func (q *RangeQuery) Lt(v interface{}) *RangeQuery {
+	q.params["lt"] = v
+	return q
+}
+
+func (q *RangeQuery) Lte(v interface{}) *RangeQuery {
+	q.params["lte"] = v
+	return q
+}
+
+func (q *RangeQuery) Format(format string) *RangeQuery {
+	q.params["format"] = format
+	return q
+}
+
+func (q *RangeQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"range": map[string]interface{}{q.field: q.params}}
+}
+
+type BoolQuery struct {
+	must               []Query
+	filter             []Query
+	should             []Query
+	mustNot            []Query
+	minimumShouldMatch interface{}
+}
+
+func NewBoolQuery() *BoolQuery {
+	return &BoolQuery{}
+}
+
+func (q *BoolQuery) Must(queries ...Query) *BoolQuery {
+	q.must = append(q.must, queries...)
+	return q
+}
+
+func (q *BoolQuery) Filter(queries ...Query) *BoolQuery {
+	q.filter = append(q.filter, queries...)
+	return q
+}
+
+func (q *BoolQuery) Should(queries ...Query) *BoolQuery {
+	q.should = append(q.should, queries...)
+	return q
+}
+
+func (q *BoolQuery) MustNot(queries ...Query) *BoolQuery {
+	q.mustNot = append(q.mustNot, queries...)
+	return q
+}
+
+func (q *BoolQuery) MinimumShouldMatch(v interface{}) *BoolQuery {
+	q.minimumShouldMatch = v
+	return q
+}
+
+func (q *BoolQuery) Source() map[string]interface{} {
+	params := map[string]interface{}{}
+	clauses := map[string][]Query{"must": q.must, "filter": q.filter, "should": q.should, "must_not": q.mustNot}
+	for name, queries := range clauses {
+		if len(queries) == 0 {
+			continue
+		}
+		var sources []interface{}
+		for _, query := range queries {
+			sources = append(sources, query.Source())
+		}
+		params[name] = sources
+	}
+	if q.minimumShouldMatch != nil {
+		params["minimum_should_match"] = q.minimumShouldMatch
+	}
+	return map[string]interface{}{"bool": params}
+}
+
+type GeoDistanceQuery struct {
+	field    string
+	lon      float64
+	lat      float64
+	distance string
+}
+
+func NewGeoDistanceQuery(field string, lon float64, lat float64) *GeoDistanceQuery {
+	return &GeoDistanceQuery{field: field, lon: lon, lat: lat}
+}
+
+// Distance sets the radius, unit is one of the es distance units like km, m or mi
+func (q *GeoDistanceQuery) Distance(dis float64, unit string) *GeoDistanceQuery {
+	q.distance = strconv.FormatFloat(dis, 'f', -1, 64) + unit
+	return q
+}
+
+func (q *GeoDistanceQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"geo_distance": map[string]interface{}{
+		"distance": q.distance,
+		q.field:    map[string]interface{}{"lon": q.lon, "lat": q.lat},
+	}}
+}
+
+type GeoBoundingBoxQuery struct {
+	field       string
+	topLeft     [2]float64
+	bottomRight [2]float64
+}
+
+// NewGeoBoundingBoxQuery takes the corners as lon, lat pairs
+func NewGeoBoundingBoxQuery(field string, topLeft [2]float64, bottomRight [2]float64) *GeoBoundingBoxQuery {
+	return &GeoBoundingBoxQuery{field: field, topLeft: topLeft, bottomRight: bottomRight}
+}
+
+func (q *GeoBoundingBoxQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"geo_bounding_box": map[string]interface{}{
+		q.field: map[string]interface{}{
+			"top_left":     map[string]interface{}{"lon": q.topLeft[0], "lat": q.topLeft[1]},
+			"bottom_right": map[string]interface{}{"lon": q.bottomRight[0], "lat": q.bottomRight[1]},
+		},
+	}}
+}
+
+// GeoShapeQuery filters documents whose geo field relates to a GeoJSON shape, geo_point fields are supported since es 7.14
+type GeoShapeQuery struct {
+	field    string
+	shape    interface{}
+	relation string
+}
+
+// NewGeoShapeQuery takes any value rendering to a GeoJSON geometry
+func NewGeoShapeQuery(field string, shape interface{}) *GeoShapeQuery {
+	return &GeoShapeQuery{field: field, shape: shape, relation: "intersects"}
+}
+
+func (q *GeoShapeQuery) Relation(relation string) *GeoShapeQuery {
+	q.relation = relation
+	return q
+}
+
+func (q *GeoShapeQuery) Source() map[string]interface{} {
+	return map[string]interface{}{"geo_shape": map[string]interface{}{
+		q.field: map[string]interface{}{
+			"shape":    q.shape,
+			"relation": q.relation,
+		},
+	}}
+}
+
+type FieldSort struct {
+	field string
+	order string
+}
+
+func NewFieldSort(field string) *FieldSort {
+	return &FieldSort{field: field, order: "asc"}
+}
+
+func (s *FieldSort) Desc() *FieldSort {
+	s.order = "desc"
+	return s
+}
+
+func (s *FieldSort) Source() interface{} {
+	return map[string]interface{}{s.field: map[string]interface{}{"order": s.order}}
+}
+
+type GeoDistanceSort struct {
+	field string
+	lon   float64
+	lat   float64
+	unit  string
+	order string
+}
+
+func NewGeoDistanceSort(field string, lon float64, lat float64) *GeoDistanceSort {
+	return &GeoDistanceSort{field: field, lon: lon, lat: lat, order: "asc"}
+}
+
+func (s *GeoDistanceSort) Unit(unit string) *GeoDistanceSort {
+	s.unit = unit
+	return s
+}
+
+func (s *GeoDistanceSort) Desc() *GeoDistanceSort {
+	s.order = "desc"
+	return s
+}
+
+func (s *GeoDistanceSort) Source() interface{} {
+	params := map[string]interface{}{
+		s.field: map[string]interface{}{"lon": s.lon, "lat": s.lat},
+		"order": s.order,
+	}
+	if s.unit != "" {
+		params["unit"] = s.unit
+	}
+	return map[string]interface{}{"_geo_distance": params}
+}
+
+// MetricAggregation covers the single field metrics like max, min, avg, sum and value_count
+type MetricAggregation struct {
+	kind  string
+	field string
+}
+
+func NewMaxAggregation(field string) *MetricAggregation {
+	return &MetricAggregation{kind: "max", field: field}
+}
+
+func NewMinAggregation(field string) *MetricAggregation {
+	return &MetricAggregation{kind: "min", field: field}
+}
+
+func NewAvgAggregation(field string) *MetricAggregation {
+	return &MetricAggregation{kind: "avg", field: field}
+}
+
+func NewSumAggregation(field string) *MetricAggregation {
+	return &MetricAggregation{kind: "sum", field: field}
+}
+
+func NewValueCountAggregation(field string) *MetricAggregation {
+	return &MetricAggregation{kind: "value_count", field: field}
+}
+
+func (a *MetricAggregation) Source() map[string]interface{} {
+	return map[string]interface{}{a.kind: map[string]interface{}{"field": a.field}}
+}
+
+type PercentilesAggregation struct {
+	field    string
+	percents []float64
+}
+
+func NewPercentilesAggregation(field string, percents ...float64) *PercentilesAggregation {
+	return &PercentilesAggregation{field: field, percents: percents}
+}
+
+func (a *PercentilesAggregation) Source() map[string]interface{} {
+	params := map[string]interface{}{"field": a.field}
+	if len(a.percents) > 0 {
+		params["percents"] = a.percents
+	}
+	return map[string]interface{}{"percentiles": params}
+}
+
+type TermsAggregation struct {
+	field   string
+	size    int
+	order   map[string]interface{}
+	subAggs map[string]Aggregation
+}
+
+func NewTermsAggregation(field string) *TermsAggregation {
+	return &TermsAggregation{field: field}
+}
+
+func (a *TermsAggregation) Size(size int) *TermsAggregation {
+	a.size = size
+	return a
+}
+
+// Order sorts the buckets by a key like _key, _count or the name of a sub aggregation
+func (a *TermsAggregation) Order(key string, asc bool) *TermsAggregation {
+	order := "desc"
+	if asc {
+		order = "asc"
+	}
+	a.order = map[string]interface{}{key: order}
+	return a
+}
+
+func (a *TermsAggregation) SubAggregation(name string, agg Aggregation) *TermsAggregation {
+	if a.subAggs == nil {
+		a.subAggs = map[string]Aggregation{}
+	}
+	a.subAggs[name] = agg
+	return a
+}
+
+func (a *TermsAggregation) Source() map[string]interface{} {
+	params := map[string]interface{}{"field": a.field}
+	if a.size > 0 {
+		params["size"] = a.size
+	}
+	if a.order != nil {
+		params["order"] = a.order
+	}
+	source := map[string]interface{}{"terms": params}
+	if len(a.subAggs) > 0 {
+		source["aggs"] = aggsSource(a.subAggs)
+	}
+	return source
+}
+
+type DateHistogramAggregation struct {
+	field       string
+	interval    string
+	timeZone    string
+	minDocCount *int
+	bounds      map[string]interface{}
+	subAggs     map[string]Aggregation
+}
+
+// NewDateHistogramAggregation buckets by a calendar interval like hour, day, week or month
+func NewDateHistogramAggregation(field string, interval string) *DateHistogramAggregation {
+	return &DateHistogramAggregation{field: field, interval: interval}
+}
+
+func (a *DateHistogramAggregation) TimeZone(tz string) *DateHistogramAggregation {
+	a.timeZone = tz
+	return a
+}
+
+func (a *DateHistogramAggregation) MinDocCount(count int) *DateHistogramAggregation {
+	a.minDocCount = &count
+	return a
+}
+
+// ExtendedBounds forces empty buckets from min to max, both in epoch millis
+func (a *DateHistogramAggregation) ExtendedBounds(min int64, max int64) *DateHistogramAggregation {
+	a.bounds = map[string]interface{}{"min": min, "max": max}
+	return a
+}
+
+func (a *DateHistogramAggregation) SubAggregation(name string, agg Aggregation) *DateHistogramAggregation {
+	if a.subAggs == nil {
+		a.subAggs = map[string]Aggregation{}
+	}
+	a.subAggs[name] = agg
+	return a
+}
+
+func (a *DateHistogramAggregation) Source() map[string]interface{} {
+	params := map[string]interface{}{
+		"field":             a.field,
+		"calendar_interval": a.interval,
+	}
+	if a.timeZone != "" {
+		params["time_zone"] = a.timeZone
+	}
+	if a.minDocCount != nil {
+		params["min_doc_count"] = *a.minDocCount
+	}
+	if a.bounds != nil {
+		params["extended_bounds"] = a.bounds
+	}
+	source := map[string]interface{}{"date_histogram": params}
+	if len(a.subAggs) > 0 {
+		source["aggs"] = aggsSource(a.subAggs)
+	}
+	return source
+}
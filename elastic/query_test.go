@@ -0,0 +1,118 @@
+package elastic
+
+import (
+	"testing"
+)
+
+func TestEscapeWildcard(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "Beijing", want: "Beijing"},
+		{in: `Xi"an`, want: `Xi"an`},
+		{in: "*", want: `\*`},
+		{in: "St. John?", want: `St. John\?`},
+		{in: `C:\temp`, want: `C:\\temp`},
+		{in: `\*`, want: `\\\*`},
+		{in: `a"*?\b`, want: `a"\*\?\\b`},
+		{in: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			if got := EscapeWildcard(tt.in); got != tt.want {
+				t.Errorf("EscapeWildcard(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWildcardQueryBody(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "beijing", want: `{"query":{"wildcard":{"name":{"case_insensitive":true,"value":"*beijing*"}}}}`},
+		{name: "quote", in: `Xi"an`, want: `{"query":{"wildcard":{"name":{"case_insensitive":true,"value":"*Xi\"an*"}}}}`},
+		{name: "star", in: "a*b", want: `{"query":{"wildcard":{"name":{"case_insensitive":true,"value":"*a\\*b*"}}}}`},
+		{name: "question mark", in: "a?", want: `{"query":{"wildcard":{"name":{"case_insensitive":true,"value":"*a\\?*"}}}}`},
+		{name: "backslash", in: `a\`, want: `{"query":{"wildcard":{"name":{"case_insensitive":true,"value":"*a\\\\*"}}}}`},
+		{name: "json breakout", in: `"}},"size":10000,"x":{"`,
+			want: `{"query":{"wildcard":{"name":{"case_insensitive":true,"value":"*\"}},\"size\":10000,\"x\":{\"*"}}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := NewWildcardQuery("name", "*"+EscapeWildcard(tt.in)+"*").CaseInsensitive(true)
+			got, err := NewSearchBody().Query(query).Build()
+			if err != nil {
+				t.Fatalf("Build() err: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Build() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchBodyBuild(t *testing.T) {
+	tests := []struct {
+		name string
+		body *SearchBody
+		want string
+	}{
+		{name: "empty", body: NewSearchBody(), want: `{}`},
+		{
+			name: "terms with user input",
+			body: NewSearchBody().Query(NewTermsQueryFromStrings("sid", []string{`1"2`, `3\4`})).Size(2),
+			want: `{"query":{"terms":{"sid":["1\"2","3\\4"]}},"size":2}`,
+		},
+		{
+			name: "bool range sort",
+			body: NewSearchBody().
+				Query(NewBoolQuery().
+					Filter(NewTermQuery("pol", `pm25"`), NewRangeQuery("tm").Gte(int64(1000)).Lte(int64(2000))).
+					MustNot(NewTermQuery("disabled", true))).
+				Sort(NewFieldSort("tm").Desc()).
+				From(10).
+				Size(5).
+				TrackTotalHits(true),
+			want: `{"from":10,"query":{"bool":{"filter":[{"term":{"pol":"pm25\""}},{"range":{"tm":{"gte":1000,"lte":2000}}}],` +
+				`"must_not":[{"term":{"disabled":true}}]}},"size":5,"sort":[{"tm":{"order":"desc"}}],"track_total_hits":true}`,
+		},
+		{
+			name: "aggregation",
+			body: NewSearchBody().Size(0).Aggregation("sids", NewTermsAggregation("sid").Size(3).
+				SubAggregation("max", NewMaxAggregation("data"))),
+			want: `{"aggs":{"sids":{"aggs":{"max":{"max":{"field":"data"}}},"terms":{"field":"sid","size":3}}},"size":0}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.body.Build()
+			if err != nil {
+				t.Fatalf("Build() err: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Build() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiSearchBodyBuild(t *testing.T) {
+	body := NewMultiSearchBody().
+		Add([]string{"aqi_history_2021"}, NewSearchBody().Query(NewTermQuery("sid", `1"`)).Size(1)).
+		Add([]string{"aqi_history_2020", "aqi_history_2021"}, NewSearchBody().Size(0))
+	got, err := body.Build()
+	if err != nil {
+		t.Fatalf("Build() err: %v", err)
+	}
+	want := `{"ignore_unavailable":true,"index":["aqi_history_2021"]}` + "\n" +
+		`{"query":{"term":{"sid":"1\""}},"size":1}` + "\n" +
+		`{"ignore_unavailable":true,"index":["aqi_history_2020","aqi_history_2021"]}` + "\n" +
+		`{"size":0}` + "\n"
+	if got != want {
+		t.Errorf("Build() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,56 @@
+package elastic
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/csnight/storm-aqi-server/elastic")
+
+// startRequestSpan starts a client span named after the esapi request type like es.Search,
+// recording the index of the request when it has one
+func startRequestSpan(ctx context.Context, req esapi.Request) (context.Context, trace.Span) {
+	v := reflect.Indirect(reflect.ValueOf(req))
+	op := strings.TrimSuffix(v.Type().Name(), "Request")
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "elasticsearch"),
+		attribute.String("db.operation", op),
+	}
+	if index := v.FieldByName("Index"); index.IsValid() {
+		switch index.Kind() {
+		case reflect.String:
+			attrs = append(attrs, attribute.String("es.index", index.String()))
+		case reflect.Slice:
+			if indexes, ok := index.Interface().([]string); ok {
+				attrs = append(attrs, attribute.String("es.index", strings.Join(indexes, ",")))
+			}
+		}
+	}
+	return tracer.Start(ctx, "es."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endRequestSpan records the hit counts of a search response or the error and ends the span
+func endRequestSpan(span trace.Span, resp []byte, err error) {
+	defer span.End()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	if !span.IsRecording() || resp == nil {
+		return
+	}
+	span.SetAttributes(attribute.Int("es.response_bytes", len(resp)))
+	hits := gjson.GetBytes(resp, "hits")
+	if hits.Exists() {
+		span.SetAttributes(attribute.Int64("es.hits_total", hits.Get("total.value").Int()), attribute.Int64("es.hits", hits.Get("hits.#").Int()))
+	}
+}
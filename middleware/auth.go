@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+const apiKeyLocal = "apiKey"
+
+// ApiKey is an authenticated key stored in the request locals
+type ApiKey struct {
+	Name         string
+	Scopes       map[string]bool
+	Rate         float64
+	Burst        int
+	MonthlyQuota int64
+	// scope is the sorted scopes joined by commas, which splits the response cache by scope
+	scope string
+}
+
+// tokenBucket refills rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token and returns zero, or the wait until the next token when the bucket is empty
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) time.Duration {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+type quotaCounter struct {
+	Month string `json:"month"`
+	Count int64  `json:"count"`
+}
+
+// Auth checks api keys sent as X-Api-Key or Authorization: Bearer, limits the request rate of
+// every key and client ip with token buckets and counts the monthly quota of every key by its name
+type Auth struct {
+	// Next defines a function to skip this middleware when returned true.
+	// Optional. Default: nil
+	Next func(c *fiber.Ctx) bool
+	log  *zap.Logger
+	// enabled and quotaFile are fixed at start, a reload replaces cfg under lock
+	enabled   bool
+	quotaFile string
+	cfg       *conf.AuthConfig
+	lock      sync.Mutex
+	keys      map[string]*ApiKey
+	keyBucket map[string]*tokenBucket
+	ipBucket  map[string]*tokenBucket
+	quota     map[string]*quotaCounter
+	ticker    *time.Ticker
+	done      chan bool
+}
+
+// NewAuth loads the keys of the config and keys file, a nil or disabled config lets every request through
+func NewAuth(cfg *conf.AuthConfig, logger *zap.Logger) (*Auth, error) {
+	auth := &Auth{
+		log:       logger.Named("[auth]"),
+		cfg:       cfg,
+		keyBucket: map[string]*tokenBucket{},
+		ipBucket:  map[string]*tokenBucket{},
+		quota:     map[string]*quotaCounter{},
+		done:      make(chan bool),
+	}
+	if cfg == nil || !cfg.Enable {
+		return auth, nil
+	}
+	auth.enabled = true
+	auth.quotaFile = cfg.QuotaFile
+	setRateDefaults(auth.cfg)
+	keys, err := loadApiKeys(auth.cfg)
+	if err != nil {
+		return nil, err
+	}
+	auth.keys = keys
+	if auth.quotaFile != "" {
+		data, err := ioutil.ReadFile(auth.quotaFile)
+		if err == nil {
+			err = json.Unmarshal(data, &auth.quota)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	auth.ticker = time.NewTicker(time.Minute)
+	go func() {
+		for {
+			select {
+			case <-auth.done:
+				return
+			case <-auth.ticker.C:
+				auth.sweep()
+				auth.flushQuota()
+			}
+		}
+	}()
+	auth.log.Info("api key auth enabled", zap.Int("keys", len(keys)))
+	return auth, nil
+}
+
+func setRateDefaults(cfg *conf.AuthConfig) {
+	if cfg.Rate <= 0 {
+		cfg.Rate = 10
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate * 2))
+	}
+	if cfg.IpRate <= 0 {
+		cfg.IpRate = 20
+	}
+	if cfg.IpBurst <= 0 {
+		cfg.IpBurst = int(math.Ceil(cfg.IpRate * 2))
+	}
+}
+
+// Reload puts the keys and rate limits of cfg in effect keeping the buckets and quota counters,
+// nothing changes when the keys are invalid. Turning auth on or off and the quota file need a restart
+func (a *Auth) Reload(cfg *conf.AuthConfig) error {
+	if !a.Enabled() || cfg == nil {
+		return nil
+	}
+	c := *cfg
+	c.Enable = a.enabled
+	c.QuotaFile = a.quotaFile
+	setRateDefaults(&c)
+	keys, err := loadApiKeys(&c)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.cfg = &c
+	a.keys = keys
+	return nil
+}
+
+func loadApiKeys(cfg *conf.AuthConfig) (map[string]*ApiKey, error) {
+	list := append([]conf.ApiKeyConfig{}, cfg.Keys...)
+	if cfg.KeysFile != "" {
+		data, err := ioutil.ReadFile(cfg.KeysFile)
+		if err != nil {
+			return nil, err
+		}
+		var fileKeys []conf.ApiKeyConfig
+		if err = yaml.Unmarshal(data, &fileKeys); err != nil {
+			return nil, err
+		}
+		list = append(list, fileKeys...)
+	}
+	keys := map[string]*ApiKey{}
+	for i, item := range list {
+		if item.Key == "" {
+			return nil, errors.New("api key " + strconv.Itoa(i) + " is empty")
+		}
+		key := &ApiKey{
+			Name:         item.Name,
+			Scopes:       map[string]bool{},
+			Rate:         item.Rate,
+			Burst:        item.Burst,
+			MonthlyQuota: item.MonthlyQuota,
+		}
+		if key.Name == "" {
+			key.Name = "key" + strconv.Itoa(i)
+		}
+		if key.Rate <= 0 {
+			key.Rate = cfg.Rate
+		}
+		if key.Burst <= 0 {
+			key.Burst = int(math.Max(math.Ceil(key.Rate*2), 1))
+		}
+		for _, other := range keys {
+			if other.Name == key.Name {
+				return nil, errors.New("api key name " + key.Name + " is duplicated")
+			}
+		}
+		for _, scope := range item.Scopes {
+			key.Scopes[scope] = true
+		}
+		if len(key.Scopes) == 0 {
+			key.Scopes["read"] = true
+		}
+		scopes := make([]string, 0, len(key.Scopes))
+		for scope := range key.Scopes {
+			scopes = append(scopes, scope)
+		}
+		sort.Strings(scopes)
+		key.scope = strings.Join(scopes, ",")
+		keys[item.Key] = key
+	}
+	return keys, nil
+}
+
+func (a *Auth) Enabled() bool {
+	return a.enabled
+}
+
+// Handler authenticates the request, answering 401 for a missing or unknown key and 429 with
+// Retry-After when the key or ip is over its rate or the key has used up its monthly quota
+func (a *Auth) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !a.Enabled() || c.Method() == fiber.MethodOptions || (a.Next != nil && a.Next(c)) {
+			return c.Next()
+		}
+		token := c.Get("X-Api-Key")
+		if token == "" {
+			token = strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		}
+		now := time.Now()
+		a.lock.Lock()
+		// the ip token is taken before the key lookup so guessing keys is throttled too
+		wait := a.take(a.ipBucket, c.IP(), now, a.cfg.IpRate, a.cfg.IpBurst)
+		key, ok := a.keys[token]
+		if wait == 0 && (token == "" || !ok) {
+			a.lock.Unlock()
+			return authFail(http.StatusUnauthorized, "missing or invalid api key", c)
+		}
+		if wait == 0 {
+			wait = a.take(a.keyBucket, key.Name, now, key.Rate, key.Burst)
+		}
+		if wait > 0 {
+			a.lock.Unlock()
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return authFail(http.StatusTooManyRequests, "rate limit exceeded", c)
+		}
+		month := now.UTC().Format("2006-01")
+		counter, ok := a.quota[key.Name]
+		if !ok || counter.Month != month {
+			counter = &quotaCounter{Month: month}
+			a.quota[key.Name] = counter
+		}
+		if key.MonthlyQuota > 0 && counter.Count >= key.MonthlyQuota {
+			a.lock.Unlock()
+			utc := now.UTC()
+			reset := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(reset.Sub(now).Seconds()))))
+			c.Set("X-Quota-Remaining", "0")
+			return authFail(http.StatusTooManyRequests, "monthly quota exceeded", c)
+		}
+		counter.Count++
+		if key.MonthlyQuota > 0 {
+			c.Set("X-Quota-Remaining", strconv.FormatInt(key.MonthlyQuota-counter.Count, 10))
+		}
+		a.lock.Unlock()
+		c.Locals(apiKeyLocal, key)
+		return c.Next()
+	}
+}
+
+// Require answers 403 when the key of the request lacks the scope, the admin scope grants every scope.
+// It passes when auth is disabled or skipped for the request
+func (a *Auth) Require(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !a.Enabled() || (a.Next != nil && a.Next(c)) {
+			return c.Next()
+		}
+		key, ok := c.Locals(apiKeyLocal).(*ApiKey)
+		if !ok || !(key.Scopes[scope] || key.Scopes["admin"]) {
+			return authFail(http.StatusForbidden, "api key lacks scope "+scope, c)
+		}
+		return c.Next()
+	}
+}
+
+// KeyName returns the name of the api key of the request, empty when auth is disabled or skipped
+func KeyName(c *fiber.Ctx) string {
+	if key, ok := c.Locals(apiKeyLocal).(*ApiKey); ok {
+		return key.Name
+	}
+	return ""
+}
+
+// CacheScope returns the scopes of the api key of the request, empty when auth is disabled or skipped.
+// Responses are cached per scope, so a response to an admin key is never served to a read key
+func CacheScope(c *fiber.Ctx) string {
+	if key, ok := c.Locals(apiKeyLocal).(*ApiKey); ok {
+		return key.scope
+	}
+	return ""
+}
+
+// take spends a token of the bucket of id, new buckets start full
+func (a *Auth) take(buckets map[string]*tokenBucket, id string, now time.Time, rate float64, burst int) time.Duration {
+	b, ok := buckets[id]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[id] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// sweep drops the buckets idle long enough to be full again, so the ip map does not grow forever
+func (a *Auth) sweep() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	idle := time.Now().Add(-10 * time.Minute)
+	for _, buckets := range []map[string]*tokenBucket{a.keyBucket, a.ipBucket} {
+		for id, b := range buckets {
+			if b.last.Before(idle) {
+				delete(buckets, id)
+			}
+		}
+	}
+}
+
+func (a *Auth) flushQuota() {
+	if a.quotaFile == "" {
+		return
+	}
+	a.lock.Lock()
+	data, err := json.Marshal(a.quota)
+	a.lock.Unlock()
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(a.quotaFile), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(a.quotaFile+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(a.quotaFile+".tmp", a.quotaFile)
+	}
+	if err != nil {
+		a.log.Error("flush quota counters err:", zap.Error(err))
+	}
+}
+
+func (a *Auth) Close() {
+	if a.ticker == nil {
+		return
+	}
+	a.ticker.Stop()
+	close(a.done)
+	a.flushQuota()
+}
+
+// authFail answers in the json envelope of the api
+func authFail(code int, msg string, c *fiber.Ctx) error {
+	return c.Status(code).JSON(fiber.Map{
+		"status": http.StatusText(code),
+		"code":   code,
+		"body":   nil,
+		"msg":    msg,
+		"time":   time.Now().UnixMilli(),
+	})
+}
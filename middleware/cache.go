@@ -3,6 +3,7 @@ package middleware
 import (
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/coocood/freecache"
@@ -11,23 +12,51 @@ import (
 )
 
 type CacheConfig struct {
+	// Next defines a function to skip this middleware when returned true.
+	// Optional. Default: nil
+	Next func(c *fiber.Ctx) bool
+	// KeyPrefix splits the cached responses of a url, like by the scope of the api key
+	// Optional. Default: nil
+	KeyPrefix   func(c *fiber.Ctx) string
 	Expiration  int
 	CacheHeader string
 	Compress    bool
 }
 
-// NewCache creates a new cache handler
-func NewCache(cfg CacheConfig) fiber.Handler {
+// cacheExpiration is the entry lifetime in seconds of the cache made by NewCache, negative disables it
+var cacheExpiration int64
 
-	// Nothing to cache
-	if cfg.Expiration*int(time.Second) < 0 {
-		return func(c *fiber.Ctx) error {
-			return c.Next()
-		}
+// SetCacheExpiration changes the lifetime of new cache entries, the cached entries keep theirs
+func SetCacheExpiration(seconds int) {
+	atomic.StoreInt64(&cacheExpiration, int64(seconds))
+}
+
+// responseCache is the cache made by NewCache, kept for PurgeCache
+var responseCache atomic.Value
+
+// PurgeCache drops every cached response, for writes whose changes must show at once
+func PurgeCache() {
+	if manager, ok := responseCache.Load().(*freecache.Cache); ok {
+		manager.Clear()
 	}
+}
+
+// NewCache creates a new cache handler
+func NewCache(cfg CacheConfig) fiber.Handler {
+	SetCacheExpiration(cfg.Expiration)
 	manager := freecache.NewCache(100 * 1024 * 1024)
+	responseCache.Store(manager)
 	// Return new handler
 	return func(c *fiber.Ctx) error {
+		// Don't execute middleware if Next returns true
+		if cfg.Next != nil && cfg.Next(c) {
+			return c.Next()
+		}
+		// Nothing to cache
+		expiration := int(atomic.LoadInt64(&cacheExpiration))
+		if expiration < 0 {
+			return c.Next()
+		}
 		// Only cache GET methods
 		if c.Method() != fiber.MethodGet {
 			c.Set(cfg.CacheHeader, "unreachable")
@@ -49,6 +78,9 @@ func NewCache(cfg CacheConfig) fiber.Handler {
 		}
 		// Get key from request
 		key := utils.CopyString(c.OriginalURL())
+		if cfg.KeyPrefix != nil {
+			key = cfg.KeyPrefix(c) + " " + key
+		}
 
 		// Get entry from pool
 		e, err := manager.Get([]byte(key))
@@ -63,10 +95,13 @@ func NewCache(cfg CacheConfig) fiber.Handler {
 			c.Set(cfg.CacheHeader, "hit")
 			return nil
 		}
+		c.Set(cfg.CacheHeader, "miss")
 		if err = c.Next(); err != nil {
 			return err
 		}
-		if c.Response().StatusCode() == http.StatusOK {
+		// responses marked no-store like history pages pointing into a point in time are never cached
+		noStore := strings.Contains(string(c.Response().Header.Peek(fiber.HeaderCacheControl)), "no-store")
+		if c.Response().StatusCode() == http.StatusOK && !noStore {
 			body := utils.CopyBytes(c.Response().Body())
 			if len(body) > 0 {
 				ct := utils.CopyBytes(c.Response().Header.ContentType())
@@ -77,7 +112,7 @@ func NewCache(cfg CacheConfig) fiber.Handler {
 					cacheBytes[0] = ctB
 					cacheBytes[1] = getEncodingByte(encoding)
 					cacheBytes = append(cacheBytes, body...)
-					_ = manager.Set([]byte(key), cacheBytes, cfg.Expiration)
+					_ = manager.Set([]byte(key), cacheBytes, expiration)
 					cacheBytes = nil
 				}
 			}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var (
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aqi_http_request_duration_seconds",
+		Help:    "Latency of http requests by route, method and status.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "status"})
+	httpCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aqi_http_cache_requests_total",
+		Help: "GET requests served from the response cache (hit) or by the handlers (miss).",
+	}, []string{"result"})
+)
+
+type MetricsConfig struct {
+	// Next defines a function to skip this middleware when returned true.
+	// Optional. Default: nil
+	Next        func(c *fiber.Ctx) bool
+	CacheHeader string
+}
+
+// NewMetrics observes the latency of every request and counts the response cache results,
+// requests answered before reaching a route are labeled cached or none
+func NewMetrics(cfg MetricsConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if cfg.Next != nil && cfg.Next(c) {
+			return c.Next()
+		}
+		start := time.Now()
+		err := c.Next()
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+		cache := string(c.Response().Header.Peek(cfg.CacheHeader))
+		if cache == "hit" || cache == "miss" {
+			httpCache.WithLabelValues(cache).Inc()
+		}
+		route := c.Route().Path
+		if cache == "hit" {
+			route = "cached"
+		} else if route != strings.TrimSuffix(c.Path(), "/") && !strings.ContainsAny(route, ":*") {
+			// the chain stopped in a middleware mounted on a prefix, like 404, 401 or 429
+			route = "none"
+		}
+		httpDuration.WithLabelValues(route, c.Method(), strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// MetricsHandler serves the default prometheus registry in the text exposition format,
+// compression is left to the compress middleware
+func MetricsHandler() fiber.Handler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		DisableCompression: true,
+	}))
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		return nil
+	}
+}
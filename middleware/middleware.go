@@ -1,6 +1,9 @@
 package middleware
 
 import (
+	"strings"
+	"sync/atomic"
+
 	"github.com/csnight/storm-aqi-server/conf"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/compress"
@@ -11,43 +14,95 @@ import (
 	"go.uber.org/zap"
 )
 
-func Use(server *fiber.App, config *conf.GConfig) *zap.Logger {
+func Use(server *fiber.App, config *conf.GConfig) (*zap.Logger, *Auth, error) {
 
 	logger := InitLogger(config.LogConf)
 
 	server.Use(rcp.New())
 
+	server.Use(NewTrace())
+
 	server.Use(etag.New(etag.Config{
+		Next: IsStream,
 		Weak: true,
 	}))
 
 	server.Use(New(LogConfig{
-		Next:         nil,
+		Next:         IsProbe,
 		Logger:       logger,
-		Fields:       []string{"ips", "port", "url", "method", "status", "latency", "queryParams", "body"},
+		Fields:       []string{"ips", "port", "url", "method", "status", "latency", "queryParams", "body", "traceId"},
 		Messages:     []string{"Server error", "Client error", "Success"},
 		CompressBody: config.AppConf.EnableCompress,
 	}))
 
-	server.Use(cors.New(cors.Config{
-		AllowOrigins:     "*",
-		AllowHeaders:     "Content-Type,AccessToken,X-CSRF-Token,Authorization,Token,X-Token,X-User-Id",
-		AllowCredentials: true,
+	server.Use(NewMetrics(MetricsConfig{
+		Next:        IsStream,
+		CacheHeader: "X-Cache-Storm",
 	}))
 
+	SetCorsOrigins(config.AppConf.CorsOrigins)
+	server.Use(func(c *fiber.Ctx) error {
+		return corsHandler.Load().(fiber.Handler)(c)
+	})
+
+	auth, err := NewAuth(config.AuthConf, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	auth.Next = IsPublic
+	server.Use(auth.Handler())
+
+	expiration := config.AppConf.CacheExpiration
+	if expiration == 0 {
+		expiration = 300
+	}
 	server.Use(NewCache(CacheConfig{
-		Expiration:  300,
+		Next:        IsStream,
+		KeyPrefix:   CacheScope,
+		Expiration:  expiration,
 		Compress:    config.AppConf.EnableCompress,
 		CacheHeader: "X-Cache-Storm",
 	}))
 
 	if config.AppConf.EnableCompress {
 		server.Use(compress.New(compress.Config{
+			Next:  IsStream,
 			Level: compress.LevelDefault, // 1
 		}))
 	}
 
-	server.Get("/monitor", monitor.New())
+	server.Get("/monitor", auth.Require("admin"), monitor.New())
+	server.Get("/metrics", auth.Require("admin"), MetricsHandler())
+
+	return logger, auth, nil
+}
+
+// corsHandler is the cors middleware of the allowed origins in effect
+var corsHandler atomic.Value
+
+// SetCorsOrigins replaces the cors middleware, origins is a comma separated list and empty allows all
+func SetCorsOrigins(origins string) {
+	if origins == "" {
+		origins = "*"
+	}
+	corsHandler.Store(cors.New(cors.Config{
+		AllowOrigins:     origins,
+		AllowHeaders:     "Content-Type,X-Api-Key,AccessToken,X-CSRF-Token,Authorization,Token,X-Token,X-User-Id",
+		AllowCredentials: true,
+	}))
+}
+
+// IsPublic lets the api docs page, its static assets and the probes through without an api key
+func IsPublic(c *fiber.Ctx) bool {
+	return c.Method() == fiber.MethodGet && (strings.HasSuffix(c.Path(), "/v1/") || strings.Contains(c.Path(), "/v1/static/") || IsProbe(c))
+}
+
+// IsProbe matches the liveness and readiness probes, which are not logged as they come every few seconds
+func IsProbe(c *fiber.Ctx) bool {
+	return c.Path() == "/livez" || c.Path() == "/readyz"
+}
 
-	return logger
+// IsStream skips middlewares which read the whole response body on streaming routes
+func IsStream(c *fiber.Ctx) bool {
+	return strings.HasSuffix(c.Path(), "/stream") || strings.HasSuffix(c.Path(), "/export")
 }
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InitTracer installs the global tracer provider and the W3C trace context propagator, the returned
+// shutdown flushes the pending spans. A nil or disabled config keeps the no-op provider of otel
+func InitTracer(cfg *conf.TraceConfig) (func(ctx context.Context) error, error) {
+	if cfg == nil || !cfg.Enable {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+	var exporter sdktrace.SpanExporter
+	var file *os.File
+	var err error
+	switch cfg.Exporter {
+	case "file":
+		if cfg.File == "" {
+			return nil, errors.New("trace file exporter needs trace.file")
+		}
+		if err = os.MkdirAll(filepath.Dir(cfg.File), 0755); err != nil {
+			return nil, err
+		}
+		file, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case "otlp", "":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, errors.New("unknown trace exporter " + cfg.Exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.ServiceName
+	if name == "" {
+		name = "storm-aqi-server"
+	}
+	ratio := cfg.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(name))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			_ = file.Close()
+		}
+		return err
+	}, nil
+}
+
+// headerCarrier reads the propagation headers from the request and writes them to the response
+type headerCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h headerCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h headerCarrier) Set(key string, value string) {
+	h.c.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	return []string{"traceparent", "tracestate"}
+}
+
+// NewTrace starts a server span for every request as a child of the traceparent header if any,
+// hands it to the handlers as the user context and returns the traceparent of the span
+func NewTrace() fiber.Handler {
+	tracer := otel.Tracer("github.com/csnight/storm-aqi-server/server")
+	return func(c *fiber.Ctx) error {
+		propagator := otel.GetTextMapPropagator()
+		ctx := propagator.Extract(context.Background(), headerCarrier{c})
+		ctx, span := tracer.Start(ctx, c.Method()+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Method()),
+				semconv.HTTPTargetKey.String(c.OriginalURL()),
+				semconv.HTTPClientIPKey.String(c.IP()),
+			))
+		defer span.End()
+		c.SetUserContext(ctx)
+		propagator.Inject(ctx, headerCarrier{c})
+		err := c.Next()
+		status := c.Response().StatusCode()
+		span.SetName(c.Method() + " " + c.Route().Path)
+		span.SetAttributes(semconv.HTTPRouteKey.String(c.Route().Path), semconv.HTTPStatusCodeKey.Int(status))
+		if err != nil {
+			span.RecordError(err)
+		}
+		if status >= 500 || err != nil {
+			span.SetStatus(codes.Error, "")
+		}
+		return err
+	}
+}
+
+// TraceId returns the trace id of the request span, empty when the request is not sampled
+func TraceId(c *fiber.Ctx) string {
+	sc := trace.SpanContextFromContext(c.UserContext())
+	if !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
@@ -33,13 +33,20 @@ type LogConfig struct {
 	CompressBody bool
 }
 
+// logLevel is shared by the cores of the logger so a reload changes the level in place
+var logLevel = zap.NewAtomicLevel()
+
+// SetLogLevel changes the level of the logger made by InitLogger
+func SetLogLevel(level string) error {
+	return logLevel.UnmarshalText([]byte(level))
+}
+
 func InitLogger(cfg *conf.LogConfig) *zap.Logger {
 	writeSyncer := getLogWriter(cfg.Filename, cfg.MaxSize, cfg.MaxBackups, cfg.MaxAge)
 	encoder := getEncoder()
-	var l = new(zapcore.Level)
-	_ = l.UnmarshalText([]byte(cfg.Level))
-	core := zapcore.NewCore(encoder, writeSyncer, l)
-	coreConsole := zapcore.NewCore(encoder, zapcore.AddSync(os.Stdout), l)
+	_ = logLevel.UnmarshalText([]byte(cfg.Level))
+	core := zapcore.NewCore(encoder, writeSyncer, logLevel)
+	coreConsole := zapcore.NewCore(encoder, zapcore.AddSync(os.Stdout), logLevel)
 	logger := zap.New(zapcore.NewTee(core, coreConsole), zap.AddCaller())
 	zap.ReplaceGlobals(logger) // 替换zap包中全局的logger实例，后续在其他包中只需使用zap.L()调用即可
 	return logger
@@ -149,6 +156,10 @@ func New(cfg LogConfig) fiber.Handler {
 				fields = append(fields, zap.String("method", c.Method()))
 			case "bytesReceived":
 				fields = append(fields, zap.Int("bytesReceived", len(c.Request().Body())))
+			case "traceId":
+				if traceId := TraceId(c); traceId != "" {
+					fields = append(fields, zap.String("traceId", traceId))
+				}
 			}
 		}
 		cfg.Logger.Info("Request", fields...)
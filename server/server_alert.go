@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+type AlertRuleRequest struct {
+	Name      string   `json:"name" validate:"required,max=64"`
+	Pol       string   `json:"pol" validate:"required,oneof=no2 pm25 pm10 o3 so2 co"`
+	Metric    string   `json:"metric" validate:"omitempty,oneof=aqi value"`
+	Op        string   `json:"op" validate:"required,oneof=gt gte lt lte"`
+	Threshold float64  `json:"threshold" validate:"min=0"`
+	Hours     int      `json:"hours" validate:"required,min=1,max=72"`
+	Sids      []string `json:"sids" validate:"omitempty,max=500,dive,number"`
+	City      string   `json:"city" validate:"omitempty,max=64,excludesall=@?*%"`
+	Webhook   string   `json:"webhook" validate:"required,url,startswith=http"`
+	Secret    string   `json:"secret" validate:"omitempty,max=256"`
+	Enabled   *bool    `json:"enabled"`
+}
+
+type AlertStatesRequest struct {
+	QType  string `json:"qType" validate:"required,oneof=_get"`
+	RuleId string `json:"ruleId" validate:"omitempty,max=64"`
+	Firing bool   `json:"firing"`
+}
+
+// AlertRuleResp never carries the secret, only whether one is set
+type AlertRuleResp struct {
+	db.AlertRule
+	HasSecret bool `json:"has_secret"`
+}
+
+func buildAlertRuleResp(rule db.AlertRule) AlertRuleResp {
+	resp := AlertRuleResp{AlertRule: rule, HasSecret: rule.Secret != ""}
+	resp.Secret = ""
+	return resp
+}
+
+// saveAlertRule creates a rule when id is empty, otherwise replaces the rule keeping an omitted secret
+func (app *AQIServer) saveAlertRule(id string, ctx *fiber.Ctx) error {
+	var body AlertRuleRequest
+	if err := ctx.BodyParser(&body); err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(body)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if len(body.Sids) == 0 && body.City == "" {
+		return FailWithMessage(http.StatusBadRequest, "rule needs sids or city", ctx)
+	}
+	rule := &db.AlertRule{
+		Name:      body.Name,
+		Pol:       body.Pol,
+		Metric:    body.Metric,
+		Op:        body.Op,
+		Threshold: body.Threshold,
+		Hours:     body.Hours,
+		Sids:      body.Sids,
+		City:      strings.TrimSpace(body.City),
+		Webhook:   body.Webhook,
+		Secret:    body.Secret,
+		Enabled:   body.Enabled == nil || *body.Enabled,
+	}
+	if rule.Metric == "" {
+		rule.Metric = "aqi"
+	}
+	if rule.Sids == nil {
+		rule.Sids = []string{}
+	}
+	if id == "" {
+		if err := app.dbc(ctx).CreateAlertRule(rule); err != nil {
+			return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+		}
+		return Result(http.StatusCreated, buildAlertRuleResp(*rule), "Success", ctx)
+	}
+	var err error
+	if app.alert != nil {
+		err = app.alert.UpdateRule(id, rule)
+	} else {
+		err = app.dbc(ctx).UpdateAlertRule(id, rule)
+	}
+	if err != nil {
+		if err == db.ErrAlertRuleNotFound {
+			return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+		}
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	return OkWithDetailed(buildAlertRuleResp(*rule), "Success", ctx)
+}
+
+func (app *AQIServer) AlertRulesGet(ctx *fiber.Ctx) error {
+	rules, err := app.dbc(ctx).GetAlertRules()
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	resp := []AlertRuleResp{}
+	for _, rule := range rules {
+		resp = append(resp, buildAlertRuleResp(rule))
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(resp, "Success", ctx)
+}
+
+func (app *AQIServer) AlertRuleGet(ctx *fiber.Ctx) error {
+	rule, err := app.dbc(ctx).GetAlertRule(ctx.Params("id"))
+	if err != nil {
+		if err == db.ErrAlertRuleNotFound {
+			return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+		}
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(buildAlertRuleResp(*rule), "Success", ctx)
+}
+
+func (app *AQIServer) AlertRuleCreate(ctx *fiber.Ctx) error {
+	return app.saveAlertRule("", ctx)
+}
+
+func (app *AQIServer) AlertRuleUpdate(ctx *fiber.Ctx) error {
+	return app.saveAlertRule(ctx.Params("id"), ctx)
+}
+
+// AlertRuleDelete goes through the engine when it runs, which resolves the firing stations of the rule first
+func (app *AQIServer) AlertRuleDelete(ctx *fiber.Ctx) error {
+	var err error
+	if app.alert != nil {
+		err = app.alert.DeleteRule(ctx.Params("id"))
+	} else {
+		err = app.dbc(ctx).DeleteAlertRule(ctx.Params("id"))
+	}
+	if err != nil {
+		if err == db.ErrAlertRuleNotFound {
+			return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+		}
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	return Ok(ctx)
+}
+
+func (app *AQIServer) AlertStatesGet(ctx *fiber.Ctx) error {
+	var query AlertStatesRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	states, err := app.dbc(ctx).GetAlertStates(query.RuleId, query.Firing)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(states, "Success", ctx)
+}
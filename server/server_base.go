@@ -1,7 +1,12 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/csnight/storm-aqi-server/conf"
 	"github.com/csnight/storm-aqi-server/db"
@@ -10,14 +15,24 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
 type AQIServer struct {
-	app *fiber.App
-	log *zap.Logger
-	db  *db.DB
-	cfg *conf.GConfig
+	app   *fiber.App
+	log   *zap.Logger
+	db    *db.DB
+	hub   *db.RealtimeHub
+	alert *db.AlertEngine
+	// ingest is nil when the silam ingestion is disabled
+	ingest *db.SilamIngester
+	auth   *middleware.Auth
+	cfg    atomic.Value
+	trace  func(ctx context.Context) error
+	// reloadLock orders reloads and guards pending
+	reloadLock sync.RWMutex
+	pending    []string
 }
 
 var json = jsoniter.Config{
@@ -37,28 +52,57 @@ func New(conf *conf.GConfig) (*AQIServer, error) {
 		JSONEncoder:       json.Marshal,
 		JSONDecoder:       json.Unmarshal,
 	})
-	logger := middleware.Use(server, conf)
+	shutdownTrace, err := middleware.InitTracer(conf.TraceConf)
+	if err != nil {
+		return nil, err
+	}
+	logger, auth, err := middleware.Use(server, conf)
+	if err != nil {
+		return nil, err
+	}
 
 	dbEs, err := db.Init(conf, logger)
 	if err != nil {
 		return nil, err
 	}
 	dbEs.RefreshCache()
+	if err = prometheus.Register(&statsCollector{db: dbEs}); err != nil {
+		return nil, err
+	}
+	hub := dbEs.NewRealtimeHub()
+	hub.Start()
+	var alert *db.AlertEngine
+	if conf.AlertConf != nil && conf.AlertConf.Enable {
+		alert = dbEs.NewAlertEngine(conf.AlertConf)
+		alert.Start()
+	}
+	var ingest *db.SilamIngester
+	if conf.SilamConf != nil && conf.SilamConf.Enable {
+		ingest = dbEs.NewSilamIngester(conf.SilamConf)
+		ingest.Start()
+	}
 	api := server.Group("/api")
 	v1 := api.Group("/v1")
 	v1.Static("/static", "./assets/static")
 	app := &AQIServer{
-		app: server,
-		log: logger,
-		db:  dbEs,
-		cfg: conf,
+		app:    server,
+		log:    logger,
+		db:     dbEs,
+		hub:    hub,
+		alert:  alert,
+		ingest: ingest,
+		auth:   auth,
+		trace:  shutdownTrace,
 	}
+	app.cfg.Store(conf)
+	server.Get("/livez", app.Livez)
+	server.Get("/readyz", app.Readyz)
 	app.Register(v1)
 	return app, nil
 }
 
 func (app *AQIServer) StartHttpServer() {
-	err := app.app.Listen(":" + strconv.Itoa(app.cfg.AppConf.Port))
+	err := app.app.Listen(":" + strconv.Itoa(app.config().AppConf.Port))
 	if err != nil {
 		app.log.Error("start aqi server err:", zap.Error(err))
 		return
@@ -66,9 +110,63 @@ func (app *AQIServer) StartHttpServer() {
 	app.log.Info("\u001B[32mStart aqi syncer complete\u001B[0m")
 }
 
+// Shutdown stops accepting connections and gives the in-flight requests the shutdown timeout to finish
+// before closing the background jobs and the stores. Event streams are ended right away as they never finish
+func (app *AQIServer) Shutdown() {
+	timeout := 30 * time.Second
+	if app.config().AppConf.ShutdownTimeout > 0 {
+		timeout = time.Duration(app.config().AppConf.ShutdownTimeout) * time.Second
+	}
+	// event streams never finish on their own, ending them lets the connections drain
+	app.hub.Close()
+	if err := app.shutdownWithTimeout(timeout); err == errShutdownTimeout {
+		app.log.Warn("shutdown timeout, in-flight requests are dropped", zap.Duration("timeout", timeout))
+	} else if err != nil {
+		app.log.Error("shutdown http server err:", zap.Error(err))
+	} else {
+		app.log.Info("http server drained")
+	}
+	app.Close()
+}
+
+var errShutdownTimeout = errors.New("shutdown timeout")
+
+// shutdownWithTimeout stands in for the ShutdownWithTimeout of later fiber releases, which this
+// version lacks: it closes the listeners and waits for the open connections up to the timeout
+func (app *AQIServer) shutdownWithTimeout(timeout time.Duration) error {
+	drained := make(chan error, 1)
+	go func() {
+		drained <- app.app.Shutdown()
+	}()
+	select {
+	case err := <-drained:
+		return err
+	case <-time.After(timeout):
+		return errShutdownTimeout
+	}
+}
+
+// Close stops the background jobs and closes the stores, the realtime hub is closed by Shutdown
 func (app *AQIServer) Close() {
+	if app.alert != nil {
+		app.alert.Close()
+	}
+	if app.ingest != nil {
+		app.ingest.Close()
+	}
+	app.auth.Close()
 	app.db.Close()
 	app.log.Info(`elasticsearch api closed`)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := app.trace(ctx); err != nil {
+		app.log.Error("flush traces err:", zap.Error(err))
+	}
+}
+
+// dbc returns the db running its calls in the span of the request
+func (app *AQIServer) dbc(ctx *fiber.Ctx) *db.DB {
+	return app.db.WithContext(ctx.UserContext())
 }
 
 type ErrorResponse struct {
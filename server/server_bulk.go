@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+type BulkFailuresRequest struct {
+	QType string `json:"qType" validate:"required,oneof=_get"`
+	Index string `json:"index" validate:"omitempty,max=255"`
+	Size  int    `json:"size" validate:"omitempty,min=1,max=1000"`
+}
+
+// DeadLettersRequest picks dead letters by seq or index, none of them picks all
+type DeadLettersRequest struct {
+	Index string   `json:"index" query:"index" validate:"omitempty,max=255"`
+	Seqs  []uint64 `json:"seqs" query:"seqs" validate:"omitempty,max=1000"`
+}
+
+type DeadLettersResponse struct {
+	Count int `json:"count"`
+}
+
+// bulkFailuresFail maps the fail queue errors to their status
+func bulkFailuresFail(err error, ctx *fiber.Ctx) error {
+	switch err {
+	case db.ErrNoFailQueue, db.ErrNoDeadLetters:
+		return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+	}
+	return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+}
+
+func (app *AQIServer) BulkFailuresGet(ctx *fiber.Ctx) error {
+	var query BulkFailuresRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if query.Size == 0 {
+		query.Size = 100
+	}
+	failures, err := app.dbc(ctx).GetBulkFailures(query.Index, query.Size)
+	if err != nil {
+		return bulkFailuresFail(err, ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(failures, "Success", ctx)
+}
+
+func (app *AQIServer) DeadLettersGet(ctx *fiber.Ctx) error {
+	var query BulkFailuresRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if query.Size == 0 {
+		query.Size = 100
+	}
+	letters, err := app.dbc(ctx).GetDeadLetters(query.Index, query.Size)
+	if err != nil {
+		return bulkFailuresFail(err, ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(letters, "Success", ctx)
+}
+
+func (app *AQIServer) DeadLettersReplay(ctx *fiber.Ctx) error {
+	var body DeadLettersRequest
+	if len(ctx.Body()) > 0 {
+		if err := ctx.BodyParser(&body); err != nil {
+			return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+		}
+	}
+	errResp := ValidateStruct(body)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	count, err := app.dbc(ctx).ReplayDeadLetters(body.Index, body.Seqs)
+	if err != nil {
+		return bulkFailuresFail(err, ctx)
+	}
+	return Result(http.StatusAccepted, DeadLettersResponse{Count: count}, "Success", ctx)
+}
+
+func (app *AQIServer) DeadLettersPurge(ctx *fiber.Ctx) error {
+	var query DeadLettersRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	count, err := app.dbc(ctx).PurgeDeadLetters(query.Index, query.Seqs)
+	if err != nil {
+		return bulkFailuresFail(err, ctx)
+	}
+	return OkWithDetailed(DeadLettersResponse{Count: count}, "Success", ctx)
+}
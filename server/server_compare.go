@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CompareRequest struct {
+	QType  string   `json:"qType" validate:"required,oneof=_get"`
+	Sids   []string `json:"sids" validate:"required,min=2,max=20,unique,dive,number"`
+	Pol    string   `json:"pol" validate:"required,oneof=no2 pm25 pm10 o3 so2 co"`
+	Recent string   `json:"recent" validate:"required_without=Start,omitempty,oneof=lastDay lastWeek lastMonth lastQuarter lastYear"`
+	Start  string   `json:"start" validate:"required_without=Recent,omitempty,datetime=2006-01-02"`
+	End    string   `json:"end" validate:"required_with=Start,omitempty,datetime=2006-01-02"`
+}
+
+func (app *AQIServer) CompareGet(ctx *fiber.Ctx) error {
+	var query CompareRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	var stTime, etTime time.Time
+	if query.Recent != "" {
+		stTime, etTime = db.HistoryRecentRange(query.Recent)
+	} else {
+		stTime, err = time.ParseInLocation("2006-01-02", query.Start, time.UTC)
+		if err != nil {
+			return FailWithMessage(http.StatusBadRequest, "bad start time", ctx)
+		}
+		etTime, err = time.ParseInLocation("2006-01-02", query.End, time.UTC)
+		if err != nil {
+			return FailWithMessage(http.StatusBadRequest, "bad end time", ctx)
+		}
+		if etTime.Before(stTime) {
+			return FailWithMessage(http.StatusBadRequest, "end time can't less then start time", ctx)
+		}
+		// one hourly series of a year stays below the 10000 hits of a single search
+		if etTime.Sub(stTime) > 366*24*time.Hour {
+			return FailWithMessage(http.StatusBadRequest, "time range can't exceed one year", ctx)
+		}
+		etTime = etTime.Add(24*time.Hour - time.Millisecond)
+	}
+	rt, err := app.dbc(ctx).CompareStations(query.Sids, query.Pol, stTime, etTime)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	if len(rt.Stations) == 0 {
+		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
+	}
+	return OkWithData(rt, ctx)
+}
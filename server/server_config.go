@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/csnight/storm-aqi-server/conf"
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/csnight/storm-aqi-server/middleware"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// ConfigResp is the config in effect with secrets redacted, pending lists the edits which need a restart
+type ConfigResp struct {
+	Config  *conf.GConfig `json:"config"`
+	Pending []string      `json:"pending"`
+}
+
+// config returns the config in effect
+func (app *AQIServer) config() *conf.GConfig {
+	return app.cfg.Load().(*conf.GConfig)
+}
+
+// Reload puts the reloadable settings of a reloaded config in effect all together: the log level,
+// the response cache expiration, the cors origins, the aqi section but regions and stream interval,
+// the es addresses and the api keys and rate limits. A config failing validation changes nothing
+func (app *AQIServer) Reload(cfg *conf.GConfig) {
+	app.reloadLock.Lock()
+	defer app.reloadLock.Unlock()
+	old := app.config()
+	if err := validateReload(cfg); err != nil {
+		app.log.Error("config reload rejected, the config in use is kept", zap.Error(err))
+		return
+	}
+	effective := reloadable(old, cfg)
+	changes := old.Diff(effective)
+	app.pending = effective.Diff(cfg)
+	for _, change := range app.pending {
+		app.log.Warn("config change needs a restart", zap.String("change", change))
+	}
+	if len(changes) == 0 {
+		return
+	}
+	if err := app.auth.Reload(effective.AuthConf); err != nil {
+		app.log.Error("config reload rejected, the config in use is kept", zap.Error(err))
+		return
+	}
+	_ = middleware.SetLogLevel(effective.LogConf.Level)
+	expiration := effective.AppConf.CacheExpiration
+	if expiration == 0 {
+		expiration = 300
+	}
+	middleware.SetCacheExpiration(expiration)
+	middleware.SetCorsOrigins(effective.AppConf.CorsOrigins)
+	app.db.Reload(effective.AQIConf, effective.ESConf)
+	app.cfg.Store(effective)
+	for _, change := range changes {
+		app.log.Info("config changed", zap.String("change", change))
+	}
+}
+
+func validateReload(cfg *conf.GConfig) error {
+	if cfg.AppConf == nil || cfg.AQIConf == nil || cfg.LogConf == nil {
+		return errors.New("app, aqi and log sections are required")
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(cfg.LogConf.Level)); err != nil {
+		return err
+	}
+	if cfg.AQIConf.StationIndex == "" || cfg.AQIConf.RealtimeIndex == "" || !strings.Contains(cfg.AQIConf.HisIndex, "$year") {
+		return errors.New("aqi index names are empty or his_index lacks $year")
+	}
+	if !db.IsAqiStandard(cfg.AQIConf.AqiStandard) {
+		return errors.New("unknown aqi standard " + cfg.AQIConf.AqiStandard)
+	}
+	if err := db.CheckImageConf(cfg.AQIConf); err != nil {
+		return err
+	}
+	if _, err := db.RankingLocation(cfg.AQIConf.RankingTz); err != nil {
+		return errors.New("unknown ranking_tz " + cfg.AQIConf.RankingTz)
+	}
+	if cfg.ESConf != nil && len(cfg.ESConf.Uri) == 0 {
+		return errors.New("elastic uri is empty")
+	}
+	return nil
+}
+
+// reloadable returns old with the settings of cfg which can change without a restart
+func reloadable(old *conf.GConfig, cfg *conf.GConfig) *conf.GConfig {
+	effective := *old
+	appConf := *old.AppConf
+	appConf.CacheExpiration = cfg.AppConf.CacheExpiration
+	appConf.CorsOrigins = cfg.AppConf.CorsOrigins
+	effective.AppConf = &appConf
+	logConf := *old.LogConf
+	logConf.Level = cfg.LogConf.Level
+	effective.LogConf = &logConf
+	aqiConf := *cfg.AQIConf
+	aqiConf.Regions = old.AQIConf.Regions
+	aqiConf.StreamInterval = old.AQIConf.StreamInterval
+	effective.AQIConf = &aqiConf
+	if old.ESConf != nil && cfg.ESConf != nil {
+		esConf := *old.ESConf
+		esConf.Uri = cfg.ESConf.Uri
+		effective.ESConf = &esConf
+	}
+	if old.AuthConf != nil && old.AuthConf.Enable && cfg.AuthConf != nil {
+		authConf := *cfg.AuthConf
+		authConf.Enable = old.AuthConf.Enable
+		authConf.QuotaFile = old.AuthConf.QuotaFile
+		effective.AuthConf = &authConf
+	}
+	return &effective
+}
+
+func (app *AQIServer) ConfigGet(ctx *fiber.Ctx) error {
+	app.reloadLock.RLock()
+	resp := ConfigResp{Config: app.config().Redact(), Pending: app.pending}
+	app.reloadLock.RUnlock()
+	if resp.Pending == nil {
+		resp.Pending = []string{}
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(resp, "Success", ctx)
+}
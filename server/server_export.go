@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+type ExportRequest struct {
+	QType       string    `json:"qType" validate:"required,oneof=_get"`
+	PType       string    `json:"pType" validate:"required,oneof=sids city area"`
+	Sids        []string  `json:"sids" validate:"required_if=PType sids,omitempty,max=2000,dive,number"`
+	City        string    `json:"city" validate:"required_if=PType city,omitempty,max=100"`
+	TopLeft     []float64 `json:"topLeft" validate:"required_if=PType area,omitempty,len=2"`
+	BottomRight []float64 `json:"bottomRight" validate:"required_if=PType area,omitempty,len=2"`
+	Pols        []string  `json:"pols" validate:"omitempty,dive,oneof=no2 pm25 pm10 o3 so2 co"`
+	Start       string    `json:"start" validate:"required,datetime=2006-01-02"`
+	End         string    `json:"end" validate:"required,datetime=2006-01-02"`
+	Format      string    `json:"format" validate:"required,oneof=csv parquet netcdf"`
+}
+
+func (app *AQIServer) ExportGet(ctx *fiber.Ctx) error {
+	var query ExportRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	stTime, err := time.ParseInLocation("2006-01-02", query.Start, time.UTC)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad start time", ctx)
+	}
+	etTime, err := time.ParseInLocation("2006-01-02", query.End, time.UTC)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad end time", ctx)
+	}
+	if etTime.Before(stTime) {
+		return FailWithMessage(http.StatusBadRequest, "end time can't less then start time", ctx)
+	}
+	req := &db.ExportRequest{
+		Pols:   query.Pols,
+		Start:  stTime,
+		End:    etTime.Add(24*time.Hour - time.Millisecond),
+		Format: query.Format,
+	}
+	switch query.PType {
+	case "sids":
+		req.Sids = query.Sids
+	case "city":
+		req.City = query.City
+	case "area":
+		errResp = ValidateVar(query.TopLeft[0], "longitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		errResp = ValidateVar(query.TopLeft[1], "latitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		errResp = ValidateVar(query.BottomRight[0], "longitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		errResp = ValidateVar(query.BottomRight[1], "latitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		req.Bbox = &db.Bounds{
+			TopLeft:     db.GeoPoint{Lon: query.TopLeft[0], Lat: query.TopLeft[1]},
+			BottomRight: db.GeoPoint{Lon: query.BottomRight[0], Lat: query.BottomRight[1]},
+		}
+	}
+	dbc := app.dbc(ctx)
+	stations, err := dbc.ResolveExportStations(req)
+	if err != nil {
+		switch err {
+		case db.ErrExportNoStation:
+			return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+		case db.ErrExportTooManyStations:
+			return FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+		}
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	format := db.ExportFormats[query.Format]
+	ctx.Set(fiber.HeaderContentType, format[0])
+	ctx.Set(fiber.HeaderContentDisposition, `attachment; filename="aqi_history_`+query.Start+`_`+query.End+`.`+format[1]+`"`)
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	ctx.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		// the status is already sent, a failed export is logged and the file ends with the error marker line
+		err := dbc.ExportHistory(w, req, stations)
+		if err != nil {
+			app.log.Error("ExportGet(). db.ExportHistory(). err:", zap.Error(err))
+		}
+		_ = w.Flush()
+	}))
+	return nil
+}
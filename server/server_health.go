@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Livez answers as long as the process serves http, it checks no dependency
+// so a slow elasticsearch never gets the pod restarted
+func (app *AQIServer) Livez(ctx *fiber.Ctx) error {
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return Ok(ctx)
+}
+
+// Readyz answers 503 with the failed checks until elasticsearch, the object buckets
+// and the station cache are ready
+func (app *AQIServer) Readyz(ctx *fiber.Ctx) error {
+	c, cancel := context.WithTimeout(ctx.UserContext(), 5*time.Second)
+	defer cancel()
+	resp := app.db.CheckReady(c)
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	if !resp.Ready {
+		return Result(http.StatusServiceUnavailable, resp, "Not ready", ctx)
+	}
+	return OkWithDetailed(resp, "Success", ctx)
+}
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/csnight/storm-aqi-server/db"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -15,6 +16,18 @@ type HistoryRequest struct {
 	Recent string `json:"recent" validate:"required_if=QType _get PType recent,omitempty,oneof=lastDay lastWeek lastMonth lastQuarter lastYear"`
 	Start  string `json:"start" validate:"required_if=QType _get PType range,omitempty,datetime=2006-01-02"`
 	End    string `json:"end" validate:"required_if=QType _get PType range,omitempty,datetime=2006-01-02"`
+	Cursor string `json:"cursor" validate:"omitempty,max=4096"`
+	Limit  int    `json:"limit" validate:"omitempty,min=1,max=10000"`
+}
+
+type HistoryStatsRequest struct {
+	QType     string  `json:"qType" validate:"required,oneof=_get"`
+	Sid       string  `json:"sid" validate:"required,number"`
+	Pol       string  `json:"pol" validate:"required,oneof=no2 pm25 pm10 o3 so2 co"`
+	Start     string  `json:"start" validate:"required,datetime=2006-01-02"`
+	End       string  `json:"end" validate:"required,datetime=2006-01-02"`
+	Interval  string  `json:"interval" validate:"required,oneof=day week month year"`
+	Threshold float64 `json:"threshold" validate:"omitempty,gt=0"`
 }
 
 func (app *AQIServer) HistoryGet(ctx *fiber.Ctx) error {
@@ -27,99 +40,78 @@ func (app *AQIServer) HistoryGet(ctx *fiber.Ctx) error {
 	if errResp != nil {
 		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
 	}
-	if query.PType == "recent" {
-		switch query.Recent {
-		case "lastDay":
-			return app.GetHistoryYesterday(query.Sid, query.Pol, ctx)
-		case "lastWeek":
-			return app.GetHistoryWeek(query.Sid, query.Pol, ctx)
-		case "lastMonth":
-			return app.GetHistoryMonth(query.Sid, query.Pol, ctx)
-		case "lastQuarter":
-			return app.GetHistoryQuarter(query.Sid, query.Pol, ctx)
-		case "lastYear":
-			return app.GetHistoryYear(query.Sid, query.Pol, ctx)
-		default:
-			return nil
-		}
-	} else {
-		return app.GetHistoryRange(query.Sid, query.Pol, query.Start, query.End, ctx)
-	}
+	return app.GetHistoryPage(query, ctx)
 }
 
-func (app *AQIServer) GetHistoryYesterday(sid string, pol string, ctx *fiber.Ctx) error {
-	rt, err := app.db.GetHistoryYesterday(sid, pol)
-	if err != nil {
-		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
-	}
-	if rt == nil {
-		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
-	}
-	return OkWithData(rt, ctx)
-}
-
-func (app *AQIServer) GetHistoryWeek(sid string, pol string, ctx *fiber.Ctx) error {
-	rt, err := app.db.GetHistoryLastWeek(sid, pol)
-	if err != nil {
-		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
-	}
-	if rt == nil {
-		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
-	}
-	return OkWithData(rt, ctx)
+func (app *AQIServer) GetNoneStation(ctx *fiber.Ctx) error {
+	idx := app.dbc(ctx).GetNoneStation()
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithData(idx, ctx)
 }
 
-func (app *AQIServer) GetHistoryMonth(sid string, pol string, ctx *fiber.Ctx) error {
-	rt, err := app.db.GetHistoryLastMonth(sid, pol)
-	if err != nil {
-		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+func (app *AQIServer) GetHistoryPage(query HistoryRequest, ctx *fiber.Ctx) error {
+	var stTime, etTime time.Time
+	if query.PType == "recent" {
+		stTime, etTime = db.HistoryRecentRange(query.Recent)
+	} else {
+		var err error
+		stTime, err = time.ParseInLocation("2006-01-02", query.Start, time.UTC)
+		if err != nil {
+			return FailWithMessage(http.StatusBadRequest, "bad start time", ctx)
+		}
+		etTime, err = time.ParseInLocation("2006-01-02", query.End, time.UTC)
+		if err != nil {
+			return FailWithMessage(http.StatusBadRequest, "bad end time", ctx)
+		}
+		if etTime.Before(stTime) {
+			return FailWithMessage(http.StatusBadRequest, "end time can't less then start time", ctx)
+		}
 	}
-	if rt == nil {
-		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
+	// every response is bounded, a client pages on with next_cursor
+	limit := query.Limit
+	if limit == 0 {
+		limit = 1000
 	}
-	return OkWithData(rt, ctx)
-}
-
-func (app *AQIServer) GetHistoryQuarter(sid string, pol string, ctx *fiber.Ctx) error {
-	rt, err := app.db.GetHistoryLastQuarter(sid, pol)
+	rt, err := app.dbc(ctx).GetHistoryPage(query.Sid, query.Pol, stTime, etTime, query.Cursor, limit)
 	if err != nil {
+		if err == db.ErrInvalidCursor {
+			return FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+		}
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
 	if rt == nil {
 		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
 	}
-	return OkWithData(rt, ctx)
+	// a cursor points into a point in time, the page must not be served from cache
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(rt, "Success", ctx)
 }
 
-func (app *AQIServer) GetHistoryYear(sid string, pol string, ctx *fiber.Ctx) error {
-	rt, err := app.db.GetHistoryYear(sid, pol)
+func (app *AQIServer) HistoryStatsGet(ctx *fiber.Ctx) error {
+	var query HistoryStatsRequest
+	err := ctx.QueryParser(&query)
 	if err != nil {
-		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
 	}
-	if rt == nil {
-		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
 	}
-	return OkWithData(rt, ctx)
-}
-
-func (app *AQIServer) GetNoneStation(ctx *fiber.Ctx) error {
-	idx := app.db.GetNoneStation()
-	return OkWithData(idx, ctx)
-}
-
-func (app *AQIServer) GetHistoryRange(sid string, pol string, st string, et string, ctx *fiber.Ctx) error {
-	stTime, err := time.ParseInLocation("2006-01-02", st, time.UTC)
+	stTime, err := time.ParseInLocation("2006-01-02", query.Start, time.UTC)
 	if err != nil {
 		return FailWithMessage(http.StatusBadRequest, "bad start time", ctx)
 	}
-	etTime, err := time.ParseInLocation("2006-01-02", et, time.UTC)
+	etTime, err := time.ParseInLocation("2006-01-02", query.End, time.UTC)
 	if err != nil {
 		return FailWithMessage(http.StatusBadRequest, "bad end time", ctx)
 	}
 	if etTime.Before(stTime) {
 		return FailWithMessage(http.StatusBadRequest, "end time can't less then start time", ctx)
 	}
-	rt, err := app.db.GetHistoryRange(sid, pol, stTime, etTime)
+	if etTime.After(stTime.AddDate(10, 0, 0)) {
+		return FailWithMessage(http.StatusBadRequest, "time range can't more than ten years", ctx)
+	}
+	rt, err := app.dbc(ctx).GetHistoryStats(query.Sid, query.Pol, stTime, etTime, query.Interval, query.Threshold)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
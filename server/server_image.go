@@ -2,8 +2,11 @@ package server
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
+	"github.com/csnight/storm-aqi-server/db"
 	"github.com/csnight/storm-aqi-server/tools"
 	"github.com/gofiber/fiber/v2"
 )
@@ -13,6 +16,80 @@ type ImageRequest struct {
 	Pol  string `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
 }
 
+type ImageListRequest struct {
+	Pol  string `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
+	From string `json:"from" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	To   string `json:"to" validate:"required,datetime=2006-01-02T15:04:05Z"`
+}
+
+type ImageAnimationRequest struct {
+	Pol    string `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
+	From   string `json:"from" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	To     string `json:"to" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	Format string `json:"format" validate:"omitempty,oneof=gif apng webp"`
+	Delay  int    `json:"delay" validate:"omitempty,min=20,max=5000"`
+	Width  int    `json:"width" validate:"omitempty,min=64,max=2048"`
+	Legend *bool  `json:"legend"`
+}
+
+type ImageSampleRequest struct {
+	Time string `json:"time" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	Pol  string `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
+	Lon  string `json:"lon" validate:"required,longitude"`
+	Lat  string `json:"lat" validate:"required,latitude"`
+}
+
+type ImageBatchSampleRequest struct {
+	Time   string        `json:"time" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	Pol    string        `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
+	Points []db.GeoPoint `json:"points" validate:"required,min=1,max=500,dive"`
+}
+
+type ImageSeriesRequest struct {
+	Pol  string `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
+	Lon  string `json:"lon" validate:"required,longitude"`
+	Lat  string `json:"lat" validate:"required,latitude"`
+	From string `json:"from" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	To   string `json:"to" validate:"required,datetime=2006-01-02T15:04:05Z"`
+}
+
+type SilamTileRequest struct {
+	Pol     string   `json:"pol" validate:"required,oneof=no2 pm25 pm10 co so2 o3 dust pmFRP"`
+	Time    string   `json:"time" validate:"required,datetime=2006-01-02T15:04:05Z"`
+	Z       int      `json:"z" validate:"min=0,max=12"`
+	X       int      `json:"x" validate:"min=0"`
+	Y       int      `json:"y" validate:"min=0"`
+	Ramp    string   `json:"ramp" validate:"omitempty,oneof=silam viridis magma greys"`
+	Opacity *float64 `json:"opacity" validate:"omitempty,min=0,max=1"`
+}
+
+const (
+	imageListMaxRange      = 10 * 24 * time.Hour
+	imageAnimationMaxRange = 120 * time.Hour
+)
+
+// animations bounds the animations encoded at once as every one decodes and encodes all of its frames
+var animations = make(chan bool, 2)
+
+var animationTypes = map[string]string{
+	"gif":  "image/gif",
+	"apng": "image/apng",
+	"webp": "image/webp",
+}
+
+// parseImageRange parses from and to, which must be ordered and at most max apart
+func parseImageRange(from string, to string, max time.Duration) (time.Time, time.Time, string) {
+	st, _ := time.Parse("2006-01-02T15:04:05Z", from)
+	et, _ := time.Parse("2006-01-02T15:04:05Z", to)
+	if et.Before(st) {
+		return st, et, "from must not be after to"
+	}
+	if et.Sub(st) > max {
+		return st, et, "range must not exceed " + strconv.Itoa(int(max.Hours())) + " hours"
+	}
+	return st, et, ""
+}
+
 func (app *AQIServer) ImageGet(ctx *fiber.Ctx) error {
 	var query ImageRequest
 	err := ctx.QueryParser(&query)
@@ -23,7 +100,7 @@ func (app *AQIServer) ImageGet(ctx *fiber.Ctx) error {
 	if errResp != nil {
 		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
 	}
-	resp, err := app.db.GetImage(query.Time, query.Pol)
+	resp, err := app.dbc(ctx).GetImage(query.Time, query.Pol)
 	if err != nil {
 		return FailWithDetailed(http.StatusBadRequest, err, "", ctx)
 	}
@@ -32,7 +109,7 @@ func (app *AQIServer) ImageGet(ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) ImageDownload(ctx *fiber.Ctx) error {
-	resp, err := app.db.DownloadImage(ctx.Params("dir"), ctx.Params("file"))
+	resp, err := app.dbc(ctx).DownloadImage(ctx.Params("dir"), ctx.Params("file"))
 	if err != nil {
 		return err
 	}
@@ -45,3 +122,201 @@ func (app *AQIServer) ImageDownload(ctx *fiber.Ctx) error {
 	ctx.Set("Last-Modified", time.Now().Format(time.RFC1123))
 	return OkWithRaw("image/png", resp, ctx)
 }
+
+func (app *AQIServer) ImageList(ctx *fiber.Ctx) error {
+	var query ImageListRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	st, et, msg := parseImageRange(query.From, query.To, imageListMaxRange)
+	if msg != "" {
+		return FailWithMessage(http.StatusBadRequest, msg, ctx)
+	}
+	frames, err := app.dbc(ctx).ListImages(query.Pol, st, et)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	return OkWithData(frames, ctx)
+}
+
+func (app *AQIServer) ImageAnimation(ctx *fiber.Ctx) error {
+	var query ImageAnimationRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	st, et, msg := parseImageRange(query.From, query.To, imageAnimationMaxRange)
+	if msg != "" {
+		return FailWithMessage(http.StatusBadRequest, msg, ctx)
+	}
+	opts := db.AnimationOptions{
+		Format: query.Format,
+		Delay:  query.Delay,
+		Width:  query.Width,
+		Legend: query.Legend == nil || *query.Legend,
+	}
+	if opts.Format == "" {
+		opts.Format = "gif"
+	}
+	if opts.Delay == 0 {
+		opts.Delay = 200
+	}
+	select {
+	case animations <- true:
+		defer func() {
+			<-animations
+		}()
+	default:
+		ctx.Set(fiber.HeaderRetryAfter, "5")
+		return FailWithMessage(http.StatusTooManyRequests, "too many animations in progress", ctx)
+	}
+	data, err := app.dbc(ctx).AnimateImages(query.Pol, st, et, opts)
+	if err != nil {
+		if err == db.ErrNoImages {
+			return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+		}
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	// set directly as Type only knows the mime types of file extensions and has no apng
+	ctx.Set(fiber.HeaderContentType, animationTypes[opts.Format])
+	ctx.Set(fiber.HeaderCacheControl, "max-age=3600")
+	return ctx.Status(http.StatusOK).Send(data)
+}
+
+// imageSampleFail maps the errors of reading an image to their status
+func imageSampleFail(err error, ctx *fiber.Ctx) error {
+	if err == db.ErrImageNotFound {
+		return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+	}
+	return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+}
+
+func (app *AQIServer) ImageSampleGet(ctx *fiber.Ctx) error {
+	var query ImageSampleRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	lon, _ := strconv.ParseFloat(query.Lon, 64)
+	lat, _ := strconv.ParseFloat(query.Lat, 64)
+	tm, _ := time.Parse("2006-01-02T15:04:05Z", query.Time)
+	samples, err := app.dbc(ctx).SampleImage(tm, query.Pol, []db.GeoPoint{{Lon: lon, Lat: lat}})
+	if err != nil {
+		return imageSampleFail(err, ctx)
+	}
+	return OkWithData(samples[0], ctx)
+}
+
+func (app *AQIServer) ImageSampleBatch(ctx *fiber.Ctx) error {
+	var body ImageBatchSampleRequest
+	if err := ctx.BodyParser(&body); err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(body)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	tm, _ := time.Parse("2006-01-02T15:04:05Z", body.Time)
+	samples, err := app.dbc(ctx).SampleImage(tm, body.Pol, body.Points)
+	if err != nil {
+		return imageSampleFail(err, ctx)
+	}
+	return OkWithData(samples, ctx)
+}
+
+func (app *AQIServer) ImageSampleSeries(ctx *fiber.Ctx) error {
+	var query ImageSeriesRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	st, et, msg := parseImageRange(query.From, query.To, imageListMaxRange)
+	if msg != "" {
+		return FailWithMessage(http.StatusBadRequest, msg, ctx)
+	}
+	lon, _ := strconv.ParseFloat(query.Lon, 64)
+	lat, _ := strconv.ParseFloat(query.Lat, 64)
+	series, err := app.dbc(ctx).SampleImageSeries(query.Pol, db.GeoPoint{Lon: lon, Lat: lat}, st, et)
+	if err != nil {
+		return imageSampleFail(err, ctx)
+	}
+	return OkWithData(series, ctx)
+}
+
+func (app *AQIServer) SilamTileGet(ctx *fiber.Ctx) error {
+	var query SilamTileRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	query.Pol = ctx.Params("pol")
+	query.Time, err = url.PathUnescape(ctx.Params("time"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad time", ctx)
+	}
+	query.Z, err = strconv.Atoi(ctx.Params("z"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad zoom", ctx)
+	}
+	query.X, err = strconv.Atoi(ctx.Params("x"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad tile x", ctx)
+	}
+	query.Y, err = strconv.Atoi(ctx.Params("y"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad tile y", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if query.X >= 1<<query.Z || query.Y >= 1<<query.Z {
+		return FailWithMessage(http.StatusBadRequest, "tile out of range", ctx)
+	}
+	opts := db.TileOptions{Ramp: query.Ramp, Opacity: 1}
+	if query.Opacity != nil {
+		opts.Opacity = *query.Opacity
+	}
+	tm, _ := time.Parse("2006-01-02T15:04:05Z", query.Time)
+	data, err := app.dbc(ctx).SilamTile(query.Pol, tm, query.Z, query.X, query.Y, opts)
+	if err != nil {
+		return imageSampleFail(err, ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "max-age=7200")
+	return OkWithRaw("png", data, ctx)
+}
+
+func (app *AQIServer) ImageIngestGet(ctx *fiber.Ctx) error {
+	if app.ingest == nil {
+		return FailWithMessage(http.StatusNotFound, "silam ingestion is disabled", ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(app.ingest.Status(), "Success", ctx)
+}
+
+func (app *AQIServer) ImageIngestRun(ctx *fiber.Ctx) error {
+	if app.ingest == nil {
+		return FailWithMessage(http.StatusNotFound, "silam ingestion is disabled", ctx)
+	}
+	if err := app.ingest.Trigger(); err != nil {
+		return FailWithMessage(http.StatusConflict, err.Error(), ctx)
+	}
+	return Result(http.StatusAccepted, app.ingest.Status(), "Success", ctx)
+}
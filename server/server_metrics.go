@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheEntriesDesc   = prometheus.NewDesc("aqi_station_cache_entries", "Entries in the station cache.", nil, nil)
+	cacheLookupsDesc   = prometheus.NewDesc("aqi_station_cache_lookups_total", "Station cache lookups by result.", []string{"result"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("aqi_station_cache_evictions_total", "Station cache entries evicted for space.", nil, nil)
+	cacheExpiredDesc   = prometheus.NewDesc("aqi_station_cache_expired_total", "Station cache entries expired.", nil, nil)
+	poolActiveDesc     = prometheus.NewDesc("aqi_es_pool_active", "Elasticsearch clients borrowed from the pool.", nil, nil)
+	poolIdleDesc       = prometheus.NewDesc("aqi_es_pool_idle", "Elasticsearch clients idle in the pool.", nil, nil)
+	poolDestroyedDesc  = prometheus.NewDesc("aqi_es_pool_destroyed_total", "Elasticsearch clients destroyed by the pool.", nil, nil)
+	poolBorrowsDesc    = prometheus.NewDesc("aqi_es_pool_borrows_total", "Elasticsearch client borrows.", nil, nil)
+	poolWaitDesc       = prometheus.NewDesc("aqi_es_pool_wait_seconds_total", "Time spent waiting to borrow elasticsearch clients.", nil, nil)
+	bulkDesc           = prometheus.NewDesc("aqi_es_bulk_items_total", "Bulk indexer items by stage.", []string{"stage"}, nil)
+	bulkRequestsDesc   = prometheus.NewDesc("aqi_es_bulk_requests_total", "Bulk requests flushed by the bulk indexer.", nil, nil)
+	failQueueDesc      = prometheus.NewDesc("aqi_es_fail_queue_length", "Bulk items waiting in the fail queue for a retry.", nil, nil)
+	deadLettersDesc    = prometheus.NewDesc("aqi_es_dead_letters", "Bulk items out of attempts or rejected by elasticsearch.", nil, nil)
+)
+
+// statsCollector reads db.Stats on every scrape, the es metrics are missing on the memory backend
+// and the bulk metrics while the bulk indexer is down
+type statsCollector struct {
+	db *db.DB
+}
+
+func (s *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{cacheEntriesDesc, cacheLookupsDesc, cacheEvictionsDesc, cacheExpiredDesc,
+		poolActiveDesc, poolIdleDesc, poolDestroyedDesc, poolBorrowsDesc, poolWaitDesc, bulkDesc, bulkRequestsDesc, failQueueDesc, deadLettersDesc} {
+		ch <- desc
+	}
+}
+
+func (s *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := s.db.Stats()
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.CacheEntries))
+	ch <- prometheus.MustNewConstMetric(cacheLookupsDesc, prometheus.CounterValue, float64(stats.CacheHits), "hit")
+	ch <- prometheus.MustNewConstMetric(cacheLookupsDesc, prometheus.CounterValue, float64(stats.CacheMisses), "miss")
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.CacheEvictions))
+	ch <- prometheus.MustNewConstMetric(cacheExpiredDesc, prometheus.CounterValue, float64(stats.CacheExpired))
+	es := stats.Es
+	if es == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(poolActiveDesc, prometheus.GaugeValue, float64(es.PoolActive))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(es.PoolIdle))
+	ch <- prometheus.MustNewConstMetric(poolDestroyedDesc, prometheus.CounterValue, float64(es.PoolDestroyed))
+	ch <- prometheus.MustNewConstMetric(poolBorrowsDesc, prometheus.CounterValue, float64(es.Borrows))
+	ch <- prometheus.MustNewConstMetric(poolWaitDesc, prometheus.CounterValue, es.BorrowWait.Seconds())
+	ch <- prometheus.MustNewConstMetric(failQueueDesc, prometheus.GaugeValue, float64(es.FailQueue))
+	ch <- prometheus.MustNewConstMetric(deadLettersDesc, prometheus.GaugeValue, float64(es.DeadLetters))
+	if es.Bulk == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(bulkDesc, prometheus.CounterValue, float64(es.Bulk.NumAdded), "added")
+	ch <- prometheus.MustNewConstMetric(bulkDesc, prometheus.CounterValue, float64(es.Bulk.NumFlushed), "flushed")
+	ch <- prometheus.MustNewConstMetric(bulkDesc, prometheus.CounterValue, float64(es.Bulk.NumFailed), "failed")
+	ch <- prometheus.MustNewConstMetric(bulkDesc, prometheus.CounterValue, float64(es.Bulk.NumIndexed), "indexed")
+	ch <- prometheus.MustNewConstMetric(bulkRequestsDesc, prometheus.CounterValue, float64(es.Bulk.NumRequests))
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+type RankingsRequest struct {
+	QType  string `json:"qType" validate:"required,oneof=_get"`
+	Level  string `json:"level" validate:"required,oneof=city"`
+	Pol    string `json:"pol" validate:"required,oneof=no2 pm25 pm10 o3 so2 co"`
+	Agg    string `json:"agg" validate:"omitempty,oneof=avg max"`
+	Period string `json:"period" validate:"omitempty,oneof=realtime day month"`
+	Date   string `json:"date" validate:"omitempty,max=10"`
+	Order  string `json:"order" validate:"omitempty,oneof=worst best"`
+	Limit  int    `json:"limit" validate:"omitempty,min=1,max=500"`
+}
+
+func (app *AQIServer) RankingsGet(ctx *fiber.Ctx) error {
+	var query RankingsRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if query.Agg == "" {
+		query.Agg = "avg"
+	}
+	if query.Period == "" {
+		query.Period = "realtime"
+	}
+	if query.Order == "" {
+		query.Order = "worst"
+	}
+	if query.Limit == 0 {
+		query.Limit = 50
+	}
+	// days and months start in the configured zone, cities far from it still share the boundaries
+	loc, err := db.RankingLocation(app.config().AQIConf.RankingTz)
+	if err != nil {
+		loc = time.UTC
+	}
+	var stTime, etTime time.Time
+	now := time.Now().In(loc)
+	switch query.Period {
+	case "day":
+		stTime = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		if query.Date != "" {
+			stTime, err = time.ParseInLocation("2006-01-02", query.Date, loc)
+			if err != nil {
+				return FailWithMessage(http.StatusBadRequest, "bad date, day period needs format like 2021-01-01", ctx)
+			}
+		}
+		etTime = stTime.AddDate(0, 0, 1).Add(-time.Millisecond)
+	case "month":
+		stTime = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		if query.Date != "" {
+			stTime, err = time.ParseInLocation("2006-01", query.Date, loc)
+			if err != nil {
+				return FailWithMessage(http.StatusBadRequest, "bad date, month period needs format like 2021-01", ctx)
+			}
+		}
+		etTime = stTime.AddDate(0, 1, 0).Add(-time.Millisecond)
+	}
+	rt, err := app.dbc(ctx).GetRankings(query.Level, query.Pol, query.Agg, query.Period, stTime, etTime, query.Order, query.Limit)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	return OkWithData(rt, ctx)
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/csnight/storm-aqi-server/db"
 	"github.com/gofiber/fiber/v2"
@@ -14,6 +15,15 @@ type RealtimeRequest struct {
 	Pol   string `json:"pol" validate:"required_if=PType single,omitempty,oneof=all no2 pm25 pm10 o3 so2 co"`
 }
 
+type RealtimePointRequest struct {
+	QType  string  `json:"qType" validate:"required,oneof=_get"`
+	Lon    string  `json:"lon" validate:"required,longitude"`
+	Lat    string  `json:"lat" validate:"required,latitude"`
+	K      int     `json:"k" validate:"omitempty,min=1,max=20"`
+	Radius float64 `json:"radius" validate:"omitempty,gt=0,max=500"`
+	Power  float64 `json:"power" validate:"omitempty,gt=0,max=5"`
+}
+
 type ForecastRequest struct {
 	QType string `json:"qType" validate:"required,oneof=_get"`
 	PType string `json:"pType" validate:"required,oneof=single"`
@@ -38,6 +48,37 @@ func (app *AQIServer) RealtimeGet(ctx *fiber.Ctx) error {
 	}
 }
 
+func (app *AQIServer) RealtimePointGet(ctx *fiber.Ctx) error {
+	var query RealtimePointRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if query.K == 0 {
+		query.K = 6
+	}
+	if query.Radius == 0 {
+		query.Radius = 50
+	}
+	if query.Power == 0 {
+		query.Power = 2
+	}
+	lon, _ := strconv.ParseFloat(query.Lon, 64)
+	lat, _ := strconv.ParseFloat(query.Lat, 64)
+	rt, err := app.dbc(ctx).InterpolateRealtime(lon, lat, query.K, query.Radius, query.Power)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	if rt == nil {
+		return OkWithNotFound(fiber.MIMEApplicationJSON, ctx)
+	}
+	return OkWithData(rt, ctx)
+}
+
 func (app *AQIServer) ForecastGet(ctx *fiber.Ctx) error {
 	var query ForecastRequest
 	err := ctx.QueryParser(&query)
@@ -52,7 +93,7 @@ func (app *AQIServer) ForecastGet(ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) GetAllRealtime(ctx *fiber.Ctx) error {
-	rt, err := app.db.GetAllAqiRealtime()
+	rt, err := app.dbc(ctx).GetAllAqiRealtime()
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -66,9 +107,9 @@ func (app *AQIServer) GetSingleRealtime(sid string, pol string, ctx *fiber.Ctx)
 	var rt *db.RealtimeResp
 	var err error
 	if pol == "all" {
-		rt, err = app.db.GetAqiRealtimeById(sid)
+		rt, err = app.dbc(ctx).GetAqiRealtimeById(sid)
 	} else {
-		rt, err = app.db.GetAqiRealtimeByIdAndPol(sid, pol)
+		rt, err = app.dbc(ctx).GetAqiRealtimeByIdAndPol(sid, pol)
 	}
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
@@ -80,7 +121,7 @@ func (app *AQIServer) GetSingleRealtime(sid string, pol string, ctx *fiber.Ctx)
 }
 
 func (app *AQIServer) GetAllForecast(sid string, ctx *fiber.Ctx) error {
-	fore, err := app.db.GetForecast(sid, "all")
+	fore, err := app.dbc(ctx).GetForecast(sid, "all")
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -91,7 +132,7 @@ func (app *AQIServer) GetAllForecast(sid string, ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) GetForecastByPol(sid string, pol string, ctx *fiber.Ctx) error {
-	fore, err := app.db.GetForecast(sid, pol)
+	fore, err := app.dbc(ctx).GetForecast(sid, pol)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -3,17 +3,51 @@ package server
 import "github.com/gofiber/fiber/v2"
 
 func (app *AQIServer) Register(root fiber.Router) {
+	admin := app.auth.Require("admin")
+	root.Use(app.auth.Require("read"))
 	root.Get("/", func(c *fiber.Ctx) error {
 		return c.Render("index", fiber.Map{})
 	})
 	root.Get("/station", app.StationGet)
+	root.Post("/station", admin, app.StationCreate)
+	root.Get("/station/audit", admin, app.StationAuditGet)
+	root.Put("/station/:sid", admin, app.StationUpdate)
+	root.Delete("/station/:sid", admin, app.StationRetire)
 	root.Get("/stations", app.StationSearch)
+	root.Post("/stations", app.StationSearch)
+	root.Get("/regions", app.RegionsGet)
+	root.Get("/tiles/:z/:x/:y.mvt", app.TileGet)
 	root.Get("/realtime", app.RealtimeGet)
+	root.Get("/realtime/stream", app.RealtimeStream)
+	root.Get("/realtime/point", app.RealtimePointGet)
 	root.Get("/forecast", app.ForecastGet)
 	root.Get("/image", app.ImageGet)
+	root.Get("/image/list", app.ImageList)
+	root.Get("/image/animation", app.ImageAnimation)
+	root.Get("/image/sample", app.ImageSampleGet)
+	root.Post("/image/sample", app.ImageSampleBatch)
+	root.Get("/image/sample/series", app.ImageSampleSeries)
+	root.Get("/image/ingest", admin, app.ImageIngestGet)
+	root.Post("/image/ingest", admin, app.ImageIngestRun)
+	root.Get("/silam/tiles/:pol/:time/:z/:x/:y.png", app.SilamTileGet)
 	root.Get("/silam/:dir/:file", app.ImageDownload)
 	root.Get("/history", app.HistoryGet)
-	root.Get("/none_his", app.GetNoneStation)
+	root.Get("/history/stats", app.HistoryStatsGet)
+	root.Get("/history/export", app.ExportGet)
+	root.Get("/compare", app.CompareGet)
+	root.Get("/rankings", app.RankingsGet)
+	root.Get("/alerts/rules", admin, app.AlertRulesGet)
+	root.Post("/alerts/rules", admin, app.AlertRuleCreate)
+	root.Get("/alerts/rules/:id", admin, app.AlertRuleGet)
+	root.Put("/alerts/rules/:id", admin, app.AlertRuleUpdate)
+	root.Delete("/alerts/rules/:id", admin, app.AlertRuleDelete)
+	root.Get("/alerts/states", admin, app.AlertStatesGet)
+	root.Get("/none_his", admin, app.GetNoneStation)
+	root.Get("/config", admin, app.ConfigGet)
+	root.Get("/bulk/failures", admin, app.BulkFailuresGet)
+	root.Get("/bulk/dead_letters", admin, app.DeadLettersGet)
+	root.Post("/bulk/dead_letters/replay", admin, app.DeadLettersReplay)
+	root.Delete("/bulk/dead_letters", admin, app.DeadLettersPurge)
 	root.Get("/logo/:logo", app.StationLogoGet)
-	root.Post("/sync_logo", app.SyncStationLog)
+	root.Post("/sync_logo", admin, app.SyncStationLog)
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/csnight/storm-aqi-server/db"
 	"github.com/gofiber/fiber/v2"
+	jsoniter "github.com/json-iterator/go"
 )
 
 type StationGetRequest struct {
@@ -20,7 +21,7 @@ type StationGetRequest struct {
 
 type StationSearchRequest struct {
 	QType       string    `json:"qType" validate:"required,oneof=_search _all"`
-	PType       string    `json:"pType" validate:"required_if=QType _search,omitempty,oneof=name city area radius"`
+	PType       string    `json:"pType" validate:"required_if=QType _search,omitempty,oneof=name city area radius polygon region"`
 	Size        int       `json:"size" validate:"required_if=QType _search,omitempty,number,min=1,max=10000"`
 	Name        string    `json:"name" validate:"required_if=QType _search PType name,omitempty,excludesall=@?*%"`
 	City        string    `json:"city" validate:"required_if=QType _search PType city,omitempty,excludesall=@?*%"`
@@ -29,6 +30,10 @@ type StationSearchRequest struct {
 	Center      []float64 `json:"center" validate:"required_if=QType _search PType radius,omitempty,len=2"`
 	Radius      float64   `json:"radius" validate:"required_if=QType _search PType radius,omitempty,gt=0,max=10000"`
 	Unit        string    `json:"unit" validate:"required_if=QType _search PType radius,omitempty,oneof=kilometers miles meters"`
+	Region      string    `json:"region" validate:"required_if=QType _search PType region,omitempty,max=64"`
+	// a GeoJSON Polygon or MultiPolygon, only read from a POST body
+	Geometry jsoniter.RawMessage `json:"geometry" query:"-" validate:"required_if=QType _search PType polygon"`
+	Format   string              `json:"format" validate:"omitempty,oneof=json geojson"`
 }
 
 func (app *AQIServer) StationGet(ctx *fiber.Ctx) error {
@@ -55,7 +60,12 @@ func (app *AQIServer) StationGet(ctx *fiber.Ctx) error {
 
 func (app *AQIServer) StationSearch(ctx *fiber.Ctx) error {
 	var query StationSearchRequest
-	err := ctx.QueryParser(&query)
+	var err error
+	if ctx.Method() == fiber.MethodPost {
+		err = ctx.BodyParser(&query)
+	} else {
+		err = ctx.QueryParser(&query)
+	}
 	if err != nil {
 		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
 	}
@@ -64,12 +74,16 @@ func (app *AQIServer) StationSearch(ctx *fiber.Ctx) error {
 		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
 	}
 	if query.QType == "_all" {
-		return app.SearchAllStations(ctx)
+		return app.SearchAllStations(query.Format, ctx)
 	}
 	if query.PType == "name" {
-		return app.SearchStationsByName(query.Name, query.Size, ctx)
+		return app.SearchStationsByName(query.Name, query.Size, query.Format, ctx)
 	} else if query.PType == "city" {
-		return app.SearchStationsByCityName(query.City, query.Size, ctx)
+		return app.SearchStationsByCityName(query.City, query.Size, query.Format, ctx)
+	} else if query.PType == "polygon" {
+		return app.SearchStationsByPolygon(query.Geometry, query.Size, query.Format, ctx)
+	} else if query.PType == "region" {
+		return app.SearchStationsByRegion(query.Region, query.Size, query.Format, ctx)
 	} else if query.PType == "area" {
 		errResp = ValidateVar(query.TopLeft[0], "longitude")
 		if errResp != nil {
@@ -87,7 +101,7 @@ func (app *AQIServer) StationSearch(ctx *fiber.Ctx) error {
 		if errResp != nil {
 			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
 		}
-		return app.SearchStationsByArea(query.TopLeft, query.BottomRight, query.Size, ctx)
+		return app.SearchStationsByArea(query.TopLeft, query.BottomRight, query.Size, query.Format, ctx)
 	} else {
 		errResp = ValidateVar(query.Center[0], "longitude")
 		if errResp != nil {
@@ -97,12 +111,12 @@ func (app *AQIServer) StationSearch(ctx *fiber.Ctx) error {
 		if errResp != nil {
 			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
 		}
-		return app.SearchStationsByRadius(query.Center, query.Unit, query.Radius, query.Size, ctx)
+		return app.SearchStationsByRadius(query.Center, query.Unit, query.Radius, query.Size, query.Format, ctx)
 	}
 }
 
 func (app *AQIServer) GetStationById(sid string, ctx *fiber.Ctx) error {
-	st, err := app.db.GetStationById(sid)
+	st, err := app.dbc(ctx).GetStationById(sid)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -113,7 +127,7 @@ func (app *AQIServer) GetStationById(sid string, ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) GetStationByName(name string, ctx *fiber.Ctx) error {
-	st, err := app.db.GetStationByName(name)
+	st, err := app.dbc(ctx).GetStationByName(name)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -124,7 +138,7 @@ func (app *AQIServer) GetStationByName(name string, ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) GetStationByCity(city string, ctx *fiber.Ctx) error {
-	st, err := app.db.GetStationByCityName(city)
+	st, err := app.dbc(ctx).GetStationByCityName(city)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -135,7 +149,7 @@ func (app *AQIServer) GetStationByCity(city string, ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) GetStationByLoc(x string, y string, ctx *fiber.Ctx) error {
-	st, err := app.db.SearchStationByRadius(x, y, 10, "km", 10)
+	st, err := app.dbc(ctx).SearchStationByRadius(x, y, 10, "km", 10)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
@@ -145,24 +159,24 @@ func (app *AQIServer) GetStationByLoc(x string, y string, ctx *fiber.Ctx) error
 	return OkWithData(st[0], ctx)
 }
 
-func (app *AQIServer) SearchStationsByName(name string, size int, ctx *fiber.Ctx) error {
-	sts, err := app.db.SearchStationsByName(name, size)
+func (app *AQIServer) SearchStationsByName(name string, size int, format string, ctx *fiber.Ctx) error {
+	sts, err := app.dbc(ctx).SearchStationsByName(name, size)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
-	return OkWithData(sts, ctx)
+	return app.OkWithStations(sts, format, ctx)
 }
 
-func (app *AQIServer) SearchStationsByCityName(city string, size int, ctx *fiber.Ctx) error {
-	sts, err := app.db.SearchStationsByCityName(city, size)
+func (app *AQIServer) SearchStationsByCityName(city string, size int, format string, ctx *fiber.Ctx) error {
+	sts, err := app.dbc(ctx).SearchStationsByCityName(city, size)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
-	return OkWithData(sts, ctx)
+	return app.OkWithStations(sts, format, ctx)
 }
 
-func (app *AQIServer) SearchStationsByArea(topLeft []float64, bottomRight []float64, size int, ctx *fiber.Ctx) error {
-	sts, err := app.db.SearchStationsByArea(db.Bounds{
+func (app *AQIServer) SearchStationsByArea(topLeft []float64, bottomRight []float64, size int, format string, ctx *fiber.Ctx) error {
+	sts, err := app.dbc(ctx).SearchStationsByArea(db.Bounds{
 		TopLeft: db.GeoPoint{
 			Lon: topLeft[0],
 			Lat: topLeft[1],
@@ -175,10 +189,41 @@ func (app *AQIServer) SearchStationsByArea(topLeft []float64, bottomRight []floa
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
-	return OkWithData(sts, ctx)
+	return app.OkWithStations(sts, format, ctx)
+}
+
+func (app *AQIServer) SearchStationsByPolygon(geometry []byte, size int, format string, ctx *fiber.Ctx) error {
+	polygon, err := db.ParsePolygon(geometry)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	sts, err := app.dbc(ctx).SearchStationsByPolygon(polygon, size)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	return app.OkWithStations(sts, format, ctx)
 }
 
-func (app *AQIServer) SearchStationsByRadius(center []float64, unit string, radius float64, size int, ctx *fiber.Ctx) error {
+func (app *AQIServer) SearchStationsByRegion(region string, size int, format string, ctx *fiber.Ctx) error {
+	sts, err := app.dbc(ctx).SearchStationsByRegion(region, size)
+	if err != nil {
+		if err == db.ErrRegionNotFound {
+			return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+		}
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	return app.OkWithStations(sts, format, ctx)
+}
+
+func (app *AQIServer) RegionsGet(ctx *fiber.Ctx) error {
+	regions := app.dbc(ctx).GetRegions()
+	if regions == nil {
+		regions = []*db.Region{}
+	}
+	return OkWithData(regions, ctx)
+}
+
+func (app *AQIServer) SearchStationsByRadius(center []float64, unit string, radius float64, size int, format string, ctx *fiber.Ctx) error {
 	x := strconv.FormatFloat(center[0], 'f', 8, 64)
 	y := strconv.FormatFloat(center[1], 'f', 8, 64)
 	unitMark := "km"
@@ -191,18 +236,32 @@ func (app *AQIServer) SearchStationsByRadius(center []float64, unit string, radi
 	case "meters":
 		unitMark = "m"
 	}
-	sts, err := app.db.SearchStationByRadius(x, y, radius, unitMark, size)
+	sts, err := app.dbc(ctx).SearchStationByRadius(x, y, radius, unitMark, size)
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
-	return OkWithData(sts, ctx)
+	return app.OkWithStations(sts, format, ctx)
 }
 
-func (app *AQIServer) SearchAllStations(ctx *fiber.Ctx) error {
-	sts, err := app.db.GetAllStations()
+func (app *AQIServer) SearchAllStations(format string, ctx *fiber.Ctx) error {
+	sts, err := app.dbc(ctx).GetAllStations()
 	if err != nil {
 		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
 	}
+	return app.OkWithStations(sts, format, ctx)
+}
+
+// OkWithStations responds a station list in the Response envelope or as a bare GeoJSON FeatureCollection
+func (app *AQIServer) OkWithStations(sts []db.AqiStationResp, format string, ctx *fiber.Ctx) error {
+	if format == "geojson" {
+		values := app.hub.AqiSnapshot()
+		ctx.Set("Cache-Control", aqiCacheControl(values))
+		data, err := json.Marshal(StationsToGeoJSON(sts, values))
+		if err != nil {
+			return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+		}
+		return OkWithRaw("application/geo+json", data, ctx)
+	}
 	return OkWithData(sts, ctx)
 }
 
@@ -211,7 +270,7 @@ func (app *AQIServer) StationLogoGet(ctx *fiber.Ctx) error {
 	if logo == "" {
 		return FailWithMessage(http.StatusNotFound, "empty logo", ctx)
 	}
-	img, err := app.db.GetStationLogo(logo)
+	img, err := app.dbc(ctx).GetStationLogo(logo)
 	if logo == "" {
 		return FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
 	}
@@ -219,7 +278,7 @@ func (app *AQIServer) StationLogoGet(ctx *fiber.Ctx) error {
 }
 
 func (app *AQIServer) SyncStationLog(ctx *fiber.Ctx) error {
-	err := app.db.SyncStationLogos()
+	err := app.dbc(ctx).SyncStationLogos()
 	if err != nil {
 		return FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
 	}
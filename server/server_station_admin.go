@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/csnight/storm-aqi-server/middleware"
+	"github.com/gofiber/fiber/v2"
+)
+
+type StationLocRequest struct {
+	Lon float64 `json:"lon" validate:"longitude"`
+	Lat float64 `json:"lat" validate:"latitude"`
+}
+
+type StationWriteRequest struct {
+	Sid      string             `json:"sid" validate:"omitempty,number,max=32"`
+	Idx      int                `json:"idx" validate:"min=0"`
+	Name     string             `json:"name" validate:"required,max=128"`
+	Loc      *StationLocRequest `json:"loc" validate:"required"`
+	Tz       string             `json:"tz" validate:"required,len=6"`
+	CityName string             `json:"city_name" validate:"omitempty,max=64,excludesall=@?*%"`
+	Sources  []db.Source        `json:"sources" validate:"omitempty,max=50"`
+	// Retired set to false on an update restores a retired station
+	Retired *bool `json:"retired"`
+}
+
+type StationAuditRequest struct {
+	QType string `json:"qType" validate:"required,oneof=_get"`
+	Sid   string `json:"sid" validate:"omitempty,number"`
+	Size  int    `json:"size" validate:"omitempty,min=1,max=1000"`
+}
+
+func auditActor(ctx *fiber.Ctx) db.AuditActor {
+	return db.AuditActor{Name: middleware.KeyName(ctx), Ip: ctx.IP()}
+}
+
+// stationWriteFail maps the station write errors to their status
+func stationWriteFail(err error, ctx *fiber.Ctx) error {
+	switch err {
+	case db.ErrStationNotFound:
+		return FailWithMessage(http.StatusNotFound, err.Error(), ctx)
+	case db.ErrStationExists, db.ErrStationRetired:
+		return FailWithMessage(http.StatusConflict, err.Error(), ctx)
+	}
+	return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+}
+
+// saveStation creates a station when sid is empty, otherwise replaces the metadata of the station sid
+func (app *AQIServer) saveStation(sid string, ctx *fiber.Ctx) error {
+	var body StationWriteRequest
+	if err := ctx.BodyParser(&body); err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(body)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if sid == "" && body.Sid == "" {
+		return FailWithMessage(http.StatusBadRequest, "station needs sid", ctx)
+	}
+	if _, err := time.Parse("-07:00", body.Tz); err != nil {
+		return FailWithMessage(http.StatusBadRequest, "tz must be an offset like +08:00", ctx)
+	}
+	sources := body.Sources
+	if sources == nil {
+		sources = []db.Source{}
+	}
+	raw, err := json.MarshalToString(sources)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, err.Error(), ctx)
+	}
+	st := &db.AqiStation{
+		Sid:      body.Sid,
+		Idx:      body.Idx,
+		Name:     strings.TrimSpace(body.Name),
+		Loc:      db.GeoPoint{Lon: body.Loc.Lon, Lat: body.Loc.Lat},
+		Tz:       body.Tz,
+		CityName: strings.TrimSpace(body.CityName),
+		Sources:  raw,
+	}
+	if sid == "" {
+		resp, err := app.dbc(ctx).CreateStation(st, auditActor(ctx))
+		if err != nil {
+			return stationWriteFail(err, ctx)
+		}
+		middleware.PurgeCache()
+		return Result(http.StatusCreated, resp, "Success", ctx)
+	}
+	restore := body.Retired != nil && !*body.Retired
+	resp, err := app.dbc(ctx).UpdateStation(sid, st, restore, auditActor(ctx))
+	if err != nil {
+		return stationWriteFail(err, ctx)
+	}
+	middleware.PurgeCache()
+	return OkWithDetailed(resp, "Success", ctx)
+}
+
+func (app *AQIServer) StationCreate(ctx *fiber.Ctx) error {
+	return app.saveStation("", ctx)
+}
+
+func (app *AQIServer) StationUpdate(ctx *fiber.Ctx) error {
+	return app.saveStation(ctx.Params("sid"), ctx)
+}
+
+func (app *AQIServer) StationRetire(ctx *fiber.Ctx) error {
+	st, err := app.dbc(ctx).RetireStation(ctx.Params("sid"), auditActor(ctx))
+	if err != nil {
+		return stationWriteFail(err, ctx)
+	}
+	middleware.PurgeCache()
+	return OkWithDetailed(st, "Success", ctx)
+}
+
+func (app *AQIServer) StationAuditGet(ctx *fiber.Ctx) error {
+	var query StationAuditRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	if query.Size == 0 {
+		query.Size = 100
+	}
+	entries, err := app.dbc(ctx).GetStationAudits(query.Sid, query.Size)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+	return OkWithDetailed(entries, "Success", ctx)
+}
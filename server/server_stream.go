@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"time"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+type RealtimeStreamRequest struct {
+	QType       string    `json:"qType" validate:"required,oneof=_sub"`
+	PType       string    `json:"pType" validate:"required,oneof=all sids area"`
+	Sids        []string  `json:"sids" validate:"required_if=PType sids,omitempty,max=10000,dive,number"`
+	TopLeft     []float64 `json:"topLeft" validate:"required_if=PType area,omitempty,len=2"`
+	BottomRight []float64 `json:"bottomRight" validate:"required_if=PType area,omitempty,len=2"`
+}
+
+func (app *AQIServer) RealtimeStream(ctx *fiber.Ctx) error {
+	var query RealtimeStreamRequest
+	err := ctx.QueryParser(&query)
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "can't parser params", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	var sids []string
+	if query.PType == "sids" {
+		sids = query.Sids
+	} else if query.PType == "area" {
+		errResp = ValidateVar(query.TopLeft[0], "longitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		errResp = ValidateVar(query.TopLeft[1], "latitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		errResp = ValidateVar(query.BottomRight[0], "longitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		errResp = ValidateVar(query.BottomRight[1], "latitude")
+		if errResp != nil {
+			return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+		}
+		sts, err := app.dbc(ctx).SearchStationsByArea(db.Bounds{
+			TopLeft:     db.GeoPoint{Lon: query.TopLeft[0], Lat: query.TopLeft[1]},
+			BottomRight: db.GeoPoint{Lon: query.BottomRight[0], Lat: query.BottomRight[1]},
+		}, 10000)
+		if err != nil {
+			return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+		}
+		sids = []string{}
+		for _, st := range sts {
+			sids = append(sids, st.Sid)
+		}
+	}
+	sub := app.hub.Subscribe(sids)
+	ctx.Set(fiber.HeaderContentType, "text/event-stream")
+	ctx.Set(fiber.HeaderCacheControl, "no-cache")
+	ctx.Set(fiber.HeaderConnection, "keep-alive")
+	ctx.Set("X-Accel-Buffering", "no")
+	ctx.Context().SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer app.hub.Unsubscribe(sub)
+		keepAlive := time.NewTicker(20 * time.Second)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case msg, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(msg)
+				if err != nil {
+					continue
+				}
+				_, _ = w.WriteString("event: " + msg.Event + "\ndata: ")
+				_, _ = w.Write(data)
+				_, _ = w.WriteString("\n\n")
+			case <-keepAlive.C:
+				_, _ = w.WriteString(": ping\n\n")
+			}
+			// flush fails once the client has gone away
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}))
+	return nil
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/csnight/storm-aqi-server/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	tileLayer        = "stations"
+	clusterMaxZoom   = 8
+	clusterCellPixel = 64
+)
+
+type TileRequest struct {
+	Z int `json:"z" validate:"min=0,max=22"`
+	X int `json:"x" validate:"min=0"`
+	Y int `json:"y" validate:"min=0"`
+}
+
+type cluster struct {
+	lon   float64
+	lat   float64
+	count int
+	sum   int
+	num   int
+	max   int
+	st    *db.AqiStationResp
+}
+
+func (app *AQIServer) TileGet(ctx *fiber.Ctx) error {
+	var query TileRequest
+	var err error
+	query.Z, err = strconv.Atoi(ctx.Params("z"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad zoom", ctx)
+	}
+	query.X, err = strconv.Atoi(ctx.Params("x"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad tile x", ctx)
+	}
+	query.Y, err = strconv.Atoi(ctx.Params("y"))
+	if err != nil {
+		return FailWithMessage(http.StatusBadRequest, "bad tile y", ctx)
+	}
+	errResp := ValidateStruct(query)
+	if errResp != nil {
+		return FailWithDetailed(http.StatusBadRequest, errResp, "", ctx)
+	}
+	tile := maptile.New(uint32(query.X), uint32(query.Y), maptile.Zoom(query.Z))
+	if !tile.Valid() {
+		return FailWithMessage(http.StatusBadRequest, "tile out of range", ctx)
+	}
+	values := app.hub.AqiSnapshot()
+	fc := app.buildTileFeatures(tile, values)
+	layers := mvt.NewLayers(map[string]*geojson.FeatureCollection{tileLayer: fc})
+	layers.ProjectToTile(tile)
+	data, err := mvt.Marshal(layers)
+	if err != nil {
+		return FailWithMessage(http.StatusInternalServerError, err.Error(), ctx)
+	}
+	ctx.Set("Cache-Control", aqiCacheControl(values))
+	if len(fc.Features) == 0 {
+		return OkWithEmptyRaw("application/vnd.mapbox-vector-tile", ctx)
+	}
+	return OkWithRaw("application/vnd.mapbox-vector-tile", data, ctx)
+}
+
+// buildTileFeatures selects the stations of a tile, grouping them into grid clusters at low zoom levels
+func (app *AQIServer) buildTileFeatures(tile maptile.Tile, values map[string]db.StationAqi) *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection()
+	// a small buffer keeps symbols on tile edges from being cut
+	bound := tile.Bound(0.05)
+	stations := app.db.GetCachedStations()
+	if tile.Z > clusterMaxZoom {
+		for i := range stations {
+			st := &stations[i]
+			pt := orb.Point{st.Loc.Lon, st.Loc.Lat}
+			if !bound.Contains(pt) {
+				continue
+			}
+			fc.Append(stationFeature(st, values))
+		}
+		return fc
+	}
+	cells := map[[2]int]*cluster{}
+	var keys [][2]int
+	for i := range stations {
+		st := &stations[i]
+		pt := orb.Point{st.Loc.Lon, st.Loc.Lat}
+		if !bound.Contains(pt) {
+			continue
+		}
+		frac := maptile.Fraction(pt, tile.Z)
+		key := [2]int{
+			int(math.Floor(frac[0] * 256 / clusterCellPixel)),
+			int(math.Floor(frac[1] * 256 / clusterCellPixel)),
+		}
+		c, ok := cells[key]
+		if !ok {
+			c = &cluster{max: -1}
+			cells[key] = c
+			keys = append(keys, key)
+		}
+		c.lon += st.Loc.Lon
+		c.lat += st.Loc.Lat
+		c.count++
+		c.st = st
+		if val, ok := values[st.Sid]; ok {
+			c.sum += val.Aqi
+			c.num++
+			if val.Aqi > c.max {
+				c.max = val.Aqi
+			}
+		}
+	}
+	for _, key := range keys {
+		c := cells[key]
+		if c.count == 1 {
+			fc.Append(stationFeature(c.st, values))
+			continue
+		}
+		f := geojson.NewFeature(orb.Point{c.lon / float64(c.count), c.lat / float64(c.count)})
+		f.Properties["cluster"] = true
+		f.Properties["point_count"] = c.count
+		if c.num > 0 {
+			f.Properties["aqi"] = c.max
+			f.Properties["aqi_avg"] = math.Round(float64(c.sum)/float64(c.num)*10) / 10
+		}
+		fc.Append(f)
+	}
+	return fc
+}
+
+func stationFeature(st *db.AqiStationResp, values map[string]db.StationAqi) *geojson.Feature {
+	f := geojson.NewFeature(orb.Point{st.Loc.Lon, st.Loc.Lat})
+	f.ID = st.Sid
+	f.Properties["sid"] = st.Sid
+	f.Properties["idx"] = st.Idx
+	f.Properties["name"] = st.Name
+	f.Properties["city_name"] = st.CityName
+	f.Properties["tz"] = st.Tz
+	if val, ok := values[st.Sid]; ok {
+		f.Properties["aqi"] = val.Aqi
+	}
+	return f
+}
+
+// aqiCacheControl keeps the features served before the first aqi poll out of the client caches
+func aqiCacheControl(values map[string]db.StationAqi) string {
+	if len(values) == 0 {
+		return "no-store"
+	}
+	return "max-age=600"
+}
+
+// StationsToGeoJSON joins the latest realtime aqi and pollutant values into station features
+func StationsToGeoJSON(sts []db.AqiStationResp, values map[string]db.StationAqi) *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection()
+	for i := range sts {
+		f := stationFeature(&sts[i], values)
+		for pol, val := range values[sts[i].Sid].Values {
+			f.Properties[pol] = val
+		}
+		fc.Append(f)
+	}
+	return fc
+}